@@ -0,0 +1,267 @@
+package issuer
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AuditAction string
+
+const (
+	AuditIssue  AuditAction = "issue"
+	AuditRevoke AuditAction = "revoke"
+)
+
+// AuditEvent records one card signed or revoked. It holds no health data: the card itself is identified by its
+// rid and by the hash of its signed payload.
+type AuditEvent struct {
+	Time         time.Time   `json:"time"`
+	Action       AuditAction `json:"action"`
+	IssuerURL    string      `json:"iss"`
+	KeyId        string      `json:"kid"`
+	RevocationId string      `json:"rid,omitempty"`
+	Types        []string    `json:"types,omitempty"`
+	// PayloadHash is the hex SHA-256 of the card's compressed JWS payload, so the event for a card can be found
+	// from the card alone
+	PayloadHash string `json:"payloadHash,omitempty"`
+	// Requester identifies who asked for the card, as set with WithRequester
+	Requester string `json:"requester,omitempty"`
+
+	// Sequence, PreviousHash and Hash link the events of a chained log. Hash is an HMAC-SHA256 under the log's key.
+	Sequence     uint64 `json:"seq,omitempty"`
+	PreviousHash string `json:"prev,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+}
+
+// AuditHead is the last event of a chained audit log. The chain alone cannot show that events were removed from its
+// end, so keep a head outside the log, e.g. in a ticket or the transparency log, and verify later logs against it.
+type AuditHead struct {
+	Sequence uint64 `json:"seq"`
+	Hash     string `json:"hash"`
+}
+
+func (h AuditHead) String() string {
+	return fmt.Sprintf("%d:%s", h.Sequence, h.Hash)
+}
+
+// ParseAuditHead parses the seq:hash form AuditHead.String returns.
+func ParseAuditHead(value string) (AuditHead, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return AuditHead{}, fmt.Errorf("audit head %q is not seq:hash", value)
+	}
+	var head AuditHead
+	if _, err := fmt.Sscanf(parts[0], "%d", &head.Sequence); err != nil || head.Sequence == 0 || parts[1] == "" {
+		return AuditHead{}, fmt.Errorf("audit head %q is not seq:hash", value)
+	}
+	head.Hash = parts[1]
+	return head, nil
+}
+
+// AuditSink receives an event for every card an Issuer signs or revokes. An Issuer with a sink does not hand out
+// a card whose event could not be recorded.
+type AuditSink interface {
+	Record(ctx context.Context, event AuditEvent) error
+}
+
+// AuditSinkFunc adapts a function to AuditSink, e.g. to forward events to a log pipeline.
+type AuditSinkFunc func(ctx context.Context, event AuditEvent) error
+
+func (f AuditSinkFunc) Record(ctx context.Context, event AuditEvent) error {
+	return f(ctx, event)
+}
+
+type requesterKey struct{}
+
+// WithRequester returns a context whose issuances are attributed to requester, e.g. a user or client id.
+func WithRequester(ctx context.Context, requester string) context.Context {
+	return context.WithValue(ctx, requesterKey{}, requester)
+}
+
+// RequesterFromContext returns the requester set with WithRequester.
+func RequesterFromContext(ctx context.Context) string {
+	requester, _ := ctx.Value(requesterKey{}).(string)
+	return requester
+}
+
+// JSONLinesSink writes each event as a line of JSON. In chained mode every event carries a sequence number, the hash
+// of the event before it and its own HMAC under the log's key, so without the key no line can be edited, removed or
+// reordered without VerifyAuditLog noticing. Removing events from the end is only detected against an AuditHead
+// kept elsewhere.
+type JSONLinesSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	key    []byte
+	seq    uint64
+	last   string
+}
+
+// NewJSONLinesSink writes events to w, chained under key unless it is empty. The key should be at least 32 random
+// bytes kept away from the log. Writes are serialized, so one sink can be shared by concurrent issuers.
+func NewJSONLinesSink(w io.Writer, key []byte) *JSONLinesSink {
+	return &JSONLinesSink{w: w, key: key}
+}
+
+// OpenAuditLog appends events to the JSON-lines file at path, creating it if needed, chained under key unless it is
+// empty. A chained log is verified first and continued from its last event; a log that fails verification is not
+// appended to.
+func OpenAuditLog(path string, key []byte) (*JSONLinesSink, error) {
+	sink := &JSONLinesSink{key: key}
+	if len(key) > 0 {
+		existing, err := os.Open(path)
+		if err == nil {
+			var head AuditHead
+			head, err = verifyAuditChain(existing, key, nil)
+			existing.Close()
+			if err != nil {
+				return nil, fmt.Errorf("audit log %s: %w", path, err)
+			}
+			sink.seq, sink.last = head.Sequence, head.Hash
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sink.w, sink.closer = file, file
+	return sink, nil
+}
+
+func (s *JSONLinesSink) Record(ctx context.Context, event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event.Time = event.Time.UTC()
+	if len(s.key) > 0 {
+		event.Sequence = s.seq + 1
+		event.PreviousHash = s.last
+		event.Hash = ""
+		hash, err := auditEventHash(event, s.key)
+		if err != nil {
+			return err
+		}
+		event.Hash = hash
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+	if file, ok := s.w.(*os.File); ok {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync audit log: %w", err)
+		}
+	}
+	if len(s.key) > 0 {
+		s.seq, s.last = event.Sequence, event.Hash
+	}
+	return nil
+}
+
+// Close closes the file of a sink opened with OpenAuditLog.
+func (s *JSONLinesSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// Head returns the last event written to a chained log, to keep as an anchor for VerifyAuditLog.
+func (s *JSONLinesSink) Head() AuditHead {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return AuditHead{Sequence: s.seq, Hash: s.last}
+}
+
+// VerifyAuditLog checks the chain of an audit log under its key and returns its head. With an anchor, a head kept
+// from an earlier verification, the log must still hold that event, so events removed from its end are detected too.
+func VerifyAuditLog(r io.Reader, key []byte, anchor *AuditHead) (AuditHead, error) {
+	if len(key) == 0 {
+		return AuditHead{}, errors.New("an audit log can only be verified with its key")
+	}
+	return verifyAuditChain(r, key, anchor)
+}
+
+func verifyAuditChain(r io.Reader, key []byte, anchor *AuditHead) (AuditHead, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var head AuditHead
+	for line := 1; scanner.Scan(); line++ {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return head, fmt.Errorf("line %d is not an audit event: %w", line, err)
+		}
+		if event.Sequence != head.Sequence+1 {
+			return head, fmt.Errorf("line %d has sequence %d, expected %d", line, event.Sequence, head.Sequence+1)
+		}
+		if event.PreviousHash != head.Hash {
+			return head, fmt.Errorf("line %d does not follow the event before it", line)
+		}
+		recorded := event.Hash
+		event.Hash = ""
+		hash, err := auditEventHash(event, key)
+		if err != nil {
+			return head, err
+		}
+		if !hmac.Equal([]byte(hash), []byte(recorded)) {
+			return head, fmt.Errorf("line %d has been modified or was written with another key", line)
+		}
+		if anchor != nil && event.Sequence == anchor.Sequence && recorded != anchor.Hash {
+			return head, fmt.Errorf("line %d does not match the anchored head %s", line, anchor)
+		}
+		head = AuditHead{Sequence: event.Sequence, Hash: recorded}
+	}
+	if err := scanner.Err(); err != nil {
+		return head, err
+	}
+	if anchor != nil && head.Sequence < anchor.Sequence {
+		return head, fmt.Errorf("the log ends at event %d, before the anchored head %s", head.Sequence, anchor)
+	}
+	return head, nil
+}
+
+// auditEventHash returns the hex HMAC-SHA256 under key of the event as it is written, without its own hash
+func auditEventHash(event AuditEvent, key []byte) (string, error) {
+	if event.Hash != "" {
+		return "", errors.New("event is already hashed")
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// jwsPayloadHash returns the hex SHA-256 of the decoded payload segment of a compact JWS
+func jwsPayloadHash(jws string) string {
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
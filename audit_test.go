@@ -0,0 +1,164 @@
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "audit.jsonl")
+
+	auditKey := []byte("0123456789abcdef0123456789abcdef")
+	sink, err := OpenAuditLog(logPath, auditKey)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %s", err.Error())
+	}
+	crls, err := OpenCRLStore(filepath.Join(dir, "crl.json"))
+	if err != nil {
+		t.Fatalf("Failed to open revocation lists: %s", err.Error())
+	}
+	test, key := newTestIssuer(t, IssuerOptions{})
+	keyId, _ := ComputeKeyId(&key.PublicKey)
+	issuer, _ := NewIssuer(IssuerConfig{IssuerURL: test.IssuerURL(), KeySource: test.keys, Clock: test.clock, Audit: sink, Revocations: crls})
+
+	ctx := WithRequester(context.Background(), "clinic-frontdesk")
+	jws, err := issuer.Issue(ctx, sampleVerifiableCredential(t))
+	if err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+	if _, err := issuer.Issue(context.Background(), sampleVerifiableCredential(t)); err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+	if err := issuer.Revoke(ctx, keyId, "MKyCxh7p6uQ"); err != nil {
+		t.Fatalf("Failed to revoke card: %s", err.Error())
+	}
+	if err := issuer.Revoke(ctx, keyId, "not a rid!"); err == nil {
+		t.Fatal("Expected an invalid rid to be refused")
+	}
+	sink.Close()
+
+	data, _ := ioutil.ReadFile(logPath)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 events, got %d:\n%s", len(lines), data)
+	}
+	var issued, revoked AuditEvent
+	_ = json.Unmarshal([]byte(lines[0]), &issued)
+	_ = json.Unmarshal([]byte(lines[2]), &revoked)
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(jws, ".")[1])
+	sum := sha256.Sum256(payload)
+	if issued.Action != AuditIssue || issued.KeyId != keyId || issued.RevocationId != "MKyCxh7p6uQ" || len(issued.Types) != 3 ||
+		issued.PayloadHash != hex.EncodeToString(sum[:]) || issued.Requester != "clinic-frontdesk" || issued.Sequence != 1 {
+		t.Fatalf("Unexpected issue event %+v", issued)
+	}
+	if revoked.Action != AuditRevoke || revoked.RevocationId != "MKyCxh7p6uQ" || revoked.Sequence != 3 || revoked.PreviousHash == "" {
+		t.Fatalf("Unexpected revoke event %+v", revoked)
+	}
+	if bytes.Contains(data, []byte("Anyperson")) {
+		t.Fatal("The audit log must not contain health data")
+	}
+
+	// reopening continues the chain
+	sink, err = OpenAuditLog(logPath, auditKey)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log: %s", err.Error())
+	}
+	_ = sink.Record(context.Background(), AuditEvent{Action: AuditIssue, IssuerURL: issuer.IssuerURL(), KeyId: keyId})
+	anchor := sink.Head()
+	sink.Close()
+	data, _ = ioutil.ReadFile(logPath)
+	if head, err := VerifyAuditLog(bytes.NewReader(data), auditKey, &anchor); err != nil || head != anchor || head.Sequence != 4 {
+		t.Fatalf("Expected 4 verified events ending at %s, got %s: %v", anchor, head, err)
+	}
+	if parsed, err := ParseAuditHead(anchor.String()); err != nil || parsed != anchor {
+		t.Fatalf("Expected %s to parse back, got %s: %v", anchor, parsed, err)
+	}
+
+	// editing, dropping or reordering events breaks the chain
+	lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	for name, tampered := range map[string][]string{
+		"edited":    {lines[0], strings.Replace(lines[1], `"kid"`, `"requester":"someone-else","kid"`, 1), lines[2], lines[3]},
+		"dropped":   {lines[0], lines[2], lines[3]},
+		"reordered": {lines[1], lines[0], lines[2], lines[3]},
+	} {
+		if _, err := VerifyAuditLog(strings.NewReader(strings.Join(tampered, "\n")), auditKey, nil); err == nil {
+			t.Fatalf("Expected the %s log to fail verification", name)
+		}
+	}
+
+	// a chain rebuilt without the key does not verify, and cutting the end is caught by the anchor
+	var rewritten bytes.Buffer
+	forger := NewJSONLinesSink(&rewritten, []byte("not the audit log's key"))
+	for _, line := range lines {
+		var event AuditEvent
+		_ = json.Unmarshal([]byte(line), &event)
+		event.Requester = "someone-else"
+		_ = forger.Record(context.Background(), event)
+	}
+	if _, err := VerifyAuditLog(&rewritten, auditKey, nil); err == nil {
+		t.Fatal("Expected a chain written with another key to fail verification")
+	}
+	truncated := strings.Join(lines[:3], "\n")
+	if _, err := VerifyAuditLog(strings.NewReader(truncated), auditKey, nil); err != nil {
+		t.Fatalf("Expected the first events to verify on their own: %v", err)
+	}
+	if _, err := VerifyAuditLog(strings.NewReader(truncated), auditKey, &anchor); err == nil {
+		t.Fatal("Expected a log cut before its anchored head to fail verification")
+	}
+	if _, err := VerifyAuditLog(bytes.NewReader(data), nil, nil); err == nil {
+		t.Fatal("Expected verification without the key to be refused")
+	}
+
+	_ = ioutil.WriteFile(logPath, []byte(strings.Join([]string{lines[0], lines[2]}, "\n")+"\n"), 0600)
+	if _, err := OpenAuditLog(logPath, auditKey); err == nil {
+		t.Fatal("Expected a tampered log not to be reopened")
+	}
+
+	// the revocation is saved and published, and verifiers pick it up
+	crls, _ = OpenCRLStore(filepath.Join(dir, "crl.json"))
+	list, ok := crls.List(keyId)
+	if !ok || list.Counter != 1 || !list.Revoked("MKyCxh7p6uQ", 0) {
+		t.Fatalf("Unexpected revocation list %+v", list)
+	}
+	w := serviceRequest(t, newTestService(t, issuer, ServiceOptions{}), http.MethodGet, "/.well-known/crl/"+keyId+".json", "", "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"rids":["MKyCxh7p6uQ.`) {
+		t.Fatalf("Unexpected CRL response %d: %s", w.Code, w.Body.String())
+	}
+	jwks, _ := issuer.JWKS()
+	verifier, _ := NewVerifier(VerifierConfig{Trust: NewTrustDirectory(TrustedIssuer{
+		IssuerURL:   issuer.IssuerURL(),
+		Keys:        jwks,
+		Revocations: map[string]RevocationList{keyId: list},
+	})})
+	if result := verifier.VerifyJWS(jws); result.Verdict != VerdictRevoked {
+		t.Fatalf("Expected the revoked card to be rejected, got %s", result.Verdict)
+	}
+}
+
+func TestAuditSinkFailure(t *testing.T) {
+	test, _ := newTestIssuer(t, IssuerOptions{})
+	failing := AuditSinkFunc(func(ctx context.Context, event AuditEvent) error {
+		return errors.New("disk full")
+	})
+	issuer, _ := NewIssuer(IssuerConfig{IssuerURL: test.IssuerURL(), KeySource: test.keys, Audit: failing})
+	jws, err := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+	if err == nil || jws != "" {
+		t.Fatal("Expected no card when its audit event cannot be recorded")
+	}
+}
@@ -0,0 +1,270 @@
+package issuer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// Error codes of authorization failures, answered with 401 and 403
+const (
+	ERROR_UNAUTHORIZED = "unauthorized"
+	ERROR_FORBIDDEN    = "forbidden"
+)
+
+// SCOPE_PATIENT_IMMUNIZATION_READ is the SMART scope an app needs to get an immunization card for its patient
+const SCOPE_PATIENT_IMMUNIZATION_READ = "patient/Immunization.read"
+
+type AuthConfig struct {
+	// Issuer is the iss claim of the authorization server's access tokens (required)
+	Issuer string
+
+	// Audience is the aud claim the tokens must carry, usually this service's or the FHIR server's base URL
+	// (required). Without it a token the same authorization server issued for another resource server would do.
+	Audience string
+
+	// JWKSURL is where the authorization server publishes its signing keys. They are cached and refreshed in the
+	// background for as long as the context passed to NewSMARTAuthorizer lives.
+	JWKSURL string
+
+	// KeySet is used instead of JWKSURL when the authorization server's keys are configured locally
+	KeySet jwk.Set
+
+	// RequiredScopes must each be granted by the token, in SMART v1 or v2 syntax. Defaults to patient/Immunization.read.
+	RequiredScopes []string
+
+	HTTPClient *http.Client
+
+	// Clock and AcceptableSkew decide whether a token has expired. Clock defaults to time.Now.
+	Clock          func() time.Time
+	AcceptableSkew time.Duration
+}
+
+// AccessToken is what a validated bearer token says about the request.
+type AccessToken struct {
+	Subject   string
+	ClientId  string
+	Scopes    []string
+	ExpiresAt time.Time
+
+	// Patient is the FHIR id of the patient in the token's launch context
+	Patient string
+	// FHIRUser is the user's FHIR resource URL, when the token carries one
+	FHIRUser string
+}
+
+// SMARTAuthorizer validates SMART on FHIR access tokens issued by one authorization server.
+type SMARTAuthorizer struct {
+	config AuthConfig
+	keys   jwk.Set
+}
+
+func NewSMARTAuthorizer(ctx context.Context, config AuthConfig) (*SMARTAuthorizer, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("authorization server issuer is required")
+	}
+	if config.Audience == "" {
+		return nil, errors.New("access token audience is required")
+	}
+	if len(config.RequiredScopes) == 0 {
+		config.RequiredScopes = []string{SCOPE_PATIENT_IMMUNIZATION_READ}
+	}
+	for _, scope := range config.RequiredScopes {
+		if _, _, _, _, ok := parseScope(scope); !ok {
+			return nil, fmt.Errorf("invalid SMART scope %q", scope)
+		}
+	}
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+
+	keys := config.KeySet
+	if keys == nil {
+		if config.JWKSURL == "" {
+			return nil, errors.New("either a JWKS URL or a key set is required")
+		}
+		var options []jwk.RegisterOption
+		if config.HTTPClient != nil {
+			options = append(options, jwk.WithHTTPClient(config.HTTPClient))
+		}
+		cache := jwk.NewCache(ctx)
+		if err := cache.Register(config.JWKSURL, options...); err != nil {
+			return nil, fmt.Errorf("failed to register authorization server JWKS: %w", err)
+		}
+		// fail at startup rather than on the first request when the keys cannot be read
+		if _, err := cache.Refresh(ctx, config.JWKSURL); err != nil {
+			return nil, fmt.Errorf("failed to fetch authorization server JWKS: %w", err)
+		}
+		keys = jwk.NewCachedSet(cache, config.JWKSURL)
+	}
+	return &SMARTAuthorizer{config: config, keys: keys}, nil
+}
+
+// Authorize validates the bearer token of the request: its signature, issuer, audience, lifetime, scopes and
+// patient launch context.
+func (a *SMARTAuthorizer) Authorize(r *http.Request) (*AccessToken, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return nil, &AuthorizationError{Status: http.StatusUnauthorized, Message: "a bearer access token is required"}
+	}
+
+	options := []jwt.ParseOption{
+		jwt.WithKeySet(a.keys, jws.WithInferAlgorithmFromKey(true)),
+		jwt.WithIssuer(a.config.Issuer),
+		jwt.WithClock(jwt.ClockFunc(a.config.Clock)),
+		jwt.WithAcceptableSkew(a.config.AcceptableSkew),
+		jwt.WithRequiredClaim(jwt.ExpirationKey),
+		jwt.WithAudience(a.config.Audience),
+	}
+	token, err := jwt.ParseString(strings.TrimSpace(header[7:]), options...)
+	if err != nil {
+		return nil, &AuthorizationError{Status: http.StatusUnauthorized, Message: "invalid access token: " + err.Error()}
+	}
+
+	claims := token.PrivateClaims()
+	accessToken := &AccessToken{
+		Subject:   token.Subject(),
+		ExpiresAt: token.Expiration(),
+		Scopes:    tokenScopes(claims),
+	}
+	accessToken.ClientId, _ = claims["client_id"].(string)
+	accessToken.Patient, _ = claims["patient"].(string)
+	accessToken.FHIRUser, _ = claims["fhirUser"].(string)
+
+	for _, required := range a.config.RequiredScopes {
+		if !accessToken.HasScope(required) {
+			return nil, &AuthorizationError{Status: http.StatusForbidden, Scope: required, Message: "the access token does not grant " + required}
+		}
+	}
+	if accessToken.Patient == "" {
+		return nil, &AuthorizationError{Status: http.StatusForbidden, Message: "the access token has no patient launch context"}
+	}
+	return accessToken, nil
+}
+
+// Middleware rejects requests without a valid access token and passes the token on in the request context, where
+// AccessTokenFromContext finds it.
+func (a *SMARTAuthorizer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := a.Authorize(r)
+		if err != nil {
+			writeAuthorizationError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accessTokenKey{}, token)))
+	})
+}
+
+// HasScope reports whether any of the token's scopes grants the required one. patient/*.read grants
+// patient/Immunization.read, and so does the SMART v2 patient/Immunization.rs.
+func (t *AccessToken) HasScope(required string) bool {
+	for _, granted := range t.Scopes {
+		if scopeGrants(granted, required) {
+			return true
+		}
+	}
+	return false
+}
+
+type accessTokenKey struct{}
+
+// AccessTokenFromContext returns the token Middleware validated for the request.
+func AccessTokenFromContext(ctx context.Context) (*AccessToken, bool) {
+	token, ok := ctx.Value(accessTokenKey{}).(*AccessToken)
+	return token, ok
+}
+
+// AuthorizationError is a rejected request, with the status and the details of its WWW-Authenticate challenge.
+type AuthorizationError struct {
+	Status  int
+	Message string
+	// Scope is the missing scope of an insufficient_scope error
+	Scope string
+}
+
+func (e *AuthorizationError) Error() string {
+	return e.Message
+}
+
+// writeAuthorizationError answers with an RFC 6750 challenge and the services' usual JSON error body
+func writeAuthorizationError(w http.ResponseWriter, err error) {
+	var authErr *AuthorizationError
+	if !errors.As(err, &authErr) {
+		authErr = &AuthorizationError{Status: http.StatusUnauthorized, Message: err.Error()}
+	}
+	code, challenge := ERROR_UNAUTHORIZED, `Bearer error="invalid_token"`
+	if authErr.Status == http.StatusForbidden {
+		code, challenge = ERROR_FORBIDDEN, `Bearer error="insufficient_scope"`
+		if authErr.Scope != "" {
+			challenge += fmt.Sprintf(`, scope="%s"`, authErr.Scope)
+		}
+	}
+	challenge += fmt.Sprintf(`, error_description="%s"`, strings.ReplaceAll(authErr.Message, `"`, `'`))
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeServiceError(w, authErr.Status, ServiceError{Code: code, Message: authErr.Message})
+}
+
+// tokenScopes reads the space-separated scope claim, or the scp array some servers use instead
+func tokenScopes(claims map[string]interface{}) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	return stringSlice(claims["scp"])
+}
+
+// parseScope splits a SMART scope such as patient/Immunization.read or patient/*.rs?category=x into its
+// context, resource type, permissions, with v1 permissions translated to v2 letters, and query
+func parseScope(scope string) (string, string, string, string, bool) {
+	var query string
+	if mark := strings.IndexByte(scope, '?'); mark >= 0 {
+		scope, query = scope[:mark], scope[mark+1:]
+	}
+	slash, dot := strings.IndexByte(scope, '/'), strings.LastIndexByte(scope, '.')
+	if slash <= 0 || dot <= slash+1 || dot == len(scope)-1 {
+		return "", "", "", "", false
+	}
+	permissions := scope[dot+1:]
+	switch permissions {
+	case "read":
+		permissions = "rs"
+	case "write":
+		permissions = "cud"
+	case "*":
+		permissions = "cruds"
+	}
+	for _, permission := range permissions {
+		if !strings.ContainsRune("cruds", permission) {
+			return "", "", "", "", false
+		}
+	}
+	return scope[:slash], scope[slash+1 : dot], permissions, query, true
+}
+
+// scopeGrants reports whether the granted scope covers the required one. A granted scope with a query such as
+// ?status=completed only covers some of the resources, so it only grants a required scope with the same query.
+func scopeGrants(granted, required string) bool {
+	grantedContext, grantedResource, grantedPermissions, grantedQuery, ok := parseScope(granted)
+	if !ok {
+		return false
+	}
+	requiredContext, requiredResource, requiredPermissions, requiredQuery, ok := parseScope(required)
+	if !ok || grantedContext != requiredContext || (grantedResource != "*" && grantedResource != requiredResource) {
+		return false
+	}
+	if grantedQuery != "" && grantedQuery != requiredQuery {
+		return false
+	}
+	for _, permission := range requiredPermissions {
+		if !strings.ContainsRune(grantedPermissions, permission) {
+			return false
+		}
+	}
+	return true
+}
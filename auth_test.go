@@ -0,0 +1,212 @@
+package issuer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// tokenIssuer stands in for a SMART authorization server, serving its JWKS and signing access tokens
+type tokenIssuer struct {
+	t      *testing.T
+	key    jwk.Key
+	server *httptest.Server
+}
+
+func newTokenIssuer(t *testing.T) *tokenIssuer {
+	raw, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err.Error())
+	}
+	key, _ := jwk.FromRaw(raw)
+	_ = key.Set(jwk.KeyIDKey, "auth-key")
+	_ = key.Set(jwk.AlgorithmKey, jwa.ES256)
+	public, _ := key.PublicKey()
+	set := jwk.NewSet()
+	_ = set.AddKey(public)
+
+	issuer := &tokenIssuer{t: t, key: key}
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (i *tokenIssuer) token(claims map[string]interface{}) string {
+	token := jwt.New()
+	_ = token.Set(jwt.IssuerKey, i.server.URL)
+	_ = token.Set(jwt.AudienceKey, "https://issuer.example.org")
+	_ = token.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+	_ = token.Set("patient", "123")
+	_ = token.Set("scope", "launch/patient openid patient/Immunization.read")
+	for name, value := range claims {
+		if value == nil {
+			_ = token.Remove(name)
+		} else {
+			_ = token.Set(name, value)
+		}
+	}
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.ES256, i.key))
+	if err != nil {
+		i.t.Fatalf("Failed to sign token: %s", err.Error())
+	}
+	return string(signed)
+}
+
+func TestScopeGrants(t *testing.T) {
+	for _, test := range []struct {
+		granted  string
+		expected bool
+	}{
+		{"patient/Immunization.read", true},
+		{"patient/*.read", true},
+		{"patient/Immunization.*", true},
+		{"patient/Immunization.rs", true},
+		{"patient/*.cruds", true},
+		{"patient/Immunization.rs?status=completed", false},
+		{"patient/Immunization.r", false},
+		{"patient/Immunization.write", false},
+		{"patient/Observation.read", false},
+		{"user/Immunization.read", false},
+		{"launch/patient", false},
+	} {
+		if scopeGrants(test.granted, SCOPE_PATIENT_IMMUNIZATION_READ) != test.expected {
+			t.Fatalf("Expected %s granting %s to be %t", test.granted, SCOPE_PATIENT_IMMUNIZATION_READ, test.expected)
+		}
+	}
+}
+
+// newTestRecords is a FHIR server holding patient 123's record
+func newTestRecords(t *testing.T) *FHIRClient {
+	fhir := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", FHIR_JSON_CONTENT_TYPE)
+		switch r.URL.Path {
+		case "/Patient/123":
+			_, _ = w.Write([]byte(`{"resourceType": "Patient", "id": "123", "name": [{"family": "Fromserver", "given": ["Jane"]}], "birthDate": "1961-01-20"}`))
+		case "/Immunization":
+			_, _ = w.Write([]byte(`{"resourceType": "Bundle", "type": "searchset", "entry": [{"resource": {"resourceType": "Immunization", "status": "completed",
+				"vaccineCode": {"coding": [{"system": "http://hl7.org/fhir/sid/cvx", "code": "207"}]}, "occurrenceDateTime": "2021-01-01"}}]}`))
+		default:
+			_, _ = w.Write([]byte(`{"resourceType": "Bundle", "type": "searchset"}`))
+		}
+	}))
+	t.Cleanup(fhir.Close)
+	records, err := NewFHIRClient(FHIRClientConfig{BaseURL: fhir.URL})
+	if err != nil {
+		t.Fatalf("Failed to create FHIR client: %s", err.Error())
+	}
+	return records
+}
+
+func TestSMARTAuthorizer(t *testing.T) {
+	tokens := newTokenIssuer(t)
+	authorizer, err := NewSMARTAuthorizer(context.Background(), AuthConfig{
+		Issuer:   tokens.server.URL,
+		Audience: "https://issuer.example.org",
+		JWKSURL:  tokens.server.URL,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authorizer: %s", err.Error())
+	}
+	if _, err := NewSMARTAuthorizer(context.Background(), AuthConfig{Issuer: tokens.server.URL, JWKSURL: tokens.server.URL}); err == nil {
+		t.Fatal("Expected an authorizer without an audience to be refused")
+	}
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	if _, err := NewIssuingService(issuer, ServiceOptions{Authorizer: authorizer}); err == nil {
+		t.Fatal("Expected an authorized service without records to be refused")
+	}
+	service := newTestService(t, issuer, ServiceOptions{Authorizer: authorizer, Records: newTestRecords(t)})
+
+	bundle := func(patient string) []byte {
+		return []byte(`{"resourceType": "Bundle", "type": "collection", "entry": [
+			{"resource": {"resourceType": "Patient", "id": "` + patient + `", "name": [{"family": "Anyperson", "given": ["John"]}], "birthDate": "1951-01-20"}},
+			{"resource": {"resourceType": "Immunization", "status": "completed", "patient": {"reference": "Patient/` + patient + `"},
+				"vaccineCode": {"coding": [{"system": "http://hl7.org/fhir/sid/cvx", "code": "207"}]}, "occurrenceDateTime": "2021-01-01"}}
+		]}`)
+	}
+	issue := func(token string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/issue", strings.NewReader(string(body)))
+		r.Header.Set("Content-Type", FHIR_JSON_CONTENT_TYPE)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		service.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := issue(tokens.token(nil), bundle("123")); w.Code != http.StatusOK {
+		t.Fatalf("Expected the patient's card to be issued, got %d: %s", w.Code, w.Body.String())
+	}
+
+	other := newTokenIssuer(t)
+	for _, test := range []struct {
+		name      string
+		token     string
+		body      []byte
+		status    int
+		challenge string
+	}{
+		{"no token", "", bundle("123"), http.StatusUnauthorized, `error="invalid_token"`},
+		{"foreign signature", other.token(map[string]interface{}{jwt.IssuerKey: tokens.server.URL}), bundle("123"), http.StatusUnauthorized, `error="invalid_token"`},
+		{"expired", tokens.token(map[string]interface{}{jwt.ExpirationKey: time.Now().Add(-time.Hour)}), bundle("123"), http.StatusUnauthorized, `error="invalid_token"`},
+		{"wrong audience", tokens.token(map[string]interface{}{jwt.AudienceKey: "https://elsewhere.example.org"}), bundle("123"), http.StatusUnauthorized, `error="invalid_token"`},
+		{"no audience", tokens.token(map[string]interface{}{jwt.AudienceKey: nil}), bundle("123"), http.StatusUnauthorized, `error="invalid_token"`},
+		{"missing scope", tokens.token(map[string]interface{}{"scope": "launch/patient patient/Observation.read"}), bundle("123"), http.StatusForbidden, `scope="patient/Immunization.read"`},
+		{"no patient context", tokens.token(map[string]interface{}{"patient": nil}), bundle("123"), http.StatusForbidden, `error="insufficient_scope"`},
+		{"query-restricted scope", tokens.token(map[string]interface{}{"scope": "launch/patient patient/Immunization.rs?status=completed"}), bundle("123"), http.StatusForbidden, `scope="patient/Immunization.read"`},
+	} {
+		w := issue(test.token, test.body)
+		if w.Code != test.status || !strings.Contains(w.Header().Get("WWW-Authenticate"), test.challenge) {
+			t.Fatalf("%s: expected %d with %s, got %d %q: %s", test.name, test.status, test.challenge, w.Code, w.Header().Get("WWW-Authenticate"), w.Body.String())
+		}
+	}
+
+	// the JWKS and health endpoints stay public
+	if w := serviceRequest(t, service, http.MethodGet, "/.well-known/jwks.json", "", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the JWKS to be public, got %d", w.Code)
+	}
+}
+
+func TestSMARTAuthorizerRecords(t *testing.T) {
+	records := newTestRecords(t)
+
+	tokens := newTokenIssuer(t)
+	keys, _ := jwk.Fetch(context.Background(), tokens.server.URL)
+	authorizer, err := NewSMARTAuthorizer(context.Background(), AuthConfig{Issuer: tokens.server.URL, Audience: "https://issuer.example.org", KeySet: keys})
+	if err != nil {
+		t.Fatalf("Failed to create authorizer: %s", err.Error())
+	}
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	service := newTestService(t, issuer, ServiceOptions{Authorizer: authorizer, Records: records})
+
+	// the body is ignored: the card holds what the FHIR server says about the token's patient
+	r := httptest.NewRequest(http.MethodPost, "/issue", strings.NewReader(string(vc)))
+	r.Header.Set("Authorization", "Bearer "+tokens.token(nil))
+	w := httptest.NewRecorder()
+	service.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected a card, got %d: %s", w.Code, w.Body.String())
+	}
+	var issued struct {
+		JWS string `json:"jws"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &issued)
+	card, err := DecodeCard(issued.JWS)
+	if err != nil || !strings.Contains(string(card.Payload), "Fromserver") || strings.Contains(string(card.Payload), "Anyperson") {
+		t.Fatalf("Expected the card to hold the server's record: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package issuer
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// IssueRequest is a single card to sign as part of a batch.
+type IssueRequest struct {
+	// ID is an optional correlation ID that is copied to the result
+	ID                   string
+	VerifiableCredential map[string]interface{}
+}
+
+// IssueResult is the outcome of a single IssueRequest. Err is set when that card failed to sign,
+// which does not affect the rest of the batch.
+type IssueResult struct {
+	ID string
+	// Index is the position of the request in the input stream
+	Index int
+	JWS   string
+	Err   error
+}
+
+type BatchOptions struct {
+	// Workers is the number of cards signed concurrently. Defaults to runtime.NumCPU().
+	Workers int
+
+	// Ordered emits results in the same order the requests were received. Otherwise results are emitted as soon
+	// as they are signed and callers correlate them using ID or Index.
+	Ordered bool
+}
+
+// IssueBatch signs every request received on requests using a bounded pool of workers and streams the results.
+// The returned channel is closed once requests is closed and every received request has a result.
+//
+// When ctx is cancelled no further requests are read, and requests that were already read are reported with
+// the context error. Callers sending on requests should therefore also select on ctx.Done().
+func (i *Issuer) IssueBatch(ctx context.Context, requests <-chan IssueRequest, options BatchOptions) <-chan IssueResult {
+	workers := options.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	type job struct {
+		index   int
+		request IssueRequest
+	}
+	jobs := make(chan job)
+	signed := make(chan IssueResult, workers)
+
+	// in ordered mode a slow card holds back every result after it, so the number of cards in flight is capped
+	// to keep the reorder buffer from growing without bound
+	var window chan struct{}
+	if options.Ordered {
+		window = make(chan struct{}, workers*4)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers + 1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for index := 0; ; index++ {
+			var request IssueRequest
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case request, ok = <-requests:
+				if !ok {
+					return
+				}
+			}
+			// a request read just as ctx was cancelled is not handed to a worker, but still gets its result
+			cancelled := IssueResult{ID: request.ID, Index: index}
+			if window != nil {
+				select {
+				case window <- struct{}{}:
+				case <-ctx.Done():
+					cancelled.Err = ctx.Err()
+					signed <- cancelled
+					return
+				}
+			}
+			select {
+			case jobs <- job{index: index, request: request}:
+			case <-ctx.Done():
+				cancelled.Err = ctx.Err()
+				signed <- cancelled
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				jws, err := i.Issue(ctx, j.request.VerifiableCredential)
+				signed <- IssueResult{ID: j.request.ID, Index: j.index, JWS: jws, Err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(signed)
+	}()
+
+	if !options.Ordered {
+		return signed
+	}
+
+	results := make(chan IssueResult, workers)
+	go func() {
+		defer close(results)
+		pending := map[int]IssueResult{}
+		next := 0
+		for result := range signed {
+			pending[result.Index] = result
+			for {
+				ready, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				results <- ready
+				// a request cancelled before it entered the window holds no slot
+				select {
+				case <-window:
+				default:
+				}
+				next++
+			}
+		}
+	}()
+	return results
+}
+
+// IssueAll signs a slice of requests and returns the results in the same order.
+// Requests that were never started because ctx was cancelled are reported with the context error.
+func (i *Issuer) IssueAll(ctx context.Context, requests []IssueRequest, options BatchOptions) []IssueResult {
+	input := make(chan IssueRequest)
+	go func() {
+		defer close(input)
+		for _, request := range requests {
+			select {
+			case input <- request:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	results := make([]IssueResult, len(requests))
+	done := make([]bool, len(requests))
+	for result := range i.IssueBatch(ctx, input, options) {
+		results[result.Index] = result
+		done[result.Index] = true
+	}
+	for index, ok := range done {
+		if !ok {
+			results[index] = IssueResult{ID: requests[index].ID, Index: index, Err: ctx.Err()}
+		}
+	}
+	return results
+}
@@ -0,0 +1,125 @@
+package issuer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestIssueBatch(t *testing.T) {
+	issuer, key := newTestIssuer(t, IssuerOptions{})
+	verifiableCredential := sampleVerifiableCredential(t)
+
+	requests := make([]IssueRequest, 50)
+	for i := range requests {
+		requests[i] = IssueRequest{ID: fmt.Sprintf("patient-%d", i), VerifiableCredential: verifiableCredential}
+	}
+	// a credential that cannot be marshalled must fail on its own without aborting the batch
+	requests[7].VerifiableCredential = map[string]interface{}{"invalid": make(chan int)}
+
+	results := issuer.IssueAll(context.Background(), requests, BatchOptions{Workers: 4})
+	for i, result := range results {
+		if result.Index != i || result.ID != requests[i].ID {
+			t.Fatalf("Result %d is out of order: %+v", i, result)
+		}
+		if i == 7 {
+			if result.Err == nil {
+				t.Fatalf("Expected the invalid credential to fail")
+			}
+			continue
+		}
+		if result.Err != nil {
+			t.Fatalf("Failed to issue card %d: %s", i, result.Err.Error())
+		}
+		signed, err := jose.ParseSigned(result.JWS)
+		if err != nil {
+			t.Fatalf("Failed to parse card %d: %s", i, err.Error())
+		}
+		if _, err = signed.Verify(&key.PublicKey); err != nil {
+			t.Fatalf("Failed to verify card %d: %s", i, err.Error())
+		}
+	}
+
+	// ordered streaming keeps the input order even with many workers
+	input := make(chan IssueRequest)
+	go func() {
+		defer close(input)
+		for _, request := range requests {
+			input <- request
+		}
+	}()
+	next := 0
+	for result := range issuer.IssueBatch(context.Background(), input, BatchOptions{Workers: 8, Ordered: true}) {
+		if result.Index != next {
+			t.Fatalf("Expected result %d, got %d", next, result.Index)
+		}
+		next++
+	}
+	if next != len(requests) {
+		t.Fatalf("Expected %d results, got %d", len(requests), next)
+	}
+}
+
+func TestIssueBatchCancelled(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	verifiableCredential := sampleVerifiableCredential(t)
+
+	requests := make([]IssueRequest, 20)
+	for i := range requests {
+		requests[i] = IssueRequest{ID: fmt.Sprintf("patient-%d", i), VerifiableCredential: verifiableCredential}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, result := range issuer.IssueAll(ctx, requests, BatchOptions{Workers: 2}) {
+		if result.Err != context.Canceled {
+			t.Fatalf("Expected request %s to be cancelled, got %v", result.ID, result.Err)
+		}
+	}
+}
+
+func TestIssueBatchCancelledWhileWorkersBusy(t *testing.T) {
+	test, _ := newTestIssuer(t, IssuerOptions{})
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	issuer, _ := NewIssuer(IssuerConfig{IssuerURL: test.IssuerURL(), KeySource: test.keys, Audit: AuditSinkFunc(func(context.Context, AuditEvent) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	requests := make(chan IssueRequest, 10)
+	for i := 0; i < 10; i++ {
+		requests <- IssueRequest{ID: fmt.Sprintf("patient-%d", i), VerifiableCredential: sampleVerifiableCredential(t)}
+	}
+	close(requests)
+	results := issuer.IssueBatch(ctx, requests, BatchOptions{Workers: 1})
+
+	// the only worker is stuck on the first card, so the dispatcher is waiting to hand out the second
+	<-started
+	for len(requests) > 8 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case result := <-results:
+		if result.Index != 1 || result.Err != context.Canceled {
+			t.Fatalf("Expected the waiting request to be cancelled, got %+v", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the dispatcher to stop waiting for a worker once cancelled")
+	}
+	close(release)
+
+	count := 1
+	for range results {
+		count++
+	}
+	if count != 2 || len(started) != 0 {
+		t.Fatalf("Expected no cards to be handed out after cancellation, got %d results and %d more signed", count, len(started))
+	}
+}
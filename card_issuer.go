@@ -0,0 +1,403 @@
+package issuer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// PublicKeySource is implemented by key sources that hold more than the active signing key (e.g. a Keystore
+// after a rotation). Every key it returns is published in the issuer's JWKS.
+type PublicKeySource interface {
+	PublicKeys() map[string]*ecdsa.PublicKey
+}
+
+type IssuerOptions struct {
+	// ExpiresIn sets the exp claim relative to the issuance date. Zero issues cards without an expiration,
+	// which is what the spec recommends for immunization cards.
+	ExpiresIn time.Duration
+
+	// EmbedJWK embeds the public key in the JWS header. It makes every card larger, so it is off by default.
+	EmbedJWK bool
+
+	// QRImageSize is the width in pixels of the PNGs produced by QRCodes. Defaults to 256.
+	QRImageSize int
+
+	// ProfileValidation checks each credential against its VCI content profile before signing
+	ProfileValidation ProfileMode
+
+	// Compression selects the DEFLATE encoder. CompressionOptimal makes cards slightly smaller at a large CPU cost.
+	Compression Compression
+
+	// CredentialTypes are the vc.type values, besides HEALTH_CARD_TYPE, of the cards this issuer signs, such as
+	// IMMUNIZATION_TYPE. A credential with any other type is refused. They are published in the SMART
+	// configuration; when empty any type is signed and only HEALTH_CARD_TYPE is published.
+	CredentialTypes []string
+}
+
+type IssuerConfig struct {
+	IssuerURL string
+	KeySource KeySource
+
+	// Clock returns the issuance time of each card. Defaults to time.Now.
+	Clock func() time.Time
+
+	// Audit, when set, records an event for every card signed or revoked
+	Audit AuditSink
+
+	// Revocations, when set, holds the revocation lists Revoke adds to
+	Revocations *CRLStore
+
+	// Transparency, when set, logs every card signed so cards signed outside this issuer can be found
+	Transparency *TransparencyLog
+
+	// Logger and Instrumentation observe every card issued and QR code rendered. They default to doing nothing.
+	Logger          Logger
+	Instrumentation Instrumentation
+
+	Options IssuerOptions
+}
+
+// Issuer signs SMART health cards for a single issuer URL. It is configured once and is safe for concurrent use,
+// so a single Issuer can serve every goroutine of a bulk run or an HTTP service.
+type Issuer struct {
+	url     string
+	keys    KeySource
+	clock   func() time.Time
+	audit   AuditSink
+	crls    *CRLStore
+	options IssuerOptions
+
+	transparency    *TransparencyLog
+	logger          Logger
+	instrumentation Instrumentation
+
+	// signers caches one jose signer per key ID, together with the key it signs with, so a key rotation in the key
+	// source is picked up on the next card even when the new key reuses the kid
+	mu      sync.RWMutex
+	signers map[string]cachedSigner
+}
+
+type cachedSigner struct {
+	public *ecdsa.PublicKey
+	signer jose.Signer
+}
+
+func NewIssuer(config IssuerConfig) (*Issuer, error) {
+	if config.IssuerURL == "" {
+		return nil, errors.New("issuer URL is required")
+	}
+	if config.KeySource == nil {
+		return nil, errors.New("key source is required")
+	}
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+	if config.Logger == nil {
+		config.Logger = nopLogger{}
+	}
+	if config.Instrumentation == nil {
+		config.Instrumentation = nopInstrumentation{}
+	}
+	if config.Options.QRImageSize == 0 {
+		config.Options.QRImageSize = 256
+	}
+	if config.Transparency != nil {
+		// a thief with a card key could otherwise sign a forked tree head that hides the cards they sign
+		cardKeys, err := keySourceJWKS(config.KeySource)
+		if err != nil {
+			return nil, err
+		}
+		logKeys, err := config.Transparency.JWKS()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range cardKeys.Keys {
+			if len(logKeys.Key(key.KeyID)) > 0 {
+				return nil, fmt.Errorf("the transparency log must sign tree heads with a key of its own, not card key %s", key.KeyID)
+			}
+		}
+	}
+	return &Issuer{
+		url:     config.IssuerURL,
+		keys:    config.KeySource,
+		clock:   config.Clock,
+		audit:   config.Audit,
+		crls:    config.Revocations,
+		options: config.Options,
+		signers: map[string]cachedSigner{},
+
+		transparency:    config.Transparency,
+		logger:          config.Logger,
+		instrumentation: config.Instrumentation,
+	}, nil
+}
+
+// IssuerURL returns the iss claim of every card this issuer signs.
+func (i *Issuer) IssuerURL() string {
+	return i.url
+}
+
+// CredentialTypes returns the vc.type values of the cards this issuer signs, see IssuerOptions.CredentialTypes.
+func (i *Issuer) CredentialTypes() []string {
+	return appendUnique([]string{HEALTH_CARD_TYPE}, i.options.CredentialTypes...)
+}
+
+// Issue signs the verifiable credential and returns the compact JWS.
+func (i *Issuer) Issue(ctx context.Context, verifiableCredential map[string]interface{}) (string, error) {
+	jws, _, err := i.IssueWithDiagnostics(ctx, verifiableCredential)
+	return jws, err
+}
+
+// IssueWithDiagnostics signs the verifiable credential and also returns the profile diagnostics when profile
+// validation is enabled. In strict mode a credential with profile errors is not signed and a
+// *ProfileValidationError is returned.
+func (i *Issuer) IssueWithDiagnostics(ctx context.Context, verifiableCredential map[string]interface{}) (string, Diagnostics, error) {
+	return i.issueWith(ctx, verifiableCredential, nil)
+}
+
+// IssueQRCodes signs the verifiable credential and renders its QR codes, one PNG per chunk, before the card is added
+// to the transparency log or audited: a card that cannot be rendered is refused like any other, and leaves no record of
+// a card nobody received.
+func (i *Issuer) IssueQRCodes(ctx context.Context, verifiableCredential map[string]interface{}) (string, [][]byte, Diagnostics, error) {
+	var images [][]byte
+	jws, diagnostics, err := i.issueWith(ctx, verifiableCredential, func(jws string) error {
+		var err error
+		images, err = i.QRCodes(jws)
+		return err
+	})
+	if err != nil {
+		return "", nil, diagnostics, err
+	}
+	return jws, images, diagnostics, nil
+}
+
+// issueWith does the work of IssueWithDiagnostics. render, if not nil, gets the signed card before it is recorded and
+// can refuse it.
+func (i *Issuer) issueWith(ctx context.Context, verifiableCredential map[string]interface{}, render func(jws string) error) (string, Diagnostics, error) {
+	ctx, done := observe(ctx, i.instrumentation, OperationIssue)
+	jws, keyId, diagnostics, reason, err := i.issue(ctx, verifiableCredential, render)
+	measurement := Measurement{KeyId: keyId, FailureReason: reason, Err: err}
+	switch {
+	case err == nil:
+		measurement.JWSBytes, measurement.PayloadBytes, measurement.Chunks = len(jws), jwsPayloadSize(jws), len(SplitJWS(jws))
+		i.logger.Debug("card issued", "kid", keyId, "jwsBytes", measurement.JWSBytes, "payloadBytes", measurement.PayloadBytes, "chunks", measurement.Chunks)
+	case reason == FAILURE_PROFILE_VALIDATION:
+		// the diagnostic messages may quote the credential, so only their codes are logged
+		var codes []string
+		for _, diagnostic := range diagnostics {
+			if diagnostic.Severity == SeverityError {
+				codes = appendUnique(codes, diagnostic.Code)
+			}
+		}
+		i.logger.Info("card not issued", "reason", reason, "codes", strings.Join(codes, ","))
+	default:
+		i.logger.Error("card not issued", "reason", reason, "kid", keyId, "error", err)
+	}
+	done(measurement)
+	return jws, diagnostics, err
+}
+
+// issue does the work of issueWith, also returning the key used and why issuance failed
+func (i *Issuer) issue(ctx context.Context, verifiableCredential map[string]interface{}, render func(jws string) error) (string, string, Diagnostics, string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", nil, FAILURE_CANCELED, err
+	}
+	if len(verifiableCredential) == 0 {
+		return "", "", nil, FAILURE_INVALID_CREDENTIAL, fmt.Errorf("%w: the credential is empty", ErrInvalidCredential)
+	}
+	if len(i.options.CredentialTypes) > 0 {
+		allowed := i.CredentialTypes()
+		for _, t := range stringSlice(verifiableCredential["type"]) {
+			if !containsString(allowed, t) {
+				return "", "", nil, FAILURE_INVALID_CREDENTIAL, fmt.Errorf("%w: the issuer does not sign %s cards", ErrInvalidCredential, t)
+			}
+		}
+	}
+
+	var diagnostics Diagnostics
+	if i.options.ProfileValidation != ProfileValidationOff {
+		diagnostics = ValidateProfile(verifiableCredential)
+		if i.options.ProfileValidation == ProfileValidationStrict && diagnostics.HasErrors() {
+			return "", "", diagnostics, FAILURE_PROFILE_VALIDATION, &ProfileValidationError{Diagnostics: diagnostics}
+		}
+	}
+
+	jws, keyId, issuedAt, err := i.sign(verifiableCredential)
+	if errors.Is(err, ErrInvalidCredential) {
+		return "", keyId, diagnostics, FAILURE_INVALID_CREDENTIAL, err
+	}
+	if err != nil {
+		return "", keyId, diagnostics, FAILURE_SIGNING, err
+	}
+	if render != nil {
+		if err := render(jws); err != nil {
+			return "", keyId, diagnostics, FAILURE_QR_ENCODING, err
+		}
+	}
+	if i.transparency != nil {
+		entry := TransparencyEntry{IssuerURL: i.url, KeyId: keyId, IssuedAt: issuedAt.Unix(), PayloadHash: jwsPayloadHash(jws)}
+		if _, err := i.transparency.Append(entry); err != nil {
+			return "", keyId, diagnostics, FAILURE_TRANSPARENCY, fmt.Errorf("failed to log card: %w", err)
+		}
+	}
+	if i.audit != nil {
+		event := AuditEvent{
+			Time:         issuedAt,
+			Action:       AuditIssue,
+			IssuerURL:    i.url,
+			KeyId:        keyId,
+			RevocationId: getString(verifiableCredential, "rid"),
+			Types:        stringSlice(verifiableCredential["type"]),
+			PayloadHash:  jwsPayloadHash(jws),
+			Requester:    RequesterFromContext(ctx),
+		}
+		if err := i.audit.Record(ctx, event); err != nil {
+			return "", keyId, diagnostics, FAILURE_AUDIT, fmt.Errorf("failed to record audit event: %w", err)
+		}
+	}
+	return jws, keyId, diagnostics, "", nil
+}
+
+// Revoke adds the rid to the revocation list of the key that signed the card, so verifiers reject cards with that
+// rid issued up to now. It needs IssuerConfig.Revocations.
+func (i *Issuer) Revoke(ctx context.Context, keyId string, rid string) error {
+	if i.crls == nil {
+		return errors.New("issuer has no revocation lists")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := i.clock()
+	if err := i.crls.Revoke(keyId, rid, now); err != nil {
+		return err
+	}
+	if i.audit != nil {
+		event := AuditEvent{
+			Time:         now,
+			Action:       AuditRevoke,
+			IssuerURL:    i.url,
+			KeyId:        keyId,
+			RevocationId: rid,
+			Requester:    RequesterFromContext(ctx),
+		}
+		if err := i.audit.Record(ctx, event); err != nil {
+			return fmt.Errorf("failed to record audit event: %w", err)
+		}
+	}
+	return nil
+}
+
+func (i *Issuer) sign(verifiableCredential map[string]interface{}) (string, string, time.Time, error) {
+	key, keyId, err := i.keys.SigningKey()
+	if err != nil {
+		return "", "", time.Time{}, &SigningError{Err: fmt.Errorf("failed to load signing key: %w", err)}
+	}
+	signer, err := i.signer(key, keyId)
+	if err != nil {
+		return "", keyId, time.Time{}, &SigningError{KeyId: keyId, Err: err}
+	}
+
+	now := i.clock()
+	card := SmartHealthCard{
+		IssuerURL:            i.url,
+		IssuanceDate:         int(now.Unix()),
+		VerifiableCredential: verifiableCredential,
+	}
+	if i.options.ExpiresIn > 0 {
+		card.ExpirationDate = int(now.Add(i.options.ExpiresIn).Unix())
+	}
+
+	jws, err := card.signWith(signer, i.options.Compression)
+	if err != nil {
+		return "", keyId, time.Time{}, &SigningError{KeyId: keyId, Err: err}
+	}
+	compact, err := jws.CompactSerialize()
+	if err != nil {
+		return "", keyId, time.Time{}, &SigningError{KeyId: keyId, Err: err}
+	}
+	return compact, keyId, now, nil
+}
+
+func (i *Issuer) signer(key *ecdsa.PrivateKey, keyId string) (jose.Signer, error) {
+	i.mu.RLock()
+	cached, ok := i.signers[keyId]
+	i.mu.RUnlock()
+	if ok && key != nil && cached.public.Equal(&key.PublicKey) {
+		return cached.signer, nil
+	}
+
+	signer, err := newCardSigner(key, keyId, i.options.EmbedJWK)
+	if err != nil {
+		return nil, err
+	}
+	i.mu.Lock()
+	i.signers[keyId] = cachedSigner{public: &key.PublicKey, signer: signer}
+	i.mu.Unlock()
+	return signer, nil
+}
+
+// JWKS returns the public keys verifiers need, to be served at <issuer URL>/.well-known/jwks.json.
+func (i *Issuer) JWKS() (jose.JSONWebKeySet, error) {
+	return keySourceJWKS(i.keys)
+}
+
+// keySourceJWKS returns every public key of the source, see PublicKeySource
+func keySourceJWKS(source KeySource) (jose.JSONWebKeySet, error) {
+	var keys map[string]*ecdsa.PublicKey
+	if public, ok := source.(PublicKeySource); ok {
+		keys = public.PublicKeys()
+	} else {
+		key, keyId, err := source.SigningKey()
+		if err != nil {
+			return jose.JSONWebKeySet{}, fmt.Errorf("failed to load signing key: %w", err)
+		}
+		keys = map[string]*ecdsa.PublicKey{keyId: &key.PublicKey}
+	}
+
+	set := jose.JSONWebKeySet{Keys: make([]jose.JSONWebKey, 0, len(keys))}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, jose.JSONWebKey{
+			Key:       key,
+			KeyID:     kid,
+			Algorithm: string(jose.ES256),
+			Use:       "sig",
+		})
+	}
+	sort.Slice(set.Keys, func(a, b int) bool {
+		return set.Keys[a].KeyID < set.Keys[b].KeyID
+	})
+	return set, nil
+}
+
+// JWKSJSON returns the JWKS serialized the way it should be served.
+func (i *Issuer) JWKSJSON() ([]byte, error) {
+	set, err := i.JWKS()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(set)
+}
+
+// QRCodes returns one PNG per QR chunk of the JWS.
+func (i *Issuer) QRCodes(jws string) ([][]byte, error) {
+	_, done := observe(context.Background(), i.instrumentation, OperationQR)
+	images, err := QRCodePNGs(jws, i.options.QRImageSize)
+	measurement := Measurement{JWSBytes: len(jws), PayloadBytes: jwsPayloadSize(jws), Chunks: len(SplitJWS(jws)), Err: err}
+	if err != nil {
+		measurement.FailureReason = FAILURE_QR_ENCODING
+		i.logger.Error("QR codes not rendered", "reason", measurement.FailureReason, "jwsBytes", measurement.JWSBytes, "error", err)
+	} else {
+		i.logger.Debug("QR codes rendered", "jwsBytes", measurement.JWSBytes, "chunks", measurement.Chunks)
+	}
+	done(measurement)
+	return images, err
+}
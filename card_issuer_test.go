@@ -0,0 +1,174 @@
+package issuer
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func sampleVerifiableCredential(t testing.TB) map[string]interface{} {
+	var verifiableCredential map[string]interface{}
+	if err := json.Unmarshal([]byte(vc), &verifiableCredential); err != nil {
+		t.Fatalf("Failed to unmarshal fhir json: %s", err.Error())
+	}
+	return verifiableCredential
+}
+
+func newTestIssuer(t testing.TB, options IssuerOptions) (*Issuer, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %s", err.Error())
+	}
+	keyId, err := ComputeKeyId(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to compute key ID: %s", err.Error())
+	}
+	issuer, err := NewIssuer(IssuerConfig{
+		IssuerURL: "https://smarthealth.cards/examples/issuer",
+		KeySource: StaticKey{PrivateKey: key, KeyId: keyId},
+		Clock: func() time.Time {
+			return time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+		},
+		Options: options,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create issuer: %s", err.Error())
+	}
+	return issuer, key
+}
+
+func TestIssuerConcurrentIssue(t *testing.T) {
+	issuer, key := newTestIssuer(t, IssuerOptions{ExpiresIn: 24 * time.Hour})
+	verifiableCredential := sampleVerifiableCredential(t)
+
+	var wg sync.WaitGroup
+	jwsList := make([]string, 32)
+	errs := make([]error, len(jwsList))
+	for i := range jwsList {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			jwsList[i], errs[i] = issuer.Issue(context.Background(), verifiableCredential)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, jws := range jwsList {
+		if errs[i] != nil {
+			t.Fatalf("Failed to issue card %d: %s", i, errs[i].Error())
+		}
+		signed, err := jose.ParseSigned(jws)
+		if err != nil {
+			t.Fatalf("Failed to parse signed JWS: %s", err.Error())
+		}
+		if signed.Signatures[0].Header.JSONWebKey != nil {
+			t.Fatalf("Expected no embedded JWK in the header by default")
+		}
+		payload, err := signed.Verify(&key.PublicKey)
+		if err != nil {
+			t.Fatalf("Failed to verify card: %s", err.Error())
+		}
+		inflated, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			t.Fatalf("Failed to inflate payload: %s", err.Error())
+		}
+		var card SmartHealthCard
+		if err = json.Unmarshal(inflated, &card); err != nil {
+			t.Fatalf("Failed to unmarshal card: %s", err.Error())
+		}
+		if card.IssuanceDate != 1622505600 || card.ExpirationDate != 1622592000 {
+			t.Fatalf("Unexpected nbf/exp: %d/%d", card.IssuanceDate, card.ExpirationDate)
+		}
+	}
+}
+
+func TestIssuerJWKS(t *testing.T) {
+	issuer, key := newTestIssuer(t, IssuerOptions{})
+	set, err := issuer.JWKS()
+	if err != nil {
+		t.Fatalf("Failed to build JWKS: %s", err.Error())
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("Expected a single key in the JWKS, got %d", len(set.Keys))
+	}
+	if !set.Keys[0].IsPublic() {
+		t.Fatalf("The JWKS contains private key material")
+	}
+	keyId, _ := ComputeKeyId(&key.PublicKey)
+	if set.Keys[0].KeyID != keyId || set.Keys[0].Algorithm != "ES256" || set.Keys[0].Use != "sig" {
+		t.Fatalf("Unexpected JWK: %+v", set.Keys[0])
+	}
+}
+
+// sameKeyIdSource replaces its key without changing the kid, as a key source configured by hand might
+type sameKeyIdSource struct {
+	key *ecdsa.PrivateKey
+}
+
+func (s *sameKeyIdSource) SigningKey() (*ecdsa.PrivateKey, string, error) {
+	return s.key, "issuer-key", nil
+}
+
+func TestIssuerKeyChangeUnderSameKeyId(t *testing.T) {
+	first, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	second, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keys := &sameKeyIdSource{key: first}
+	issuer, err := NewIssuer(IssuerConfig{IssuerURL: "https://example.org/issuer", KeySource: keys})
+	if err != nil {
+		t.Fatalf("Failed to create issuer: %s", err.Error())
+	}
+	for _, key := range []*ecdsa.PrivateKey{first, second} {
+		keys.key = key
+		jws, err := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+		if err != nil {
+			t.Fatalf("Failed to issue card: %s", err.Error())
+		}
+		jwks := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "issuer-key", Algorithm: "ES256"}}}
+		if _, err := VerifyCard(jws, jwks); err != nil {
+			t.Fatalf("Expected the card to be signed with the current key: %s", err.Error())
+		}
+	}
+}
+
+func TestQRContents(t *testing.T) {
+	single := QRContents("abc")
+	if len(single) != 1 || single[0] != "shc:/525354" {
+		t.Fatalf("Unexpected QR contents: %v", single)
+	}
+
+	jws := strings.Repeat("a", 2*MAX_CHUNK_SIZE+10)
+	contents := QRContents(jws)
+	if len(contents) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(contents))
+	}
+	for i, content := range contents {
+		if !strings.HasPrefix(content, "shc:/"+string(rune('1'+i))+"/3/") {
+			t.Fatalf("Unexpected chunk prefix: %s", content[:12])
+		}
+	}
+	for _, chunk := range SplitJWS(jws) {
+		if len(chunk) > MAX_CHUNK_SIZE || len(chunk) < MAX_CHUNK_SIZE/2 {
+			t.Fatalf("Chunks are not balanced: %d", len(chunk))
+		}
+	}
+
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	images, err := issuer.QRCodes(jws)
+	if err != nil {
+		t.Fatalf("Failed to render QR codes: %s", err.Error())
+	}
+	if len(images) != 3 {
+		t.Fatalf("Expected 3 QR images, got %d", len(images))
+	}
+}
@@ -0,0 +1,1239 @@
+// Command shc issues, verifies and inspects SMART health cards.
+//
+//	shc keygen  -keystore issuer.keystore [-rotate] [-jwks jwks.json]
+//	shc issue   -keystore issuer.keystore -iss https://example.org/issuer -vc vc.json [-format jws|file|qr] [-out path]
+//	shc issue   -keystore issuer.keystore -iss https://example.org/issuer -fhir https://fhir.example.org/r4 -patient 123
+//	shc issue   -keystore issuer.keystore -iss https://example.org/issuer -hl7 vxu.hl7
+//	shc serve   -keystore issuer.keystore -iss https://example.org/issuer [-addr :8080] [-auth-issuer https://auth.example.org -auth-audience https://example.org/issuer -fhir https://fhir.example.org/r4]
+//	shc import  -keystore issuer.keystore -iss https://example.org/issuer [-mapping mapping.json] -out cards records.csv
+//	shc plan    -keystore issuer.keystore -iss https://example.org/issuer -vc vc.json [-embed-jwk] [-json]
+//	shc revoke  -keystore issuer.keystore -iss https://example.org/issuer -crl crl.json [-kid kid] rid...
+//	shc audit-verify [-head seq:hash] audit.jsonl
+//	shc transparency -keystore transparency.keystore -iss https://example.org/issuer -log log.jsonl [card]
+//	shc verify  -jwks jwks.json card
+//	shc verify  -trust trust/ card
+//	shc verifier -trust trust/ [-addr :8081]
+//	shc qr      -out qr card
+//	shc inspect [-json|-payload] card
+//	shc render  [-jwks jwks.json] [-out card.html] card
+//	shc pdf     [-jwks jwks.json] [-paper letter|a4] [-layout page|wallet] -out card.pdf card
+//
+// The keystore passphrase is read from the environment variable named by -passphrase-env (SHC_PASSPHRASE by default)
+// so it never ends up in shell history. issue, serve, import and revoke append an event per card to the log named by
+// -audit, chained under the HMAC key in -audit-key-env (SHC_AUDIT_KEY by default) unless -audit-chain=false; the head
+// printed on exit can be passed to audit-verify -head later. Tree heads of the -transparency log are signed with the key
+// in -transparency-keystore, which must not hold a card key. A card argument may be a JWS, a .smart-health-card file or a file of shc:/
+// lines; "-" reads it from stdin.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	issuer "smart-health-cards-go"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"keygen", "create a keystore or add a new key to it", runKeygen},
+	{"issue", "sign a verifiable credential", runIssue},
+	{"serve", "run an HTTP service that issues cards", runServe},
+	{"import", "issue a card per patient from a vaccination spreadsheet", runImport},
+	{"plan", "predict a card's size and QR codes without signing it", runPlan},
+	{"revoke", "add cards to their key's revocation list", runRevoke},
+	{"audit-verify", "check the HMAC chain of an audit log", runAuditVerify},
+	{"transparency", "print the signed tree head of a transparency log, or a card's inclusion proof", runTransparency},
+	{"verify", "verify a card against a JWKS or a trust directory", runVerify},
+	{"verifier", "run an HTTP service that verifies cards against a trust directory", runVerifier},
+	{"qr", "write the QR code PNGs for a card", runQR},
+	{"inspect", "print a human-readable report of a card", runInspect},
+	{"render", "write an HTML page showing what a card says", runRender},
+	{"pdf", "write a printable PDF page or wallet card", runPDF},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			if err := c.run(os.Args[2:]); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					os.Exit(2)
+				}
+				fmt.Fprintf(os.Stderr, "shc %s: %s\n", c.name, err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: shc <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.usage)
+	}
+}
+
+func passphrase(env string) (string, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return "", fmt.Errorf("set the keystore passphrase in $%s", env)
+	}
+	return value, nil
+}
+
+func runKeygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	keystorePath := flags.String("keystore", "issuer.keystore", "keystore file to create or update")
+	passphraseEnv := flags.String("passphrase-env", "SHC_PASSPHRASE", "environment variable holding the keystore passphrase")
+	rotate := flags.Bool("rotate", false, "make the new key the active signing key")
+	jwksPath := flags.String("jwks", "", "also write the public JWKS to this file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	pass, err := passphrase(*passphraseEnv)
+	if err != nil {
+		return err
+	}
+
+	var ks *issuer.Keystore
+	if _, statErr := os.Stat(*keystorePath); statErr == nil {
+		ks, err = issuer.OpenKeystore(*keystorePath, pass)
+	} else {
+		ks, err = issuer.NewKeystore(*keystorePath, pass)
+	}
+	if err != nil {
+		return err
+	}
+
+	var kid string
+	if *rotate {
+		kid, err = ks.Rotate()
+	} else {
+		kid, err = ks.GenerateKey()
+	}
+	if err != nil {
+		return err
+	}
+	if err := ks.Save(); err != nil {
+		return err
+	}
+	fmt.Println(kid)
+
+	if *jwksPath != "" {
+		iss, err := issuer.NewIssuer(issuer.IssuerConfig{IssuerURL: "unused", KeySource: ks})
+		if err != nil {
+			return err
+		}
+		jwks, err := iss.JWKSJSON()
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(*jwksPath, jwks, 0644)
+	}
+	return nil
+}
+
+func runIssue(args []string) error {
+	flags := flag.NewFlagSet("issue", flag.ContinueOnError)
+	keystorePath := flags.String("keystore", "issuer.keystore", "keystore holding the signing key")
+	passphraseEnv := flags.String("passphrase-env", "SHC_PASSPHRASE", "environment variable holding the keystore passphrase")
+	issuerURL := flags.String("iss", "", "issuer URL (required)")
+	vcPath := flags.String("vc", "", "verifiable credential JSON file (required unless -fhir or -hl7 is given)")
+	hl7Path := flags.String("hl7", "", "HL7 v2 VXU^V04 message to read the patient's immunizations from")
+	fhirBase := flags.String("fhir", "", "FHIR R4 base URL to read the patient's immunizations and lab results from")
+	patientId := flags.String("patient", "", "patient ID on the FHIR server")
+	fhirTokenEnv := flags.String("fhir-token-env", "FHIR_TOKEN", "environment variable holding a bearer token for the FHIR server")
+	since := flags.String("since", "", "only read FHIR resources changed since this RFC 3339 time")
+	format := flags.String("format", "jws", "output format: jws, file or qr")
+	out := flags.String("out", "", "output file, or file prefix for qr (defaults to stdout, or \"qr\" for qr)")
+	expires := flags.Duration("expires", 0, "expire the card after this duration")
+	profile := flags.String("profile", "strict", "content profile validation: off, warn or strict")
+	compression := flags.String("compression", "best", "DEFLATE encoder: best, or optimal for smaller cards that take longer to sign")
+	codes := flags.String("codes", "", "directory with newer CDC cvx/mvx/tradename exports to validate against")
+	auditPath := flags.String("audit", "", "append an audit event per card to this JSON-lines file")
+	auditChain := flags.Bool("audit-chain", true, "chain the audit log under an HMAC key so tampering is detected")
+	auditKeyEnv := flags.String("audit-key-env", "SHC_AUDIT_KEY", "environment variable holding the audit log's HMAC key")
+	transparencyPath := flags.String("transparency", "", "append every card signed to this transparency log")
+	transparencyKeystore := flags.String("transparency-keystore", "transparency.keystore", "keystore holding the log's own key that signs tree heads")
+	transparencyPassphraseEnv := flags.String("transparency-passphrase-env", "SHC_TRANSPARENCY_PASSPHRASE", "environment variable holding the transparency keystore passphrase")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := loadCodeTables(*codes); err != nil {
+		return err
+	}
+	profileMode, err := parseProfileMode(*profile)
+	if err != nil {
+		return err
+	}
+	encoder, err := parseCompression(*compression)
+	if err != nil {
+		return err
+	}
+	sources := 0
+	for _, source := range []string{*vcPath, *fhirBase, *hl7Path} {
+		if source != "" {
+			sources++
+		}
+	}
+	if *issuerURL == "" || sources != 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	var vc map[string]interface{}
+	if *fhirBase != "" {
+		var err error
+		if vc, err = fetchCredential(*fhirBase, *patientId, os.Getenv(*fhirTokenEnv), *since); err != nil {
+			return err
+		}
+	} else if *hl7Path != "" {
+		var err error
+		if vc, err = readVXU(*hl7Path); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if vc, err = readCredential(*vcPath); err != nil {
+			return err
+		}
+	}
+
+	pass, err := passphrase(*passphraseEnv)
+	if err != nil {
+		return err
+	}
+	ks, err := issuer.OpenKeystore(*keystorePath, pass)
+	if err != nil {
+		return err
+	}
+	audit, err := openAudit(*auditPath, *auditChain, *auditKeyEnv)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+	log, err := openTransparency(*transparencyPath, *issuerURL, *transparencyKeystore, *transparencyPassphraseEnv)
+	if err != nil {
+		return err
+	}
+	if log != nil {
+		defer log.Close()
+	}
+	iss, err := issuer.NewIssuer(issuer.IssuerConfig{
+		IssuerURL:    *issuerURL,
+		KeySource:    ks,
+		Audit:        audit.sink(),
+		Transparency: log,
+		Options:      issuer.IssuerOptions{ExpiresIn: *expires, ProfileValidation: profileMode, Compression: encoder},
+	})
+	if err != nil {
+		return err
+	}
+
+	var jws string
+	var images [][]byte
+	var diagnostics issuer.Diagnostics
+	if *format == "qr" {
+		// rendered before the card is logged, so a card too large for QR codes is not recorded as issued
+		jws, images, diagnostics, err = iss.IssueQRCodes(context.Background(), vc)
+	} else {
+		jws, diagnostics, err = iss.IssueWithDiagnostics(context.Background(), vc)
+	}
+	for _, diagnostic := range diagnostics {
+		fmt.Fprintln(os.Stderr, diagnostic.String())
+	}
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "jws":
+		return writeOutput(*out, []byte(jws+"\n"))
+	case "file":
+		file, err := issuer.MarshalCardFile(jws)
+		if err != nil {
+			return err
+		}
+		return writeOutput(*out, file)
+	case "qr":
+		prefix := *out
+		if prefix == "" {
+			prefix = "qr"
+		}
+		return writePNGs(prefix, images)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+}
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	keystorePath := flags.String("keystore", "issuer.keystore", "keystore holding the signing key")
+	passphraseEnv := flags.String("passphrase-env", "SHC_PASSPHRASE", "environment variable holding the keystore passphrase")
+	issuerURL := flags.String("iss", "", "issuer URL (required)")
+	addr := flags.String("addr", ":8080", "address to listen on")
+	maxBytes := flags.Int64("max-request-bytes", 1<<20, "largest request body accepted")
+	profile := flags.String("profile", "strict", "content profile validation: off, warn or strict")
+	compression := flags.String("compression", "best", "DEFLATE encoder: best, or optimal for smaller cards that take longer to sign")
+	codes := flags.String("codes", "", "directory with newer CDC cvx/mvx/tradename exports to validate against")
+	types := flags.String("types", "", "comma-separated card types to sign and publish: immunization, covid19, laboratory (default any)")
+	authIssuer := flags.String("auth-issuer", "", "SMART authorization server whose patient access tokens /issue requires")
+	authJWKS := flags.String("auth-jwks", "", "JWKS URL of the authorization server (defaults to <auth-issuer>/.well-known/jwks.json)")
+	authAudience := flags.String("auth-audience", "", "aud claim access tokens must carry (required with -auth-issuer)")
+	authorizeEndpoint := flags.String("authorize-endpoint", "", "authorization endpoint to publish in .well-known/smart-configuration")
+	tokenEndpoint := flags.String("token-endpoint", "", "token endpoint to publish in .well-known/smart-configuration")
+	fhirBase := flags.String("fhir", "", "FHIR R4 base URL to read authorized patients' records from (required with -auth-issuer)")
+	fhirTokenEnv := flags.String("fhir-token-env", "FHIR_TOKEN", "environment variable holding a bearer token for the FHIR server")
+	crlPath := flags.String("crl", "", "revocation lists to publish under /.well-known/crl/, as written by shc revoke")
+	verbose := flags.Bool("verbose", false, "log every card issued, not only failures")
+	auditPath := flags.String("audit", "", "append an audit event per card to this JSON-lines file")
+	auditChain := flags.Bool("audit-chain", true, "chain the audit log under an HMAC key so tampering is detected")
+	auditKeyEnv := flags.String("audit-key-env", "SHC_AUDIT_KEY", "environment variable holding the audit log's HMAC key")
+	transparencyPath := flags.String("transparency", "", "append every card signed to this transparency log")
+	transparencyKeystore := flags.String("transparency-keystore", "transparency.keystore", "keystore holding the log's own key that signs tree heads")
+	transparencyPassphraseEnv := flags.String("transparency-passphrase-env", "SHC_TRANSPARENCY_PASSPHRASE", "environment variable holding the transparency keystore passphrase")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *issuerURL == "" || (*fhirBase == "") != (*authIssuer == "") || (*authAudience == "") != (*authIssuer == "") {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	if err := loadCodeTables(*codes); err != nil {
+		return err
+	}
+	profileMode, err := parseProfileMode(*profile)
+	if err != nil {
+		return err
+	}
+	encoder, err := parseCompression(*compression)
+	if err != nil {
+		return err
+	}
+	credentialTypes, err := parseCredentialTypes(*types)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	options := issuer.ServiceOptions{
+		MaxRequestBytes: *maxBytes,
+		SMARTConfiguration: issuer.SMARTConfigurationOptions{
+			AuthorizationEndpoint: *authorizeEndpoint,
+			TokenEndpoint:         *tokenEndpoint,
+			IssueEndpoint:         strings.TrimSuffix(*issuerURL, "/") + "/issue",
+		},
+	}
+	if *authIssuer != "" {
+		jwksURL := *authJWKS
+		if jwksURL == "" {
+			jwksURL = strings.TrimSuffix(*authIssuer, "/") + "/.well-known/jwks.json"
+		}
+		if options.Authorizer, err = issuer.NewSMARTAuthorizer(ctx, issuer.AuthConfig{
+			Issuer:   *authIssuer,
+			Audience: *authAudience,
+			JWKSURL:  jwksURL,
+		}); err != nil {
+			return err
+		}
+	}
+	if *fhirBase != "" {
+		config := issuer.FHIRClientConfig{BaseURL: *fhirBase}
+		if token := os.Getenv(*fhirTokenEnv); token != "" {
+			config.Header = http.Header{"Authorization": {"Bearer " + token}}
+		}
+		if options.Records, err = issuer.NewFHIRClient(config); err != nil {
+			return err
+		}
+	}
+
+	pass, err := passphrase(*passphraseEnv)
+	if err != nil {
+		return err
+	}
+	ks, err := issuer.OpenKeystore(*keystorePath, pass)
+	if err != nil {
+		return err
+	}
+	audit, err := openAudit(*auditPath, *auditChain, *auditKeyEnv)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+	var crls *issuer.CRLStore
+	if *crlPath != "" {
+		if crls, err = issuer.OpenCRLStore(*crlPath); err != nil {
+			return err
+		}
+	}
+	log, err := openTransparency(*transparencyPath, *issuerURL, *transparencyKeystore, *transparencyPassphraseEnv)
+	if err != nil {
+		return err
+	}
+	if log != nil {
+		defer log.Close()
+	}
+	iss, err := issuer.NewIssuer(issuer.IssuerConfig{
+		IssuerURL:    *issuerURL,
+		KeySource:    ks,
+		Audit:        audit.sink(),
+		Revocations:  crls,
+		Transparency: log,
+		Logger:       issuer.NewStdLogger(nil, *verbose),
+		Options:      issuer.IssuerOptions{ProfileValidation: profileMode, Compression: encoder, CredentialTypes: credentialTypes},
+	})
+	if err != nil {
+		return err
+	}
+
+	service, err := issuer.NewIssuingService(iss, options)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "issuing cards for %s on %s\n", *issuerURL, *addr)
+	return service.ListenAndServe(ctx, *addr)
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	keystorePath := flags.String("keystore", "issuer.keystore", "keystore holding the signing key")
+	passphraseEnv := flags.String("passphrase-env", "SHC_PASSPHRASE", "environment variable holding the keystore passphrase")
+	issuerURL := flags.String("iss", "", "issuer URL (required)")
+	mappingPath := flags.String("mapping", "", "JSON file mapping spreadsheet columns to card fields (defaults to the template columns)")
+	performer := flags.String("performer", "", "performer for rows that do not name one, e.g. the clinic")
+	out := flags.String("out", "cards", "directory to write one .smart-health-card file per patient to")
+	reportJSON := flags.Bool("json", false, "print the summary report as JSON")
+	auditPath := flags.String("audit", "", "append an audit event per card to this JSON-lines file")
+	auditChain := flags.Bool("audit-chain", true, "chain the audit log under an HMAC key so tampering is detected")
+	auditKeyEnv := flags.String("audit-key-env", "SHC_AUDIT_KEY", "environment variable holding the audit log's HMAC key")
+	transparencyPath := flags.String("transparency", "", "append every card signed to this transparency log")
+	transparencyKeystore := flags.String("transparency-keystore", "transparency.keystore", "keystore holding the log's own key that signs tree heads")
+	transparencyPassphraseEnv := flags.String("transparency-passphrase-env", "SHC_TRANSPARENCY_PASSPHRASE", "environment variable holding the transparency keystore passphrase")
+	compression := flags.String("compression", "best", "DEFLATE encoder: best, or optimal for smaller cards that take longer to sign")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *issuerURL == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	encoder, err := parseCompression(*compression)
+	if err != nil {
+		return err
+	}
+
+	mapping := issuer.DefaultCSVMapping()
+	if *mappingPath != "" {
+		var err error
+		if mapping, err = issuer.LoadCSVMapping(*mappingPath); err != nil {
+			return err
+		}
+	}
+	if *performer != "" {
+		mapping.DefaultPerformer = *performer
+	}
+
+	input, err := readInput(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	imported, err := issuer.ImportCSV(bytes.NewReader(input), mapping)
+	if err != nil {
+		return err
+	}
+
+	pass, err := passphrase(*passphraseEnv)
+	if err != nil {
+		return err
+	}
+	ks, err := issuer.OpenKeystore(*keystorePath, pass)
+	if err != nil {
+		return err
+	}
+	audit, err := openAudit(*auditPath, *auditChain, *auditKeyEnv)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+	log, err := openTransparency(*transparencyPath, *issuerURL, *transparencyKeystore, *transparencyPassphraseEnv)
+	if err != nil {
+		return err
+	}
+	if log != nil {
+		defer log.Close()
+	}
+	iss, err := issuer.NewIssuer(issuer.IssuerConfig{
+		IssuerURL:    *issuerURL,
+		KeySource:    ks,
+		Audit:        audit.sink(),
+		Transparency: log,
+		Options:      issuer.IssuerOptions{Compression: encoder},
+	})
+	if err != nil {
+		return err
+	}
+
+	report := imported.Issue(context.Background(), iss, issuer.BatchOptions{})
+	if err := report.WriteCardFiles(*out); err != nil {
+		return err
+	}
+	if *reportJSON {
+		return report.WriteJSON(os.Stdout)
+	}
+	return report.WriteText(os.Stdout)
+}
+
+func runPlan(args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	keystorePath := flags.String("keystore", "issuer.keystore", "keystore holding the signing key")
+	passphraseEnv := flags.String("passphrase-env", "SHC_PASSPHRASE", "environment variable holding the keystore passphrase")
+	issuerURL := flags.String("iss", "", "issuer URL (required)")
+	vcPath := flags.String("vc", "", "verifiable credential JSON file (required)")
+	expires := flags.Duration("expires", 0, "plan a card that expires after this duration")
+	embedJWK := flags.Bool("embed-jwk", false, "plan a card with the public key embedded in its header")
+	asJSON := flags.Bool("json", false, "print the plan as JSON")
+	compression := flags.String("compression", "best", "DEFLATE encoder: best, or optimal for the size of a card signed with the optimal encoder")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *issuerURL == "" || *vcPath == "" {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	encoder, err := parseCompression(*compression)
+	if err != nil {
+		return err
+	}
+
+	vc, err := readCredential(*vcPath)
+	if err != nil {
+		return err
+	}
+	pass, err := passphrase(*passphraseEnv)
+	if err != nil {
+		return err
+	}
+	ks, err := issuer.OpenKeystore(*keystorePath, pass)
+	if err != nil {
+		return err
+	}
+	iss, err := issuer.NewIssuer(issuer.IssuerConfig{
+		IssuerURL: *issuerURL,
+		KeySource: ks,
+		Options:   issuer.IssuerOptions{ExpiresIn: *expires, EmbedJWK: *embedJWK, Compression: encoder},
+	})
+	if err != nil {
+		return err
+	}
+	plan, err := iss.Plan(vc)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+	fmt.Printf("payload:  %d bytes deflated, %d byte header\n", plan.PayloadSize, plan.HeaderSize)
+	fmt.Printf("jws:      %d characters, single QR limit %d\n", plan.JWSLength, issuer.MAX_SINGLE_JWS_SIZE)
+	fmt.Printf("qr codes: %d, versions %v\n", plan.Chunks, plan.QRVersions)
+	for _, step := range plan.Minimizations {
+		fits := ""
+		if step.Fits {
+			fits = ", fits one QR code"
+		}
+		fmt.Printf("  -%-4d %s: %s (%d characters%s)\n", step.Saving, step.Step, step.Description, step.JWSLength, fits)
+	}
+	return nil
+}
+
+func runRevoke(args []string) error {
+	flags := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	keystorePath := flags.String("keystore", "issuer.keystore", "keystore holding the signing key")
+	passphraseEnv := flags.String("passphrase-env", "SHC_PASSPHRASE", "environment variable holding the keystore passphrase")
+	issuerURL := flags.String("iss", "", "issuer URL (required)")
+	crlPath := flags.String("crl", "crl.json", "revocation lists file to update")
+	keyId := flags.String("kid", "", "key the cards were signed with (defaults to the active key)")
+	requester := flags.String("requester", "", "who asked for the revocation, for the audit log (defaults to $USER)")
+	auditPath := flags.String("audit", "", "append an audit event per card to this JSON-lines file")
+	auditChain := flags.Bool("audit-chain", true, "chain the audit log under an HMAC key so tampering is detected")
+	auditKeyEnv := flags.String("audit-key-env", "SHC_AUDIT_KEY", "environment variable holding the audit log's HMAC key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *issuerURL == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	pass, err := passphrase(*passphraseEnv)
+	if err != nil {
+		return err
+	}
+	ks, err := issuer.OpenKeystore(*keystorePath, pass)
+	if err != nil {
+		return err
+	}
+	if *keyId == "" {
+		if _, *keyId, err = ks.SigningKey(); err != nil {
+			return err
+		}
+	}
+	crls, err := issuer.OpenCRLStore(*crlPath)
+	if err != nil {
+		return err
+	}
+	audit, err := openAudit(*auditPath, *auditChain, *auditKeyEnv)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+	iss, err := issuer.NewIssuer(issuer.IssuerConfig{IssuerURL: *issuerURL, KeySource: ks, Audit: audit.sink(), Revocations: crls})
+	if err != nil {
+		return err
+	}
+
+	who := *requester
+	if who == "" {
+		who = os.Getenv("USER")
+	}
+	ctx := issuer.WithRequester(context.Background(), who)
+	for _, rid := range flags.Args() {
+		if err := iss.Revoke(ctx, *keyId, rid); err != nil {
+			return err
+		}
+	}
+	list, _ := crls.List(*keyId)
+	fmt.Fprintf(os.Stderr, "%s now revokes %d cards (ctr %d)\n", *keyId, len(list.RevokedIds), list.Counter)
+	return nil
+}
+
+func runAuditVerify(args []string) error {
+	flags := flag.NewFlagSet("audit-verify", flag.ContinueOnError)
+	keyEnv := flags.String("audit-key-env", "SHC_AUDIT_KEY", "environment variable holding the audit log's HMAC key")
+	anchor := flags.String("head", "", "a head printed earlier, as seq:hash, that the log must still hold")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	var head *issuer.AuditHead
+	if *anchor != "" {
+		parsed, err := issuer.ParseAuditHead(*anchor)
+		if err != nil {
+			return err
+		}
+		head = &parsed
+	}
+	input, err := readInput(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	verified, err := issuer.VerifyAuditLog(bytes.NewReader(input), []byte(os.Getenv(*keyEnv)), head)
+	if err != nil {
+		return fmt.Errorf("audit log fails verification after %d events: %w", verified.Sequence, err)
+	}
+	fmt.Printf("%d events, chain intact, head %s\n", verified.Sequence, verified)
+	return nil
+}
+
+func runTransparency(args []string) error {
+	flags := flag.NewFlagSet("transparency", flag.ContinueOnError)
+	keystorePath := flags.String("keystore", "transparency.keystore", "keystore holding the log's own key that signs tree heads")
+	passphraseEnv := flags.String("passphrase-env", "SHC_TRANSPARENCY_PASSPHRASE", "environment variable holding the keystore passphrase")
+	issuerURL := flags.String("iss", "", "issuer URL (required)")
+	logPath := flags.String("log", "", "transparency log file (required)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *issuerURL == "" || *logPath == "" || flags.NArg() > 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	if _, err := os.Stat(*logPath); err != nil {
+		return err
+	}
+
+	log, err := openTransparency(*logPath, *issuerURL, *keystorePath, *passphraseEnv)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	head, err := log.TreeHead()
+	if err != nil {
+		return err
+	}
+	result := map[string]interface{}{"sth": head}
+
+	if flags.NArg() == 1 {
+		cards, err := readCards(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		var proofs []*issuer.InclusionProof
+		for _, card := range cards {
+			entry, err := issuer.TransparencyEntryForCard(card)
+			if err != nil {
+				return err
+			}
+			index, ok := log.Lookup(entry.PayloadHash)
+			if !ok {
+				return fmt.Errorf("card signed by %s at %d is not in the log", entry.KeyId, entry.IssuedAt)
+			}
+			proof, err := log.InclusionProof(index, head.TreeSize)
+			if err != nil {
+				return err
+			}
+			proofs = append(proofs, proof)
+		}
+		result["proofs"] = proofs
+	}
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
+
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	jwksPath := flags.String("jwks", "", "JWKS file of the issuer")
+	trustPath := flags.String("trust", "", "trust directory file or directory, instead of -jwks; prints the verdict as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if (*jwksPath == "") == (*trustPath == "") || flags.NArg() != 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	if *trustPath != "" {
+		input, err := readInput(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		trust, err := issuer.LoadTrustDirectory(*trustPath)
+		if err != nil {
+			return err
+		}
+		verifier, err := issuer.NewVerifier(issuer.VerifierConfig{Trust: trust})
+		if err != nil {
+			return err
+		}
+		result, err := verifier.Verify(input)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+		if result.Verdict != issuer.VerdictValid {
+			return fmt.Errorf("card is %s", result.Verdict)
+		}
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(*jwksPath)
+	if err != nil {
+		return err
+	}
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(raw, &jwks); err != nil {
+		return fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	cards, err := readCards(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	for i, jws := range cards {
+		decoded, err := issuer.VerifyCard(jws, jwks)
+		if err != nil {
+			return fmt.Errorf("card %d: %w", i+1, err)
+		}
+		fmt.Printf("card %d: valid signature by %s (kid %s), issued %s\n", i+1,
+			decoded.Card.IssuerURL, decoded.Header.KeyId,
+			time.Unix(int64(decoded.Card.IssuanceDate), 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func runVerifier(args []string) error {
+	flags := flag.NewFlagSet("verifier", flag.ContinueOnError)
+	trustPath := flags.String("trust", "", "trust directory file or directory (required)")
+	addr := flags.String("addr", ":8081", "address to listen on")
+	maxBytes := flags.Int64("max-request-bytes", 1<<20, "largest request body accepted")
+	codes := flags.String("codes", "", "directory with newer CDC cvx/mvx/tradename exports to describe vaccines with")
+	verbose := flags.Bool("verbose", false, "log every card checked, not only failures")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *trustPath == "" {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	if err := loadCodeTables(*codes); err != nil {
+		return err
+	}
+	trust, err := issuer.LoadTrustDirectory(*trustPath)
+	if err != nil {
+		return err
+	}
+	verifier, err := issuer.NewVerifier(issuer.VerifierConfig{Trust: trust, Logger: issuer.NewStdLogger(nil, *verbose)})
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Fprintf(os.Stderr, "verifying cards from %d trusted issuers on %s\n", trust.Len(), *addr)
+	return issuer.NewVerificationService(verifier, issuer.ServiceOptions{MaxRequestBytes: *maxBytes}).ListenAndServe(ctx, *addr)
+}
+
+func runQR(args []string) error {
+	flags := flag.NewFlagSet("qr", flag.ContinueOnError)
+	out := flags.String("out", "qr", "file prefix for the PNGs")
+	size := flags.Int("size", 512, "width of each PNG in pixels")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	cards, err := readCards(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	for i, jws := range cards {
+		prefix := *out
+		if len(cards) > 1 {
+			prefix = fmt.Sprintf("%s-card%d", *out, i+1)
+		}
+		images, err := issuer.QRCodePNGs(jws, *size)
+		if err != nil {
+			return err
+		}
+		if err := writePNGs(prefix, images); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runInspect(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	raw := flags.Bool("payload", false, "print the decoded header and payload instead of the report")
+	codes := flags.String("codes", "", "directory with newer CDC cvx/mvx/tradename exports to describe codes with")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := loadCodeTables(*codes); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	input, err := readInput(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *raw {
+		return printPayloads(input)
+	}
+
+	report, err := issuer.Inspect(input)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return report.WriteJSON(os.Stdout)
+	}
+	return report.WriteText(os.Stdout)
+}
+
+func runRender(args []string) error {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	jwksPath := flags.String("jwks", "", "JWKS file of the issuer, to show whether the signature is valid")
+	out := flags.String("out", "", "HTML file, or file prefix when the input holds several cards (defaults to stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	var options issuer.RenderOptions
+	var err error
+	if options.JWKS, err = readJWKS(*jwksPath); err != nil {
+		return err
+	}
+
+	cards, err := readCards(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	for i, jws := range cards {
+		card, err := issuer.DecodeCard(jws)
+		if err != nil {
+			return fmt.Errorf("card %d: %w", i+1, err)
+		}
+		var page bytes.Buffer
+		if err := issuer.RenderHTML(&page, card, options); err != nil {
+			return err
+		}
+		path := *out
+		if path != "" && len(cards) > 1 {
+			path = fmt.Sprintf("%s-card%d.html", strings.TrimSuffix(path, ".html"), i+1)
+		}
+		if err := writeOutput(path, page.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runPDF(args []string) error {
+	flags := flag.NewFlagSet("pdf", flag.ContinueOnError)
+	jwksPath := flags.String("jwks", "", "JWKS file of the issuer, to print whether the signature is valid")
+	paper := flags.String("paper", "letter", "paper size: letter or a4")
+	layout := flags.String("layout", "page", "layout: page, or wallet for credit card sized panels to cut out")
+	out := flags.String("out", "", "PDF file, or file prefix when the input holds several cards (required)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+
+	options := issuer.PDFOptions{Layout: issuer.PDFLayout(*layout)}
+	switch *paper {
+	case "letter":
+		options.Paper = issuer.PaperLetter
+	case "a4":
+		options.Paper = issuer.PaperA4
+	default:
+		return fmt.Errorf("unknown paper size %q", *paper)
+	}
+	var err error
+	if options.JWKS, err = readJWKS(*jwksPath); err != nil {
+		return err
+	}
+
+	cards, err := readCards(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	for i, jws := range cards {
+		card, err := issuer.DecodeCard(jws)
+		if err != nil {
+			return fmt.Errorf("card %d: %w", i+1, err)
+		}
+		var pdf bytes.Buffer
+		if err := issuer.RenderPDF(&pdf, card, options); err != nil {
+			return err
+		}
+		path := *out
+		if len(cards) > 1 {
+			path = fmt.Sprintf("%s-card%d.pdf", strings.TrimSuffix(path, ".pdf"), i+1)
+		}
+		if err := writeOutput(path, pdf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditLog is the optional audit log of a command; its methods are safe to call when no log was asked for
+type auditLog struct {
+	log     *issuer.JSONLinesSink
+	chained bool
+}
+
+// openAudit opens the audit log at path, chained under the key in the keyEnv environment variable
+func openAudit(path string, chained bool, keyEnv string) (*auditLog, error) {
+	if path == "" {
+		return &auditLog{}, nil
+	}
+	var key []byte
+	if chained {
+		if key = []byte(os.Getenv(keyEnv)); len(key) == 0 {
+			return nil, fmt.Errorf("set $%s to the audit log's HMAC key, or pass -audit-chain=false", keyEnv)
+		}
+	}
+	log, err := issuer.OpenAuditLog(path, key)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{log: log, chained: chained}, nil
+}
+
+// sink returns nil rather than a nil *JSONLinesSink, so the issuer sees no sink at all
+func (a *auditLog) sink() issuer.AuditSink {
+	if a.log == nil {
+		return nil
+	}
+	return a.log
+}
+
+// Close closes the log and prints its head, to keep where the log's writer cannot change it and pass to audit-verify
+func (a *auditLog) Close() {
+	if a.log == nil {
+		return
+	}
+	if head := a.log.Head(); a.chained && head.Sequence > 0 {
+		fmt.Fprintf(os.Stderr, "audit log head %s\n", head)
+	}
+	a.log.Close()
+}
+
+// openTransparency opens the transparency log at path, if one was asked for, with tree heads signed by the key in its
+// own keystore: a stolen card key must not be able to sign tree heads too
+func openTransparency(path string, issuerURL string, keystorePath string, passphraseEnv string) (*issuer.TransparencyLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	pass, err := passphrase(passphraseEnv)
+	if err != nil {
+		return nil, err
+	}
+	ks, err := issuer.OpenKeystore(keystorePath, pass)
+	if err != nil {
+		return nil, err
+	}
+	return issuer.OpenTransparencyLog(issuer.TransparencyLogConfig{Path: path, IssuerURL: issuerURL, KeySource: ks})
+}
+
+func parseProfileMode(mode string) (issuer.ProfileMode, error) {
+	profileModes := map[string]issuer.ProfileMode{
+		"off":    issuer.ProfileValidationOff,
+		"warn":   issuer.ProfileValidationWarn,
+		"strict": issuer.ProfileValidationStrict,
+	}
+	profileMode, ok := profileModes[mode]
+	if !ok {
+		return 0, fmt.Errorf("unknown profile validation mode %q", mode)
+	}
+	return profileMode, nil
+}
+
+func parseCompression(name string) (issuer.Compression, error) {
+	compressions := map[string]issuer.Compression{
+		"best":    issuer.CompressionBest,
+		"optimal": issuer.CompressionOptimal,
+	}
+	compression, ok := compressions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown compression %q", name)
+	}
+	return compression, nil
+}
+
+func parseCredentialTypes(names string) ([]string, error) {
+	credentialTypes := map[string]string{
+		"immunization": issuer.IMMUNIZATION_TYPE,
+		"covid19":      issuer.COVID19_TYPE,
+		"laboratory":   issuer.LABORATORY_TYPE,
+	}
+	var types []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		credentialType, ok := credentialTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown card type %q", name)
+		}
+		types = append(types, credentialType)
+	}
+	return types, nil
+}
+
+func readJWKS(path string) (*jose.JSONWebKeySet, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(raw, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	return &jwks, nil
+}
+
+// fetchCredential reads the patient's record from a FHIR server and builds the vc claim
+func fetchCredential(base, patientId, token, since string) (map[string]interface{}, error) {
+	if patientId == "" {
+		return nil, errors.New("-patient is required with -fhir")
+	}
+	config := issuer.FHIRClientConfig{BaseURL: base}
+	if token != "" {
+		config.Header = http.Header{"Authorization": {"Bearer " + token}}
+	}
+	client, err := issuer.NewFHIRClient(config)
+	if err != nil {
+		return nil, err
+	}
+	var options issuer.FetchOptions
+	if since != "" {
+		if options.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, fmt.Errorf("invalid -since: %w", err)
+		}
+	}
+	return client.FetchCredential(context.Background(), patientId, options)
+}
+
+// readVXU maps an HL7 v2 VXU message to the vc claim, printing what could not be mapped
+// readCredential reads a verifiable credential, accepting both a bare vc claim and one wrapped the way the spec
+// examples are
+func readCredential(path string) (map[string]interface{}, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var vc map[string]interface{}
+	if err := json.Unmarshal(raw, &vc); err != nil {
+		return nil, fmt.Errorf("failed to parse verifiable credential: %w", err)
+	}
+	if inner, ok := vc["vc"].(map[string]interface{}); ok {
+		vc = inner
+	}
+	return vc, nil
+}
+
+func readVXU(path string) (map[string]interface{}, error) {
+	message, err := readInput(path)
+	if err != nil {
+		return nil, err
+	}
+	vxu, diagnostics, err := issuer.ParseVXU(message)
+	for _, diagnostic := range diagnostics {
+		fmt.Fprintln(os.Stderr, diagnostic.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if diagnostics.HasErrors() {
+		return nil, errors.New("the VXU message could not be mapped")
+	}
+	return vxu.Credential()
+}
+
+// loadCodeTables replaces the embedded CVX and MVX tables when a directory is given
+func loadCodeTables(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	tables, err := issuer.LoadCodeTables(dir)
+	if err != nil {
+		return err
+	}
+	issuer.SetDefaultCodeTables(tables)
+	return nil
+}
+
+func printPayloads(input []byte) error {
+	cards, err := issuer.ExtractJWS(input)
+	if err != nil {
+		return err
+	}
+	for i, jws := range cards {
+		decoded, err := issuer.DecodeCard(jws)
+		if err != nil {
+			return fmt.Errorf("card %d: %w", i+1, err)
+		}
+		header, err := json.MarshalIndent(decoded.Header, "", "  ")
+		if err != nil {
+			return err
+		}
+		var payload bytes.Buffer
+		if err := json.Indent(&payload, decoded.Payload, "", "  "); err != nil {
+			return err
+		}
+		fmt.Printf("# card %d header\n%s\n# card %d payload\n%s\n", i+1, header, i+1, payload.String())
+	}
+	return nil
+}
+
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
+
+func readCards(path string) ([]string, error) {
+	raw, err := readInput(path)
+	if err != nil {
+		return nil, err
+	}
+	return issuer.ExtractJWS(raw)
+}
+
+func writePNGs(prefix string, images [][]byte) error {
+	for i, png := range images {
+		filename := prefix + ".png"
+		if len(images) > 1 {
+			filename = fmt.Sprintf("%s-%d.png", prefix, i+1)
+		}
+		if err := ioutil.WriteFile(filename, png, 0644); err != nil {
+			return err
+		}
+		fmt.Println(filename)
+	}
+	return nil
+}
+
+func writeOutput(path string, data []byte) error {
+	var w io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,342 @@
+package issuer
+
+import (
+	"embed"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EMBEDDED_CODE_TABLES_VERSION is the date of the newest entry in the CDC exports bundled in codes/
+const EMBEDDED_CODE_TABLES_VERSION = "2022-07-13"
+
+// CVX status values used by the CDC
+const (
+	CVX_STATUS_ACTIVE       = "Active"
+	CVX_STATUS_INACTIVE     = "Inactive"
+	CVX_STATUS_NON_US       = "Non-US"
+	CVX_STATUS_NEVER_ACTIVE = "Never Active"
+	CVX_STATUS_PENDING      = "Pending"
+)
+
+//go:embed codes/cvx.csv codes/mvx.csv codes/tradename.csv
+var embeddedCodeTables embed.FS
+
+// VaccineCode is an entry of the CDC CVX table.
+type VaccineCode struct {
+	Code             string
+	ShortDescription string
+	FullName         string
+	Status           string
+	LastUpdated      time.Time
+	// Manufacturers are the MVX codes of the products that map to this CVX code
+	Manufacturers []string
+}
+
+// Active reports whether the code may be used for new administrations in the US.
+func (v VaccineCode) Active() bool {
+	return v.Status == CVX_STATUS_ACTIVE
+}
+
+// Manufacturer is an entry of the CDC MVX table.
+type Manufacturer struct {
+	Code        string
+	Name        string
+	Status      string
+	LastUpdated time.Time
+}
+
+// Product maps a trade name to its CVX and MVX codes.
+type Product struct {
+	Name             string
+	CVX              string
+	MVX              string
+	ProductStatus    string
+	ManufacturerName string
+}
+
+// CodeTables holds the CVX, MVX and trade name tables. The tables are read-only once loaded.
+type CodeTables struct {
+	// Version is the date of the newest entry in the tables
+	Version string
+
+	cvx      map[string]VaccineCode
+	mvx      map[string]Manufacturer
+	products []Product
+}
+
+var (
+	codeTablesMu      sync.RWMutex
+	defaultCodeTables *CodeTables
+)
+
+// DefaultCodeTables returns the tables used for validation and display: the embedded tables unless
+// SetDefaultCodeTables has installed newer ones.
+func DefaultCodeTables() *CodeTables {
+	codeTablesMu.RLock()
+	tables := defaultCodeTables
+	codeTablesMu.RUnlock()
+	if tables != nil {
+		return tables
+	}
+
+	codeTablesMu.Lock()
+	defer codeTablesMu.Unlock()
+	if defaultCodeTables == nil {
+		tables, err := EmbeddedCodeTables()
+		if err != nil {
+			// the embedded data is part of the build, so this can only be a programming error
+			panic(err)
+		}
+		defaultCodeTables = tables
+	}
+	return defaultCodeTables
+}
+
+// SetDefaultCodeTables replaces the tables used for validation and display, e.g. with tables from LoadCodeTables.
+func SetDefaultCodeTables(tables *CodeTables) {
+	codeTablesMu.Lock()
+	defer codeTablesMu.Unlock()
+	defaultCodeTables = tables
+}
+
+// EmbeddedCodeTables parses the tables bundled with the package.
+func EmbeddedCodeTables() (*CodeTables, error) {
+	open := func(name string) (io.ReadCloser, error) {
+		return embeddedCodeTables.Open("codes/" + name)
+	}
+	return readCodeTables(open, "cvx.csv", "mvx.csv", "tradename.csv")
+}
+
+// LoadCodeTables reads new CDC exports from dir. The directory needs cvx and mvx files and optionally a tradename
+// file, each either the pipe-delimited .txt download from the CDC IIS code set pages or a .csv export.
+func LoadCodeTables(dir string) (*CodeTables, error) {
+	find := func(base string, required bool) (string, error) {
+		for _, ext := range []string{".txt", ".csv"} {
+			if _, err := os.Stat(filepath.Join(dir, base+ext)); err == nil {
+				return base + ext, nil
+			}
+		}
+		if required {
+			return "", fmt.Errorf("no %s.txt or %s.csv in %s", base, base, dir)
+		}
+		return "", nil
+	}
+
+	cvxFile, err := find("cvx", true)
+	if err != nil {
+		return nil, err
+	}
+	mvxFile, err := find("mvx", true)
+	if err != nil {
+		return nil, err
+	}
+	tradenameFile, err := find("tradename", false)
+	if err != nil {
+		return nil, err
+	}
+
+	open := func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(dir, name))
+	}
+	return readCodeTables(open, cvxFile, mvxFile, tradenameFile)
+}
+
+// CVX looks up a vaccine code.
+func (t *CodeTables) CVX(code string) (VaccineCode, bool) {
+	v, ok := t.cvx[normalizeCVX(code)]
+	return v, ok
+}
+
+// MVX looks up a manufacturer code.
+func (t *CodeTables) MVX(code string) (Manufacturer, bool) {
+	m, ok := t.mvx[strings.ToUpper(strings.TrimSpace(code))]
+	return m, ok
+}
+
+// ManufacturersOf returns the manufacturers of the products mapped to the CVX code.
+func (t *CodeTables) ManufacturersOf(cvx string) []Manufacturer {
+	v, ok := t.CVX(cvx)
+	if !ok {
+		return nil
+	}
+	var manufacturers []Manufacturer
+	for _, code := range v.Manufacturers {
+		if m, ok := t.mvx[code]; ok {
+			manufacturers = append(manufacturers, m)
+		}
+	}
+	return manufacturers
+}
+
+// Products returns the trade names mapped to the CVX code.
+func (t *CodeTables) Products(cvx string) []Product {
+	code := normalizeCVX(cvx)
+	var products []Product
+	for _, p := range t.products {
+		if p.CVX == code {
+			products = append(products, p)
+		}
+	}
+	return products
+}
+
+// VaccineCodes returns every CVX entry ordered by code.
+func (t *CodeTables) VaccineCodes() []VaccineCode {
+	codes := make([]VaccineCode, 0, len(t.cvx))
+	for _, v := range t.cvx {
+		codes = append(codes, v)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if len(codes[i].Code) != len(codes[j].Code) {
+			return len(codes[i].Code) < len(codes[j].Code)
+		}
+		return codes[i].Code < codes[j].Code
+	})
+	return codes
+}
+
+// normalizeCVX pads single digit codes, since the CDC publishes 03 and cards often carry 3
+func normalizeCVX(code string) string {
+	code = strings.TrimSpace(code)
+	if len(code) == 1 {
+		return "0" + code
+	}
+	return code
+}
+
+func readCodeTables(open func(name string) (io.ReadCloser, error), cvxFile, mvxFile, tradenameFile string) (*CodeTables, error) {
+	tables := &CodeTables{
+		cvx: map[string]VaccineCode{},
+		mvx: map[string]Manufacturer{},
+	}
+	var newest time.Time
+
+	// CVX Code|CVX Short Description|Full Vaccine Name|Notes|VaccineStatus|internalID|nonvaccine|update date
+	err := readCodeFile(open, cvxFile, 5, func(fields []string) error {
+		v := VaccineCode{
+			Code:             normalizeCVX(fields[0]),
+			ShortDescription: fields[1],
+			FullName:         fields[2],
+			Status:           fields[4],
+		}
+		if len(fields) > 7 {
+			v.LastUpdated = parseCDCDate(fields[7])
+		}
+		if v.LastUpdated.After(newest) {
+			newest = v.LastUpdated
+		}
+		tables.cvx[v.Code] = v
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// MVX Code|Manufacturer Name|Notes|Status|Last Updated
+	err = readCodeFile(open, mvxFile, 4, func(fields []string) error {
+		m := Manufacturer{
+			Code:   strings.ToUpper(fields[0]),
+			Name:   fields[1],
+			Status: fields[3],
+		}
+		if len(fields) > 4 {
+			m.LastUpdated = parseCDCDate(fields[4])
+		}
+		if m.LastUpdated.After(newest) {
+			newest = m.LastUpdated
+		}
+		tables.mvx[m.Code] = m
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if tradenameFile != "" {
+		// CDC Product Name|Short Description|CVX Code|Manufacturer|MVX Code|MVX Status|Product Name Status|Last Updated
+		err = readCodeFile(open, tradenameFile, 7, func(fields []string) error {
+			p := Product{
+				Name:             fields[0],
+				CVX:              normalizeCVX(fields[2]),
+				ManufacturerName: fields[3],
+				MVX:              strings.ToUpper(fields[4]),
+				ProductStatus:    fields[6],
+			}
+			tables.products = append(tables.products, p)
+			if v, ok := tables.cvx[p.CVX]; ok && !containsString(v.Manufacturers, p.MVX) {
+				v.Manufacturers = append(v.Manufacturers, p.MVX)
+				tables.cvx[p.CVX] = v
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !newest.IsZero() {
+		tables.Version = newest.Format("2006-01-02")
+	}
+	return tables, nil
+}
+
+// readCodeFile reads a CDC export, which is either pipe-delimited without a header or a CSV with a header row
+func readCodeFile(open func(name string) (io.ReadCloser, error), name string, minFields int, fn func(fields []string) error) error {
+	f, err := open(name)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	if strings.HasSuffix(name, ".txt") {
+		r.Comma = '|'
+		r.LazyQuotes = true
+	}
+	r.FieldsPerRecord = -1
+
+	for line := 1; ; line++ {
+		fields, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if len(fields) == 1 && strings.TrimSpace(fields[0]) == "" {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if line == 1 && strings.Contains(strings.ToLower(fields[0]), "code") {
+			continue
+		}
+		if len(fields) < minFields {
+			return fmt.Errorf("%s line %d has %d fields, expected at least %d", name, line, len(fields), minFields)
+		}
+		if fields[0] == "" {
+			return errors.New(name + " has a row without a code")
+		}
+		if err := fn(fields); err != nil {
+			return err
+		}
+	}
+}
+
+func parseCDCDate(value string) time.Time {
+	for _, layout := range []string{"2006/01/02", "1/2/2006", "2006-01-02", "1/2/2006 3:04:05 PM"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
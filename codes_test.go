@@ -0,0 +1,92 @@
+package issuer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmbeddedCodeTables(t *testing.T) {
+	tables := DefaultCodeTables()
+	if tables.Version != EMBEDDED_CODE_TABLES_VERSION {
+		t.Fatalf("Expected version %s, got %s", EMBEDDED_CODE_TABLES_VERSION, tables.Version)
+	}
+
+	moderna, ok := tables.CVX("207")
+	if !ok || !moderna.Active() {
+		t.Fatalf("Expected CVX 207 to be active, got %+v", moderna)
+	}
+	manufacturers := tables.ManufacturersOf("207")
+	if len(manufacturers) != 1 || manufacturers[0].Code != "MOD" {
+		t.Fatalf("Expected CVX 207 to be made by MOD, got %+v", manufacturers)
+	}
+	if mmr, ok := tables.CVX("3"); !ok || mmr.Code != "03" {
+		t.Fatalf("Expected CVX 3 to resolve to 03, got %+v", mmr)
+	}
+	if _, ok := tables.CVX("999"); ok {
+		t.Fatal("Expected CVX 999 to be unknown")
+	}
+
+	// every code that types a card #covid19 must be in the table
+	for code := range covid19VaccineCodes {
+		if _, ok := tables.CVX(code); !ok {
+			t.Errorf("COVID-19 vaccine code %s is missing from the CVX table", code)
+		}
+	}
+}
+
+func TestLoadCodeTables(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"cvx.txt": "207|COVID-19, mRNA, LNP-S, PF, 100 mcg/0.5mL dose|SARS-COV-2 (COVID-19) vaccine, mRNA|" +
+			"|Active|207|False|2022/09/01\n" +
+			"62|HPV, quadrivalent|human papilloma virus vaccine, quadrivalent||Inactive|62|False|2017/03/23\n",
+		"mvx.txt": "MOD|Moderna US, Inc.||Active|2020/12/10\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err.Error())
+		}
+	}
+
+	tables, err := LoadCodeTables(dir)
+	if err != nil {
+		t.Fatalf("Failed to load code tables: %s", err.Error())
+	}
+	if tables.Version != "2022-09-01" {
+		t.Fatalf("Expected version 2022-09-01, got %s", tables.Version)
+	}
+	if hpv, ok := tables.CVX("62"); !ok || hpv.Active() {
+		t.Fatalf("Expected CVX 62 to be inactive, got %+v", hpv)
+	}
+	if _, ok := tables.MVX("mod"); !ok {
+		t.Fatal("Expected MVX lookups to ignore case")
+	}
+
+	if _, err := LoadCodeTables(t.TempDir()); err == nil {
+		t.Fatal("Expected an error for a directory without code tables")
+	}
+}
+
+func TestValidateCVXCodeStatus(t *testing.T) {
+	patient := Patient{Family: "Anyperson", Given: []string{"John"}, BirthDate: "1951-01-20"}
+	for code, expected := range map[string]string{
+		"999": CODE_PROFILE_CODE,
+		"48":  CODE_PROFILE_CODE,
+		"62":  CODE_PROFILE_CODE_STATUS,
+		"510": CODE_PROFILE_CODE_STATUS,
+	} {
+		vc, err := NewImmunizationCredential(patient, Immunization{
+			VaccineCode:        CVX(code),
+			OccurrenceDateTime: "2021-01-01",
+			Performer:          "ABC General Hospital",
+			LotNumber:          "0000001",
+		})
+		if err != nil {
+			t.Fatalf("Failed to build credential: %s", err.Error())
+		}
+		if diagnostics := ValidateProfile(vc); len(diagnostics.WithCode(expected)) != 1 || diagnostics.HasErrors() {
+			t.Fatalf("Expected only diagnostic %s for CVX %s, got %v", expected, code, diagnostics)
+		}
+	}
+}
@@ -0,0 +1,606 @@
+package issuer
+
+import (
+	"math"
+	"sort"
+)
+
+// Compression selects the DEFLATE encoder cards are compressed with. Every encoder writes standard raw DEFLATE
+// without a preset dictionary, so verifiers cannot tell them apart.
+type Compression int
+
+const (
+	// CompressionBest uses compress/flate at BestCompression. It is fast and what cards are signed with by default.
+	CompressionBest Compression = iota
+	// CompressionOptimal searches for the smallest encoding the way Zopfli does. It takes tens of times longer than
+	// CompressionBest and is never larger: about 1% smaller on a two dose card and 3-4% on bundles of dozens of
+	// doses, which can be what keeps a card in a single QR code.
+	CompressionOptimal
+)
+
+const (
+	// optimalIterations is how many times the optimal encoder reparses the input with the costs of its last parse
+	optimalIterations = 15
+	// optimalChainLength bounds the earlier positions searched for matches at each position
+	optimalChainLength = 4096
+
+	deflateWindowSize = 32768
+	deflateMinMatch   = 3
+	deflateMaxMatch   = 258
+	deflateEndOfBlock = 256
+)
+
+var deflateLengthBase = [29]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+var deflateLengthExtra = [29]int{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+var deflateDistanceBase = [30]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+var deflateDistanceExtra = [30]int{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+// the order the code length code lengths are written in, from RFC 1951 section 3.2.7
+var deflateCodeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+// deflateLengthSymbol maps a match length to the index of its length code in deflateLengthBase
+var deflateLengthSymbol = func() [deflateMaxMatch + 1]int {
+	var symbols [deflateMaxMatch + 1]int
+	for code, base := range deflateLengthBase {
+		for length := base; length < base+1<<deflateLengthExtra[code] && length <= deflateMaxMatch; length++ {
+			symbols[length] = code
+		}
+	}
+	return symbols
+}()
+
+func deflateDistanceSymbol(distance int) int {
+	return sort.Search(len(deflateDistanceBase), func(code int) bool {
+		return deflateDistanceBase[code] > distance
+	}) - 1
+}
+
+// deflateWith compresses the payload of a card with the chosen encoder
+func deflateWith(inflated string, compression Compression) ([]byte, error) {
+	best, err := deflate(inflated)
+	if err != nil || compression != CompressionOptimal {
+		return best, err
+	}
+	if optimal := deflateOptimal([]byte(inflated)); len(optimal) < len(best) {
+		return optimal, nil
+	}
+	return best, nil
+}
+
+// lz77Token is a literal byte when length is 0, otherwise a match of length bytes distance bytes back
+type lz77Token struct {
+	literal  byte
+	length   int
+	distance int
+}
+
+// lz77Match says that matches of up to length bytes are found distance bytes back. The matches at a position are
+// sorted by length, and each has the shortest distance any match of its length has.
+type lz77Match struct {
+	length   int
+	distance int
+}
+
+// deflateOptimal writes the data as a single final DEFLATE block. Like Zopfli, it finds every match at every
+// position once, then repeatedly picks the cheapest parse under the symbol costs of the previous parse and keeps
+// the parse that encodes smallest.
+func deflateOptimal(data []byte) []byte {
+	matches := findMatches(data)
+	costs := fixedCosts()
+	var best []lz77Token
+	bestBits := math.MaxInt64
+	for iteration := 0; iteration < optimalIterations; iteration++ {
+		tokens := cheapestParse(data, matches, costs)
+		block := newDeflateBlock(tokens)
+		if bits := block.bits(); bits < bestBits {
+			best, bestBits = tokens, bits
+		}
+		costs = block.costs()
+	}
+
+	var w deflateBitWriter
+	newDeflateBlock(best).write(&w, best)
+	return w.bytes()
+}
+
+// findMatches returns the matches at every position, searching hash chains of three byte prefixes
+func findMatches(data []byte) [][]lz77Match {
+	const hashSize = 1 << 15
+	hash := func(i int) int {
+		return (int(data[i])<<10 ^ int(data[i+1])<<5 ^ int(data[i+2])) & (hashSize - 1)
+	}
+	head := make([]int, hashSize)
+	for i := range head {
+		head[i] = -1
+	}
+	previous := make([]int, len(data))
+
+	matches := make([][]lz77Match, len(data))
+	for i := 0; i+deflateMinMatch <= len(data); i++ {
+		maxLength := len(data) - i
+		if maxLength > deflateMaxMatch {
+			maxLength = deflateMaxMatch
+		}
+		h := hash(i)
+		best := deflateMinMatch - 1
+		for j, steps := head[h], 0; j >= 0 && i-j <= deflateWindowSize && steps < optimalChainLength; j, steps = previous[j], steps+1 {
+			if data[j+best] != data[i+best] {
+				continue
+			}
+			length := 0
+			for length < maxLength && data[j+length] == data[i+length] {
+				length++
+			}
+			if length > best {
+				// the chain runs from the nearest position back, so this is the shortest distance for these lengths
+				matches[i] = append(matches[i], lz77Match{length: length, distance: i - j})
+				best = length
+				if best == maxLength {
+					break
+				}
+			}
+		}
+		previous[i] = head[h]
+		head[h] = i
+	}
+	return matches
+}
+
+// symbolCosts holds the cost in bits of each literal/length and distance symbol, without extra bits
+type symbolCosts struct {
+	literals  [286]float64
+	distances [30]float64
+}
+
+func fixedCosts() *symbolCosts {
+	costs := &symbolCosts{}
+	lengths := fixedLiteralLengths()
+	for symbol := range costs.literals {
+		costs.literals[symbol] = float64(lengths[symbol])
+	}
+	for symbol := range costs.distances {
+		costs.distances[symbol] = 5
+	}
+	return costs
+}
+
+// lengths returns the cost of every match length, including its extra bits
+func (c *symbolCosts) lengths() [deflateMaxMatch + 1]float64 {
+	var costs [deflateMaxMatch + 1]float64
+	for length := deflateMinMatch; length <= deflateMaxMatch; length++ {
+		code := deflateLengthSymbol[length]
+		costs[length] = c.literals[257+code] + float64(deflateLengthExtra[code])
+	}
+	return costs
+}
+
+func (c *symbolCosts) distance(distance int) float64 {
+	code := deflateDistanceSymbol(distance)
+	return c.distances[code] + float64(deflateDistanceExtra[code])
+}
+
+// cheapestParse finds the sequence of literals and matches with the lowest total cost
+func cheapestParse(data []byte, matches [][]lz77Match, costs *symbolCosts) []lz77Token {
+	lengthCosts := costs.lengths()
+	cost := make([]float64, len(data)+1)
+	step := make([]lz77Token, len(data)+1)
+	for i := 1; i <= len(data); i++ {
+		cost[i] = math.Inf(1)
+	}
+	for i := 0; i < len(data); i++ {
+		if literal := cost[i] + costs.literals[data[i]]; literal < cost[i+1] {
+			cost[i+1] = literal
+			step[i+1] = lz77Token{literal: data[i]}
+		}
+		length := deflateMinMatch
+		for _, match := range matches[i] {
+			start := cost[i] + costs.distance(match.distance)
+			for ; length <= match.length; length++ {
+				if total := start + lengthCosts[length]; total < cost[i+length] {
+					cost[i+length] = total
+					step[i+length] = lz77Token{length: length, distance: match.distance}
+				}
+			}
+		}
+	}
+
+	var tokens []lz77Token
+	for i := len(data); i > 0; {
+		token := step[i]
+		tokens = append(tokens, token)
+		if token.length == 0 {
+			i--
+		} else {
+			i -= token.length
+		}
+	}
+	for a, b := 0, len(tokens)-1; a < b; a, b = a+1, b-1 {
+		tokens[a], tokens[b] = tokens[b], tokens[a]
+	}
+	return tokens
+}
+
+// deflateBlock is the Huffman coding of a parse, either with the fixed codes or with codes of its own
+type deflateBlock struct {
+	literalCounts  [286]int
+	distanceCounts [30]int
+
+	literalLengths  []int
+	distanceLengths []int
+	header          codeLengthHeader
+	fixed           bool
+}
+
+func newDeflateBlock(tokens []lz77Token) *deflateBlock {
+	b := &deflateBlock{}
+	for _, token := range tokens {
+		if token.length == 0 {
+			b.literalCounts[token.literal]++
+		} else {
+			b.literalCounts[257+deflateLengthSymbol[token.length]]++
+			b.distanceCounts[deflateDistanceSymbol(token.distance)]++
+		}
+	}
+	b.literalCounts[deflateEndOfBlock]++
+
+	b.literalLengths = huffmanLengths(b.literalCounts[:], 15)
+	b.distanceLengths = huffmanLengths(b.distanceCounts[:], 15)
+	b.header = bestCodeLengthHeader(b.literalLengths, b.distanceLengths)
+
+	fixedLengths := fixedLiteralLengths()
+	if b.dataBits(fixedLengths, fixedDistanceLengths()) < b.header.bits()+b.dataBits(b.literalLengths, b.distanceLengths) {
+		b.fixed = true
+		b.literalLengths, b.distanceLengths = fixedLengths, fixedDistanceLengths()
+	}
+	return b
+}
+
+// bits is the size of the block, including its header
+func (b *deflateBlock) bits() int {
+	if b.fixed {
+		return 3 + b.dataBits(b.literalLengths, b.distanceLengths)
+	}
+	return 3 + b.header.bits() + b.dataBits(b.literalLengths, b.distanceLengths)
+}
+
+func (b *deflateBlock) dataBits(literalLengths []int, distanceLengths []int) int {
+	bits := 0
+	for symbol, count := range b.literalCounts {
+		bits += count * literalLengths[symbol]
+		if symbol > deflateEndOfBlock {
+			bits += count * deflateLengthExtra[symbol-257]
+		}
+	}
+	for symbol, count := range b.distanceCounts {
+		bits += count * (distanceLengths[symbol] + deflateDistanceExtra[symbol])
+	}
+	return bits
+}
+
+// costs estimates the symbol costs of the next parse from how often this one used each symbol. An alphabet this
+// parse did not use keeps its fixed code costs.
+func (b *deflateBlock) costs() *symbolCosts {
+	costs := fixedCosts()
+	entropy := func(counts []int, costs []float64) {
+		total := 0
+		for _, count := range counts {
+			total += count
+		}
+		if total == 0 {
+			return
+		}
+		for symbol, count := range counts {
+			if count == 0 {
+				count = 1
+			}
+			costs[symbol] = math.Log2(float64(total)) - math.Log2(float64(count))
+		}
+	}
+	entropy(b.literalCounts[:], costs.literals[:])
+	entropy(b.distanceCounts[:], costs.distances[:])
+	return costs
+}
+
+func (b *deflateBlock) write(w *deflateBitWriter, tokens []lz77Token) {
+	w.writeBits(1, 1) // BFINAL
+	if b.fixed {
+		w.writeBits(1, 2)
+	} else {
+		w.writeBits(2, 2)
+		b.header.write(w)
+	}
+
+	literalCodes := canonicalCodes(b.literalLengths)
+	distanceCodes := canonicalCodes(b.distanceLengths)
+	for _, token := range tokens {
+		if token.length == 0 {
+			w.writeBits(literalCodes[token.literal], b.literalLengths[token.literal])
+			continue
+		}
+		lengthCode := deflateLengthSymbol[token.length]
+		w.writeBits(literalCodes[257+lengthCode], b.literalLengths[257+lengthCode])
+		w.writeBits(token.length-deflateLengthBase[lengthCode], deflateLengthExtra[lengthCode])
+		distanceCode := deflateDistanceSymbol(token.distance)
+		w.writeBits(distanceCodes[distanceCode], b.distanceLengths[distanceCode])
+		w.writeBits(token.distance-deflateDistanceBase[distanceCode], deflateDistanceExtra[distanceCode])
+	}
+	w.writeBits(literalCodes[deflateEndOfBlock], b.literalLengths[deflateEndOfBlock])
+}
+
+func fixedLiteralLengths() []int {
+	lengths := make([]int, 288)
+	for symbol := range lengths {
+		switch {
+		case symbol < 144:
+			lengths[symbol] = 8
+		case symbol < 256:
+			lengths[symbol] = 9
+		case symbol < 280:
+			lengths[symbol] = 7
+		default:
+			lengths[symbol] = 8
+		}
+	}
+	return lengths
+}
+
+func fixedDistanceLengths() []int {
+	lengths := make([]int, 30)
+	for symbol := range lengths {
+		lengths[symbol] = 5
+	}
+	return lengths
+}
+
+// codeLengthHeader is the run-length encoded code lengths of a dynamic block, with the code they are written in
+type codeLengthHeader struct {
+	literals  int
+	distances int
+	symbols   []codeLengthSymbol
+	lengths   []int
+}
+
+type codeLengthSymbol struct {
+	symbol int
+	extra  int
+}
+
+// bestCodeLengthHeader tries each combination of the repeat codes 16, 17 and 18 and keeps the smallest header, as
+// using a repeat code is not always cheaper than writing the lengths it stands for
+func bestCodeLengthHeader(literalLengths []int, distanceLengths []int) codeLengthHeader {
+	literals := 286
+	for literals > 257 && literalLengths[literals-1] == 0 {
+		literals--
+	}
+	distances := 30
+	for distances > 1 && distanceLengths[distances-1] == 0 {
+		distances--
+	}
+	lengths := append(append([]int{}, literalLengths[:literals]...), distanceLengths[:distances]...)
+
+	var best codeLengthHeader
+	for flags := 0; flags < 8; flags++ {
+		header := codeLengthHeader{literals: literals, distances: distances}
+		header.symbols = runLengthEncode(lengths, flags&1 != 0, flags&2 != 0, flags&4 != 0)
+		var counts [19]int
+		for _, symbol := range header.symbols {
+			counts[symbol.symbol]++
+		}
+		header.lengths = huffmanLengths(counts[:], 7)
+		if best.symbols == nil || header.bits() < best.bits() {
+			best = header
+		}
+	}
+	return best
+}
+
+func runLengthEncode(lengths []int, repeat bool, shortZeros bool, longZeros bool) []codeLengthSymbol {
+	var symbols []codeLengthSymbol
+	for i := 0; i < len(lengths); {
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == lengths[i] {
+			run++
+		}
+		i += run
+		if lengths[i-run] == 0 {
+			for longZeros && run >= 11 {
+				n := min(run, 138)
+				symbols = append(symbols, codeLengthSymbol{18, n - 11})
+				run -= n
+			}
+			for shortZeros && run >= 3 {
+				n := min(run, 10)
+				symbols = append(symbols, codeLengthSymbol{17, n - 3})
+				run -= n
+			}
+		} else if repeat && run >= 4 {
+			symbols = append(symbols, codeLengthSymbol{lengths[i-run], 0})
+			run--
+			for run >= 3 {
+				n := min(run, 6)
+				symbols = append(symbols, codeLengthSymbol{16, n - 3})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			symbols = append(symbols, codeLengthSymbol{lengths[i-run], 0})
+		}
+	}
+	return symbols
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// codeLengthCount is the number of code length code lengths written, trailing zeros in deflateCodeLengthOrder dropped
+func (h codeLengthHeader) codeLengthCount() int {
+	count := 19
+	for count > 4 && h.lengths[deflateCodeLengthOrder[count-1]] == 0 {
+		count--
+	}
+	return count
+}
+
+func (h codeLengthHeader) bits() int {
+	bits := 5 + 5 + 4 + 3*h.codeLengthCount()
+	for _, symbol := range h.symbols {
+		bits += h.lengths[symbol.symbol] + codeLengthExtraBits(symbol.symbol)
+	}
+	return bits
+}
+
+func (h codeLengthHeader) write(w *deflateBitWriter) {
+	count := h.codeLengthCount()
+	w.writeBits(h.literals-257, 5)
+	w.writeBits(h.distances-1, 5)
+	w.writeBits(count-4, 4)
+	for _, symbol := range deflateCodeLengthOrder[:count] {
+		w.writeBits(h.lengths[symbol], 3)
+	}
+	codes := canonicalCodes(h.lengths)
+	for _, symbol := range h.symbols {
+		w.writeBits(codes[symbol.symbol], h.lengths[symbol.symbol])
+		w.writeBits(symbol.extra, codeLengthExtraBits(symbol.symbol))
+	}
+}
+
+func codeLengthExtraBits(symbol int) int {
+	switch symbol {
+	case 16:
+		return 2
+	case 17:
+		return 3
+	case 18:
+		return 7
+	}
+	return 0
+}
+
+// huffmanLengths returns the code lengths, at most maxBits long, that encode the counts in the fewest bits, using
+// the package-merge algorithm. Fewer than two used symbols still get a complete code of two one-bit codes, which
+// every inflater accepts.
+func huffmanLengths(counts []int, maxBits int) []int {
+	lengths := make([]int, len(counts))
+	var symbols []int
+	for symbol, count := range counts {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	if len(symbols) < 2 {
+		for symbol := 0; symbol < len(counts) && len(symbols) < 2; symbol++ {
+			if counts[symbol] == 0 {
+				symbols = append(symbols, symbol)
+			}
+		}
+		for _, symbol := range symbols {
+			lengths[symbol] = 1
+		}
+		return lengths
+	}
+
+	type node struct {
+		weight      int
+		symbol      int
+		left, right *node
+	}
+	sort.SliceStable(symbols, func(a, b int) bool {
+		return counts[symbols[a]] < counts[symbols[b]]
+	})
+	leaves := make([]*node, len(symbols))
+	for n, symbol := range symbols {
+		leaves[n] = &node{weight: counts[symbol], symbol: symbol}
+	}
+
+	list := leaves
+	for bits := 1; bits < maxBits; bits++ {
+		packages := make([]*node, 0, len(list)/2)
+		for n := 0; n+1 < len(list); n += 2 {
+			packages = append(packages, &node{weight: list[n].weight + list[n+1].weight, symbol: -1, left: list[n], right: list[n+1]})
+		}
+		merged := make([]*node, 0, len(leaves)+len(packages))
+		a, b := 0, 0
+		for a < len(leaves) || b < len(packages) {
+			if b == len(packages) || (a < len(leaves) && leaves[a].weight <= packages[b].weight) {
+				merged = append(merged, leaves[a])
+				a++
+			} else {
+				merged = append(merged, packages[b])
+				b++
+			}
+		}
+		list = merged
+	}
+
+	var count func(n *node)
+	count = func(n *node) {
+		if n.symbol >= 0 {
+			lengths[n.symbol]++
+			return
+		}
+		count(n.left)
+		count(n.right)
+	}
+	for _, n := range list[:2*len(symbols)-2] {
+		count(n)
+	}
+	return lengths
+}
+
+// canonicalCodes assigns the codes RFC 1951 derives from the code lengths, bit-reversed to be written LSB first
+func canonicalCodes(lengths []int) []int {
+	var lengthCounts [16]int
+	for _, length := range lengths {
+		lengthCounts[length]++
+	}
+	lengthCounts[0] = 0
+	var next [16]int
+	code := 0
+	for bits := 1; bits < 16; bits++ {
+		code = (code + lengthCounts[bits-1]) << 1
+		next[bits] = code
+	}
+
+	codes := make([]int, len(lengths))
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		reversed := 0
+		for bit, c := 0, next[length]; bit < length; bit, c = bit+1, c>>1 {
+			reversed = reversed<<1 | c&1
+		}
+		codes[symbol] = reversed
+		next[length]++
+	}
+	return codes
+}
+
+// deflateBitWriter packs bits least significant first, as DEFLATE streams are read
+type deflateBitWriter struct {
+	out   []byte
+	bits  uint64
+	nbits int
+}
+
+func (w *deflateBitWriter) writeBits(value int, n int) {
+	w.bits |= uint64(value) << uint(w.nbits)
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *deflateBitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits, w.nbits = 0, 0
+	}
+	return w.out
+}
@@ -0,0 +1,133 @@
+package issuer
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// largeVerifiableCredential is the sample credential with doses more immunizations, each at its own clinic
+func largeVerifiableCredential(t testing.TB, doses int) map[string]interface{} {
+	verifiableCredential := sampleVerifiableCredential(t)
+	bundle := getMap(getMap(verifiableCredential, "credentialSubject"), "fhirBundle")
+	entries := getSlice(bundle, "entry")
+	for n := 0; n < doses; n++ {
+		entries = append(entries, map[string]interface{}{
+			"fullUrl": fmt.Sprintf("resource:%d", len(entries)),
+			"resource": map[string]interface{}{
+				"resourceType": "Immunization",
+				"status":       "completed",
+				"vaccineCode": map[string]interface{}{
+					"coding": []interface{}{map[string]interface{}{"system": "http://hl7.org/fhir/sid/cvx", "code": []string{"207", "208", "210", "212"}[n%4]}},
+				},
+				"patient":            map[string]interface{}{"reference": "resource:0"},
+				"occurrenceDateTime": time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, 29*n).Format("2006-01-02"),
+				"performer":          []interface{}{map[string]interface{}{"actor": map[string]interface{}{"display": fmt.Sprintf("Clinic %d", n%7)}}},
+				"lotNumber":          fmt.Sprintf("%07d", 7919*n%10000000),
+			},
+		})
+	}
+	bundle["entry"] = entries
+	return verifiableCredential
+}
+
+func cardPayload(t testing.TB, verifiableCredential map[string]interface{}) string {
+	payload, err := json.Marshal(SmartHealthCard{IssuerURL: "https://smarthealth.cards/examples/issuer", IssuanceDate: 1622505600, VerifiableCredential: verifiableCredential})
+	if err != nil {
+		t.Fatalf("Failed to marshal card: %s", err.Error())
+	}
+	return string(payload)
+}
+
+func TestOptimalDeflate(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := map[string]string{
+		"empty":        "",
+		"single byte":  "a",
+		"no matches":   "abcdefghijklmnopqrstuvwxyz",
+		"long run":     strings.Repeat("0", 20000),
+		"random":       string(random),
+		"sample card":  cardPayload(t, sampleVerifiableCredential(t)),
+		"20 dose card": cardPayload(t, largeVerifiableCredential(t, 20)),
+	}
+	for name, input := range inputs {
+		optimal := deflateOptimal([]byte(input))
+		inflated, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(optimal)))
+		if err != nil || string(inflated) != input {
+			t.Fatalf("Expected the %s input to inflate back to itself: %v", name, err)
+		}
+
+		best, _ := deflate(input)
+		selected, _ := deflateWith(input, CompressionOptimal)
+		if len(selected) > len(best) {
+			t.Fatalf("Expected the optimal %s payload to be no larger than %d bytes, got %d", name, len(best), len(selected))
+		}
+		t.Logf("%-12s %6d bytes: best %5d, optimal %5d", name, len(input), len(best), len(optimal))
+	}
+
+	for name, input := range map[string]string{"sample card": inputs["sample card"], "20 dose card": inputs["20 dose card"]} {
+		best, _ := deflate(input)
+		if optimal := deflateOptimal([]byte(input)); len(optimal) >= len(best) {
+			t.Fatalf("Expected the %s to compress better than BestCompression's %d bytes, got %d", name, len(best), len(optimal))
+		}
+	}
+}
+
+func TestSignWithOptimalCompression(t *testing.T) {
+	issuer, key := newTestIssuer(t, IssuerOptions{Compression: CompressionOptimal})
+	verifiableCredential := largeVerifiableCredential(t, 4)
+	plan, err := issuer.Plan(verifiableCredential)
+	if err != nil {
+		t.Fatalf("Failed to plan card: %s", err.Error())
+	}
+	jws, err := issuer.Issue(context.Background(), verifiableCredential)
+	if err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+	if len(jws) != plan.JWSLength {
+		t.Fatalf("Expected the plan to use the issuer's compression, planned %d for %d", plan.JWSLength, len(jws))
+	}
+	jwks, _ := issuer.JWKS()
+	if _, err := VerifyCard(jws, jwks); err != nil {
+		t.Fatalf("Failed to verify card: %s", err.Error())
+	}
+
+	card := SmartHealthCard{IssuerURL: issuer.IssuerURL(), IssuanceDate: 1622505600, VerifiableCredential: verifiableCredential}
+	keyId, _ := ComputeKeyId(&key.PublicKey)
+	best, _ := card.Sign(key, keyId)
+	optimal, err := card.Sign(key, keyId, CompressionOptimal)
+	if err != nil {
+		t.Fatalf("Failed to sign card: %s", err.Error())
+	}
+	if len(optimal.UnsafePayloadWithoutVerification()) >= len(best.UnsafePayloadWithoutVerification()) {
+		t.Fatal("Expected Sign to use the optimal encoder")
+	}
+}
+
+func BenchmarkDeflate(b *testing.B) {
+	for _, doses := range []int{0, 10, 40} {
+		input := cardPayload(b, largeVerifiableCredential(b, doses))
+		for _, compression := range []Compression{CompressionBest, CompressionOptimal} {
+			name := fmt.Sprintf("doses=%d/best", doses)
+			if compression == CompressionOptimal {
+				name = fmt.Sprintf("doses=%d/optimal", doses)
+			}
+			b.Run(name, func(b *testing.B) {
+				var deflated []byte
+				for n := 0; n < b.N; n++ {
+					deflated, _ = deflateWith(input, compression)
+				}
+				b.ReportMetric(float64(len(input)), "inflated-bytes")
+				b.ReportMetric(float64(len(deflated)), "deflated-bytes")
+			})
+		}
+	}
+}
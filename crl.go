@@ -0,0 +1,165 @@
+package issuer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// revocationIdPattern is the spec's limit on rids: base64url, at most 24 characters
+var revocationIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,24}$`)
+
+// CRLStore holds an issuer's revocation lists, one per signing key, and serves them where verifiers look for them:
+// <issuer URL>/.well-known/crl/<kid>.json.
+type CRLStore struct {
+	mu    sync.RWMutex
+	path  string
+	lists map[string]*RevocationList
+}
+
+type crlFile struct {
+	CRLs []RevocationList `json:"crls"`
+}
+
+// NewCRLStore returns a store that only lives in memory.
+func NewCRLStore() *CRLStore {
+	return &CRLStore{lists: map[string]*RevocationList{}}
+}
+
+// OpenCRLStore reads the revocation lists saved at path, which need not exist yet. Every revocation is saved back
+// to it before Revoke returns.
+func OpenCRLStore(path string) (*CRLStore, error) {
+	store := NewCRLStore()
+	store.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file crlFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse revocation lists: %w", err)
+	}
+	for i := range file.CRLs {
+		list := file.CRLs[i]
+		store.lists[list.KeyId] = &list
+	}
+	return store, nil
+}
+
+// Revoke adds the rid to the key's list, revoking cards with that rid issued up to the given time. Revoking a rid
+// again moves its cutoff.
+func (s *CRLStore) Revoke(keyId string, rid string, at time.Time) error {
+	if keyId == "" {
+		return errors.New("key ID is required")
+	}
+	if !revocationIdPattern.MatchString(rid) {
+		return fmt.Errorf("invalid rid %q: it must be at most 24 base64url characters", rid)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, ok := s.lists[keyId]
+	if !ok {
+		list = &RevocationList{KeyId: keyId, Method: "rid"}
+		s.lists[keyId] = list
+	}
+	previous := *list
+	previous.RevokedIds = append([]string(nil), list.RevokedIds...)
+
+	entry := rid + "." + strconv.FormatInt(at.Unix(), 10)
+	replaced := false
+	for i, existing := range list.RevokedIds {
+		if existing == rid || strings.HasPrefix(existing, rid+".") {
+			list.RevokedIds[i], replaced = entry, true
+		}
+	}
+	if !replaced {
+		list.RevokedIds = append(list.RevokedIds, entry)
+	}
+	list.Counter++
+
+	if err := s.save(); err != nil {
+		*list = previous
+		return err
+	}
+	return nil
+}
+
+// List returns the revocation list of a key.
+func (s *CRLStore) List(keyId string) (RevocationList, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list, ok := s.lists[keyId]
+	if !ok {
+		return RevocationList{}, false
+	}
+	copied := *list
+	copied.RevokedIds = append([]string{}, list.RevokedIds...)
+	return copied, true
+}
+
+// Handler serves GET <prefix><kid>.json. Mount it with http.StripPrefix, as the issuing service does for
+// /.well-known/crl/.
+func (s *CRLStore) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeServiceError(w, http.StatusMethodNotAllowed, ServiceError{Code: ERROR_METHOD_NOT_ALLOWED, Message: "use GET"})
+			return
+		}
+		keyId := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".json")
+		list, ok := s.List(keyId)
+		if !ok {
+			writeServiceError(w, http.StatusNotFound, ServiceError{Code: ERROR_NOT_FOUND, Message: "no revocation list for key " + keyId})
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+		_ = json.NewEncoder(w).Encode(list)
+	})
+}
+
+// save writes the lists to a temporary file and renames it over the old one, so a crash never leaves a partial file
+func (s *CRLStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	file := crlFile{CRLs: []RevocationList{}}
+	for _, list := range s.lists {
+		file.CRLs = append(file.CRLs, *list)
+	}
+	sort.Slice(file.CRLs, func(a, b int) bool {
+		return file.CRLs[a].KeyId < file.CRLs[b].KeyId
+	})
+	raw, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal revocation lists: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create revocation list file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write revocation lists: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write revocation lists: %w", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,381 @@
+package issuer
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CSVMapping names the spreadsheet column holding each field. Column names are matched case-insensitively
+// against the header row.
+type CSVMapping struct {
+	// PatientId groups rows into patients. Without it rows are grouped by name and birth date.
+	PatientId      string `json:"patientId,omitempty"`
+	Family         string `json:"family"`
+	Given          string `json:"given"`
+	BirthDate      string `json:"birthDate"`
+	VaccineCode    string `json:"vaccineCode"`
+	OccurrenceDate string `json:"occurrenceDate"`
+	LotNumber      string `json:"lotNumber,omitempty"`
+	Performer      string `json:"performer,omitempty"`
+
+	// DefaultPerformer is used for rows without a performer, e.g. the name of the clinic that ran the event
+	DefaultPerformer string `json:"defaultPerformer,omitempty"`
+
+	// DateLayouts are Go time layouts tried in order for both dates. Defaults to ISO dates and US m/d/yyyy.
+	DateLayouts []string `json:"dateLayouts,omitempty"`
+
+	// Delimiter defaults to a comma
+	Delimiter string `json:"delimiter,omitempty"`
+}
+
+// DefaultCSVMapping is the layout of the template spreadsheet handed to clinics.
+func DefaultCSVMapping() CSVMapping {
+	return CSVMapping{
+		PatientId:      "patient_id",
+		Family:         "family_name",
+		Given:          "given_name",
+		BirthDate:      "birth_date",
+		VaccineCode:    "cvx",
+		OccurrenceDate: "date",
+		LotNumber:      "lot",
+		Performer:      "performer",
+	}
+}
+
+// LoadCSVMapping reads a JSON mapping file.
+func LoadCSVMapping(path string) (CSVMapping, error) {
+	var mapping CSVMapping
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return mapping, err
+	}
+	if err := json.Unmarshal(raw, &mapping); err != nil {
+		return mapping, fmt.Errorf("failed to parse CSV mapping: %w", err)
+	}
+	return mapping, nil
+}
+
+var defaultCSVDateLayouts = []string{"2006-01-02", "1/2/2006", "01/02/2006", "20060102"}
+
+// CSVPatient is a group of rows that becomes one card.
+type CSVPatient struct {
+	// Id is the value of the patient ID column, if the mapping has one
+	Id string
+	// Lines are the 1-based line numbers of the patient's rows
+	Lines                []int
+	VerifiableCredential map[string]interface{}
+}
+
+// RejectedRow is a spreadsheet row that was not issued.
+type RejectedRow struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// CSVImport is the result of reading a spreadsheet: the patients whose rows all mapped and passed profile
+// validation, and every row that was rejected. A patient with any rejected row is rejected as a whole, so a card
+// never silently misses a dose.
+type CSVImport struct {
+	Rows     int
+	Patients []CSVPatient
+	Rejected []RejectedRow
+}
+
+type csvColumns map[string]int
+
+func (c csvColumns) get(record []string, column string) string {
+	if i, ok := c[strings.ToLower(column)]; ok && i < len(record) {
+		return strings.TrimSpace(record[i])
+	}
+	return ""
+}
+
+type csvGroup struct {
+	id         string
+	lines      []int
+	patient    Patient
+	patientSet bool
+	doses      []Immunization
+	rejected   bool
+}
+
+// ImportCSV reads the spreadsheet, groups the rows into patients and builds and validates each patient's vc
+// claim. Errors are only returned when the file itself cannot be read; bad rows are reported in Rejected.
+func ImportCSV(r io.Reader, mapping CSVMapping) (*CSVImport, error) {
+	reader := csv.NewReader(r)
+	if mapping.Delimiter != "" {
+		reader.Comma = []rune(mapping.Delimiter)[0]
+	}
+	reader.FieldsPerRecord = -1
+	layouts := mapping.DateLayouts
+	if len(layouts) == 0 {
+		layouts = defaultCSVDateLayouts
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	columns := csvColumns{}
+	for i, name := range header {
+		// spreadsheets exported as UTF-8 CSV start with a byte order mark
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for field, column := range map[string]string{
+		"family": mapping.Family, "given": mapping.Given, "birthDate": mapping.BirthDate,
+		"vaccineCode": mapping.VaccineCode, "occurrenceDate": mapping.OccurrenceDate,
+	} {
+		if column == "" {
+			return nil, fmt.Errorf("CSV mapping has no column for %s", field)
+		}
+		if _, ok := columns[strings.ToLower(column)]; !ok {
+			return nil, fmt.Errorf("CSV has no %q column for %s", column, field)
+		}
+	}
+
+	result := &CSVImport{}
+	var groups []*csvGroup
+	byKey := map[string]*csvGroup{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV line %d: %w", line, err)
+		}
+		if isBlankRecord(record) {
+			continue
+		}
+		result.Rows++
+
+		patient := Patient{
+			Family:    columns.get(record, mapping.Family),
+			Given:     strings.Fields(columns.get(record, mapping.Given)),
+			BirthDate: columns.get(record, mapping.BirthDate),
+		}
+		id := columns.get(record, mapping.PatientId)
+		key := id
+		if mapping.PatientId == "" {
+			key = strings.ToLower(patient.Family + "|" + strings.Join(patient.Given, " ") + "|" + patient.BirthDate)
+		}
+		group, ok := byKey[key]
+		if !ok {
+			group = &csvGroup{id: id}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.lines = append(group.lines, line)
+
+		dose, reason := csvImmunization(columns, record, mapping, layouts)
+		if reason == "" {
+			reason = group.addPatient(patient, layouts)
+		}
+		if reason != "" {
+			group.rejected = true
+			result.Rejected = append(result.Rejected, RejectedRow{Line: line, Reason: reason})
+			continue
+		}
+		group.doses = append(group.doses, dose)
+	}
+
+	for _, group := range groups {
+		if !group.rejected {
+			vc, err := NewImmunizationCredential(group.patient, group.doses...)
+			if err == nil {
+				if diagnostics := ValidateProfile(vc); diagnostics.HasErrors() {
+					err = &ProfileValidationError{Diagnostics: diagnostics}
+				}
+			}
+			if err == nil {
+				result.Patients = append(result.Patients, CSVPatient{Id: group.id, Lines: group.lines, VerifiableCredential: vc})
+				continue
+			}
+			result.Rejected = append(result.Rejected, RejectedRow{Line: group.lines[0], Reason: err.Error()})
+		}
+		result.rejectGroup(group.lines)
+	}
+	sortRejectedRows(result.Rejected)
+	return result, nil
+}
+
+// addPatient checks the row's patient against the first row of the group
+func (g *csvGroup) addPatient(patient Patient, layouts []string) string {
+	if patient.Family == "" && len(patient.Given) == 0 {
+		return "patient name is missing"
+	}
+	birthDate, ok := parseCSVDate(patient.BirthDate, layouts)
+	if !ok {
+		return fmt.Sprintf("birth date %q is not a date", patient.BirthDate)
+	}
+	patient.BirthDate = birthDate
+
+	if !g.patientSet {
+		g.patient, g.patientSet = patient, true
+		return ""
+	}
+	if patient.BirthDate != g.patient.BirthDate || !strings.EqualFold(patient.Family, g.patient.Family) {
+		return "name or birth date differs from the patient's other rows"
+	}
+	return ""
+}
+
+func csvImmunization(columns csvColumns, record []string, mapping CSVMapping, layouts []string) (Immunization, string) {
+	code := normalizeCVX(columns.get(record, mapping.VaccineCode))
+	// codes missing from the CVX table are left for profile validation to warn about, see validateCVXCode
+	if !cvxCode.MatchString(code) {
+		return Immunization{}, fmt.Sprintf("%q is not a CVX code", code)
+	}
+	date, ok := parseCSVDate(columns.get(record, mapping.OccurrenceDate), layouts)
+	if !ok {
+		return Immunization{}, fmt.Sprintf("vaccination date %q is not a date", columns.get(record, mapping.OccurrenceDate))
+	}
+
+	immunization := Immunization{
+		VaccineCode:        CVX(code),
+		OccurrenceDateTime: date,
+		LotNumber:          columns.get(record, mapping.LotNumber),
+		Performer:          columns.get(record, mapping.Performer),
+	}
+	if immunization.Performer == "" {
+		immunization.Performer = mapping.DefaultPerformer
+	}
+	return immunization, ""
+}
+
+// rejectGroup rejects the patient's rows that were not already rejected on their own
+func (r *CSVImport) rejectGroup(lines []int) {
+	rejected := map[int]bool{}
+	for _, row := range r.Rejected {
+		rejected[row.Line] = true
+	}
+	for _, line := range lines {
+		if !rejected[line] {
+			r.Rejected = append(r.Rejected, RejectedRow{Line: line, Reason: fmt.Sprintf("another row of this patient was rejected (lines %s)", joinInts(lines))})
+		}
+	}
+}
+
+// Requests returns one IssueRequest per patient for Issuer.IssueAll.
+func (r *CSVImport) Requests() []IssueRequest {
+	requests := make([]IssueRequest, len(r.Patients))
+	for i, patient := range r.Patients {
+		requests[i] = IssueRequest{ID: patient.Id, VerifiableCredential: patient.VerifiableCredential}
+	}
+	return requests
+}
+
+// IssuedPatient is a card written by a CSV import.
+type IssuedPatient struct {
+	Id    string `json:"id,omitempty"`
+	Lines []int  `json:"lines"`
+	File  string `json:"file,omitempty"`
+	JWS   string `json:"-"`
+}
+
+// CSVImportReport summarizes a bulk issuance from a spreadsheet.
+type CSVImportReport struct {
+	Rows     int             `json:"rows"`
+	Issued   []IssuedPatient `json:"issued"`
+	Rejected []RejectedRow   `json:"rejected"`
+}
+
+// Issue signs a card for every patient. Patients whose card fails to sign are reported as rejected.
+func (r *CSVImport) Issue(ctx context.Context, issuer *Issuer, options BatchOptions) *CSVImportReport {
+	report := &CSVImportReport{Rows: r.Rows, Rejected: append([]RejectedRow(nil), r.Rejected...)}
+	for i, result := range issuer.IssueAll(ctx, r.Requests(), options) {
+		patient := r.Patients[i]
+		if result.Err != nil {
+			for _, line := range patient.Lines {
+				report.Rejected = append(report.Rejected, RejectedRow{Line: line, Reason: "failed to issue: " + result.Err.Error()})
+			}
+			continue
+		}
+		report.Issued = append(report.Issued, IssuedPatient{Id: patient.Id, Lines: patient.Lines, JWS: result.JWS})
+	}
+	sortRejectedRows(report.Rejected)
+	return report
+}
+
+var unsafeFileNameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// WriteCardFiles writes one .smart-health-card file per issued patient into dir, named after the patient ID
+// or, without one, numbered so that names never end up in file names.
+func (r *CSVImportReport) WriteCardFiles(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for i := range r.Issued {
+		patient := &r.Issued[i]
+		name := unsafeFileNameCharacters.ReplaceAllString(patient.Id, "_")
+		if name == "" || used[name] {
+			name = fmt.Sprintf("patient-%04d", i+1)
+		}
+		used[name] = true
+
+		file, err := MarshalCardFile(patient.JWS)
+		if err != nil {
+			return err
+		}
+		patient.File = filepath.Join(dir, name+".smart-health-card")
+		if err := ioutil.WriteFile(patient.File, file, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteText writes the summary and every rejected row.
+func (r *CSVImportReport) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Rows:     %d\n", r.Rows)
+	fmt.Fprintf(&b, "Issued:   %d cards\n", len(r.Issued))
+	fmt.Fprintf(&b, "Rejected: %d rows\n", len(r.Rejected))
+	for _, row := range r.Rejected {
+		fmt.Fprintf(&b, "  line %d: %s\n", row.Line, row.Reason)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *CSVImportReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func parseCSVDate(value string, layouts []string) (string, bool) {
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format("2006-01-02"), true
+		}
+	}
+	return "", false
+}
+
+func isBlankRecord(record []string) bool {
+	for _, field := range record {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func sortRejectedRows(rows []RejectedRow) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Line < rows[j].Line
+	})
+}
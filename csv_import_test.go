@@ -0,0 +1,102 @@
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sampleCSV = `patient_id,family_name,given_name,birth_date,cvx,date,lot,performer
+P1,Anyperson,John B.,1951-01-20,207,2021-01-01,0000001,ABC General Hospital
+P2,Anyperson,Jane,1961-04-01,212,04/15/2021,0000002,
+P1,Anyperson,John B.,1951-01-20,207,01/29/2021,0000007,ABC General Hospital
+P3,Doe,Sam,1990-13-01,207,2021-01-01,0000003,
+P4,Roe,Alex,1985-02-02,208,2021-02-01,0000004,
+P4,Roe,Alex,1985-02-02,CVX-999,2021-03-01,0000005,
+,,,,,,,
+`
+
+func TestImportCSV(t *testing.T) {
+	mapping := DefaultCSVMapping()
+	mapping.DefaultPerformer = "Pop-up Clinic"
+	imported, err := ImportCSV(strings.NewReader(sampleCSV), mapping)
+	if err != nil {
+		t.Fatalf("Failed to import CSV: %s", err.Error())
+	}
+	if imported.Rows != 6 || len(imported.Patients) != 2 {
+		t.Fatalf("Expected 6 rows and 2 patients, got %d rows and %+v", imported.Rows, imported.Patients)
+	}
+	if imported.Patients[0].Id != "P1" || joinInts(imported.Patients[0].Lines) != "2, 4" {
+		t.Fatalf("Expected P1 to group lines 2 and 4, got %+v", imported.Patients[0])
+	}
+	doses := getSlice(getMap(getMap(imported.Patients[1].VerifiableCredential, "credentialSubject"), "fhirBundle"), "entry")
+	dose := getMap(doses[1].(map[string]interface{}), "resource")
+	if getString(dose, "occurrenceDateTime") != "2021-04-15" || getString(getMap(getSlice(dose, "performer")[0].(map[string]interface{}), "actor"), "display") != "Pop-up Clinic" {
+		t.Fatalf("Unexpected dose for P2: %v", dose)
+	}
+
+	// P3 has a bad birth date; P4 has a code that is not a CVX code, which rejects their valid row too
+	var lines []int
+	for _, row := range imported.Rejected {
+		lines = append(lines, row.Line)
+	}
+	if joinInts(lines) != "5, 6, 7" || !strings.Contains(imported.Rejected[0].Reason, "birth date") ||
+		!strings.Contains(imported.Rejected[1].Reason, "another row") || !strings.Contains(imported.Rejected[2].Reason, `"CVX-999" is not a CVX code`) {
+		t.Fatalf("Unexpected rejected rows: %+v", imported.Rejected)
+	}
+
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	report := imported.Issue(context.Background(), issuer, BatchOptions{Workers: 2})
+	if len(report.Issued) != 2 || len(report.Rejected) != 3 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	dir := t.TempDir()
+	if err := report.WriteCardFiles(dir); err != nil {
+		t.Fatalf("Failed to write card files: %s", err.Error())
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "P1.smart-health-card"))
+	if err != nil {
+		t.Fatalf("Failed to read card file: %s", err.Error())
+	}
+	if cards, err := ExtractJWS(raw); err != nil || len(cards) != 1 || cards[0] != report.Issued[0].JWS {
+		t.Fatalf("Card file does not hold the issued card: %v", err)
+	}
+
+	var text bytes.Buffer
+	if err := report.WriteText(&text); err != nil {
+		t.Fatalf("Failed to write report: %s", err.Error())
+	}
+	if !strings.Contains(text.String(), "Issued:   2 cards") || !strings.Contains(text.String(), `line 7: "CVX-999"`) {
+		t.Fatalf("Unexpected report:\n%s", text.String())
+	}
+}
+
+func TestImportCSVMapping(t *testing.T) {
+	// a clinic's own spreadsheet: semicolons, different headers, no patient ID column
+	input := "\ufeffLast;First;DOB;Vaccine;Given on;Lot\nAnyperson;John;1/20/1951;207;1/1/2021;0000001\nAnyperson;John;1/20/1951;207;1/29/2021;0000007\n"
+	mapping := CSVMapping{
+		Family:           "last",
+		Given:            "first",
+		BirthDate:        "dob",
+		VaccineCode:      "vaccine",
+		OccurrenceDate:   "given on",
+		LotNumber:        "lot",
+		DefaultPerformer: "Pop-up Clinic",
+		Delimiter:        ";",
+	}
+	imported, err := ImportCSV(strings.NewReader(input), mapping)
+	if err != nil {
+		t.Fatalf("Failed to import CSV: %s", err.Error())
+	}
+	if len(imported.Patients) != 1 || len(imported.Rejected) != 0 {
+		t.Fatalf("Expected a single patient, got %+v", imported)
+	}
+
+	mapping.VaccineCode = "cvx code"
+	if _, err := ImportCSV(strings.NewReader(input), mapping); err == nil {
+		t.Fatal("Expected an error for a mapping naming a missing column")
+	}
+}
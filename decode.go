@@ -0,0 +1,205 @@
+package issuer
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// SmartHealthCardFile is the JSON body of a .smart-health-card file download
+type SmartHealthCardFile struct {
+	VerifiableCredential []string `json:"verifiableCredential"`
+}
+
+const SMART_HEALTH_CARD_FILE_CONTENT_TYPE = "application/smart-health-card"
+
+// MarshalCardFile returns the contents of a .smart-health-card file holding the given cards
+func MarshalCardFile(jws ...string) ([]byte, error) {
+	return json.Marshal(SmartHealthCardFile{VerifiableCredential: jws})
+}
+
+// JWSHeader holds the protected header fields of a card
+type JWSHeader struct {
+	Algorithm   string `json:"alg"`
+	KeyId       string `json:"kid"`
+	Compression string `json:"zip"`
+}
+
+// DecodedCard is a card whose payload has been decompressed and parsed, but not necessarily verified
+type DecodedCard struct {
+	Header  JWSHeader
+	Card    SmartHealthCard
+	Payload []byte
+	// CompressedSize is the size of the DEFLATE payload carried in the JWS
+	CompressedSize int
+
+	jws     *jose.JSONWebSignature
+	compact string
+}
+
+// JWS returns the compact serialization the card was decoded from.
+func (d *DecodedCard) JWS() string {
+	return d.compact
+}
+
+// DecodeCard parses the JWS and inflates its payload without verifying the signature.
+func DecodeCard(jws string) (*DecodedCard, error) {
+	signed, err := jose.ParseSigned(jws)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse jws: %w", err)
+	}
+	if len(signed.Signatures) != 1 {
+		return nil, fmt.Errorf("expected a single signature, found %d", len(signed.Signatures))
+	}
+
+	protected := signed.Signatures[0].Protected
+	header := JWSHeader{
+		Algorithm: protected.Algorithm,
+		KeyId:     protected.KeyID,
+	}
+	if zip, ok := protected.ExtraHeaders["zip"].(string); ok {
+		header.Compression = zip
+	}
+
+	compressed := signed.UnsafePayloadWithoutVerification()
+	payload, err := inflate(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inflate payload: %w", err)
+	}
+
+	decoded := &DecodedCard{
+		Header:         header,
+		Payload:        payload,
+		CompressedSize: len(compressed),
+		jws:            signed,
+		compact:        strings.TrimSpace(jws),
+	}
+	if err := json.Unmarshal(payload, &decoded.Card); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal card payload: %w", err)
+	}
+	return decoded, nil
+}
+
+// VerifyCard checks the signature of the JWS against the key in jwks matching its kid and returns the card.
+func VerifyCard(jws string, jwks jose.JSONWebKeySet) (*DecodedCard, error) {
+	decoded, err := DecodeCard(jws)
+	if err != nil {
+		return nil, &VerificationError{Reason: VerificationMalformed, Err: err}
+	}
+	keys := jwks.Key(decoded.Header.KeyId)
+	if len(keys) == 0 {
+		return nil, &VerificationError{Reason: VerificationUnknownKey, KeyId: decoded.Header.KeyId}
+	}
+	if _, err := decoded.jws.Verify(keys[0].Public()); err != nil {
+		return nil, &VerificationError{Reason: VerificationBadSignature, KeyId: decoded.Header.KeyId, Err: err}
+	}
+	return decoded, nil
+}
+
+var chunkPrefix = regexp.MustCompile(`^shc:/(\d+)/(\d+)/(\d+)$`)
+
+// ParseQRContents reassembles a JWS from the shc:/ text of its QR codes. Chunks may be given in any order.
+func ParseQRContents(contents []string) (string, error) {
+	if len(contents) == 0 {
+		return "", errors.New("no QR contents provided")
+	}
+	if len(contents) == 1 && !chunkPrefix.MatchString(strings.TrimSpace(contents[0])) {
+		return numericDecode(strings.TrimPrefix(strings.TrimSpace(contents[0]), QR_CODE_PREFIX))
+	}
+
+	type chunk struct {
+		index  int
+		digits string
+	}
+	chunks := make([]chunk, 0, len(contents))
+	for _, content := range contents {
+		match := chunkPrefix.FindStringSubmatch(strings.TrimSpace(content))
+		if match == nil {
+			return "", fmt.Errorf("invalid chunked QR content %.20q", content)
+		}
+		index, _ := strconv.Atoi(match[1])
+		total, _ := strconv.Atoi(match[2])
+		if total != len(contents) || index < 1 || index > total {
+			return "", fmt.Errorf("chunk %d/%d does not match the %d chunks provided", index, total, len(contents))
+		}
+		chunks = append(chunks, chunk{index: index, digits: match[3]})
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].index < chunks[j].index })
+
+	var jws strings.Builder
+	for i, c := range chunks {
+		if c.index != i+1 {
+			return "", fmt.Errorf("missing or duplicate chunk %d", i+1)
+		}
+		part, err := numericDecode(c.digits)
+		if err != nil {
+			return "", err
+		}
+		jws.WriteString(part)
+	}
+	return jws.String(), nil
+}
+
+// ExtractJWS finds the cards in a JWS, a .smart-health-card file, or one or more lines of shc:/ QR text.
+func ExtractJWS(data []byte) ([]string, error) {
+	text := strings.TrimSpace(string(data))
+	switch {
+	case strings.HasPrefix(text, "{"):
+		var file SmartHealthCardFile
+		if err := json.Unmarshal([]byte(text), &file); err != nil {
+			return nil, fmt.Errorf("failed to parse smart health card file: %w", err)
+		}
+		if len(file.VerifiableCredential) == 0 {
+			return nil, errors.New("smart health card file contains no credentials")
+		}
+		return file.VerifiableCredential, nil
+	case strings.HasPrefix(text, QR_CODE_PREFIX):
+		jws, err := ParseQRContents(strings.Fields(text))
+		if err != nil {
+			return nil, err
+		}
+		return []string{jws}, nil
+	case text == "":
+		return nil, errors.New("no card found in input")
+	default:
+		return []string{text}, nil
+	}
+}
+
+func numericDecode(digits string) (string, error) {
+	if len(digits)%2 != 0 {
+		return "", errors.New("QR numeric content has an odd number of digits")
+	}
+	out := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		v, err := strconv.Atoi(digits[i : i+2])
+		if err != nil {
+			return "", fmt.Errorf("invalid QR numeric content at offset %d", i)
+		}
+		out = append(out, byte(v+LOWEST_VALUED_JWS_ORDINAL_VALUE))
+	}
+	return string(out), nil
+}
+
+func inflate(deflated []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(deflated))
+	defer r.Close()
+	inflated, err := ioutil.ReadAll(io.LimitReader(r, MAX_INFLATED_PAYLOAD_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(inflated) > MAX_INFLATED_PAYLOAD_SIZE {
+		return nil, fmt.Errorf("%w: it inflates to more than %d bytes", ErrPayloadTooLarge, MAX_INFLATED_PAYLOAD_SIZE)
+	}
+	return inflated, nil
+}
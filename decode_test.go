@@ -0,0 +1,73 @@
+package issuer
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDecodeAndVerifyCard(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	jws, err := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+	if err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+
+	// round trip the card through its QR text and a .smart-health-card file
+	fromQR, err := ExtractJWS([]byte(strings.Join(QRContents(jws), "\n")))
+	if err != nil {
+		t.Fatalf("Failed to extract JWS from QR contents: %s", err.Error())
+	}
+	file, err := MarshalCardFile(jws)
+	if err != nil {
+		t.Fatalf("Failed to marshal card file: %s", err.Error())
+	}
+	fromFile, err := ExtractJWS(file)
+	if err != nil {
+		t.Fatalf("Failed to extract JWS from card file: %s", err.Error())
+	}
+	if fromQR[0] != jws || fromFile[0] != jws {
+		t.Fatalf("Extracted JWS does not match the issued card")
+	}
+
+	jwks, err := issuer.JWKS()
+	if err != nil {
+		t.Fatalf("Failed to build JWKS: %s", err.Error())
+	}
+	decoded, err := VerifyCard(jws, jwks)
+	if err != nil {
+		t.Fatalf("Failed to verify card: %s", err.Error())
+	}
+	if decoded.Header.Compression != "DEF" || decoded.Card.IssuerURL != issuer.IssuerURL() {
+		t.Fatalf("Unexpected decoded card: %+v", decoded.Header)
+	}
+
+	otherIssuer, _ := newTestIssuer(t, IssuerOptions{})
+	otherJWKS, _ := otherIssuer.JWKS()
+	// pretend the other issuer published a different key under the same kid
+	otherJWKS.Keys[0].KeyID = decoded.Header.KeyId
+	if _, err = VerifyCard(jws, otherJWKS); err == nil {
+		t.Fatalf("Verified the card with the wrong key")
+	}
+}
+
+func TestParseQRContentsChunks(t *testing.T) {
+	jws := strings.Repeat("abc.", MAX_CHUNK_SIZE)
+	contents := QRContents(jws)
+	if len(contents) < 2 {
+		t.Fatalf("Expected a chunked card")
+	}
+	// chunks can be scanned in any order
+	contents[0], contents[1] = contents[1], contents[0]
+	parsed, err := ParseQRContents(contents)
+	if err != nil {
+		t.Fatalf("Failed to parse chunked QR contents: %s", err.Error())
+	}
+	if parsed != jws {
+		t.Fatalf("Reassembled JWS does not match")
+	}
+
+	if _, err = ParseQRContents(contents[1:]); err == nil {
+		t.Fatalf("Expected an error for a missing chunk")
+	}
+}
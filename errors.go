@@ -0,0 +1,169 @@
+package issuer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors callers can match with errors.Is. The package wraps them, or returns the error types below that match them,
+// so the message still says what went wrong.
+var (
+	// ErrInvalidKey is a signing key that is missing or not a P-256 ECDSA key
+	ErrInvalidKey = errors.New("invalid signing key")
+
+	// ErrPayloadTooLarge is a card whose payload is larger than the package accepts: one that inflates past
+	// MAX_INFLATED_PAYLOAD_SIZE when read, or that needs QR codes above MAX_QR_VERSION when issued
+	ErrPayloadTooLarge = errors.New("card payload is too large")
+
+	// ErrQRVersionExceeded is QR content that does not fit in a code of MAX_QR_VERSION
+	ErrQRVersionExceeded = errors.New("QR code version exceeded")
+
+	// ErrInvalidCredential is a verifiable credential that cannot be signed as it is
+	ErrInvalidCredential = errors.New("invalid verifiable credential")
+
+	// ErrSigningFailed is matched by every *SigningError
+	ErrSigningFailed = errors.New("failed to sign card")
+
+	// ErrVerificationFailed is matched by every *VerificationError
+	ErrVerificationFailed = errors.New("card verification failed")
+)
+
+// MAX_QR_VERSION is the largest QR code the spec allows for a health card
+const MAX_QR_VERSION = 22
+
+// MAX_INFLATED_PAYLOAD_SIZE bounds the decompressed payload of a card, so a small JWS cannot inflate without limit
+const MAX_INFLATED_PAYLOAD_SIZE = 1 << 20
+
+// SigningError is a card that could not be signed with the key KeyId. Err says why, and may be ErrInvalidKey.
+type SigningError struct {
+	KeyId string
+	Err   error
+}
+
+func (e *SigningError) Error() string {
+	if e.KeyId == "" {
+		return fmt.Sprintf("failed to sign card: %s", e.Err)
+	}
+	return fmt.Sprintf("failed to sign card with key %s: %s", e.KeyId, e.Err)
+}
+
+func (e *SigningError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SigningError) Is(target error) bool {
+	return target == ErrSigningFailed
+}
+
+// KeyError is a signing key that could not be used. It matches ErrInvalidKey, and Err says why.
+type KeyError struct {
+	Message string
+	Err     error
+}
+
+func (e *KeyError) Error() string {
+	return wrappedErrorMessage(ErrInvalidKey, e.Message, e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+func (e *KeyError) Is(target error) bool {
+	return target == ErrInvalidKey
+}
+
+// CredentialError is a verifiable credential that could not be read or encoded. It matches ErrInvalidCredential,
+// and Err says why.
+type CredentialError struct {
+	Message string
+	Err     error
+}
+
+func (e *CredentialError) Error() string {
+	return wrappedErrorMessage(ErrInvalidCredential, e.Message, e.Err)
+}
+
+func (e *CredentialError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CredentialError) Is(target error) bool {
+	return target == ErrInvalidCredential
+}
+
+// wrappedErrorMessage reads like the fmt.Errorf("%w: message: %s") these error types replace
+func wrappedErrorMessage(sentinel error, message string, err error) string {
+	if message == "" {
+		return fmt.Sprintf("%s: %s", sentinel, err)
+	}
+	return fmt.Sprintf("%s: %s: %s", sentinel, message, err)
+}
+
+// VerificationReason says why a card's signature could not be verified.
+type VerificationReason string
+
+const (
+	// VerificationMalformed is a card that is not a compact JWS with a DEFLATE-compressed JSON payload
+	VerificationMalformed VerificationReason = "malformed"
+	// VerificationUnknownKey is a card signed with a kid missing from the key set
+	VerificationUnknownKey VerificationReason = "unknown-key"
+	// VerificationBadSignature is a card whose signature does not match the key named by its kid
+	VerificationBadSignature VerificationReason = "bad-signature"
+)
+
+// VerificationError is a card whose signature could not be verified.
+type VerificationError struct {
+	Reason VerificationReason
+	KeyId  string
+	Err    error
+}
+
+func (e *VerificationError) Error() string {
+	var message string
+	switch e.Reason {
+	case VerificationMalformed:
+		message = "malformed card"
+	case VerificationUnknownKey:
+		return fmt.Sprintf("no key with kid %s in the key set", e.KeyId)
+	case VerificationBadSignature:
+		message = "failed to verify signature"
+	default:
+		message = fmt.Sprintf("card verification failed (%s)", e.Reason)
+	}
+	if e.Err == nil {
+		return message
+	}
+	return fmt.Sprintf("%s: %s", message, e.Err)
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+func (e *VerificationError) Is(target error) bool {
+	return target == ErrVerificationFailed
+}
+
+// QRCodeError is a QR chunk that could not be encoded. It matches ErrQRVersionExceeded and ErrPayloadTooLarge when
+// the chunk needs a code larger than MAX_QR_VERSION, or does not fit in any QR code, in which case Version is 0.
+type QRCodeError struct {
+	Chunk   int
+	Version int
+	Err     error
+}
+
+func (e *QRCodeError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("failed to encode QR chunk %d: %s", e.Chunk, e.Err)
+	}
+	return fmt.Sprintf("QR chunk %d needs version %d, more than %d", e.Chunk, e.Version, MAX_QR_VERSION)
+}
+
+func (e *QRCodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *QRCodeError) Is(target error) bool {
+	return (target == ErrQRVersionExceeded || target == ErrPayloadTooLarge) && (e.Version == 0 || e.Version > MAX_QR_VERSION)
+}
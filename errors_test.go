@@ -0,0 +1,125 @@
+package issuer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestSigningErrors(t *testing.T) {
+	issuer, _ := NewIssuer(IssuerConfig{IssuerURL: "https://smarthealth.cards/examples/issuer", KeySource: StaticKey{}})
+	_, err := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+	var signingErr *SigningError
+	if !errors.Is(err, ErrSigningFailed) || !errors.Is(err, ErrInvalidKey) || !errors.As(err, &signingErr) {
+		t.Fatalf("Expected a signing error for a missing key, got %v", err)
+	}
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, err = SmartHealthCard{IssuerURL: "https://smarthealth.cards/examples/issuer"}.Sign(p384, "p384")
+	if !errors.Is(err, ErrInvalidKey) || !errors.As(err, &signingErr) || signingErr.KeyId != "p384" {
+		t.Fatalf("Expected an invalid key error for a P-384 key, got %v", err)
+	}
+	if _, err := (&Keystore{}).AddKey(p384); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("Expected the keystore to refuse a P-384 key, got %v", err)
+	}
+
+	test, _ := newTestIssuer(t, IssuerOptions{})
+	for name, vc := range map[string]map[string]interface{}{
+		"empty":          {},
+		"not marshaling": {"credentialSubject": map[string]interface{}{"fhirBundle": make(chan int)}},
+	} {
+		if _, err := test.Issue(context.Background(), vc); !errors.Is(err, ErrInvalidCredential) {
+			t.Fatalf("Expected the %s credential to be invalid, got %v", name, err)
+		}
+	}
+	// the encoding error stays inspectable behind the sentinel
+	unmarshalable := map[string]interface{}{"credentialSubject": map[string]interface{}{"fhirBundle": make(chan int)}}
+	_, err = test.Issue(context.Background(), unmarshalable)
+	var typeErr *json.UnsupportedTypeError
+	var credentialErr *CredentialError
+	if !errors.As(err, &typeErr) || !errors.As(err, &credentialErr) || !errors.Is(err, ErrSigningFailed) {
+		t.Fatalf("Expected the marshaling error to be wrapped, got %v", err)
+	}
+	if _, err := test.Plan(unmarshalable); !errors.Is(err, ErrInvalidCredential) || !errors.As(err, &typeErr) {
+		t.Fatalf("Expected planning to wrap the marshaling error, got %v", err)
+	}
+	if _, err := requestCredential([]byte(`{"resourceType": "Bundle", "entry": "not a list"}`)); !errors.Is(err, ErrInvalidCredential) || !errors.As(err, &credentialErr) || credentialErr.Err == nil {
+		t.Fatalf("Expected the bundle error to be wrapped, got %v", err)
+	}
+
+	laboratory, _ := newTestIssuer(t, IssuerOptions{CredentialTypes: []string{LABORATORY_TYPE}})
+	if _, err := laboratory.Issue(context.Background(), sampleVerifiableCredential(t)); !errors.Is(err, ErrInvalidCredential) {
+		t.Fatalf("Expected an immunization card to be refused by a laboratory issuer, got %v", err)
+	}
+	if !errors.Is(&ProfileValidationError{}, ErrInvalidCredential) {
+		t.Fatal("Expected profile validation errors to match ErrInvalidCredential")
+	}
+
+	// the sink's error stays inspectable through the issuer's message
+	full := errors.New("disk full")
+	audited, _ := NewIssuer(IssuerConfig{IssuerURL: test.IssuerURL(), KeySource: test.keys, Audit: AuditSinkFunc(func(context.Context, AuditEvent) error {
+		return full
+	})})
+	if _, err := audited.Issue(context.Background(), sampleVerifiableCredential(t)); !errors.Is(err, full) {
+		t.Fatalf("Expected the audit error to be wrapped, got %v", err)
+	}
+}
+
+func TestVerificationErrors(t *testing.T) {
+	issuer, key := newTestIssuer(t, IssuerOptions{})
+	jws, _ := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+	keyId, _ := ComputeKeyId(&key.PublicKey)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	for _, test := range []struct {
+		jws    string
+		jwks   jose.JSONWebKeySet
+		reason VerificationReason
+	}{
+		{"not a card", jose.JSONWebKeySet{}, VerificationMalformed},
+		{jws, jose.JSONWebKeySet{}, VerificationUnknownKey},
+		{jws, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &other.PublicKey, KeyID: keyId, Algorithm: "ES256"}}}, VerificationBadSignature},
+	} {
+		_, err := VerifyCard(test.jws, test.jwks)
+		var verificationErr *VerificationError
+		if !errors.Is(err, ErrVerificationFailed) || !errors.As(err, &verificationErr) || verificationErr.Reason != test.reason {
+			t.Fatalf("Expected a %s verification error, got %v", test.reason, err)
+		}
+	}
+
+	// every reason has a message of its own, with or without a cause
+	for _, reason := range []VerificationReason{VerificationMalformed, VerificationUnknownKey, VerificationBadSignature, "expired"} {
+		if message := (&VerificationError{Reason: reason, KeyId: keyId}).Error(); message == "" || strings.Contains(message, "<nil>") {
+			t.Fatalf("Unexpected message for a %s error without a cause: %q", reason, message)
+		}
+	}
+
+	// a payload that inflates without bound is refused before it is parsed
+	signer, _ := newCardSigner(key, keyId, false)
+	bomb, _ := deflate(strings.Repeat(" ", MAX_INFLATED_PAYLOAD_SIZE+1))
+	signed, _ := signer.Sign(bomb)
+	compact, _ := signed.CompactSerialize()
+	if _, err := DecodeCard(compact); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("Expected the payload to be too large, got %v", err)
+	}
+}
+
+func TestQRCodeErrors(t *testing.T) {
+	if _, err := newQRCode(QR_CODE_PREFIX+strings.Repeat("56", MAX_SINGLE_JWS_SIZE), 1); err != nil {
+		t.Fatalf("Expected the largest single JWS to fit: %s", err.Error())
+	}
+	for _, digits := range []int{3000, 8000} {
+		_, err := newQRCode(QR_CODE_PREFIX+strings.Repeat("5", digits), 2)
+		var qrErr *QRCodeError
+		if !errors.Is(err, ErrQRVersionExceeded) || !errors.Is(err, ErrPayloadTooLarge) || !errors.As(err, &qrErr) || qrErr.Chunk != 2 {
+			t.Fatalf("Expected %d digits to exceed the QR version limit, got %v", digits, err)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package issuer
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	LABORATORY_TYPE = "https://smarthealth.cards#laboratory"
+
+	LOINC_SYSTEM = "http://loinc.org"
+	UCUM_SYSTEM  = "http://unitsofmeasure.org"
+
+	FHIR_VERSION = "4.0.1"
+)
+
+// covid19VaccineCodes are CVX codes of COVID-19 vaccines; immunization cards carrying one are also typed #covid19
+var covid19VaccineCodes = map[string]bool{
+	"207": true, "208": true, "210": true, "211": true, "212": true, "213": true,
+	"217": true, "218": true, "219": true, "221": true, "225": true, "226": true,
+	"227": true, "228": true, "229": true, "230": true, "300": true, "301": true, "302": true,
+	"500": true, "501": true, "502": true, "503": true, "504": true, "505": true,
+	"506": true, "507": true, "508": true, "509": true, "510": true, "511": true,
+}
+
+// covid19LabCodes are LOINC codes of SARS-CoV-2 tests; lab cards carrying one are also typed #covid19
+var covid19LabCodes = map[string]bool{
+	"94309-2": true, // SARS-CoV-2 RNA NAA+probe Nasopharynx
+	"94500-6": true, // SARS-CoV-2 RNA NAA+probe Respiratory
+	"94531-1": true, // SARS-CoV-2 RNA panel NAA+probe Respiratory
+	"94534-5": true, // SARS-CoV-2 RdRp gene NAA+probe Respiratory
+	"94558-4": true, // SARS-CoV-2 Ag Respiratory Immunoassay
+	"94759-8": true, // SARS-CoV-2 RNA NAA+probe Nasopharynx
+	"95209-3": true, // SARS-CoV+SARS-CoV-2 Ag Respiratory Immunoassay
+	"96119-3": true, // SARS-CoV-2 Ag Upper respiratory Immunoassay
+	"97097-0": true, // SARS-CoV-2 Ag Upper respiratory Rapid immunoassay
+}
+
+// Coding identifies a concept in a code system. Display text is deliberately not supported since cards are minimized.
+type Coding struct {
+	System string `json:"system"`
+	Code   string `json:"code"`
+}
+
+// CVX returns a CVX coding, used for vaccine codes
+func CVX(code string) Coding {
+	return Coding{System: CVX_SYSTEM, Code: code}
+}
+
+// LOINC returns a LOINC coding, used for laboratory test codes
+func LOINC(code string) Coding {
+	return Coding{System: LOINC_SYSTEM, Code: code}
+}
+
+// SNOMED returns a SNOMED CT coding, used for qualitative lab results such as 260373001 (Detected)
+func SNOMED(code string) Coding {
+	return Coding{System: SNOMED_SYSTEM, Code: code}
+}
+
+// Quantity is a numeric result, with units preferably expressed in UCUM.
+type Quantity struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit,omitempty"`
+	System string  `json:"system,omitempty"`
+	Code   string  `json:"code,omitempty"`
+}
+
+// Patient is the subject of a card.
+type Patient struct {
+	Family string
+	Given  []string
+	// BirthDate is a FHIR date: YYYY, YYYY-MM or YYYY-MM-DD
+	BirthDate string
+}
+
+// Immunization is a single vaccine dose.
+type Immunization struct {
+	// VaccineCode is usually a CVX code, see CVX
+	VaccineCode Coding
+	// Status defaults to completed
+	Status             string
+	OccurrenceDateTime string
+	// Performer is the display name of the organization that administered the dose
+	Performer string
+	LotNumber string
+}
+
+// Observation is a laboratory result.
+type Observation struct {
+	// Code is the LOINC code of the test
+	Code Coding
+	// Status defaults to final
+	Status            string
+	EffectiveDateTime string
+
+	// exactly one of the values should be set
+	ValueCoding   *Coding
+	ValueQuantity *Quantity
+	ValueString   string
+
+	// Performer is the display name of the lab that performed the test
+	Performer string
+}
+
+type fhirCodeableConcept struct {
+	Coding []Coding `json:"coding"`
+}
+
+type fhirReference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+type fhirHumanName struct {
+	Family string   `json:"family,omitempty"`
+	Given  []string `json:"given,omitempty"`
+}
+
+type fhirPatient struct {
+	ResourceType string          `json:"resourceType"`
+	Name         []fhirHumanName `json:"name,omitempty"`
+	BirthDate    string          `json:"birthDate,omitempty"`
+}
+
+type fhirPerformer struct {
+	Actor fhirReference `json:"actor"`
+}
+
+type fhirImmunization struct {
+	ResourceType       string              `json:"resourceType"`
+	Status             string              `json:"status"`
+	VaccineCode        fhirCodeableConcept `json:"vaccineCode"`
+	Patient            fhirReference       `json:"patient"`
+	OccurrenceDateTime string              `json:"occurrenceDateTime,omitempty"`
+	Performer          []fhirPerformer     `json:"performer,omitempty"`
+	LotNumber          string              `json:"lotNumber,omitempty"`
+}
+
+type fhirObservation struct {
+	ResourceType         string               `json:"resourceType"`
+	Status               string               `json:"status"`
+	Code                 fhirCodeableConcept  `json:"code"`
+	Subject              fhirReference        `json:"subject"`
+	EffectiveDateTime    string               `json:"effectiveDateTime,omitempty"`
+	Performer            []fhirReference      `json:"performer,omitempty"`
+	ValueCodeableConcept *fhirCodeableConcept `json:"valueCodeableConcept,omitempty"`
+	ValueQuantity        *Quantity            `json:"valueQuantity,omitempty"`
+	ValueString          string               `json:"valueString,omitempty"`
+}
+
+type fhirBundleEntry struct {
+	FullURL  string      `json:"fullUrl"`
+	Resource interface{} `json:"resource"`
+}
+
+type fhirBundle struct {
+	ResourceType string            `json:"resourceType"`
+	Type         string            `json:"type"`
+	Entry        []fhirBundleEntry `json:"entry"`
+}
+
+type credentialSubject struct {
+	FHIRVersion string     `json:"fhirVersion"`
+	FHIRBundle  fhirBundle `json:"fhirBundle"`
+}
+
+type verifiableCredential struct {
+	Type              []string          `json:"type"`
+	CredentialSubject credentialSubject `json:"credentialSubject"`
+	RevocationId      string            `json:"rid,omitempty"`
+}
+
+func (p Patient) resource() fhirPatient {
+	resource := fhirPatient{ResourceType: "Patient", BirthDate: p.BirthDate}
+	if p.Family != "" || len(p.Given) > 0 {
+		resource.Name = []fhirHumanName{{Family: p.Family, Given: p.Given}}
+	}
+	return resource
+}
+
+func (i Immunization) resource(patientReference string) fhirImmunization {
+	status := i.Status
+	if status == "" {
+		status = "completed"
+	}
+	resource := fhirImmunization{
+		ResourceType:       "Immunization",
+		Status:             status,
+		VaccineCode:        fhirCodeableConcept{Coding: []Coding{i.VaccineCode}},
+		Patient:            fhirReference{Reference: patientReference},
+		OccurrenceDateTime: i.OccurrenceDateTime,
+		LotNumber:          i.LotNumber,
+	}
+	if i.Performer != "" {
+		resource.Performer = []fhirPerformer{{Actor: fhirReference{Display: i.Performer}}}
+	}
+	return resource
+}
+
+func (o Observation) resource(patientReference string) fhirObservation {
+	status := o.Status
+	if status == "" {
+		status = "final"
+	}
+	resource := fhirObservation{
+		ResourceType:      "Observation",
+		Status:            status,
+		Code:              fhirCodeableConcept{Coding: []Coding{o.Code}},
+		Subject:           fhirReference{Reference: patientReference},
+		EffectiveDateTime: o.EffectiveDateTime,
+		ValueQuantity:     o.ValueQuantity,
+		ValueString:       o.ValueString,
+	}
+	if o.ValueCoding != nil {
+		resource.ValueCodeableConcept = &fhirCodeableConcept{Coding: []Coding{*o.ValueCoding}}
+	}
+	if o.Performer != "" {
+		resource.Performer = []fhirReference{{Display: o.Performer}}
+	}
+	return resource
+}
+
+// CredentialBuilder assembles the vc claim for a patient's immunizations and lab results. The vc.type is derived
+// from the resources added: #immunization and/or #laboratory, plus #covid19 when a COVID-19 vaccine or test is present.
+type CredentialBuilder struct {
+	patient       Patient
+	immunizations []Immunization
+	observations  []Observation
+	extraTypes    []string
+	revocationId  string
+}
+
+func NewCredentialBuilder(patient Patient) *CredentialBuilder {
+	return &CredentialBuilder{patient: patient}
+}
+
+func (b *CredentialBuilder) AddImmunization(immunizations ...Immunization) *CredentialBuilder {
+	b.immunizations = append(b.immunizations, immunizations...)
+	return b
+}
+
+func (b *CredentialBuilder) AddObservation(observations ...Observation) *CredentialBuilder {
+	b.observations = append(b.observations, observations...)
+	return b
+}
+
+// AddType adds a vc.type that cannot be derived from the resources
+func (b *CredentialBuilder) AddType(types ...string) *CredentialBuilder {
+	b.extraTypes = append(b.extraTypes, types...)
+	return b
+}
+
+// WithRevocationId sets vc.rid so the card can later be revoked
+func (b *CredentialBuilder) WithRevocationId(rid string) *CredentialBuilder {
+	b.revocationId = rid
+	return b
+}
+
+// Build links the resources into a collection bundle, with the Patient at resource:0, and returns the vc claim
+// ready to pass to Issuer.Issue or IssueCardInput.
+func (b *CredentialBuilder) Build() (map[string]interface{}, error) {
+	types := []string{HEALTH_CARD_TYPE}
+	covid19 := false
+	if len(b.immunizations) > 0 {
+		types = append(types, IMMUNIZATION_TYPE)
+	}
+	if len(b.observations) > 0 {
+		types = append(types, LABORATORY_TYPE)
+	}
+
+	resources := []interface{}{b.patient.resource()}
+	for _, immunization := range b.immunizations {
+		covid19 = covid19 || (immunization.VaccineCode.System == CVX_SYSTEM && covid19VaccineCodes[immunization.VaccineCode.Code])
+		resources = append(resources, immunization.resource("resource:0"))
+	}
+	for _, observation := range b.observations {
+		covid19 = covid19 || (observation.Code.System == LOINC_SYSTEM && covid19LabCodes[observation.Code.Code])
+		resources = append(resources, observation.resource("resource:0"))
+	}
+	if covid19 {
+		types = append(types, COVID19_TYPE)
+	}
+	for _, t := range b.extraTypes {
+		if !containsString(types, t) {
+			types = append(types, t)
+		}
+	}
+	return newCredential(types, resources, b.revocationId)
+}
+
+// NewImmunizationCredential builds the vc claim of an #immunization card for the patient's doses.
+func NewImmunizationCredential(patient Patient, immunizations ...Immunization) (map[string]interface{}, error) {
+	return NewCredentialBuilder(patient).AddImmunization(immunizations...).Build()
+}
+
+// NewLaboratoryCredential builds the vc claim of a #laboratory card for the patient's results. Cards with a
+// SARS-CoV-2 test are also typed #covid19.
+func NewLaboratoryCredential(patient Patient, observations ...Observation) (map[string]interface{}, error) {
+	return NewCredentialBuilder(patient).AddObservation(observations...).Build()
+}
+
+// newCredential links the resources into a collection bundle with resource:N fullUrls and returns the vc claim.
+// The claim is round-tripped through JSON so it has exactly the shape of a parsed card.
+func newCredential(types []string, resources []interface{}, revocationId string) (map[string]interface{}, error) {
+	bundle := fhirBundle{ResourceType: "Bundle", Type: "collection"}
+	for i, resource := range resources {
+		bundle.Entry = append(bundle.Entry, fhirBundleEntry{
+			FullURL:  fmt.Sprintf("resource:%d", i),
+			Resource: resource,
+		})
+	}
+
+	raw, err := json.Marshal(verifiableCredential{
+		Type: types,
+		CredentialSubject: credentialSubject{
+			FHIRVersion: FHIR_VERSION,
+			FHIRBundle:  bundle,
+		},
+		RevocationId: revocationId,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credential: %w", err)
+	}
+	var claim map[string]interface{}
+	if err := json.Unmarshal(raw, &claim); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal credential: %w", err)
+	}
+	return claim, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
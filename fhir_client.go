@@ -0,0 +1,419 @@
+package issuer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const FHIR_JSON_CONTENT_TYPE = "application/fhir+json"
+
+// maxFHIRPages bounds how many search pages are followed for one resource type, so a server that keeps
+// returning a next link cannot stall an issuance run
+const maxFHIRPages = 100
+
+// defaultFHIRResponseBytes is the largest FHIR response read when FHIRClientConfig.MaxResponseBytes is not set
+const defaultFHIRResponseBytes = 8 << 20
+
+type FHIRClientConfig struct {
+	// BaseURL is the FHIR R4 service base, e.g. https://fhir.example.org/r4
+	BaseURL string
+
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+
+	// Header is added to every request, e.g. an Authorization bearer token
+	Header http.Header
+
+	// MaxResponseBytes bounds each response the server sends, so a misbehaving server cannot exhaust memory.
+	// Defaults to 8 MiB.
+	MaxResponseBytes int64
+}
+
+// FetchOptions narrows what is read from the FHIR server.
+type FetchOptions struct {
+	// Since only returns resources changed at or after this time. FHIR search has no _since parameter
+	// (that is the history interaction), so it is sent as _lastUpdated=ge<Since>.
+	Since time.Time
+
+	// SkipObservations leaves out laboratory results, for immunization-only cards
+	SkipObservations bool
+}
+
+// FHIRClient reads a patient's immunizations and laboratory results from a FHIR R4 server so they can be issued
+// as a health card.
+type FHIRClient struct {
+	base     *url.URL
+	client   *http.Client
+	header   http.Header
+	maxBytes int64
+}
+
+func NewFHIRClient(config FHIRClientConfig) (*FHIRClient, error) {
+	if config.BaseURL == "" {
+		return nil, errors.New("FHIR base URL is required")
+	}
+	base, err := url.Parse(strings.TrimSuffix(config.BaseURL, "/") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid FHIR base URL: %w", err)
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.MaxResponseBytes <= 0 {
+		config.MaxResponseBytes = defaultFHIRResponseBytes
+	}
+	return &FHIRClient{base: base, client: config.HTTPClient, header: config.Header, maxBytes: config.MaxResponseBytes}, nil
+}
+
+// PatientRecord is the clinical data read for one patient, already converted into the builder types.
+type PatientRecord struct {
+	Patient       Patient
+	Immunizations []Immunization
+	Observations  []Observation
+}
+
+// Credential builds the minimized vc claim for the record.
+func (r PatientRecord) Credential() (map[string]interface{}, error) {
+	if len(r.Immunizations) == 0 && len(r.Observations) == 0 {
+		return nil, errors.New("patient has no immunizations or laboratory results")
+	}
+	return NewCredentialBuilder(r.Patient).AddImmunization(r.Immunizations...).AddObservation(r.Observations...).Build()
+}
+
+// FetchPatientRecord reads the Patient and searches their Immunization and laboratory Observation resources,
+// following every page of the search results. Resources entered in error are dropped.
+func (c *FHIRClient) FetchPatientRecord(ctx context.Context, patientId string, options FetchOptions) (*PatientRecord, error) {
+	if patientId == "" {
+		return nil, errors.New("patient ID is required")
+	}
+
+	var patient serverPatient
+	if err := c.get(ctx, c.resolve("Patient/"+url.PathEscape(patientId)), &patient); err != nil {
+		return nil, err
+	}
+	if patient.ResourceType != "Patient" {
+		return nil, fmt.Errorf("expected a Patient resource, got %q", patient.ResourceType)
+	}
+	record := &PatientRecord{Patient: patient.convert()}
+
+	query := url.Values{"patient": {patientId}}
+	if !options.Since.IsZero() {
+		query.Set("_lastUpdated", "ge"+options.Since.UTC().Format(time.RFC3339))
+	}
+
+	err := c.search(ctx, "Immunization", query, func(raw json.RawMessage) error {
+		var immunization serverImmunization
+		if err := json.Unmarshal(raw, &immunization); err != nil {
+			return fmt.Errorf("failed to parse Immunization: %w", err)
+		}
+		if cardStatus("Immunization", immunization.Status) {
+			record.Immunizations = append(record.Immunizations, immunization.convert())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !options.SkipObservations {
+		query.Set("category", "laboratory")
+		err = c.search(ctx, "Observation", query, func(raw json.RawMessage) error {
+			var observation serverObservation
+			if err := json.Unmarshal(raw, &observation); err != nil {
+				return fmt.Errorf("failed to parse Observation: %w", err)
+			}
+			if cardStatus("Observation", observation.Status) {
+				record.Observations = append(record.Observations, observation.convert())
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// FetchCredential reads the patient's record and builds the minimized vc claim.
+func (c *FHIRClient) FetchCredential(ctx context.Context, patientId string, options FetchOptions) (map[string]interface{}, error) {
+	record, err := c.FetchPatientRecord(ctx, patientId, options)
+	if err != nil {
+		return nil, err
+	}
+	return record.Credential()
+}
+
+// IssueCard reads the patient's record and signs it with the issuer.
+func (c *FHIRClient) IssueCard(ctx context.Context, issuer *Issuer, patientId string, options FetchOptions) (string, error) {
+	vc, err := c.FetchCredential(ctx, patientId, options)
+	if err != nil {
+		return "", err
+	}
+	return issuer.Issue(ctx, vc)
+}
+
+func (c *FHIRClient) resolve(path string) string {
+	return c.base.ResolveReference(&url.URL{Path: path}).String()
+}
+
+// search runs a search and calls fn with every matching resource, following the bundle's next links
+func (c *FHIRClient) search(ctx context.Context, resourceType string, query url.Values, fn func(json.RawMessage) error) error {
+	next := c.resolve(resourceType) + "?" + query.Encode()
+	for page := 0; next != ""; page++ {
+		if page == maxFHIRPages {
+			return fmt.Errorf("%s search returned more than %d pages", resourceType, maxFHIRPages)
+		}
+
+		var bundle searchBundle
+		if err := c.get(ctx, next, &bundle); err != nil {
+			return err
+		}
+		if bundle.ResourceType != "Bundle" {
+			return fmt.Errorf("expected a Bundle from the %s search, got %q", resourceType, bundle.ResourceType)
+		}
+		for _, entry := range bundle.Entry {
+			// searches may also return included resources and OperationOutcomes
+			var header struct {
+				ResourceType string `json:"resourceType"`
+			}
+			if err := json.Unmarshal(entry.Resource, &header); err != nil {
+				return fmt.Errorf("failed to parse %s search result: %w", resourceType, err)
+			}
+			if header.ResourceType != resourceType {
+				continue
+			}
+			if err := fn(entry.Resource); err != nil {
+				return err
+			}
+		}
+
+		next = ""
+		for _, link := range bundle.Link {
+			if link.Relation == "next" {
+				// next links are usually absolute, but resolve them against the base in case they are not
+				u, err := c.base.Parse(link.URL)
+				if err != nil {
+					return fmt.Errorf("invalid next link %q: %w", link.URL, err)
+				}
+				// the configured header usually holds a bearer token, which must not be sent to another origin
+				if !strings.EqualFold(u.Scheme, c.base.Scheme) || !strings.EqualFold(u.Host, c.base.Host) {
+					return fmt.Errorf("%s search returned a next link to another server: %s://%s", resourceType, u.Scheme, u.Host)
+				}
+				next = u.String()
+			}
+		}
+	}
+	return nil
+}
+
+func (c *FHIRClient) get(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range c.header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Set("Accept", FHIR_JSON_CONTENT_TYPE)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("FHIR request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("FHIR server returned %s for %s: %s", resp.Status, u, strings.TrimSpace(string(body)))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.maxBytes+1))
+	if err != nil {
+		return fmt.Errorf("failed to read FHIR response from %s: %w", u, err)
+	}
+	if int64(len(body)) > c.maxBytes {
+		return fmt.Errorf("FHIR response from %s is larger than %d bytes", u, c.maxBytes)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to parse FHIR response from %s: %w", u, err)
+	}
+	return nil
+}
+
+// ParseFHIRBundle reads a FHIR R4 Bundle holding one Patient and their Immunization and Observation resources,
+// e.g. a $everything export, and keeps only what a card carries. Other resource types are ignored.
+func ParseFHIRBundle(data []byte) (*PatientRecord, error) {
+	var bundle searchBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("failed to parse FHIR bundle: %w", err)
+	}
+	if bundle.ResourceType != "Bundle" {
+		return nil, fmt.Errorf("expected a Bundle, got %q", bundle.ResourceType)
+	}
+
+	record := &PatientRecord{}
+	patients := 0
+	for i, entry := range bundle.Entry {
+		var header struct {
+			ResourceType string `json:"resourceType"`
+			Status       string `json:"status"`
+		}
+		if err := json.Unmarshal(entry.Resource, &header); err != nil {
+			return nil, fmt.Errorf("failed to parse bundle entry %d: %w", i, err)
+		}
+		if !cardStatus(header.ResourceType, header.Status) {
+			continue
+		}
+
+		var err error
+		switch header.ResourceType {
+		case "Patient":
+			var patient serverPatient
+			err = json.Unmarshal(entry.Resource, &patient)
+			record.Patient = patient.convert()
+			patients++
+		case "Immunization":
+			var immunization serverImmunization
+			err = json.Unmarshal(entry.Resource, &immunization)
+			record.Immunizations = append(record.Immunizations, immunization.convert())
+		case "Observation":
+			var observation serverObservation
+			err = json.Unmarshal(entry.Resource, &observation)
+			record.Observations = append(record.Observations, observation.convert())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s in bundle entry %d: %w", header.ResourceType, i, err)
+		}
+	}
+	if patients != 1 {
+		return nil, fmt.Errorf("expected exactly one Patient in the bundle, found %d", patients)
+	}
+	return record, nil
+}
+
+// cardStatus reports whether a resource with this status belongs on a card. An Immunization that is not-done records
+// a dose that was not given, e.g. a refusal, and only a finalized Observation has a result to sign.
+func cardStatus(resourceType string, status string) bool {
+	switch resourceType {
+	case "Immunization":
+		return status != "entered-in-error" && status != "not-done"
+	case "Observation":
+		return status == "final" || status == "amended" || status == "corrected"
+	}
+	return true
+}
+
+type searchBundle struct {
+	ResourceType string `json:"resourceType"`
+	Link         []struct {
+		Relation string `json:"relation"`
+		URL      string `json:"url"`
+	} `json:"link"`
+	Entry []struct {
+		Resource json.RawMessage `json:"resource"`
+	} `json:"entry"`
+}
+
+// the server* types read the fields a card keeps; everything else (ids, meta, narrative, display text) is dropped
+
+type serverPatient struct {
+	ResourceType string `json:"resourceType"`
+	Name         []struct {
+		Use    string   `json:"use"`
+		Family string   `json:"family"`
+		Given  []string `json:"given"`
+	} `json:"name"`
+	BirthDate string `json:"birthDate"`
+}
+
+type serverImmunization struct {
+	Status             string              `json:"status"`
+	VaccineCode        fhirCodeableConcept `json:"vaccineCode"`
+	OccurrenceDateTime string              `json:"occurrenceDateTime"`
+	Performer          []fhirPerformer     `json:"performer"`
+	LotNumber          string              `json:"lotNumber"`
+}
+
+type serverObservation struct {
+	Status               string               `json:"status"`
+	Code                 fhirCodeableConcept  `json:"code"`
+	EffectiveDateTime    string               `json:"effectiveDateTime"`
+	Performer            []fhirReference      `json:"performer"`
+	ValueCodeableConcept *fhirCodeableConcept `json:"valueCodeableConcept"`
+	ValueQuantity        *Quantity            `json:"valueQuantity"`
+	ValueString          string               `json:"valueString"`
+}
+
+func (p serverPatient) convert() Patient {
+	patient := Patient{BirthDate: p.BirthDate}
+	for i, name := range p.Name {
+		// prefer the official name, otherwise the first one
+		if i == 0 || name.Use == "official" {
+			patient.Family = name.Family
+			patient.Given = name.Given
+		}
+		if name.Use == "official" {
+			break
+		}
+	}
+	return patient
+}
+
+func (i serverImmunization) convert() Immunization {
+	immunization := Immunization{
+		VaccineCode:        preferredCoding(i.VaccineCode, CVX_SYSTEM),
+		Status:             i.Status,
+		OccurrenceDateTime: i.OccurrenceDateTime,
+		LotNumber:          i.LotNumber,
+	}
+	for _, performer := range i.Performer {
+		if performer.Actor.Display != "" {
+			immunization.Performer = performer.Actor.Display
+			break
+		}
+	}
+	return immunization
+}
+
+func (o serverObservation) convert() Observation {
+	observation := Observation{
+		Code:              preferredCoding(o.Code, LOINC_SYSTEM),
+		Status:            o.Status,
+		EffectiveDateTime: o.EffectiveDateTime,
+		ValueQuantity:     o.ValueQuantity,
+		ValueString:       o.ValueString,
+	}
+	if o.ValueCodeableConcept != nil && len(o.ValueCodeableConcept.Coding) > 0 {
+		coding := preferredCoding(*o.ValueCodeableConcept, SNOMED_SYSTEM)
+		observation.ValueCoding = &coding
+	}
+	for _, performer := range o.Performer {
+		if performer.Display != "" {
+			observation.Performer = performer.Display
+			break
+		}
+	}
+	return observation
+}
+
+// preferredCoding keeps a single coding, the one from the system the profile expects when there is one
+func preferredCoding(concept fhirCodeableConcept, system string) Coding {
+	for _, coding := range concept.Coding {
+		if coding.System == system {
+			return coding
+		}
+	}
+	if len(concept.Coding) > 0 {
+		return concept.Coding[0]
+	}
+	return Coding{}
+}
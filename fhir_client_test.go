@@ -0,0 +1,218 @@
+package issuer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFHIRStandIn serves a patient with two pages of immunizations, some of them not given, and one lab result
+func newFHIRStandIn(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	write := func(w http.ResponseWriter, resource interface{}) {
+		w.Header().Set("Content-Type", FHIR_JSON_CONTENT_TYPE)
+		_ = json.NewEncoder(w).Encode(resource)
+	}
+	immunization := func(code, date, lot string) map[string]interface{} {
+		return map[string]interface{}{
+			"resourceType": "Immunization",
+			"id":           "imm-" + lot,
+			"meta":         map[string]interface{}{"versionId": "1"},
+			"status":       "completed",
+			"vaccineCode": map[string]interface{}{
+				"coding": []interface{}{
+					map[string]interface{}{"system": NDC_SYSTEM, "code": "80777-273-10"},
+					map[string]interface{}{"system": CVX_SYSTEM, "code": code, "display": "Moderna"},
+				},
+				"text": "COVID-19 vaccine",
+			},
+			"patient":            map[string]interface{}{"reference": "Patient/123"},
+			"occurrenceDateTime": date,
+			"performer":          []interface{}{map[string]interface{}{"actor": map[string]interface{}{"reference": "Organization/1", "display": "ABC General Hospital"}}},
+			"lotNumber":          lot,
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fhir/Patient/123", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		write(w, map[string]interface{}{
+			"resourceType": "Patient",
+			"id":           "123",
+			"name": []interface{}{
+				map[string]interface{}{"use": "nickname", "given": []interface{}{"Johnny"}},
+				map[string]interface{}{"use": "official", "family": "Anyperson", "given": []interface{}{"John", "B."}},
+			},
+			"birthDate": "1951-01-20",
+			"gender":    "male",
+		})
+	})
+	mux.HandleFunc("/fhir/Immunization", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("patient") != "123" || r.URL.Query().Get("_lastUpdated") != "ge2021-01-01T00:00:00Z" {
+			t.Errorf("Unexpected Immunization search: %s", r.URL.RawQuery)
+		}
+		if r.URL.Query().Get("page") == "2" {
+			errored := immunization("207", "2021-01-15", "0000003")
+			errored["status"] = "entered-in-error"
+			refused := immunization("207", "2021-02-26", "0000009")
+			refused["status"] = "not-done"
+			write(w, map[string]interface{}{
+				"resourceType": "Bundle",
+				"type":         "searchset",
+				"entry": []interface{}{
+					map[string]interface{}{"resource": immunization("207", "2021-01-29", "0000007")},
+					map[string]interface{}{"resource": errored},
+					map[string]interface{}{"resource": refused},
+				},
+			})
+			return
+		}
+		write(w, map[string]interface{}{
+			"resourceType": "Bundle",
+			"type":         "searchset",
+			"link":         []interface{}{map[string]interface{}{"relation": "next", "url": server.URL + "/fhir/Immunization?" + r.URL.RawQuery + "&page=2"}},
+			"entry": []interface{}{
+				map[string]interface{}{"resource": immunization("207", "2021-01-01", "0000001")},
+				map[string]interface{}{"resource": map[string]interface{}{"resourceType": "OperationOutcome"}, "search": map[string]interface{}{"mode": "outcome"}},
+			},
+		})
+	})
+	mux.HandleFunc("/fhir/Observation", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("category") != "laboratory" {
+			t.Errorf("Unexpected Observation search: %s", r.URL.RawQuery)
+		}
+		write(w, map[string]interface{}{
+			"resourceType": "Bundle",
+			"type":         "searchset",
+			"entry": []interface{}{
+				map[string]interface{}{"resource": map[string]interface{}{
+					"resourceType":         "Observation",
+					"status":               "final",
+					"code":                 map[string]interface{}{"coding": []interface{}{map[string]interface{}{"system": LOINC_SYSTEM, "code": "94558-4"}}},
+					"subject":              map[string]interface{}{"reference": "Patient/123"},
+					"effectiveDateTime":    "2021-02-17",
+					"valueCodeableConcept": map[string]interface{}{"coding": []interface{}{map[string]interface{}{"system": SNOMED_SYSTEM, "code": "260385009", "display": "Negative"}}},
+					"performer":            []interface{}{map[string]interface{}{"display": "ABC Lab"}},
+				}},
+				map[string]interface{}{"resource": map[string]interface{}{
+					"resourceType":         "Observation",
+					"status":               "preliminary",
+					"code":                 map[string]interface{}{"coding": []interface{}{map[string]interface{}{"system": LOINC_SYSTEM, "code": "94558-4"}}},
+					"subject":              map[string]interface{}{"reference": "Patient/123"},
+					"effectiveDateTime":    "2021-03-01",
+					"valueCodeableConcept": map[string]interface{}{"coding": []interface{}{map[string]interface{}{"system": SNOMED_SYSTEM, "code": "10828004"}}},
+				}},
+			},
+		})
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFHIRClientFetchPatientRecord(t *testing.T) {
+	server := newFHIRStandIn(t)
+	client, err := NewFHIRClient(FHIRClientConfig{
+		BaseURL: server.URL + "/fhir",
+		Header:  http.Header{"Authorization": {"Bearer token"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create FHIR client: %s", err.Error())
+	}
+
+	options := FetchOptions{Since: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	record, err := client.FetchPatientRecord(context.Background(), "123", options)
+	if err != nil {
+		t.Fatalf("Failed to fetch patient record: %s", err.Error())
+	}
+	expected := &PatientRecord{
+		Patient: Patient{Family: "Anyperson", Given: []string{"John", "B."}, BirthDate: "1951-01-20"},
+		Immunizations: []Immunization{
+			{VaccineCode: CVX("207"), Status: "completed", OccurrenceDateTime: "2021-01-01", Performer: "ABC General Hospital", LotNumber: "0000001"},
+			{VaccineCode: CVX("207"), Status: "completed", OccurrenceDateTime: "2021-01-29", Performer: "ABC General Hospital", LotNumber: "0000007"},
+		},
+		Observations: []Observation{
+			{Code: LOINC("94558-4"), Status: "final", EffectiveDateTime: "2021-02-17", ValueCoding: &Coding{System: SNOMED_SYSTEM, Code: "260385009"}, Performer: "ABC Lab"},
+		},
+	}
+	if !reflect.DeepEqual(record, expected) {
+		t.Fatalf("Unexpected record:\n%+v\nexpected:\n%+v", record, expected)
+	}
+
+	// the record is issued as a minimized card that conforms to the profiles
+	issuer, _ := newTestIssuer(t, IssuerOptions{ProfileValidation: ProfileValidationStrict})
+	jws, err := client.IssueCard(context.Background(), issuer, "123", options)
+	if err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+	card, err := DecodeCard(jws)
+	if err != nil {
+		t.Fatalf("Failed to decode card: %s", err.Error())
+	}
+	for _, dropped := range []string{"Patient/123", "Organization/1", "meta", "Negative", NDC_SYSTEM} {
+		if strings.Contains(string(card.Payload), dropped) {
+			t.Fatalf("Expected a minimized bundle without %q, got %s", dropped, card.Payload)
+		}
+	}
+	types := getSlice(card.Card.VerifiableCredential, "type")
+	if len(types) != 4 {
+		t.Fatalf("Expected immunization, laboratory and covid19 types, got %v", types)
+	}
+}
+
+func TestFHIRClientErrors(t *testing.T) {
+	server := newFHIRStandIn(t)
+	client, err := NewFHIRClient(FHIRClientConfig{BaseURL: server.URL + "/fhir/"})
+	if err != nil {
+		t.Fatalf("Failed to create FHIR client: %s", err.Error())
+	}
+	if _, err := client.FetchPatientRecord(context.Background(), "123", FetchOptions{}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Expected an unauthorized error, got %v", err)
+	}
+	limited, _ := NewFHIRClient(FHIRClientConfig{BaseURL: server.URL + "/fhir/", Header: http.Header{"Authorization": {"Bearer token"}}, MaxResponseBytes: 64})
+	if _, err := limited.FetchPatientRecord(context.Background(), "123", FetchOptions{}); err == nil || !strings.Contains(err.Error(), "larger than 64 bytes") {
+		t.Fatalf("Expected an oversized response to be refused, got %v", err)
+	}
+	if _, err := NewFHIRClient(FHIRClientConfig{}); err == nil {
+		t.Fatal("Expected an error without a base URL")
+	}
+}
+
+func TestFHIRClientNextLinkToAnotherServer(t *testing.T) {
+	leaked := false
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = leaked || r.Header.Get("Authorization") != ""
+		w.Header().Set("Content-Type", FHIR_JSON_CONTENT_TYPE)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"resourceType": "Bundle", "type": "searchset"})
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", FHIR_JSON_CONTENT_TYPE)
+		if r.URL.Path == "/fhir/Patient/123" {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"resourceType": "Patient", "id": "123"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"resourceType": "Bundle",
+			"type":         "searchset",
+			"link":         []interface{}{map[string]interface{}{"relation": "next", "url": other.URL + "/fhir/Immunization?page=2"}},
+		})
+	}))
+	defer server.Close()
+
+	client, _ := NewFHIRClient(FHIRClientConfig{BaseURL: server.URL + "/fhir", Header: http.Header{"Authorization": {"Bearer token"}}})
+	if _, err := client.FetchPatientRecord(context.Background(), "123", FetchOptions{}); err == nil || !strings.Contains(err.Error(), "another server") {
+		t.Fatalf("Expected the next link to another server to be refused, got %v", err)
+	}
+	if leaked {
+		t.Fatal("Expected the bearer token not to be sent to another server")
+	}
+}
@@ -0,0 +1,107 @@
+package issuer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestCredentialBuilderMatchesSample(t *testing.T) {
+	patient := Patient{Family: "Anyperson", Given: []string{"John", "B."}, BirthDate: "1951-01-20"}
+	built, err := NewCredentialBuilder(patient).
+		AddImmunization(
+			Immunization{VaccineCode: CVX("207"), OccurrenceDateTime: "2021-01-01", Performer: "ABC General Hospital", LotNumber: "0000001"},
+			Immunization{VaccineCode: CVX("207"), OccurrenceDateTime: "2021-01-29", Performer: "ABC General Hospital", LotNumber: "0000007"},
+		).
+		WithRevocationId("MKyCxh7p6uQ").
+		Build()
+	if err != nil {
+		t.Fatalf("Failed to build credential: %s", err.Error())
+	}
+
+	if sample := sampleVerifiableCredential(t); !reflect.DeepEqual(built, sample) {
+		t.Fatalf("Built credential does not match the sample:\n%v\n%v", built, sample)
+	}
+
+	// a card with both doses and results gets both content types
+	mixed, err := NewCredentialBuilder(patient).
+		AddImmunization(Immunization{VaccineCode: CVX("140"), OccurrenceDateTime: "2021-10-01"}).
+		AddObservation(Observation{Code: LOINC("94309-2"), EffectiveDateTime: "2021-02-17", ValueCoding: &Coding{System: SNOMED_SYSTEM, Code: "260415000"}}).
+		Build()
+	if err != nil {
+		t.Fatalf("Failed to build credential: %s", err.Error())
+	}
+	expected := []string{HEALTH_CARD_TYPE, IMMUNIZATION_TYPE, LABORATORY_TYPE, COVID19_TYPE}
+	if types := stringSlice(mixed["type"]); !reflect.DeepEqual(types, expected) {
+		t.Fatalf("Unexpected credential types: %v", types)
+	}
+	entries := getSlice(getMap(getMap(mixed, "credentialSubject"), "fhirBundle"), "entry")
+	observation := getMap(entries[2].(map[string]interface{}), "resource")
+	if subject := getMap(observation, "subject"); subject["reference"] != "resource:0" {
+		t.Fatalf("Observation is not linked to the patient: %v", subject)
+	}
+
+	// both profiles are checked: the dose has no lot number and the result no performing lab
+	diagnostics := ValidateProfile(mixed)
+	if len(diagnostics.WithCode(CODE_PROFILE_LOT_NUMBER)) != 1 || len(diagnostics.WithCode(CODE_PROFILE_PERFORMER)) != 2 {
+		t.Fatalf("Expected the immunization and laboratory profiles to be checked, got %v", diagnostics)
+	}
+	for _, diagnostic := range diagnostics.WithCode(CODE_PROFILE_PERFORMER) {
+		if diagnostic.Severity != SeverityError {
+			t.Fatalf("Expected a missing performer to be an error, got %v", diagnostic)
+		}
+	}
+}
+
+func TestLaboratoryCredential(t *testing.T) {
+	patient := Patient{Family: "Anyperson", Given: []string{"Jane", "C."}, BirthDate: "1961-01-20"}
+	vc, err := NewLaboratoryCredential(patient,
+		Observation{
+			Code:              LOINC("94558-4"),
+			EffectiveDateTime: "2021-02-17T08:30:00-05:00",
+			ValueCoding:       &Coding{System: SNOMED_SYSTEM, Code: "260385009"},
+			Performer:         "ABC Laboratory",
+		},
+		Observation{
+			Code:              LOINC("94505-5"),
+			EffectiveDateTime: "2021-02-17",
+			ValueQuantity:     &Quantity{Value: 12.5, Unit: "[arb'U]/mL", System: UCUM_SYSTEM, Code: "[arb'U]/mL"},
+			Performer:         "ABC Laboratory",
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to build laboratory credential: %s", err.Error())
+	}
+
+	if types := stringSlice(vc["type"]); len(types) != 3 || types[1] != LABORATORY_TYPE || types[2] != COVID19_TYPE {
+		t.Fatalf("Unexpected credential types: %v", types)
+	}
+	if diagnostics := ValidateProfile(vc); len(diagnostics) != 0 {
+		t.Fatalf("Expected the laboratory credential to conform, got %v", diagnostics)
+	}
+
+	issuer, _ := newTestIssuer(t, IssuerOptions{ProfileValidation: ProfileValidationStrict})
+	jws, err := issuer.Issue(context.Background(), vc)
+	if err != nil {
+		t.Fatalf("Failed to issue laboratory card: %s", err.Error())
+	}
+	report, err := InspectJWS(jws)
+	if err != nil {
+		t.Fatalf("Failed to inspect laboratory card: %s", err.Error())
+	}
+	if summary := report.Resources[1].Summary; summary != "LOINC 94558-4, = SNOMED 260385009, on 2021-02-17T08:30:00-05:00, status final, by ABC Laboratory" {
+		t.Fatalf("Unexpected observation summary: %s", summary)
+	}
+
+	// an observation without a result or LOINC code is rejected
+	invalid, err := NewLaboratoryCredential(patient, Observation{Code: SNOMED("840539006"), EffectiveDateTime: "2021-02-17"})
+	if err != nil {
+		t.Fatalf("Failed to build laboratory credential: %s", err.Error())
+	}
+	diagnostics := ValidateProfile(invalid)
+	for _, code := range []string{CODE_PROFILE_CODE_SYSTEM, CODE_PROFILE_VALUE} {
+		if len(diagnostics.WithCode(code)) == 0 {
+			t.Fatalf("Expected diagnostic %s, got %v", code, diagnostics)
+		}
+	}
+}
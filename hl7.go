@@ -0,0 +1,371 @@
+package issuer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Diagnostic codes reported while mapping HL7 v2 messages
+const (
+	CODE_HL7_SEGMENT    = "hl7-segment"
+	CODE_HL7_FIELD      = "hl7-field"
+	CODE_HL7_DATE       = "hl7-date"
+	CODE_HL7_CODE       = "hl7-code"
+	CODE_HL7_SKIPPED    = "hl7-skipped"
+	CODE_HL7_MESSAGE    = "hl7-message-type"
+	CODE_HL7_PATIENT    = "hl7-patient"
+	CODE_HL7_COMPLETION = "hl7-completion-status"
+)
+
+// CVX 998 is "no vaccine administered", sent with refusals and contraindications
+const CVX_NO_VACCINE_ADMINISTERED = "998"
+
+// VXUMessage is the part of a VXU^V04 message that can be carried on a health card.
+type VXUMessage struct {
+	// ControlId is MSH-10, useful to match diagnostics with the sending system's logs
+	ControlId       string
+	SendingFacility string
+
+	Patient       Patient
+	Immunizations []Immunization
+}
+
+// Credential builds the vc claim for the message's immunizations.
+func (m *VXUMessage) Credential() (map[string]interface{}, error) {
+	if len(m.Immunizations) == 0 {
+		return nil, errors.New("message has no administered immunizations")
+	}
+	return NewImmunizationCredential(m.Patient, m.Immunizations...)
+}
+
+// hl7Encoding holds the delimiters declared in MSH-1 and MSH-2
+type hl7Encoding struct {
+	field, component, repetition, escape, subcomponent byte
+}
+
+type hl7Segment struct {
+	name   string
+	fields []string
+	// index is the 1-based position among segments of the same name, used in diagnostic paths
+	index int
+}
+
+// ParseVXU maps an HL7 v2.5.1 VXU^V04 message, as profiled by the CDC immunization implementation guide, to a
+// Patient and its Immunizations. It accepts the variants seen from real senders: \r, \n or \r\n segment
+// terminators, MLLP framing, a bare VXU message type, CVX or NDC coded vaccines, and the administering
+// facility in either RXA-11.4 or RXA-11.1.
+//
+// An error is returned when the message cannot be used at all. Everything that is present but cannot be put
+// on a card, and every RXA that is skipped, is reported as a diagnostic.
+func ParseVXU(message []byte) (*VXUMessage, Diagnostics, error) {
+	var diagnostics Diagnostics
+	segments, encoding, err := splitHL7(message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msh := segments[0]
+	messageType := strings.Split(msh.field(9), string(encoding.component))
+	if messageType[0] != "VXU" {
+		return nil, nil, fmt.Errorf("expected a VXU message, got %q", msh.field(9))
+	}
+	if len(messageType) < 2 || messageType[1] != "V04" {
+		diagnostics.add(CODE_HL7_MESSAGE, SeverityWarning, "MSH-9", "message type %q should be VXU^V04^VXU_V04", msh.field(9))
+	}
+	vxu := &VXUMessage{
+		ControlId:       msh.field(10),
+		SendingFacility: encoding.unescape(encoding.component1(msh.field(4))),
+	}
+
+	// ORC and RXA repeat as order groups; the ORC only matters for the order control and the RXA that follows it
+	patientSeen := false
+	var orderControl string
+	for _, segment := range segments[1:] {
+		path := fmt.Sprintf("%s[%d]", segment.name, segment.index)
+		switch segment.name {
+		case "PID":
+			if patientSeen {
+				diagnostics.add(CODE_HL7_SEGMENT, SeverityWarning, path, "only the first PID segment is used")
+				continue
+			}
+			patientSeen = true
+			vxu.Patient = encoding.patient(segment, path, &diagnostics)
+		case "ORC":
+			orderControl = segment.field(1)
+		case "RXA":
+			if immunization, ok := encoding.immunization(segment, path, orderControl, &diagnostics); ok {
+				vxu.Immunizations = append(vxu.Immunizations, immunization)
+			}
+			orderControl = ""
+		case "RXR":
+			if segment.field(1) != "" || segment.field(2) != "" {
+				diagnostics.add(CODE_HL7_FIELD, SeverityInfo, path, "route and site are not carried on health cards")
+			}
+		case "PD1", "NK1", "PV1", "PV2", "IN1", "IN2", "IN3", "GT1", "TQ1", "TQ2", "NTE", "SFT":
+			// patient demographics, next of kin, visit, insurance and timing details have no place on a card
+		case "OBX":
+			diagnostics.add(CODE_HL7_SEGMENT, SeverityInfo, path, "observations about the dose (eligibility, VIS, reactions) are not carried on health cards")
+		default:
+			diagnostics.add(CODE_HL7_SEGMENT, SeverityWarning, path, "unexpected segment %s in a VXU message", segment.name)
+		}
+	}
+
+	if !patientSeen {
+		return nil, diagnostics, errors.New("message has no PID segment")
+	}
+	return vxu, diagnostics, nil
+}
+
+// splitHL7 splits the message into segments and reads the delimiters from MSH
+func splitHL7(message []byte) ([]hl7Segment, hl7Encoding, error) {
+	// MLLP wraps a message in VT ... FS CR
+	message = bytes.Trim(message, "\x0b\x1c\r\n\t ")
+	if !bytes.HasPrefix(message, []byte("MSH")) || len(message) < 8 {
+		return nil, hl7Encoding{}, errors.New("message does not start with an MSH segment")
+	}
+	encoding := hl7Encoding{
+		field:        message[3],
+		component:    message[4],
+		repetition:   message[5],
+		escape:       message[6],
+		subcomponent: message[7],
+	}
+
+	var segments []hl7Segment
+	counts := map[string]int{}
+	lines := strings.FieldsFunc(string(message), func(r rune) bool { return r == '\r' || r == '\n' })
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, string(encoding.field))
+		name := fields[0]
+		if name == "MSH" {
+			// MSH-1 is the field separator itself, so MSH fields are shifted by one
+			fields = append([]string{"MSH", string(encoding.field)}, fields[1:]...)
+		}
+		counts[name]++
+		segments = append(segments, hl7Segment{name: name, fields: fields, index: counts[name]})
+	}
+	if counts["MSH"] != 1 {
+		return nil, encoding, errors.New("expected exactly one MSH segment; batches must be split into messages first")
+	}
+	return segments, encoding, nil
+}
+
+// field returns field n (1-based, as in the HL7 tables)
+func (s hl7Segment) field(n int) string {
+	if n < len(s.fields) {
+		return s.fields[n]
+	}
+	return ""
+}
+
+func (e hl7Encoding) repetitions(field string) []string {
+	if field == "" {
+		return nil
+	}
+	return strings.Split(field, string(e.repetition))
+}
+
+// components splits a field into components, padded so that component(n) lookups never go out of range
+func (e hl7Encoding) components(field string, n int) []string {
+	components := strings.Split(field, string(e.component))
+	for len(components) < n {
+		components = append(components, "")
+	}
+	return components
+}
+
+func (e hl7Encoding) component1(field string) string {
+	return e.components(field, 1)[0]
+}
+
+// unescape resolves the \F\ \S\ \T\ \R\ \E\ escape sequences; other escapes (formatting, hex) are dropped
+func (e hl7Encoding) unescape(value string) string {
+	escape := string(e.escape)
+	if !strings.Contains(value, escape) {
+		return value
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(value, escape)
+		if start < 0 {
+			b.WriteString(value)
+			return b.String()
+		}
+		end := strings.Index(value[start+1:], escape)
+		if end < 0 {
+			b.WriteString(value)
+			return b.String()
+		}
+		b.WriteString(value[:start])
+		switch value[start+1 : start+1+end] {
+		case "F":
+			b.WriteByte(e.field)
+		case "S":
+			b.WriteByte(e.component)
+		case "T":
+			b.WriteByte(e.subcomponent)
+		case "R":
+			b.WriteByte(e.repetition)
+		case "E":
+			b.WriteByte(e.escape)
+		}
+		value = value[start+end+2:]
+	}
+}
+
+// patient maps PID-5 (name) and PID-7 (date of birth)
+func (e hl7Encoding) patient(pid hl7Segment, path string, diagnostics *Diagnostics) Patient {
+	var patient Patient
+
+	// prefer the legal name (XPN.7 = L); senders that omit the type send the legal name first
+	names := e.repetitions(pid.field(5))
+	chosen := ""
+	for i, name := range names {
+		if i == 0 || e.components(name, 7)[6] == "L" {
+			chosen = name
+		}
+		if e.components(name, 7)[6] == "L" {
+			break
+		}
+	}
+	if chosen == "" {
+		diagnostics.add(CODE_HL7_PATIENT, SeverityError, path+"-5", "patient name is missing")
+	} else {
+		name := e.components(chosen, 3)
+		patient.Family = e.unescape(e.subcomponent1(name[0]))
+		for _, given := range []string{name[1], name[2]} {
+			if given = strings.TrimSpace(e.unescape(given)); given != "" {
+				patient.Given = append(patient.Given, given)
+			}
+		}
+	}
+
+	birthDate, ok := hl7Date(pid.field(7))
+	if !ok {
+		diagnostics.add(CODE_HL7_PATIENT, SeverityError, path+"-7", "date of birth %q is missing or invalid", pid.field(7))
+	}
+	patient.BirthDate = birthDate
+	return patient
+}
+
+// subcomponent1 returns the first subcomponent; the family name is FN.1 of XPN.1 (surname&own surname prefix...)
+func (e hl7Encoding) subcomponent1(value string) string {
+	return strings.Split(value, string(e.subcomponent))[0]
+}
+
+// immunization maps an RXA. RXAs for deleted records, refusals and doses not administered are skipped.
+func (e hl7Encoding) immunization(rxa hl7Segment, path string, orderControl string, diagnostics *Diagnostics) (Immunization, bool) {
+	if rxa.field(21) == "D" {
+		diagnostics.add(CODE_HL7_SKIPPED, SeverityInfo, path+"-21", "deleted immunization record")
+		return Immunization{}, false
+	}
+	switch rxa.field(20) {
+	case "", "CP", "PA":
+		if rxa.field(20) == "PA" {
+			diagnostics.add(CODE_HL7_COMPLETION, SeverityWarning, path+"-20", "partially administered dose is recorded as completed")
+		}
+	case "RE", "NA":
+		diagnostics.add(CODE_HL7_SKIPPED, SeverityInfo, path+"-20", "dose was not administered (completion status %s)", rxa.field(20))
+		return Immunization{}, false
+	default:
+		diagnostics.add(CODE_HL7_COMPLETION, SeverityWarning, path+"-20", "unknown completion status %q, treated as completed", rxa.field(20))
+	}
+	if orderControl != "" && orderControl != "RE" {
+		diagnostics.add(CODE_HL7_FIELD, SeverityWarning, "ORC-1", "order control %q should be RE for an immunization record", orderControl)
+	}
+
+	coding, ok := e.vaccineCoding(rxa.field(5))
+	if !ok {
+		diagnostics.add(CODE_HL7_CODE, SeverityError, path+"-5", "administered code %q has no CVX or NDC coding", rxa.field(5))
+		return Immunization{}, false
+	}
+	if coding.System == CVX_SYSTEM && coding.Code == CVX_NO_VACCINE_ADMINISTERED {
+		diagnostics.add(CODE_HL7_SKIPPED, SeverityInfo, path+"-5", "no vaccine administered")
+		return Immunization{}, false
+	}
+
+	immunization := Immunization{VaccineCode: coding, Status: "completed"}
+	occurrence, ok := hl7Date(rxa.field(3))
+	if !ok {
+		diagnostics.add(CODE_HL7_DATE, SeverityError, path+"-3", "administration date %q is missing or invalid", rxa.field(3))
+	}
+	immunization.OccurrenceDateTime = occurrence
+
+	// the CDC guide puts the facility in LA2.4 (HD); older senders use LA2.1
+	location := e.components(rxa.field(11), 4)
+	for _, facility := range []string{e.subcomponent1(location[3]), location[0]} {
+		if facility != "" {
+			immunization.Performer = e.unescape(facility)
+			break
+		}
+	}
+	if lots := e.repetitions(rxa.field(15)); len(lots) > 0 {
+		immunization.LotNumber = e.unescape(lots[0])
+		if len(lots) > 1 {
+			diagnostics.add(CODE_HL7_FIELD, SeverityWarning, path+"-15", "only the first of %d lot numbers is kept", len(lots))
+		}
+	}
+	if rxa.field(17) != "" {
+		diagnostics.add(CODE_HL7_FIELD, SeverityInfo, path+"-17", "the manufacturer is implied by the vaccine code and is not carried on health cards")
+	}
+	return immunization, true
+}
+
+// vaccineCoding picks the CVX coding of an RXA-5 CE, falling back to NDC. The coding system may be in either
+// triplet and some senders write HL70292 instead of CVX.
+func (e hl7Encoding) vaccineCoding(field string) (Coding, bool) {
+	components := e.components(field, 6)
+	var ndc string
+	for _, triplet := range [][]string{components[0:3], components[3:6]} {
+		code, system := strings.TrimSpace(triplet[0]), strings.ToUpper(triplet[2])
+		if code == "" {
+			continue
+		}
+		switch system {
+		case "CVX", "HL70292":
+			return Coding{System: CVX_SYSTEM, Code: normalizeCVX(code)}, true
+		case "NDC":
+			if ndc == "" {
+				ndc = code
+			}
+		}
+	}
+	if ndc != "" {
+		return Coding{System: NDC_SYSTEM, Code: ndc}, true
+	}
+	return Coding{}, false
+}
+
+// hl7Date converts an HL7 DTM (YYYY[MM[DD[HHMM[SS[.S]]]]][+/-ZZZZ]) to a FHIR date. Cards only carry the date,
+// which also avoids inventing a time zone for senders that omit it.
+func hl7Date(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if i := strings.IndexAny(value, "+-"); i >= 0 {
+		value = value[:i]
+	}
+	for _, r := range value {
+		if r == '.' {
+			break
+		}
+		if r < '0' || r > '9' {
+			return "", false
+		}
+	}
+	var date string
+	switch {
+	case len(value) >= 8:
+		date = value[0:4] + "-" + value[4:6] + "-" + value[6:8]
+	case len(value) == 6:
+		date = value[0:4] + "-" + value[4:6]
+	case len(value) == 4:
+		date = value
+	default:
+		return "", false
+	}
+	return date, fhirDate.MatchString(date)
+}
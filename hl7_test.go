@@ -0,0 +1,111 @@
+package issuer
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// a VXU in the shape of the CDC implementation guide examples: a historical dose, an administered dose with
+// an NDC alternate code, a refusal and a deleted record
+var sampleVXU = strings.Join([]string{
+	`MSH|^~\&|MYEHR|ABC General Hospital^1234^NPI|IIS||20210205143000-0500||VXU^V04^VXU_V04|NIST-IZ-001.00|P|2.5.1|||ER|AL|||||Z22^CDCPHINVS`,
+	`PID|1||PID001^^^MYEHR^MR||Anyperson^John^B.^^^^L|Smith^^^^^^M|19510120|M`,
+	`PD1|||||||||||02^Reminder/Recall - any method^HL70215|N|20210205`,
+	`ORC|RE||IZ-783274^MYEHR`,
+	`RXA|0|1|20210101||207^COVID-19, mRNA, LNP-S, PF, 100 mcg/0.5mL dose^CVX|999|||01^Historical information^NIP001||||||0000001|||CP|A`,
+	`ORC|RE||IZ-783275^MYEHR`,
+	`RXA|0|1|202101291030-0500||80777-0273-10^Moderna^NDC^207^COVID-19 mRNA^CVX|0.5|mL^mL^UCUM||00^New immunization record^NIP001|7832-1^Doctor^Some|^^^ABC General Hospital||||0000007|20211231|MOD^Moderna US, Inc.^MVX|||CP|A`,
+	`RXR|C28161^Intramuscular^NCIT|RD^Right Deltoid^HL70163`,
+	`OBX|1|CE|64994-7^Vaccine funding program eligibility category^LN|1|V01^Not VFC eligible^HL70064||||||F`,
+	`ORC|RE||9999^MYEHR`,
+	`RXA|0|1|20210301||998^No vaccine administered^CVX|999||||||||||||00^Parental decision^NIP002||RE`,
+	`ORC|RE||IZ-783276^MYEHR`,
+	`RXA|0|1|20210201||207^COVID-19^CVX|999||||||||||||||CP|D`,
+}, "\r")
+
+func TestParseVXU(t *testing.T) {
+	vxu, diagnostics, err := ParseVXU([]byte(sampleVXU))
+	if err != nil {
+		t.Fatalf("Failed to parse VXU: %s", err.Error())
+	}
+	if diagnostics.HasErrors() {
+		t.Fatalf("Unexpected errors: %v", diagnostics)
+	}
+	expected := &VXUMessage{
+		ControlId:       "NIST-IZ-001.00",
+		SendingFacility: "ABC General Hospital",
+		Patient:         Patient{Family: "Anyperson", Given: []string{"John", "B."}, BirthDate: "1951-01-20"},
+		Immunizations: []Immunization{
+			{VaccineCode: CVX("207"), Status: "completed", OccurrenceDateTime: "2021-01-01", LotNumber: "0000001"},
+			{VaccineCode: CVX("207"), Status: "completed", OccurrenceDateTime: "2021-01-29", Performer: "ABC General Hospital", LotNumber: "0000007"},
+		},
+	}
+	if !reflect.DeepEqual(vxu, expected) {
+		t.Fatalf("Unexpected message:\n%+v\nexpected:\n%+v", vxu, expected)
+	}
+	// the refusal and the deleted record are reported, as are the fields a card cannot carry
+	if skipped := diagnostics.WithCode(CODE_HL7_SKIPPED); len(skipped) != 2 || skipped[0].Path != "RXA[3]-20" || skipped[1].Path != "RXA[4]-21" {
+		t.Fatalf("Expected two skipped RXAs, got %v", diagnostics)
+	}
+	if len(diagnostics.WithCode(CODE_HL7_FIELD)) != 2 || len(diagnostics.WithCode(CODE_HL7_SEGMENT)) != 1 {
+		t.Fatalf("Expected RXR, RXA-17 and OBX to be reported, got %v", diagnostics)
+	}
+
+	vc, err := vxu.Credential()
+	if err != nil {
+		t.Fatalf("Failed to build credential: %s", err.Error())
+	}
+	issuer, _ := newTestIssuer(t, IssuerOptions{ProfileValidation: ProfileValidationWarn})
+	_, profile, err := issuer.IssueWithDiagnostics(context.Background(), vc)
+	if err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+	// the historical dose has no performer, which strict mode would refuse
+	for _, diagnostic := range profile {
+		if diagnostic.Severity == SeverityError && diagnostic.Code != CODE_PROFILE_PERFORMER {
+			t.Fatalf("Unexpected profile error: %v", diagnostic)
+		}
+	}
+	if !profile.WithCode(CODE_PROFILE_PERFORMER).HasErrors() {
+		t.Fatalf("Expected the missing performer to be an error, got %v", profile)
+	}
+}
+
+func TestParseVXUVariants(t *testing.T) {
+	// LF terminators, MLLP framing, a bare message type, HL70292 as the code system, facility in LA2.1 and
+	// an escaped separator in the name
+	message := "\x0b" + strings.Join([]string{
+		`MSH|^~\&|CLINIC|Clinic||IIS|20210205||VXU|42|P|2.5.1`,
+		`PID|1||X1||O\S\Brien^Mary||1980`,
+		`RXA|0|1|20210101||3^MMR^HL70292|999|||||Downtown Clinic||||L1~L2|||||PA`,
+	}, "\n") + "\x1c\r"
+
+	vxu, diagnostics, err := ParseVXU([]byte(message))
+	if err != nil {
+		t.Fatalf("Failed to parse VXU: %s", err.Error())
+	}
+	expected := Immunization{VaccineCode: CVX("03"), Status: "completed", OccurrenceDateTime: "2021-01-01", Performer: "Downtown Clinic", LotNumber: "L1"}
+	if len(vxu.Immunizations) != 1 || !reflect.DeepEqual(vxu.Immunizations[0], expected) {
+		t.Fatalf("Unexpected immunizations: %+v", vxu.Immunizations)
+	}
+	if vxu.Patient.Family != "O^Brien" || vxu.Patient.BirthDate != "1980" {
+		t.Fatalf("Unexpected patient: %+v", vxu.Patient)
+	}
+	for _, code := range []string{CODE_HL7_MESSAGE, CODE_HL7_COMPLETION, CODE_HL7_FIELD} {
+		if len(diagnostics.WithCode(code)) != 1 {
+			t.Fatalf("Expected diagnostic %s, got %v", code, diagnostics)
+		}
+	}
+
+	for _, invalid := range []string{
+		"PID|1",
+		`MSH|^~\&|A|B|C|D|20210205||ADT^A01|1|P|2.5.1`,
+		`MSH|^~\&|A|B|C|D|20210205||VXU^V04|1|P|2.5.1` + "\r" + `RXA|0|1|20210101||207^X^CVX`,
+	} {
+		if _, _, err := ParseVXU([]byte(invalid)); err == nil {
+			t.Fatalf("Expected an error for %q", invalid)
+		}
+	}
+}
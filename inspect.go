@@ -0,0 +1,305 @@
+package issuer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// InspectionReport describes every card found in an input without verifying any signatures.
+type InspectionReport struct {
+	// Format is the kind of input the cards were read from: jws, qr or file
+	Format string       `json:"format"`
+	Cards  []CardReport `json:"cards"`
+}
+
+type CardReport struct {
+	Header JWSHeader `json:"header"`
+
+	JWSSize        int `json:"jwsSize"`
+	CompressedSize int `json:"compressedPayloadSize"`
+	PayloadSize    int `json:"payloadSize"`
+	QRChunks       int `json:"qrChunks"`
+	// QRVersions is the QR code version needed by each chunk at the error correction level used by this package
+	QRVersions []int `json:"qrVersions"`
+
+	IssuerURL      string     `json:"iss"`
+	NotBefore      time.Time  `json:"nbf"`
+	ExpirationDate *time.Time `json:"exp,omitempty"`
+	Types          []string   `json:"types"`
+	RevocationId   string     `json:"rid,omitempty"`
+	FHIRVersion    string     `json:"fhirVersion,omitempty"`
+
+	Resources []ResourceSummary `json:"resources"`
+}
+
+type ResourceSummary struct {
+	FullURL      string `json:"fullUrl"`
+	ResourceType string `json:"resourceType"`
+	Summary      string `json:"summary"`
+}
+
+// Inspect decodes a JWS, shc:/ QR text or .smart-health-card file into a report. No key is needed.
+func Inspect(data []byte) (*InspectionReport, error) {
+	cards, err := ExtractJWS(data)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &InspectionReport{Format: inputFormat(data)}
+	for i, jws := range cards {
+		card, err := InspectJWS(jws)
+		if err != nil {
+			return nil, fmt.Errorf("card %d: %w", i+1, err)
+		}
+		report.Cards = append(report.Cards, *card)
+	}
+	return report, nil
+}
+
+// InspectJWS builds the report for a single card.
+func InspectJWS(jws string) (*CardReport, error) {
+	decoded, err := DecodeCard(jws)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CardReport{
+		Header:         decoded.Header,
+		JWSSize:        len(jws),
+		CompressedSize: decoded.CompressedSize,
+		PayloadSize:    len(decoded.Payload),
+		IssuerURL:      decoded.Card.IssuerURL,
+		NotBefore:      time.Unix(int64(decoded.Card.IssuanceDate), 0).UTC(),
+	}
+	if decoded.Card.ExpirationDate != 0 {
+		exp := time.Unix(int64(decoded.Card.ExpirationDate), 0).UTC()
+		report.ExpirationDate = &exp
+	}
+
+	contents := QRContents(jws)
+	report.QRChunks = len(contents)
+	for _, content := range contents {
+		report.QRVersions = append(report.QRVersions, qrVersion(content))
+	}
+
+	vc := decoded.Card.VerifiableCredential
+	report.Types = stringSlice(vc["type"])
+	report.RevocationId = getString(vc, "rid")
+	subject := getMap(vc, "credentialSubject")
+	report.FHIRVersion = getString(subject, "fhirVersion")
+	for _, entry := range getSlice(getMap(subject, "fhirBundle"), "entry") {
+		entryMap, _ := entry.(map[string]interface{})
+		resource := getMap(entryMap, "resource")
+		report.Resources = append(report.Resources, ResourceSummary{
+			FullURL:      getString(entryMap, "fullUrl"),
+			ResourceType: getString(resource, "resourceType"),
+			Summary:      summarizeResource(resource),
+		})
+	}
+	return report, nil
+}
+
+// WriteText writes the report in a human-readable layout.
+func (r *InspectionReport) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Format: %s\n", r.Format)
+	for i, card := range r.Cards {
+		fmt.Fprintf(&b, "\nCard %d of %d\n", i+1, len(r.Cards))
+		fmt.Fprintf(&b, "  Header:      alg=%s kid=%s zip=%s\n", card.Header.Algorithm, card.Header.KeyId, card.Header.Compression)
+		fmt.Fprintf(&b, "  Issuer:      %s\n", card.IssuerURL)
+		fmt.Fprintf(&b, "  Not before:  %s\n", card.NotBefore.Format(time.RFC3339))
+		if card.ExpirationDate != nil {
+			fmt.Fprintf(&b, "  Expires:     %s\n", card.ExpirationDate.Format(time.RFC3339))
+		}
+		fmt.Fprintf(&b, "  Types:       %s\n", strings.Join(card.Types, ", "))
+		if card.RevocationId != "" {
+			fmt.Fprintf(&b, "  rid:         %s\n", card.RevocationId)
+		}
+		fmt.Fprintf(&b, "  Payload:     %d bytes, %d bytes deflated\n", card.PayloadSize, card.CompressedSize)
+		fmt.Fprintf(&b, "  JWS:         %d characters\n", card.JWSSize)
+		fmt.Fprintf(&b, "  QR:          %d chunk(s), versions %s\n", card.QRChunks, joinInts(card.QRVersions))
+		fmt.Fprintf(&b, "  FHIR %s resources:\n", card.FHIRVersion)
+		for _, resource := range card.Resources {
+			fmt.Fprintf(&b, "    %-12s %-13s %s\n", resource.FullURL, resource.ResourceType, resource.Summary)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *InspectionReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func inputFormat(data []byte) string {
+	text := strings.TrimSpace(string(data))
+	switch {
+	case strings.HasPrefix(text, "{"):
+		return "file"
+	case strings.HasPrefix(text, QR_CODE_PREFIX):
+		return "qr"
+	default:
+		return "jws"
+	}
+}
+
+func summarizeResource(resource map[string]interface{}) string {
+	var parts []string
+	add := func(format string, value string) {
+		if value != "" {
+			parts = append(parts, fmt.Sprintf(format, value))
+		}
+	}
+
+	switch getString(resource, "resourceType") {
+	case "Patient":
+		add("%s", patientName(resource))
+		add("born %s", getString(resource, "birthDate"))
+	case "Immunization":
+		add("%s", summarizeCodeableConcept(getMap(resource, "vaccineCode")))
+		add("on %s", getString(resource, "occurrenceDateTime"))
+		add("status %s", getString(resource, "status"))
+		add("lot %s", getString(resource, "lotNumber"))
+		add("by %s", performerDisplay(resource))
+	case "Observation":
+		add("%s", summarizeCodeableConcept(getMap(resource, "code")))
+		add("= %s", observationValue(resource))
+		add("on %s", getString(resource, "effectiveDateTime"))
+		add("status %s", getString(resource, "status"))
+		add("by %s", performerDisplay(resource))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// patientName formats the first name of the patient as "given family"
+func patientName(patient map[string]interface{}) string {
+	names := getSlice(patient, "name")
+	if len(names) == 0 {
+		return ""
+	}
+	name, _ := names[0].(map[string]interface{})
+	if text := getString(name, "text"); text != "" {
+		return text
+	}
+	given := strings.Join(stringSlice(name["given"]), " ")
+	return strings.TrimSpace(given + " " + getString(name, "family"))
+}
+
+func summarizeCodeableConcept(concept map[string]interface{}) string {
+	var codes []string
+	for _, coding := range getSlice(concept, "coding") {
+		codingMap, _ := coding.(map[string]interface{})
+		summary := codeSystemName(getString(codingMap, "system")) + " " + getString(codingMap, "code")
+		if getString(codingMap, "system") == CVX_SYSTEM {
+			summary += cvxDisplay(getString(codingMap, "code"))
+		}
+		codes = append(codes, summary)
+	}
+	if len(codes) == 0 {
+		return getString(concept, "text")
+	}
+	return strings.Join(codes, " / ")
+}
+
+// cvxDisplay names the vaccine and its manufacturers from the CVX and MVX tables
+func cvxDisplay(code string) string {
+	tables := DefaultCodeTables()
+	vaccine, ok := tables.CVX(code)
+	if !ok {
+		return ""
+	}
+	display := " (" + vaccine.ShortDescription
+	var manufacturers []string
+	for _, m := range tables.ManufacturersOf(code) {
+		manufacturers = append(manufacturers, m.Name)
+	}
+	if len(manufacturers) > 0 {
+		display += "; " + strings.Join(manufacturers, ", ")
+	}
+	if vaccine.Status != CVX_STATUS_ACTIVE {
+		display += "; " + vaccine.Status
+	}
+	return display + ")"
+}
+
+func codeSystemName(system string) string {
+	switch system {
+	case "http://hl7.org/fhir/sid/cvx":
+		return "CVX"
+	case "http://loinc.org":
+		return "LOINC"
+	case "http://snomed.info/sct":
+		return "SNOMED"
+	case "http://hl7.org/fhir/sid/ndc":
+		return "NDC"
+	case "http://id.who.int/icd/release/11/mms":
+		return "ICD-11"
+	default:
+		return system
+	}
+}
+
+func observationValue(resource map[string]interface{}) string {
+	if concept := getMap(resource, "valueCodeableConcept"); concept != nil {
+		return summarizeCodeableConcept(concept)
+	}
+	if quantity := getMap(resource, "valueQuantity"); quantity != nil {
+		return strings.TrimSpace(fmt.Sprintf("%v %s", quantity["value"], getString(quantity, "unit")))
+	}
+	return getString(resource, "valueString")
+}
+
+func performerDisplay(resource map[string]interface{}) string {
+	var names []string
+	for _, performer := range getSlice(resource, "performer") {
+		performerMap, _ := performer.(map[string]interface{})
+		// Immunization nests the reference under actor, Observation does not
+		if actor := getMap(performerMap, "actor"); actor != nil {
+			performerMap = actor
+		}
+		if display := getString(performerMap, "display"); display != "" {
+			names = append(names, display)
+		}
+	}
+	return strings.Join(names, "; ")
+}
+
+func joinInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func getMap(m map[string]interface{}, key string) map[string]interface{} {
+	value, _ := m[key].(map[string]interface{})
+	return value
+}
+
+func getSlice(m map[string]interface{}, key string) []interface{} {
+	value, _ := m[key].([]interface{})
+	return value
+}
+
+func getString(m map[string]interface{}, key string) string {
+	value, _ := m[key].(string)
+	return value
+}
+
+func stringSlice(value interface{}) []string {
+	items, _ := value.([]interface{})
+	strs := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
@@ -0,0 +1,53 @@
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInspect(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{ExpiresIn: time.Hour})
+	jws, err := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+	if err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+
+	report, err := Inspect([]byte(strings.Join(QRContents(jws), "\n")))
+	if err != nil {
+		t.Fatalf("Failed to inspect card: %s", err.Error())
+	}
+	if report.Format != "qr" || len(report.Cards) != 1 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	card := report.Cards[0]
+	if card.JWSSize != len(jws) || card.QRChunks != 1 || len(card.QRVersions) != 1 || card.QRVersions[0] == 0 {
+		t.Fatalf("Unexpected size details: %+v", card)
+	}
+	if card.CompressedSize >= card.PayloadSize {
+		t.Fatalf("Expected the payload to shrink when deflated: %d >= %d", card.CompressedSize, card.PayloadSize)
+	}
+	if !card.NotBefore.Equal(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)) || card.ExpirationDate == nil {
+		t.Fatalf("Unexpected dates: %s %v", card.NotBefore, card.ExpirationDate)
+	}
+	if len(card.Types) != 3 || card.RevocationId != "MKyCxh7p6uQ" {
+		t.Fatalf("Unexpected credential details: %v %s", card.Types, card.RevocationId)
+	}
+	if len(card.Resources) != 3 || card.Resources[0].Summary != "John B. Anyperson, born 1951-01-20" {
+		t.Fatalf("Unexpected resources: %+v", card.Resources)
+	}
+	if !strings.Contains(card.Resources[1].Summary, "CVX 207 (COVID-19, mRNA") || !strings.Contains(card.Resources[1].Summary, "Moderna") {
+		t.Fatalf("Immunization summary is missing the vaccine code: %s", card.Resources[1].Summary)
+	}
+
+	var text bytes.Buffer
+	if err = report.WriteText(&text); err != nil {
+		t.Fatalf("Failed to write report: %s", err.Error())
+	}
+	if !strings.Contains(text.String(), "John B. Anyperson") {
+		t.Fatalf("Report is missing the patient:\n%s", text.String())
+	}
+}
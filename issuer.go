@@ -3,13 +3,12 @@ package issuer
 import (
 	"bytes"
 	"compress/flate"
+	"context"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"encoding/json"
 	"fmt"
-	"strconv"
-	"time"
 
-	"github.com/skip2/go-qrcode"
 	"gopkg.in/square/go-jose.v2"
 )
 
@@ -27,6 +26,7 @@ const (
 type SmartHealthCard struct {
 	IssuerURL            string                 `json:"iss"`
 	IssuanceDate         int                    `json:"nbf"`
+	ExpirationDate       int                    `json:"exp,omitempty"`
 	VerifiableCredential map[string]interface{} `json:"vc"`
 }
 
@@ -35,48 +35,74 @@ type IssueCardInput struct {
 	PrivateKey           *ecdsa.PrivateKey
 	KeyId                string
 	VerifiableCredential map[string]interface{}
+
+	// KeySource, when set, supplies the signing key instead of PrivateKey and KeyId (e.g. a Keystore)
+	KeySource KeySource
 }
 
+// IssueCard signs a single card. Services issuing more than one card should create an Issuer once and reuse it.
 func IssueCard(input IssueCardInput) (string, error) {
-	card := SmartHealthCard{
-		IssuerURL:            input.IssuerURL,
-		IssuanceDate:         time.Now().Hour(),
-		VerifiableCredential: input.VerifiableCredential,
+	keySource := input.KeySource
+	if keySource == nil {
+		keySource = StaticKey{PrivateKey: input.PrivateKey, KeyId: input.KeyId}
 	}
 
-	jws, err := card.Sign(input.PrivateKey, input.KeyId)
+	issuer, err := NewIssuer(IssuerConfig{
+		IssuerURL: input.IssuerURL,
+		KeySource: keySource,
+		Options:   IssuerOptions{EmbedJWK: true},
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to sign jws: %s", err.Error())
+		return "", err
 	}
-	return jws.CompactSerialize()
+	return issuer.Issue(context.Background(), input.VerifiableCredential)
 }
 
-// TODO for a health card containing a larger payload, we would need to split the jws into chunks.
+// GenerateQRCode writes the QR code for the JWS to qr.png. Larger cards are split into chunks
 // following the logic from this TCP-provided walkthrough: https://github.com/dvci/health-cards-walkthrough/blob/main/SMART%20Health%20Cards.ipynb
+// and each chunk is written to its own qr-<index>.png file.
 func GenerateQRCode(jws string) error {
-	fmt.Printf("The length of the jws is: %d", len(jws))
-	// before generating to a qr code we need to convert each character to a byte
-	runes := bytes.Runes([]byte(jws))
-	s := QR_CODE_PREFIX
-	for _, r := range runes {
-		nextRune := strconv.Itoa(int(r - LOWEST_VALUED_JWS_ORDINAL_VALUE))
-		if len(nextRune) == 1 {
-			nextRune = "0" + nextRune
+	contents := QRContents(jws)
+	for i, content := range contents {
+		filename := "qr.png"
+		if len(contents) > 1 {
+			filename = fmt.Sprintf("qr-%d.png", i+1)
+		}
+		code, err := newQRCode(content, i+1)
+		if err != nil {
+			return err
+		}
+		if err := code.WriteFile(256, filename); err != nil {
+			return err
 		}
-		s += nextRune
 	}
+	return nil
+}
 
-	if err := qrcode.WriteFile(s, qrcode.Low, 256, "qr.png"); err != nil {
-		return err
+// Sign creates the signed jws. The payload is compressed with CompressionBest unless another Compression is given.
+func (s SmartHealthCard) Sign(key *ecdsa.PrivateKey, keyId string, compression ...Compression) (*jose.JSONWebSignature, error) {
+	signer, err := newCardSigner(key, keyId, true)
+	if err != nil {
+		return nil, &SigningError{KeyId: keyId, Err: err}
 	}
-	return nil
+	encoder := CompressionBest
+	if len(compression) > 0 {
+		encoder = compression[0]
+	}
+	jws, err := s.signWith(signer, encoder)
+	if err != nil {
+		return nil, &SigningError{KeyId: keyId, Err: err}
+	}
+	return jws, nil
 }
 
-// Sign creates the signed jws
-func (s SmartHealthCard) Sign(key *ecdsa.PrivateKey, keyId string) (*jose.JSONWebSignature, error) {
+func newCardSigner(key *ecdsa.PrivateKey, keyId string, embedJWK bool) (jose.Signer, error) {
+	if key == nil || key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%w: cards are signed with P-256 ECDSA keys", ErrInvalidKey)
+	}
 	options := jose.SignerOptions{
 		NonceSource: nil,
-		EmbedJWK:    true,
+		EmbedJWK:    embedJWK,
 		ExtraHeaders: map[jose.HeaderKey]interface{}{
 			"zip": "DEF",
 			"alg": "ES256",
@@ -88,18 +114,21 @@ func (s SmartHealthCard) Sign(key *ecdsa.PrivateKey, keyId string) (*jose.JSONWe
 		Key:       key,
 	}, &options)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new signer using provided key: %s", err.Error())
+		return nil, &KeyError{Message: "failed to create new signer using provided key", Err: err}
 	}
+	return signer, nil
+}
 
+func (s SmartHealthCard) signWith(signer jose.Signer, compression Compression) (*jose.JSONWebSignature, error) {
 	cardBytes, err := json.Marshal(s)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal card into json: %s", err)
+		return nil, &CredentialError{Message: "failed to marshal card into json", Err: err}
 	}
 
 	// now we also need to compress the payload with DEFLATE algorithm
-	deflated, err := deflate(string(cardBytes))
+	deflated, err := deflateWith(string(cardBytes), compression)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compress card bytes: %s", err)
+		return nil, fmt.Errorf("failed to compress card bytes: %w", err)
 	}
 
 	return signer.Sign(deflated)
@@ -0,0 +1,379 @@
+package issuer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	KEYSTORE_VERSION = 1
+
+	// KEYSTORE_KEY_ALGORITHM wraps the content encryption key with a key derived from the passphrase,
+	// so the private JWKs never touch the disk in plaintext.
+	KEYSTORE_KEY_ALGORITHM     = jose.PBES2_HS256_A128KW
+	KEYSTORE_CONTENT_ALGORITHM = jose.A256GCM
+)
+
+// KeySource supplies the private key and key ID that cards get signed with.
+type KeySource interface {
+	SigningKey() (*ecdsa.PrivateKey, string, error)
+}
+
+// StaticKey is a KeySource for a single key held in memory.
+type StaticKey struct {
+	PrivateKey *ecdsa.PrivateKey
+	KeyId      string
+}
+
+func (s StaticKey) SigningKey() (*ecdsa.PrivateKey, string, error) {
+	if s.PrivateKey == nil {
+		return nil, "", fmt.Errorf("%w: no private key provided", ErrInvalidKey)
+	}
+	return s.PrivateKey, s.KeyId, nil
+}
+
+// KeyInfo describes a key held in a Keystore without exposing the private key material.
+type KeyInfo struct {
+	KeyId   string
+	Created time.Time
+	Active  bool
+}
+
+// Keystore holds one or more issuer private keys, each stored on disk as a passphrase-encrypted JWE.
+// The active key is the one handed out to IssueCard; older keys stay in the keystore after a rotation
+// so their public halves can keep being published until every card they signed has been replaced.
+// A Keystore is safe for concurrent use.
+type Keystore struct {
+	path       string
+	passphrase []byte
+
+	// pbes2Count overrides the PBKDF2 iteration count used when encrypting keys. Zero uses the go-jose default.
+	pbes2Count int
+
+	mu     sync.RWMutex
+	active string
+	keys   map[string]*keystoreKey
+}
+
+type keystoreKey struct {
+	key     *ecdsa.PrivateKey
+	created time.Time
+	// sealed is the encrypted form read from disk, kept so unchanged keys are not re-encrypted on Save.
+	sealed string
+}
+
+type keystoreFile struct {
+	Version int             `json:"version"`
+	Active  string          `json:"active,omitempty"`
+	Keys    []keystoreEntry `json:"keys"`
+}
+
+type keystoreEntry struct {
+	KeyId   string `json:"kid"`
+	Created int64  `json:"created"`
+	// JWE is the compact serialization of the encrypted private JWK
+	JWE string `json:"jwe"`
+}
+
+// NewKeystore creates an empty keystore that will be written to path when saved.
+func NewKeystore(path string, passphrase string) (*Keystore, error) {
+	if passphrase == "" {
+		return nil, errors.New("keystore passphrase must not be empty")
+	}
+	return &Keystore{
+		path:       path,
+		passphrase: []byte(passphrase),
+		keys:       map[string]*keystoreKey{},
+	}, nil
+}
+
+// OpenKeystore reads the keystore at path and decrypts every key in it with the passphrase.
+func OpenKeystore(path string, passphrase string) (*Keystore, error) {
+	ks, err := NewKeystore(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+
+	var file keystoreFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse keystore: %w", err)
+	}
+	if file.Version != KEYSTORE_VERSION {
+		return nil, fmt.Errorf("unsupported keystore version %d", file.Version)
+	}
+
+	for _, entry := range file.Keys {
+		key, err := ks.open(entry.JWE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt key %s: %w", entry.KeyId, err)
+		}
+		kid, err := ComputeKeyId(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if kid != entry.KeyId {
+			return nil, fmt.Errorf("key ID %s does not match the thumbprint of the stored key", entry.KeyId)
+		}
+		ks.keys[kid] = &keystoreKey{
+			key:     key,
+			created: time.Unix(entry.Created, 0).UTC(),
+			sealed:  entry.JWE,
+		}
+	}
+
+	if file.Active != "" {
+		if _, ok := ks.keys[file.Active]; !ok {
+			return nil, fmt.Errorf("active key %s is not in the keystore", file.Active)
+		}
+	}
+	ks.active = file.Active
+	return ks, nil
+}
+
+// Path returns the file the keystore is saved to.
+func (k *Keystore) Path() string {
+	return k.path
+}
+
+// AddKey adds an existing private key to the keystore and returns its key ID.
+// The first key added to an empty keystore becomes the active key.
+func (k *Keystore) AddKey(key *ecdsa.PrivateKey) (string, error) {
+	if key == nil || key.Curve != elliptic.P256() {
+		return "", fmt.Errorf("%w: keystore keys must be P-256 ECDSA keys", ErrInvalidKey)
+	}
+	kid, err := ComputeKeyId(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[kid]; ok {
+		return "", fmt.Errorf("key %s is already in the keystore", kid)
+	}
+	k.keys[kid] = &keystoreKey{key: key, created: time.Now().UTC()}
+	if k.active == "" {
+		k.active = kid
+	}
+	return kid, nil
+}
+
+// GenerateKey creates a new P-256 key, adds it to the keystore and returns its key ID.
+func (k *Keystore) GenerateKey() (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return k.AddKey(key)
+}
+
+// Rotate generates a new key and makes it the active signing key.
+// The previously active key is kept so that cards it signed can still be verified.
+func (k *Keystore) Rotate() (string, error) {
+	kid, err := k.GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	if err := k.SetActive(kid); err != nil {
+		return "", err
+	}
+	return kid, nil
+}
+
+// SetActive selects which key is used for signing.
+func (k *Keystore) SetActive(kid string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[kid]; !ok {
+		return fmt.Errorf("key %s is not in the keystore", kid)
+	}
+	k.active = kid
+	return nil
+}
+
+// Remove deletes a key from the keystore. The active key cannot be removed; rotate first.
+func (k *Keystore) Remove(kid string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[kid]; !ok {
+		return fmt.Errorf("key %s is not in the keystore", kid)
+	}
+	if kid == k.active {
+		return fmt.Errorf("key %s is the active key and cannot be removed", kid)
+	}
+	delete(k.keys, kid)
+	return nil
+}
+
+// List returns every key in the keystore, oldest first.
+func (k *Keystore) List() []KeyInfo {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	infos := make([]KeyInfo, 0, len(k.keys))
+	for kid, entry := range k.keys {
+		infos = append(infos, KeyInfo{
+			KeyId:   kid,
+			Created: entry.created,
+			Active:  kid == k.active,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Created.Equal(infos[j].Created) {
+			return infos[i].KeyId < infos[j].KeyId
+		}
+		return infos[i].Created.Before(infos[j].Created)
+	})
+	return infos
+}
+
+// PublicKeys returns the public half of every key in the keystore, keyed by key ID.
+func (k *Keystore) PublicKeys() map[string]*ecdsa.PublicKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make(map[string]*ecdsa.PublicKey, len(k.keys))
+	for kid, entry := range k.keys {
+		keys[kid] = &entry.key.PublicKey
+	}
+	return keys
+}
+
+// SigningKey returns the active key, so a Keystore can be used directly as the KeySource for IssueCard.
+func (k *Keystore) SigningKey() (*ecdsa.PrivateKey, string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.active == "" {
+		return nil, "", errors.New("keystore has no active key")
+	}
+	return k.keys[k.active].key, k.active, nil
+}
+
+// Save encrypts any keys that are not yet encrypted and writes the keystore to disk.
+// The file is replaced atomically and is only readable by the owner.
+func (k *Keystore) Save() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	file := keystoreFile{
+		Version: KEYSTORE_VERSION,
+		Active:  k.active,
+		Keys:    make([]keystoreEntry, 0, len(k.keys)),
+	}
+	for kid, entry := range k.keys {
+		if entry.sealed == "" {
+			sealed, err := k.seal(kid, entry.key)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt key %s: %w", kid, err)
+			}
+			entry.sealed = sealed
+		}
+		file.Keys = append(file.Keys, keystoreEntry{
+			KeyId:   kid,
+			Created: entry.created.Unix(),
+			JWE:     entry.sealed,
+		})
+	}
+	sort.Slice(file.Keys, func(i, j int) bool {
+		return file.Keys[i].KeyId < file.Keys[j].KeyId
+	})
+
+	raw, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal keystore: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(k.path), "."+filepath.Base(k.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create keystore file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to restrict keystore permissions: %w", err)
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write keystore: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write keystore: %w", err)
+	}
+	return os.Rename(tmp.Name(), k.path)
+}
+
+func (k *Keystore) seal(kid string, key *ecdsa.PrivateKey) (string, error) {
+	jwk := jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+	plaintext, err := jwk.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+
+	encrypter, err := jose.NewEncrypter(KEYSTORE_CONTENT_ALGORITHM, jose.Recipient{
+		Algorithm:  KEYSTORE_KEY_ALGORITHM,
+		Key:        k.passphrase,
+		PBES2Count: k.pbes2Count,
+	}, (&jose.EncrypterOptions{}).WithContentType("jwk+json"))
+	if err != nil {
+		return "", err
+	}
+
+	jwe, err := encrypter.Encrypt(plaintext)
+	if err != nil {
+		return "", err
+	}
+	return jwe.CompactSerialize()
+}
+
+func (k *Keystore) open(sealed string) (*ecdsa.PrivateKey, error) {
+	jwe, err := jose.ParseEncrypted(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if jwe.Header.Algorithm != string(KEYSTORE_KEY_ALGORITHM) {
+		return nil, fmt.Errorf("unexpected key wrapping algorithm %s", jwe.Header.Algorithm)
+	}
+
+	plaintext, err := jwe.Decrypt(k.passphrase)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted key")
+	}
+
+	var jwk jose.JSONWebKey
+	if err := jwk.UnmarshalJSON(plaintext); err != nil {
+		return nil, err
+	}
+	key, ok := jwk.Key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: stored key is not an ECDSA private key", ErrInvalidKey)
+	}
+	return key, nil
+}
+
+// ComputeKeyId returns the base64url-encoded SHA-256 JWK thumbprint of the key, which the SMART health card
+// spec requires as the kid of the signing key.
+func ComputeKeyId(pub *ecdsa.PublicKey) (string, error) {
+	jwk := jose.JSONWebKey{Key: pub}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute key thumbprint: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
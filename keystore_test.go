@@ -0,0 +1,110 @@
+package issuer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestKeystore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "issuer.keystore")
+
+	ks, err := NewKeystore(path, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("Failed to create keystore: %s", err.Error())
+	}
+	// keep the test fast, the default PBKDF2 count is deliberately slow
+	ks.pbes2Count = 1000
+
+	firstKid, err := ks.GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err.Error())
+	}
+	if err = ks.Save(); err != nil {
+		t.Fatalf("Failed to save keystore: %s", err.Error())
+	}
+
+	// the private key must not be readable from the file
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read keystore file: %s", err.Error())
+	}
+	if strings.Contains(string(raw), `"d"`) {
+		t.Fatalf("Keystore file contains a plaintext private key: %s", raw)
+	}
+
+	if _, err = OpenKeystore(path, "wrong passphrase"); err == nil {
+		t.Fatalf("Opened the keystore with the wrong passphrase")
+	}
+
+	ks, err = OpenKeystore(path, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("Failed to open keystore: %s", err.Error())
+	}
+	ks.pbes2Count = 1000
+
+	secondKid, err := ks.Rotate()
+	if err != nil {
+		t.Fatalf("Failed to rotate keystore: %s", err.Error())
+	}
+	if secondKid == firstKid {
+		t.Fatalf("Rotation did not produce a new key")
+	}
+	if err = ks.Remove(secondKid); err == nil {
+		t.Fatalf("Removed the active key")
+	}
+
+	keys := ks.List()
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys in the keystore, got %d", len(keys))
+	}
+	for _, info := range keys {
+		if info.Active != (info.KeyId == secondKid) {
+			t.Fatalf("Unexpected active state for key %s", info.KeyId)
+		}
+	}
+
+	if err = ks.Remove(firstKid); err != nil {
+		t.Fatalf("Failed to remove retired key: %s", err.Error())
+	}
+	if err = ks.Save(); err != nil {
+		t.Fatalf("Failed to save keystore: %s", err.Error())
+	}
+
+	ks, err = OpenKeystore(path, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("Failed to reopen keystore: %s", err.Error())
+	}
+	if keys = ks.List(); len(keys) != 1 || keys[0].KeyId != secondKid || !keys[0].Active {
+		t.Fatalf("Unexpected keys after removal: %+v", keys)
+	}
+
+	// the keystore plugs straight into IssueCard
+	var verifiableCredential map[string]interface{}
+	if err := json.Unmarshal([]byte(vc), &verifiableCredential); err != nil {
+		t.Fatalf("Failed to unmarshal fhir json: %s", err.Error())
+	}
+	jws, err := IssueCard(IssueCardInput{
+		IssuerURL:            "https://smarthealth.cards/examples/issuer",
+		KeySource:            ks,
+		VerifiableCredential: verifiableCredential,
+	})
+	if err != nil {
+		t.Fatalf("Failed to issue card from keystore: %s", err.Error())
+	}
+
+	card, err := jose.ParseSigned(jws)
+	if err != nil {
+		t.Fatalf("Failed to parse signed JWS: %s", err.Error())
+	}
+	if kid := card.Signatures[0].Header.KeyID; kid != secondKid {
+		t.Fatalf("Card was signed with key %s, expected %s", kid, secondKid)
+	}
+	if _, err = card.Verify(ks.PublicKeys()[secondKid]); err != nil {
+		t.Fatalf("Failed to verify card signed from keystore: %s", err.Error())
+	}
+}
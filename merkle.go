@@ -0,0 +1,255 @@
+package issuer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// The hashing of RFC 6962 (Certificate Transparency), section 2.1: leaves and interior nodes get different prefixes
+// so a leaf can never be passed off as a node.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// InclusionProof shows that the leaf at LeafIndex is in the tree of TreeSize leaves.
+type InclusionProof struct {
+	LeafIndex uint64   `json:"leaf_index"`
+	TreeSize  uint64   `json:"tree_size"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+// ConsistencyProof shows that the tree of First leaves is a prefix of the tree of Second leaves, i.e. that nothing
+// logged before was changed or removed.
+type ConsistencyProof struct {
+	First       uint64   `json:"first"`
+	Second      uint64   `json:"second"`
+	Consistency [][]byte `json:"consistency"`
+}
+
+// MerkleLeafHash returns the hash of a leaf as it appears in the tree.
+func MerkleLeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleSplit returns the largest power of two smaller than n, where the tree of n > 1 leaves is split
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// merkleRoot is MTH of RFC 6962 over leaf hashes
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// merklePath is PATH of RFC 6962: the siblings needed to recompute the root from the leaf at index m
+func merklePath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return [][]byte{}
+	}
+	k := merkleSplit(len(leaves))
+	if m < k {
+		return append(merklePath(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// merkleSubproof is SUBPROOF of RFC 6962, proving the first m leaves consistent with all of them
+func merkleSubproof(m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{merkleRoot(leaves)}
+	}
+	k := merkleSplit(n)
+	if m <= k {
+		return append(merkleSubproof(m, leaves[:k], complete), merkleRoot(leaves[k:]))
+	}
+	return append(merkleSubproof(m-k, leaves[k:], false), merkleRoot(leaves[:k]))
+}
+
+// merkleTree holds the leaf hashes of a log together with the hash of every complete subtree, so the root and proofs
+// of any tree size take O(log² n) hashes instead of rehashing every leaf.
+type merkleTree struct {
+	// levels[h][i] is the hash of the subtree of leaves i<<h up to (i+1)<<h
+	levels [][][]byte
+}
+
+func (t *merkleTree) append(leaf []byte) {
+	if len(t.levels) == 0 {
+		t.levels = [][][]byte{nil}
+	}
+	t.levels[0] = append(t.levels[0], leaf)
+	for h := 0; len(t.levels[h])%2 == 0; h++ {
+		if h+1 == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		n := len(t.levels[h])
+		t.levels[h+1] = append(t.levels[h+1], merkleNodeHash(t.levels[h][n-2], t.levels[h][n-1]))
+	}
+}
+
+func (t *merkleTree) size() int {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return len(t.levels[0])
+}
+
+// root is merkleRoot of the n leaves from start
+func (t *merkleTree) root(start, n int) []byte {
+	if n == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	if n&(n-1) == 0 && start%n == 0 {
+		return t.levels[bits.TrailingZeros(uint(n))][start/n]
+	}
+	k := merkleSplit(n)
+	return merkleNodeHash(t.root(start, k), t.root(start+k, n-k))
+}
+
+// path is merklePath of the leaf at index m among the n leaves from start
+func (t *merkleTree) path(m, start, n int) [][]byte {
+	if n <= 1 {
+		return [][]byte{}
+	}
+	k := merkleSplit(n)
+	if m < k {
+		return append(t.path(m, start, k), t.root(start+k, n-k))
+	}
+	return append(t.path(m-k, start+k, n-k), t.root(start, k))
+}
+
+// subproof is merkleSubproof of the first m of the n leaves from start
+func (t *merkleTree) subproof(m, start, n int, complete bool) [][]byte {
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{t.root(start, n)}
+	}
+	k := merkleSplit(n)
+	if m <= k {
+		return append(t.subproof(m, start, k, complete), t.root(start+k, n-k))
+	}
+	return append(t.subproof(m-k, start+k, n-k, false), t.root(start, k))
+}
+
+// Verify checks that the proof leads from the leaf hash to the root of a tree of p.TreeSize leaves.
+func (p *InclusionProof) Verify(leafHash []byte, root []byte) error {
+	if p.LeafIndex >= p.TreeSize {
+		return fmt.Errorf("leaf %d is outside a tree of %d leaves", p.LeafIndex, p.TreeSize)
+	}
+	fn, sn := p.LeafIndex, p.TreeSize-1
+	r := leafHash
+	for _, sibling := range p.AuditPath {
+		if sn == 0 {
+			return errors.New("inclusion proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(sibling, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("inclusion proof is too short")
+	}
+	if !bytes.Equal(r, root) {
+		return errors.New("inclusion proof does not lead to the root hash")
+	}
+	return nil
+}
+
+// Verify checks that the tree with firstRoot is a prefix of the tree with secondRoot.
+func (p *ConsistencyProof) Verify(firstRoot []byte, secondRoot []byte) error {
+	switch {
+	case p.First > p.Second:
+		return fmt.Errorf("a tree of %d leaves cannot follow one of %d", p.Second, p.First)
+	case p.First == p.Second:
+		if len(p.Consistency) != 0 || !bytes.Equal(firstRoot, secondRoot) {
+			return errors.New("trees of the same size must have the same root and an empty proof")
+		}
+		return nil
+	case p.First == 0:
+		// the empty tree is a prefix of every tree
+		if len(p.Consistency) != 0 {
+			return errors.New("consistency proof from the empty tree must be empty")
+		}
+		return nil
+	}
+
+	path := p.Consistency
+	if p.First&(p.First-1) == 0 {
+		// the first tree is a complete subtree of the second, so its root starts the path
+		path = append([][]byte{firstRoot}, path...)
+	}
+	if len(path) == 0 {
+		return errors.New("consistency proof is empty")
+	}
+	fn, sn := p.First-1, p.Second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return errors.New("consistency proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = merkleNodeHash(c, fr)
+			sr = merkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("consistency proof is too short")
+	}
+	if !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return errors.New("consistency proof does not lead to the root hashes")
+	}
+	return nil
+}
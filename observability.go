@@ -0,0 +1,152 @@
+package issuer
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Logger receives the package's log records: a message and alternating keys and values. Records never hold the
+// contents of a card, only sizes, key IDs and outcomes.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// NewStdLogger writes records to a standard library logger, or to the log package's default logger when it is nil,
+// as "LEVEL msg key=value ...". Debug records are dropped unless debug is set.
+func NewStdLogger(logger *log.Logger, debug bool) Logger {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &stdLogger{logger: logger, debug: debug}
+}
+
+type stdLogger struct {
+	logger *log.Logger
+	debug  bool
+}
+
+func (l *stdLogger) Debug(msg string, keyvals ...interface{}) {
+	if l.debug {
+		l.print("DEBUG", msg, keyvals)
+	}
+}
+
+func (l *stdLogger) Info(msg string, keyvals ...interface{}) {
+	l.print("INFO", msg, keyvals)
+}
+
+func (l *stdLogger) Error(msg string, keyvals ...interface{}) {
+	l.print("ERROR", msg, keyvals)
+}
+
+func (l *stdLogger) print(level string, msg string, keyvals []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		text := fmt.Sprint(value)
+		if strings.ContainsAny(text, " \"=") {
+			text = fmt.Sprintf("%q", text)
+		}
+		fmt.Fprintf(&b, " %v=%s", keyvals[i], text)
+	}
+	_ = l.logger.Output(3, b.String())
+}
+
+// Operation is a unit of work reported to Instrumentation.
+type Operation string
+
+const (
+	OperationIssue  Operation = "issue"
+	OperationQR     Operation = "qr"
+	OperationVerify Operation = "verify"
+)
+
+// Reasons an operation failed, reported in Measurement.FailureReason. Verifications that do not end valid report
+// their verdict instead.
+const (
+	FAILURE_CANCELED           = "canceled"
+	FAILURE_INVALID_CREDENTIAL = "invalid-credential"
+	FAILURE_PROFILE_VALIDATION = "profile-validation"
+	FAILURE_SIGNING            = "signing"
+	FAILURE_TRANSPARENCY       = "transparency"
+	FAILURE_AUDIT              = "audit"
+	FAILURE_QR_ENCODING        = "qr-encoding"
+)
+
+// Measurement describes a finished operation.
+type Measurement struct {
+	Operation Operation
+	Duration  time.Duration
+	KeyId     string
+
+	// JWSBytes is the length of the compact JWS and PayloadBytes the length of its compressed payload
+	JWSBytes     int
+	PayloadBytes int
+	// Chunks is the number of QR codes the card takes, or was scanned from
+	Chunks int
+
+	// FailureReason is empty when the operation succeeded
+	FailureReason string
+	Err           error
+}
+
+// Instrumentation is the hook for metrics and tracing. Start is called as an operation begins; the context it
+// returns is used for the rest of the operation, so a tracer can carry a span in it, and the function it returns is
+// called exactly once with the outcome.
+type Instrumentation interface {
+	Start(ctx context.Context, operation Operation) (context.Context, func(Measurement))
+}
+
+// InstrumentationFunc adapts a function receiving finished measurements to Instrumentation, which is all most
+// metrics libraries need.
+type InstrumentationFunc func(ctx context.Context, measurement Measurement)
+
+func (f InstrumentationFunc) Start(ctx context.Context, operation Operation) (context.Context, func(Measurement)) {
+	return ctx, func(measurement Measurement) {
+		f(ctx, measurement)
+	}
+}
+
+type nopInstrumentation struct{}
+
+func (nopInstrumentation) Start(ctx context.Context, operation Operation) (context.Context, func(Measurement)) {
+	return ctx, func(Measurement) {}
+}
+
+// observe starts an operation and returns the function that reports it, filling in its duration
+func observe(ctx context.Context, instrumentation Instrumentation, operation Operation) (context.Context, func(Measurement)) {
+	started := time.Now()
+	ctx, done := instrumentation.Start(ctx, operation)
+	return ctx, func(measurement Measurement) {
+		measurement.Operation = operation
+		measurement.Duration = time.Since(started)
+		done(measurement)
+	}
+}
+
+// jwsPayloadSize returns the length of the decoded payload segment of a compact JWS
+func jwsPayloadSize(jws string) int {
+	parts := strings.Split(jws, ".")
+	if len(parts) != 3 {
+		return 0
+	}
+	return base64.RawURLEncoding.DecodedLen(len(parts[1]))
+}
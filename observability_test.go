@@ -0,0 +1,141 @@
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+type traceKey struct{}
+
+// recorder collects measurements, and marks the context it hands back the way a tracer would
+type recorder struct {
+	measurements []Measurement
+}
+
+func (r *recorder) Start(ctx context.Context, operation Operation) (context.Context, func(Measurement)) {
+	return context.WithValue(ctx, traceKey{}, operation), func(measurement Measurement) {
+		r.measurements = append(r.measurements, measurement)
+	}
+}
+
+func (r *recorder) last() Measurement {
+	return r.measurements[len(r.measurements)-1]
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(log.New(&buf, "", 0), false)
+	logger.Debug("dropped", "a", 1)
+	logger.Info("card issued", "kid", "abc", "reason", "two words", "odd")
+	logger.Error("failed", "error", errors.New(`bad "value"`))
+	expected := "INFO card issued kid=abc reason=\"two words\" odd=(missing)\nERROR failed error=\"bad \\\"value\\\"\"\n"
+	if buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	NewStdLogger(log.New(&buf, "", 0), true).Debug("kept")
+	if buf.String() != "DEBUG kept\n" {
+		t.Fatalf("Expected the debug record, got %q", buf.String())
+	}
+}
+
+func TestIssuerInstrumentation(t *testing.T) {
+	var logs bytes.Buffer
+	hooks := &recorder{}
+	test, _ := newTestIssuer(t, IssuerOptions{})
+	traced := false
+	audit := AuditSinkFunc(func(ctx context.Context, event AuditEvent) error {
+		traced = ctx.Value(traceKey{}) == OperationIssue
+		return nil
+	})
+	issuer, _ := NewIssuer(IssuerConfig{
+		IssuerURL:       test.IssuerURL(),
+		KeySource:       test.keys,
+		Audit:           audit,
+		Logger:          NewStdLogger(log.New(&logs, "", 0), true),
+		Instrumentation: hooks,
+		Options:         IssuerOptions{ProfileValidation: ProfileValidationStrict},
+	})
+
+	jws, err := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+	if err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+	issued := hooks.last()
+	if issued.Operation != OperationIssue || issued.KeyId == "" || issued.JWSBytes != len(jws) || issued.PayloadBytes == 0 ||
+		issued.Chunks != 1 || issued.FailureReason != "" || issued.Duration <= 0 {
+		t.Fatalf("Unexpected issue measurement %+v", issued)
+	}
+	if !traced {
+		t.Fatal("Expected the instrumentation's context to reach the audit sink")
+	}
+
+	if _, err := issuer.QRCodes(jws); err != nil {
+		t.Fatalf("Failed to render QR codes: %s", err.Error())
+	}
+	if qr := hooks.last(); qr.Operation != OperationQR || qr.Chunks != 1 || qr.JWSBytes != len(jws) {
+		t.Fatalf("Unexpected QR measurement %+v", qr)
+	}
+
+	invalid := sampleVerifiableCredential(t)
+	patient := getMap(invalid, "credentialSubject")["fhirBundle"].(map[string]interface{})["entry"].([]interface{})[0].(map[string]interface{})
+	getMap(patient, "resource")["birthDate"] = "01/20/1951"
+	if _, err := issuer.Issue(context.Background(), invalid); err == nil {
+		t.Fatal("Expected the invalid credential to be refused")
+	}
+	if failed := hooks.last(); failed.FailureReason != FAILURE_PROFILE_VALIDATION || failed.Err == nil {
+		t.Fatalf("Unexpected failure measurement %+v", failed)
+	}
+
+	if !strings.Contains(logs.String(), "DEBUG card issued") || !strings.Contains(logs.String(), "codes="+CODE_PROFILE_BIRTH_DATE) {
+		t.Fatalf("Unexpected logs:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "Anyperson") || strings.Contains(logs.String(), "1951") {
+		t.Fatalf("Expected no health data in the logs:\n%s", logs.String())
+	}
+}
+
+func TestVerifierInstrumentation(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	jws, _ := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+	hooks := &recorder{}
+	verifier, _ := NewVerifier(VerifierConfig{Trust: NewTrustDirectory(), Instrumentation: hooks})
+
+	if _, err := verifier.Verify([]byte(strings.Join(QRContents(jws), "\n"))); err != nil {
+		t.Fatalf("Failed to verify card: %s", err.Error())
+	}
+	if verified := hooks.last(); verified.Operation != OperationVerify || verified.FailureReason != string(VerdictUntrusted) ||
+		verified.Chunks != 1 || verified.JWSBytes != len(jws) {
+		t.Fatalf("Unexpected verify measurement %+v", verified)
+	}
+	_, _ = verifier.Verify([]byte("not a card"))
+	if hooks.last().FailureReason != string(VerdictInvalid) || hooks.last().Err == nil {
+		t.Fatalf("Expected an invalid measurement, got %+v", hooks.last())
+	}
+}
+
+func TestGenerateQRCodeIsQuiet(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	jws, _ := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err := GenerateQRCode(jws)
+	os.Stdout = stdout
+	w.Close()
+	printed, _ := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to generate QR code: %s", err.Error())
+	}
+	if len(printed) != 0 {
+		t.Fatalf("Expected nothing on stdout, got %q", printed)
+	}
+}
@@ -0,0 +1,483 @@
+package issuer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// PaperSize is a page size in PDF points (1/72 inch).
+type PaperSize struct {
+	Width, Height float64
+}
+
+var (
+	PaperLetter = PaperSize{Width: 612, Height: 792}
+	PaperA4     = PaperSize{Width: 595.28, Height: 841.89}
+)
+
+type PDFLayout string
+
+const (
+	// PDFLayoutPage prints the summary and every QR code on full pages
+	PDFLayoutPage PDFLayout = "page"
+	// PDFLayoutWallet prints credit card sized panels with crop marks: a summary panel and one panel per QR code
+	PDFLayoutWallet PDFLayout = "wallet"
+)
+
+const (
+	pointsPerInch = 72.0
+
+	// QR codes are printed at a fixed physical size so that each module stays large enough for phone cameras and
+	// office printers: a 3 chunk card at version 22 still has 0.4 mm modules on a wallet card
+	pageQRSize   = 2.5 * pointsPerInch
+	walletQRSize = 1.85 * pointsPerInch
+
+	// ISO/IEC 7810 ID-1, the size of a credit card
+	walletWidth  = 3.375 * pointsPerInch
+	walletHeight = 2.125 * pointsPerInch
+)
+
+type PDFOptions struct {
+	// Paper defaults to US Letter
+	Paper PaperSize
+	// Layout defaults to PDFLayoutPage
+	Layout PDFLayout
+	// JWKS is the issuer's key set, used to print whether the signature was verified
+	JWKS *jose.JSONWebKeySet
+}
+
+// RenderPDF writes a printable PDF of the card. The PDF is produced without external tools or fonts: text uses
+// the standard Helvetica fonts and the QR codes are drawn as vector squares, so they stay sharp at any size.
+func RenderPDF(w io.Writer, card *DecodedCard, options PDFOptions) error {
+	if options.Paper == (PaperSize{}) {
+		options.Paper = PaperLetter
+	}
+	if options.Layout == "" {
+		options.Layout = PDFLayoutPage
+	}
+
+	view, err := NewCardView(card, RenderOptions{JWKS: options.JWKS})
+	if err != nil {
+		return err
+	}
+	contents := QRContents(card.JWS())
+	bitmaps := make([][][]bool, len(contents))
+	for i, content := range contents {
+		code, err := newQRCode(content, i+1)
+		if err != nil {
+			return err
+		}
+		bitmaps[i] = code.Bitmap()
+	}
+
+	doc := &pdfDocument{paper: options.Paper}
+	switch options.Layout {
+	case PDFLayoutPage:
+		layoutPDFPages(doc, view, bitmaps)
+	case PDFLayoutWallet:
+		layoutPDFWallet(doc, view, bitmaps)
+	default:
+		return fmt.Errorf("unknown PDF layout %q", options.Layout)
+	}
+	return doc.write(w)
+}
+
+func layoutPDFPages(doc *pdfDocument, view *CardView, bitmaps [][][]bool) {
+	const margin = 0.75 * pointsPerInch
+	width := doc.paper.Width - 2*margin
+	page := doc.newPage()
+	y := margin
+
+	// line writes wrapped text and moves down; it starts a new page when the text would run off this one
+	line := func(text string, size float64, bold bool, gap float64) {
+		for _, wrapped := range wrapPDFText(text, size, bold, width) {
+			if y+size > doc.paper.Height-margin {
+				page = doc.newPage()
+				y = margin
+			}
+			y += size
+			page.text(margin, y, size, bold, wrapped)
+			y += size * 0.35
+		}
+		y += gap
+	}
+
+	line("SMART Health Card", 22, true, 10)
+	line("Name: "+orDefault(view.PatientName, "Not recorded"), 12, false, 0)
+	line("Date of birth: "+orDefault(view.BirthDate, "Not recorded"), 12, false, 14)
+
+	if len(view.Immunizations) > 0 {
+		line("Immunizations", 14, true, 4)
+		for _, dose := range view.Immunizations {
+			line(dose.Vaccine, 11, true, 0)
+			line(joinNonEmpty(" | ", "Date "+dose.Date, dose.Code, prefixed("Manufacturer ", dose.Manufacturer),
+				prefixed("Lot ", dose.LotNumber), prefixed("Administered by ", dose.Performer)), 10, false, 6)
+		}
+		y += 8
+	}
+	if len(view.Observations) > 0 {
+		line("Laboratory results", 14, true, 4)
+		for _, observation := range view.Observations {
+			line(observation.Test, 11, true, 0)
+			line(joinNonEmpty(" | ", prefixed("Result ", observation.Result), prefixed("Date ", observation.Date),
+				prefixed("Performed by ", observation.Performer)), 10, false, 6)
+		}
+		y += 8
+	}
+
+	line("Issued by "+view.IssuerURL+" on "+view.IssuedAt.Format("January 2, 2006"), 10, false, 0)
+	if view.Expires != nil {
+		line("Expires on "+view.Expires.Format("January 2, 2006"), 10, false, 0)
+	}
+	line(signatureText(view), 10, false, 18)
+
+	// QR codes in a grid, each with its chunk label underneath
+	const gap = 24.0
+	const label = 14.0
+	columns := int((width + gap) / (pageQRSize + gap))
+	if columns < 1 {
+		columns = 1
+	}
+	for i, bitmap := range bitmaps {
+		column := i % columns
+		if column == 0 && i > 0 {
+			y += pageQRSize + label + gap
+		}
+		if y+pageQRSize+label > doc.paper.Height-margin {
+			page = doc.newPage()
+			y = margin
+		}
+		x := margin + float64(column)*(pageQRSize+gap)
+		page.qr(x, y, pageQRSize, bitmap)
+		page.text(x, y+pageQRSize+label, 10, false, chunkLabel(i, len(bitmaps)))
+	}
+	if len(bitmaps) > 1 {
+		y += pageQRSize + label + gap
+		if y+10 > doc.paper.Height-margin {
+			page = doc.newPage()
+			y = margin
+		}
+		page.text(margin, y+10, 10, false, fmt.Sprintf("Scan all %d QR codes, in any order.", len(bitmaps)))
+	}
+}
+
+func layoutPDFWallet(doc *pdfDocument, view *CardView, bitmaps [][][]bool) {
+	const padding = 10.0
+	columns := int(doc.paper.Width / walletWidth)
+	rows := int((doc.paper.Height - 36) / walletHeight)
+	if columns > 2 {
+		columns = 2
+	}
+	left := (doc.paper.Width - float64(columns)*walletWidth) / 2
+	top := (doc.paper.Height - float64(rows)*walletHeight) / 2
+
+	var page *pdfPage
+	panels := 0
+	// panel returns the top left corner of the next panel, with its crop marks drawn
+	panel := func() (float64, float64) {
+		if panels%(columns*rows) == 0 {
+			page = doc.newPage()
+		}
+		index := panels % (columns * rows)
+		panels++
+		x := left + float64(index%columns)*walletWidth
+		y := top + float64(index/columns)*walletHeight
+		page.cropMarks(x, y, walletWidth, walletHeight)
+		return x, y
+	}
+
+	// summary panel: doses are truncated to one line each
+	x, y := panel()
+	width := walletWidth - 2*padding
+	cursor := y + padding
+	text := func(s string, size float64, bold bool) {
+		cursor += size
+		page.text(x+padding, cursor, size, bold, truncatePDFText(s, size, bold, width))
+		cursor += size * 0.3
+	}
+	text("SMART Health Card", 10, true)
+	text(orDefault(view.PatientName, "Name not recorded"), 9, true)
+	text("Date of birth "+orDefault(view.BirthDate, "not recorded"), 7, false)
+	cursor += 3
+
+	lines := make([]string, 0, len(view.Immunizations)+len(view.Observations))
+	for _, dose := range view.Immunizations {
+		lines = append(lines, joinNonEmpty("  ", dose.Date, dose.Vaccine, prefixed("Lot ", dose.LotNumber)))
+	}
+	for _, observation := range view.Observations {
+		lines = append(lines, joinNonEmpty("  ", observation.Date, observation.Test, observation.Result))
+	}
+	footer := y + walletHeight - padding - 2*6.5
+	for i, l := range lines {
+		if cursor+2*6.5 > footer && i < len(lines)-1 {
+			text(fmt.Sprintf("+ %d more, see the QR code", len(lines)-i), 6.5, false)
+			break
+		}
+		text(l, 6.5, false)
+	}
+	cursor = footer
+	text("Issued by "+view.IssuerURL, 5.5, false)
+	text(view.IssuedAt.Format("2006-01-02")+"  "+signatureText(view), 5.5, false)
+
+	// one panel per QR code, with the label beside it
+	for i, bitmap := range bitmaps {
+		x, y := panel()
+		qrTop := y + (walletHeight-walletQRSize)/2
+		page.qr(x+padding, qrTop, walletQRSize, bitmap)
+
+		labelX := x + padding + walletQRSize + padding
+		labelWidth := walletWidth - walletQRSize - 3*padding
+		cursor := qrTop + 8
+		page.text(labelX, cursor, 8, true, chunkLabel(i, len(bitmaps)))
+		cursor += 6
+		for _, l := range wrapPDFText("Scan with a SMART Health Card verifier app.", 6.5, false, labelWidth) {
+			cursor += 8
+			page.text(labelX, cursor, 6.5, false, l)
+		}
+		if len(bitmaps) > 1 {
+			for _, l := range wrapPDFText(fmt.Sprintf("Scan all %d codes, in any order.", len(bitmaps)), 6.5, false, labelWidth) {
+				cursor += 8
+				page.text(labelX, cursor, 6.5, false, l)
+			}
+		}
+	}
+}
+
+func chunkLabel(index, total int) string {
+	if total == 1 {
+		return "QR code"
+	}
+	return fmt.Sprintf("QR code %d of %d", index+1, total)
+}
+
+func signatureText(view *CardView) string {
+	switch view.Signature {
+	case SignatureVerified:
+		return "Signature verified"
+	case SignatureInvalid:
+		return "Signature NOT valid"
+	default:
+		return "Signature not checked"
+	}
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func prefixed(prefix, value string) string {
+	if value == "" {
+		return ""
+	}
+	return prefix + value
+}
+
+func joinNonEmpty(separator string, values ...string) string {
+	var parts []string
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, separator)
+}
+
+type pdfDocument struct {
+	paper PaperSize
+	pages []*pdfPage
+}
+
+type pdfPage struct {
+	height  float64
+	content bytes.Buffer
+}
+
+func (d *pdfDocument) newPage() *pdfPage {
+	page := &pdfPage{height: d.paper.Height}
+	d.pages = append(d.pages, page)
+	return page
+}
+
+// text draws a line of text with its baseline at y, measured from the top of the page like the layout code
+func (p *pdfPage) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %s Tf %s %s Td (%s) Tj ET\n", font, pdfNumber(size), pdfNumber(x), pdfNumber(p.height-y), pdfEscape(s))
+}
+
+// qr draws the QR bitmap (which includes its quiet zone) as a size x size square with its top left corner at x, y.
+// Horizontal runs of dark modules are merged into one rectangle to keep the page small.
+func (p *pdfPage) qr(x, y, size float64, bitmap [][]bool) {
+	module := size / float64(len(bitmap))
+	p.content.WriteString("q 0 g\n")
+	for row, modules := range bitmap {
+		for col := 0; col < len(modules); col++ {
+			if !modules[col] {
+				continue
+			}
+			start := col
+			for col+1 < len(modules) && modules[col+1] {
+				col++
+			}
+			fmt.Fprintf(&p.content, "%s %s %s %s re\n",
+				pdfNumber(x+float64(start)*module), pdfNumber(p.height-y-float64(row+1)*module),
+				pdfNumber(float64(col-start+1)*module), pdfNumber(module))
+		}
+	}
+	p.content.WriteString("f Q\n")
+}
+
+// cropMarks draws a thin dashed outline to cut along
+func (p *pdfPage) cropMarks(x, y, width, height float64) {
+	fmt.Fprintf(&p.content, "q 0.6 G 0.5 w [3 3] 0 d %s %s %s %s re S Q\n",
+		pdfNumber(x), pdfNumber(p.height-y-height), pdfNumber(width), pdfNumber(height))
+}
+
+// write serializes the document: the catalog, the page tree, the two standard fonts, then a page and a
+// compressed content stream per page, followed by the cross-reference table.
+func (d *pdfDocument) write(w io.Writer) error {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string, stream []byte) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s", len(offsets), body)
+		if stream != nil {
+			out.WriteString("\nstream\n")
+			out.Write(stream)
+			out.WriteString("\nendstream")
+		}
+		out.WriteString("\nendobj\n")
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	const firstPage = 5
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)), nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>", nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>", nil)
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfNumber(d.paper.Width), pdfNumber(d.paper.Height), firstPage+2*i+1), nil)
+
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(page.content.Bytes()); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>", compressed.Len()), compressed.Bytes())
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func pdfNumber(v float64) string {
+	s := fmt.Sprintf("%.2f", v)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" || s == "" {
+		return "0"
+	}
+	return s
+}
+
+// pdfEscape encodes the text as a WinAnsi literal string. Characters outside Latin-1 are replaced since the
+// standard fonts cannot show them.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r <= 255:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// helveticaWidths are the advance widths of ASCII 32-126 in Helvetica, in 1/1000 em, from the standard AFM
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// pdfTextWidth measures text in points. Helvetica-Bold is slightly wider, which is close enough for wrapping.
+func pdfTextWidth(s string, size float64, bold bool) float64 {
+	total := 0
+	for _, r := range s {
+		if r >= 32 && r < 127 {
+			total += helveticaWidths[r-32]
+		} else {
+			total += 556
+		}
+	}
+	width := float64(total) * size / 1000
+	if bold {
+		width *= 1.07
+	}
+	return width
+}
+
+func wrapPDFText(s string, size float64, bold bool, width float64) []string {
+	var lines []string
+	current := ""
+	for _, word := range strings.Fields(s) {
+		candidate := word
+		if current != "" {
+			candidate = current + " " + word
+		}
+		if current != "" && pdfTextWidth(candidate, size, bold) > width {
+			lines = append(lines, current)
+			candidate = word
+		}
+		current = candidate
+	}
+	if current != "" {
+		lines = append(lines, current)
+	}
+	return lines
+}
+
+func truncatePDFText(s string, size float64, bold bool, width float64) string {
+	if pdfTextWidth(s, size, bold) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && pdfTextWidth(string(runes)+"...", size, bold) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return strings.TrimSpace(string(runes)) + "..."
+}
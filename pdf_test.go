@@ -0,0 +1,118 @@
+package issuer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var pdfStream = regexp.MustCompile(`(?s)stream\n(.*?)\nendstream`)
+
+// pdfPageContents checks the cross-reference table and returns the inflated content stream of every page
+func pdfPageContents(t *testing.T, pdf []byte) []string {
+	t.Helper()
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("Missing PDF header or trailer")
+	}
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	offset, _ := strconv.Atoi(string(startxref[1]))
+	if !bytes.HasPrefix(pdf[offset:], []byte("xref\n")) {
+		t.Fatalf("startxref does not point at the xref table")
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(pdf[offset:], -1)
+	for i, entry := range entries {
+		objectOffset, _ := strconv.Atoi(string(entry[1]))
+		if !bytes.HasPrefix(pdf[objectOffset:], []byte(strconv.Itoa(i+1)+" 0 obj\n")) {
+			t.Fatalf("xref entry %d does not point at its object", i+1)
+		}
+	}
+
+	var contents []string
+	for _, match := range pdfStream.FindAllSubmatch(pdf, -1) {
+		r, err := zlib.NewReader(bytes.NewReader(match[1]))
+		if err != nil {
+			t.Fatalf("Failed to inflate content stream: %s", err.Error())
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Failed to inflate content stream: %s", err.Error())
+		}
+		contents = append(contents, string(content))
+	}
+	return contents
+}
+
+func TestRenderPDF(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	jws, err := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+	if err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+	card, err := DecodeCard(jws)
+	if err != nil {
+		t.Fatalf("Failed to decode card: %s", err.Error())
+	}
+	jwks, _ := issuer.JWKS()
+
+	var page bytes.Buffer
+	if err := RenderPDF(&page, card, PDFOptions{Paper: PaperA4, JWKS: &jwks}); err != nil {
+		t.Fatalf("Failed to render PDF: %s", err.Error())
+	}
+	contents := pdfPageContents(t, page.Bytes())
+	if len(contents) != 1 || !strings.Contains(page.String(), "/MediaBox [0 0 595.28 841.89]") {
+		t.Fatalf("Expected a single A4 page, got %d", len(contents))
+	}
+	for _, expected := range []string{"(Name: John B. Anyperson)", "(Date of birth: 1951-01-20)", "COVID-19, mRNA", "Lot 0000007", "(Signature verified)", " re\n"} {
+		if !strings.Contains(contents[0], expected) {
+			t.Fatalf("Expected the page to contain %q", expected)
+		}
+	}
+
+	// a card large enough for several QR codes gets a wallet panel per chunk
+	vc := sampleVerifiableCredential(t)
+	// random data does not compress, unlike a repeated string
+	noise := make([]byte, 1200)
+	_, _ = rand.Read(noise)
+	vc["rid"] = hex.EncodeToString(noise)
+	jws, err = issuer.Issue(context.Background(), vc)
+	if err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+	card, _ = DecodeCard(jws)
+	chunks := len(QRContents(jws))
+	if chunks < 2 {
+		t.Fatalf("Expected a chunked card, got %d chunks", chunks)
+	}
+
+	var wallet bytes.Buffer
+	if err := RenderPDF(&wallet, card, PDFOptions{Layout: PDFLayoutWallet}); err != nil {
+		t.Fatalf("Failed to render wallet PDF: %s", err.Error())
+	}
+	contents = pdfPageContents(t, wallet.Bytes())
+	if len(contents) != 1 || strings.Count(contents[0], "[3 3] 0 d") != chunks+1 {
+		t.Fatalf("Expected %d wallet panels on one page", chunks+1)
+	}
+	if !strings.Contains(contents[0], "(QR code 2 of ") || !strings.Contains(contents[0], "Signature not checked)") {
+		t.Fatalf("Missing chunk labels or signature status:\n%s", contents[0])
+	}
+
+	if err := RenderPDF(&wallet, card, PDFOptions{Layout: "poster"}); err == nil {
+		t.Fatal("Expected an error for an unknown layout")
+	}
+}
+
+func TestPDFEscape(t *testing.T) {
+	if escaped := pdfEscape(`Müller (Clinic) \ 東`); escaped != `M\374ller \(Clinic\) \\ ?` {
+		t.Fatalf("Unexpected escaping: %s", escaped)
+	}
+	if lines := wrapPDFText("one two three four", 10, false, 50); len(lines) != 2 {
+		t.Fatalf("Expected two lines, got %q", lines)
+	}
+}
@@ -0,0 +1,380 @@
+package issuer
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// ES256_SIGNATURE_SIZE is the length of the base64url encoded signature of every ES256 card
+const ES256_SIGNATURE_SIZE = 86
+
+// Minimization steps a SizePlan can suggest. The FHIR steps are the ones the spec asks issuers to apply.
+const (
+	MINIMIZE_EMBEDDED_JWK       = "omit-embedded-jwk"
+	MINIMIZE_EXPIRATION         = "omit-exp"
+	MINIMIZE_RESOURCE_ID        = "remove-resource-id"
+	MINIMIZE_NARRATIVE_TEXT     = "remove-narrative-text"
+	MINIMIZE_META               = "remove-meta"
+	MINIMIZE_CODING_DISPLAY     = "remove-coding-display"
+	MINIMIZE_CODEABLE_TEXT      = "remove-codeable-concept-text"
+	MINIMIZE_SHORT_RESOURCE_URL = "short-resource-urls"
+)
+
+// SizePlan predicts the size of a card and its QR codes without signing it.
+type SizePlan struct {
+	// PayloadSize is the size of the DEFLATE compressed payload, HeaderSize the size of the JSON protected header
+	PayloadSize int `json:"payloadSize"`
+	HeaderSize  int `json:"headerSize"`
+
+	// JWSLength is the exact length of the compact JWS the issuer would sign
+	JWSLength int  `json:"jwsLength"`
+	Fits      bool `json:"fitsSingleQR"`
+
+	// Chunks is the number of QR codes the card needs, and QRVersions the version of each of them
+	Chunks     int   `json:"chunks"`
+	QRVersions []int `json:"qrVersions"`
+
+	// Minimizations lists the steps that make this credential smaller, largest saving first. Each step's
+	// JWSLength assumes the steps before it were also applied.
+	Minimizations []MinimizationStep `json:"minimizations,omitempty"`
+}
+
+// MinimizationStep is a change to the card or the issuer's options that makes the JWS smaller.
+type MinimizationStep struct {
+	Step        string `json:"step"`
+	Description string `json:"description"`
+
+	// Saving is the number of JWS characters the step saves on its own
+	Saving int `json:"saving"`
+
+	// JWSLength and Fits describe the card with this step and every step before it applied
+	JWSLength int  `json:"jwsLength"`
+	Fits      bool `json:"fitsSingleQR"`
+}
+
+// Plan predicts the size of the card the issuer would sign for the verifiable credential, the QR codes it needs,
+// and the minimization steps that would make it smaller. Nothing is signed, logged or audited.
+func (i *Issuer) Plan(verifiableCredential map[string]interface{}) (*SizePlan, error) {
+	return i.plan(verifiableCredential, true)
+}
+
+// plan does the work of Plan, leaving out the minimization steps unless minimize is set
+func (i *Issuer) plan(verifiableCredential map[string]interface{}, minimize bool) (*SizePlan, error) {
+	if len(verifiableCredential) == 0 {
+		return nil, fmt.Errorf("%w: the credential is empty", ErrInvalidCredential)
+	}
+	key, keyId, err := i.keys.SigningKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key: %w", err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: no signing key", ErrInvalidKey)
+	}
+
+	now := i.clock()
+	card := SmartHealthCard{
+		IssuerURL:            i.url,
+		IssuanceDate:         int(now.Unix()),
+		VerifiableCredential: verifiableCredential,
+	}
+	if i.options.ExpiresIn > 0 {
+		card.ExpirationDate = int(now.Add(i.options.ExpiresIn).Unix())
+	}
+	header, err := cardHeader(&key.PublicKey, keyId, i.options.EmbedJWK)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := card.deflatedSize(i.options.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &SizePlan{
+		PayloadSize: payload,
+		HeaderSize:  len(header),
+		JWSLength:   predictedJWSLength(len(header), payload),
+	}
+	plan.Fits = plan.JWSLength <= MAX_SINGLE_JWS_SIZE
+
+	// the QR codes only depend on the length of the JWS, so any JWS of that length has the same versions
+	contents := QRContents(strings.Repeat("-", plan.JWSLength))
+	plan.Chunks = len(contents)
+	plan.QRVersions = make([]int, len(contents))
+	for n, content := range contents {
+		plan.QRVersions[n] = qrVersion(content)
+	}
+
+	if !minimize {
+		return plan, nil
+	}
+	plan.Minimizations, err = planMinimizations(card, &key.PublicKey, keyId, i.options.EmbedJWK, i.options.Compression, plan.JWSLength)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// cardHeader returns the protected header newCardSigner produces for the key
+func cardHeader(key *ecdsa.PublicKey, keyId string, embedJWK bool) ([]byte, error) {
+	header := map[string]interface{}{
+		"alg": "ES256",
+		"kid": keyId,
+		"zip": "DEF",
+	}
+	if embedJWK {
+		header["jwk"] = jose.JSONWebKey{Key: key}
+	}
+	bytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, &KeyError{Err: err}
+	}
+	return bytes, nil
+}
+
+func predictedJWSLength(headerSize int, payloadSize int) int {
+	encoding := base64.RawURLEncoding
+	return encoding.EncodedLen(headerSize) + 1 + encoding.EncodedLen(payloadSize) + 1 + ES256_SIGNATURE_SIZE
+}
+
+func (s SmartHealthCard) deflatedSize(compression Compression) (int, error) {
+	cardBytes, err := json.Marshal(s)
+	if err != nil {
+		return 0, &CredentialError{Message: "failed to marshal card into json", Err: err}
+	}
+	deflated, err := deflateWith(string(cardBytes), compression)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compress card bytes: %w", err)
+	}
+	return len(deflated), nil
+}
+
+// minimization is a candidate step. apply changes a copy of the card and reports whether it changed anything.
+type minimization struct {
+	step        string
+	description string
+	apply       func(card *SmartHealthCard, embedJWK *bool) bool
+}
+
+var minimizations = []minimization{
+	{MINIMIZE_EMBEDDED_JWK, "issue without EmbedJWK, verifiers fetch the key from the issuer's JWKS", func(card *SmartHealthCard, embedJWK *bool) bool {
+		changed := *embedJWK
+		*embedJWK = false
+		return changed
+	}},
+	{MINIMIZE_EXPIRATION, "issue without an exp claim, as the spec recommends for immunization cards", func(card *SmartHealthCard, embedJWK *bool) bool {
+		changed := card.ExpirationDate != 0
+		card.ExpirationDate = 0
+		return changed
+	}},
+	{MINIMIZE_RESOURCE_ID, "remove Resource.id", func(card *SmartHealthCard, embedJWK *bool) bool {
+		return minimizeResources(card.VerifiableCredential, func(resource map[string]interface{}) bool {
+			return deleteKey(resource, "id")
+		})
+	}},
+	{MINIMIZE_NARRATIVE_TEXT, "remove the narrative text of each resource", func(card *SmartHealthCard, embedJWK *bool) bool {
+		return minimizeResources(card.VerifiableCredential, func(resource map[string]interface{}) bool {
+			return deleteKey(resource, "text")
+		})
+	}},
+	{MINIMIZE_META, "remove Resource.meta except for meta.security", func(card *SmartHealthCard, embedJWK *bool) bool {
+		return minimizeResources(card.VerifiableCredential, func(resource map[string]interface{}) bool {
+			meta := getMap(resource, "meta")
+			if meta == nil || (len(meta) == 1 && meta["security"] != nil) {
+				return false
+			}
+			if meta["security"] == nil {
+				return deleteKey(resource, "meta")
+			}
+			resource["meta"] = map[string]interface{}{"security": meta["security"]}
+			return true
+		})
+	}},
+	{MINIMIZE_CODING_DISPLAY, "remove Coding.display", func(card *SmartHealthCard, embedJWK *bool) bool {
+		return minimizeResources(card.VerifiableCredential, func(resource map[string]interface{}) bool {
+			return walkElements(resource, func(key string, element map[string]interface{}) bool {
+				return key == "coding" && deleteKey(element, "display")
+			})
+		})
+	}},
+	{MINIMIZE_CODEABLE_TEXT, "remove CodeableConcept.text", func(card *SmartHealthCard, embedJWK *bool) bool {
+		return minimizeResources(card.VerifiableCredential, func(resource map[string]interface{}) bool {
+			return walkElements(resource, func(key string, element map[string]interface{}) bool {
+				isCodeable := key == "vaccineCode" || key == "code" || strings.HasPrefix(key, "valueCodeableConcept")
+				return isCodeable && deleteKey(element, "text")
+			})
+		})
+	}},
+	{MINIMIZE_SHORT_RESOURCE_URL, "use resource:N for fullUrl and references", shortenResourceURLs},
+}
+
+// planMinimizations tries every minimization on its own, then applies the useful ones largest saving first
+func planMinimizations(card SmartHealthCard, key *ecdsa.PublicKey, keyId string, embedJWK bool, compression Compression, length int) ([]MinimizationStep, error) {
+	measure := func(card SmartHealthCard, embedJWK bool) (int, error) {
+		header, err := cardHeader(key, keyId, embedJWK)
+		if err != nil {
+			return 0, err
+		}
+		payload, err := card.deflatedSize(compression)
+		if err != nil {
+			return 0, err
+		}
+		return predictedJWSLength(len(header), payload), nil
+	}
+
+	type candidate struct {
+		minimization
+		saving int
+	}
+	var candidates []candidate
+	for _, m := range minimizations {
+		minimized, err := card.copy()
+		if err != nil {
+			return nil, err
+		}
+		minimizedJWK := embedJWK
+		if !m.apply(&minimized, &minimizedJWK) {
+			continue
+		}
+		minimizedLength, err := measure(minimized, minimizedJWK)
+		if err != nil {
+			return nil, err
+		}
+		if minimizedLength < length {
+			candidates = append(candidates, candidate{m, length - minimizedLength})
+		}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return candidates[a].saving > candidates[b].saving
+	})
+
+	cumulative, err := card.copy()
+	if err != nil {
+		return nil, err
+	}
+	cumulativeJWK := embedJWK
+	steps := make([]MinimizationStep, len(candidates))
+	for n, c := range candidates {
+		c.apply(&cumulative, &cumulativeJWK)
+		minimized, err := measure(cumulative, cumulativeJWK)
+		if err != nil {
+			return nil, err
+		}
+		steps[n] = MinimizationStep{
+			Step:        c.step,
+			Description: c.description,
+			Saving:      c.saving,
+			JWSLength:   minimized,
+			Fits:        minimized <= MAX_SINGLE_JWS_SIZE,
+		}
+	}
+	return steps, nil
+}
+
+// copy returns the card with a deep copy of its credential, so a minimization does not change the caller's map
+func (s SmartHealthCard) copy() (SmartHealthCard, error) {
+	bytes, err := json.Marshal(s.VerifiableCredential)
+	if err != nil {
+		return s, &CredentialError{Message: "failed to marshal card into json", Err: err}
+	}
+	var verifiableCredential map[string]interface{}
+	if err := json.Unmarshal(bytes, &verifiableCredential); err != nil {
+		return s, &CredentialError{Err: err}
+	}
+	s.VerifiableCredential = verifiableCredential
+	return s, nil
+}
+
+// minimizeResources applies the change to every resource of the credential's bundle
+func minimizeResources(verifiableCredential map[string]interface{}, change func(resource map[string]interface{}) bool) bool {
+	changed := false
+	for _, entry := range bundleEntries(verifiableCredential) {
+		if resource := getMap(entry, "resource"); resource != nil && change(resource) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// walkElements calls visit for every object nested in the element, with the key it was found under
+func walkElements(element map[string]interface{}, visit func(key string, element map[string]interface{}) bool) bool {
+	changed := false
+	for key, value := range element {
+		switch child := value.(type) {
+		case map[string]interface{}:
+			if visit(key, child) {
+				changed = true
+			}
+			if walkElements(child, visit) {
+				changed = true
+			}
+		case []interface{}:
+			for _, item := range child {
+				itemMap, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if visit(key, itemMap) {
+					changed = true
+				}
+				if walkElements(itemMap, visit) {
+					changed = true
+				}
+			}
+		}
+	}
+	return changed
+}
+
+// shortenResourceURLs renames each bundle entry to resource:N and rewrites the references to it
+func shortenResourceURLs(card *SmartHealthCard, embedJWK *bool) bool {
+	entries := bundleEntries(card.VerifiableCredential)
+	renamed := map[string]string{}
+	for n, entry := range entries {
+		short := fmt.Sprintf("resource:%d", n)
+		if fullURL := getString(entry, "fullUrl"); fullURL != short {
+			if fullURL != "" {
+				renamed[fullURL] = short
+			}
+			entry["fullUrl"] = short
+		}
+	}
+	if len(renamed) == 0 {
+		return false
+	}
+	for _, entry := range entries {
+		if resource := getMap(entry, "resource"); resource != nil {
+			walkElements(resource, func(key string, element map[string]interface{}) bool {
+				if short, ok := renamed[getString(element, "reference")]; ok {
+					element["reference"] = short
+				}
+				return false
+			})
+		}
+	}
+	return true
+}
+
+func bundleEntries(verifiableCredential map[string]interface{}) []map[string]interface{} {
+	bundle := getMap(getMap(verifiableCredential, "credentialSubject"), "fhirBundle")
+	var entries []map[string]interface{}
+	for _, entry := range getSlice(bundle, "entry") {
+		if entryMap, ok := entry.(map[string]interface{}); ok {
+			entries = append(entries, entryMap)
+		}
+	}
+	return entries
+}
+
+func deleteKey(element map[string]interface{}, key string) bool {
+	if _, ok := element[key]; !ok {
+		return false
+	}
+	delete(element, key)
+	return true
+}
@@ -0,0 +1,110 @@
+package issuer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanPredictsSignedCard(t *testing.T) {
+	for _, options := range []IssuerOptions{{}, {EmbedJWK: true, ExpiresIn: 24 * time.Hour}} {
+		issuer, _ := newTestIssuer(t, options)
+		verifiableCredential := sampleVerifiableCredential(t)
+		plan, err := issuer.Plan(verifiableCredential)
+		if err != nil {
+			t.Fatalf("Failed to plan card: %s", err.Error())
+		}
+		jws, err := issuer.Issue(context.Background(), verifiableCredential)
+		if err != nil {
+			t.Fatalf("Failed to issue card: %s", err.Error())
+		}
+
+		if plan.JWSLength != len(jws) || plan.Fits != (len(jws) <= MAX_SINGLE_JWS_SIZE) {
+			t.Fatalf("Expected a JWS of %d characters, planned %d", len(jws), plan.JWSLength)
+		}
+		card, err := DecodeCard(jws)
+		if err != nil {
+			t.Fatalf("Failed to decode card: %s", err.Error())
+		}
+		if plan.PayloadSize != card.CompressedSize {
+			t.Fatalf("Expected a payload of %d bytes, planned %d", card.CompressedSize, plan.PayloadSize)
+		}
+		var versions []int
+		for _, content := range QRContents(jws) {
+			versions = append(versions, qrVersion(content))
+		}
+		if plan.Chunks != len(versions) || !reflect.DeepEqual(plan.QRVersions, versions) {
+			t.Fatalf("Expected QR versions %v, planned %v", versions, plan.QRVersions)
+		}
+
+		hasJWKStep := len(plan.Minimizations) > 0 && plan.Minimizations[0].Step == MINIMIZE_EMBEDDED_JWK
+		if hasJWKStep != options.EmbedJWK {
+			t.Fatalf("Expected the embedded JWK to be the largest saving only when it is embedded, got %+v", plan.Minimizations)
+		}
+	}
+}
+
+func TestPlanMinimizations(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	verifiableCredential := sampleVerifiableCredential(t)
+	bundle := getMap(getMap(verifiableCredential, "credentialSubject"), "fhirBundle")
+	entries := getSlice(bundle, "entry")
+	for n := 0; n < 6; n++ {
+		entries = append(entries, map[string]interface{}{
+			"fullUrl": fmt.Sprintf("https://ehr.example.org/fhir/Immunization/%d", 1000+n),
+			"resource": map[string]interface{}{
+				"resourceType": "Immunization",
+				"id":           fmt.Sprintf("immunization-%d", 1000+n),
+				"meta":         map[string]interface{}{"versionId": "3", "lastUpdated": "2021-06-01T10:00:00Z"},
+				"text":         map[string]interface{}{"status": "generated", "div": fmt.Sprintf("<div>Dose %d of the COVID-19 vaccine given at ABC General Hospital</div>", n+1)},
+				"status":       "completed",
+				"vaccineCode": map[string]interface{}{
+					"coding": []interface{}{map[string]interface{}{"system": "http://hl7.org/fhir/sid/cvx", "code": "207", "display": "SARS-COV-2 (COVID-19) vaccine, mRNA, spike protein, LNP, preservative free, 100 mcg/0.5mL dose"}},
+					"text":   "Moderna COVID-19 Vaccine",
+				},
+				"patient":            map[string]interface{}{"reference": "resource:0"},
+				"occurrenceDateTime": fmt.Sprintf("2021-%02d-01", n+2),
+			},
+		})
+	}
+	bundle["entry"] = entries
+	original, _ := json.Marshal(verifiableCredential)
+
+	plan, err := issuer.Plan(verifiableCredential)
+	if err != nil {
+		t.Fatalf("Failed to plan card: %s", err.Error())
+	}
+	if after, _ := json.Marshal(verifiableCredential); string(after) != string(original) {
+		t.Fatal("Expected planning to leave the credential unchanged")
+	}
+	if plan.Fits || plan.Chunks < 2 || len(plan.QRVersions) != plan.Chunks {
+		t.Fatalf("Expected the bundle to need more than one QR code, got %+v", plan)
+	}
+
+	steps := map[string]bool{}
+	previous := plan.JWSLength
+	for n, step := range plan.Minimizations {
+		steps[step.Step] = true
+		if step.Saving <= 0 || step.JWSLength >= previous {
+			t.Fatalf("Expected every step to make the card smaller, got %+v", step)
+		}
+		if n > 0 && step.Saving > plan.Minimizations[n-1].Saving {
+			t.Fatalf("Expected the largest savings first, got %+v", plan.Minimizations)
+		}
+		previous = step.JWSLength
+	}
+	for _, step := range []string{MINIMIZE_RESOURCE_ID, MINIMIZE_NARRATIVE_TEXT, MINIMIZE_META, MINIMIZE_CODING_DISPLAY, MINIMIZE_CODEABLE_TEXT, MINIMIZE_SHORT_RESOURCE_URL} {
+		if !steps[step] {
+			t.Fatalf("Expected the %s step, got %+v", step, plan.Minimizations)
+		}
+	}
+	if steps[MINIMIZE_EMBEDDED_JWK] || steps[MINIMIZE_EXPIRATION] {
+		t.Fatalf("Expected no steps that would not change the card, got %+v", plan.Minimizations)
+	}
+	if last := plan.Minimizations[len(plan.Minimizations)-1]; !last.Fits {
+		t.Fatalf("Expected the minimized bundle to fit in one QR code, got %+v", last)
+	}
+}
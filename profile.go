@@ -0,0 +1,412 @@
+package issuer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ProfileMode controls whether issuance checks the credential against the VCI content profiles before signing.
+type ProfileMode int
+
+const (
+	// ProfileValidationOff signs whatever credential it is given
+	ProfileValidationOff ProfileMode = iota
+	// ProfileValidationWarn reports profile problems through IssueWithDiagnostics but still signs the card
+	ProfileValidationWarn
+	// ProfileValidationStrict refuses to sign a card with any error-level profile diagnostic
+	ProfileValidationStrict
+)
+
+const (
+	CODE_PROFILE_TYPE        = "profile-type"
+	CODE_PROFILE_CARDINALITY = "profile-cardinality"
+	CODE_PROFILE_REFERENCE   = "profile-reference"
+	CODE_PROFILE_PATIENT     = "profile-patient"
+	CODE_PROFILE_BIRTH_DATE  = "profile-birth-date"
+	CODE_PROFILE_STATUS      = "profile-status"
+	CODE_PROFILE_CODE        = "profile-code"
+	CODE_PROFILE_CODE_SYSTEM = "profile-code-system"
+	CODE_PROFILE_DATE        = "profile-date"
+	CODE_PROFILE_PERFORMER   = "profile-performer"
+	CODE_PROFILE_LOT_NUMBER  = "profile-lot-number"
+	CODE_PROFILE_VALUE       = "profile-value"
+	CODE_PROFILE_CODE_STATUS = "profile-code-status"
+)
+
+const (
+	CVX_SYSTEM    = "http://hl7.org/fhir/sid/cvx"
+	NDC_SYSTEM    = "http://hl7.org/fhir/sid/ndc"
+	SNOMED_SYSTEM = "http://snomed.info/sct"
+	ICD11_SYSTEM  = "http://id.who.int/icd/release/11/mms"
+)
+
+// vaccineCodeSystems are the code systems the VCI immunization profile allows in Immunization.vaccineCode
+var vaccineCodeSystems = map[string]bool{
+	CVX_SYSTEM:    true,
+	NDC_SYSTEM:    true,
+	SNOMED_SYSTEM: true,
+	ICD11_SYSTEM:  true,
+}
+
+var (
+	fhirDate     = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+	fhirDateTime = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2}(T\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:\d{2}))?)?)?$`)
+	cvxCode      = regexp.MustCompile(`^\d{1,3}$`)
+	loincCode    = regexp.MustCompile(`^\d{1,7}-\d$`)
+)
+
+// observationStatuses are the Observation.status values the VCI laboratory profile allows on a card
+var observationStatuses = map[string]bool{
+	"final":     true,
+	"amended":   true,
+	"corrected": true,
+}
+
+// ProfileValidationError is returned when strict profile validation blocks issuance.
+type ProfileValidationError struct {
+	Diagnostics Diagnostics
+}
+
+func (e *ProfileValidationError) Error() string {
+	var messages []string
+	for _, diagnostic := range e.Diagnostics {
+		if diagnostic.Severity == SeverityError {
+			messages = append(messages, diagnostic.String())
+		}
+	}
+	return "credential does not conform to its profile: " + strings.Join(messages, "; ")
+}
+
+// Is makes profile validation failures match ErrInvalidCredential.
+func (e *ProfileValidationError) Is(target error) bool {
+	return target == ErrInvalidCredential
+}
+
+// ValidateProfile checks the credential against every content profile named by its vc.type, so a card typed as both
+// an immunization and a laboratory card has to conform to both.
+func ValidateProfile(vc map[string]interface{}) Diagnostics {
+	var diagnostics Diagnostics
+	types := map[string]bool{}
+	for _, t := range stringSlice(vc["type"]) {
+		types[t] = true
+	}
+	if !types[HEALTH_CARD_TYPE] {
+		diagnostics.add(CODE_PROFILE_TYPE, SeverityError, "vc.type", "vc.type must include %s", HEALTH_CARD_TYPE)
+	}
+
+	if types[IMMUNIZATION_TYPE] {
+		diagnostics = append(diagnostics, ValidateImmunizationProfile(vc)...)
+	}
+	if types[LABORATORY_TYPE] {
+		diagnostics = append(diagnostics, ValidateLaboratoryProfile(vc)...)
+	}
+	if !types[IMMUNIZATION_TYPE] && !types[LABORATORY_TYPE] {
+		diagnostics.add(CODE_PROFILE_TYPE, SeverityWarning, "vc.type", "vc.type does not name a content profile this package can validate")
+	}
+	return diagnostics
+}
+
+// ValidateImmunizationProfile checks the credential against the VCI immunization profile: a single Patient with a
+// name and birth date, and one or more completed Immunizations referencing it with an allowed vaccine code, an
+// occurrence date, a performer and a lot number.
+func ValidateImmunizationProfile(vc map[string]interface{}) Diagnostics {
+	var diagnostics Diagnostics
+	bundle := newProfileBundle(vc, &diagnostics)
+	if bundle == nil {
+		return diagnostics
+	}
+
+	patient := bundle.singlePatient(&diagnostics)
+	immunizations := bundle.byType["Immunization"]
+	if len(immunizations) == 0 {
+		diagnostics.add(CODE_PROFILE_CARDINALITY, SeverityError, bundle.path, "an immunization card needs at least one Immunization")
+	}
+
+	for _, entry := range immunizations {
+		resource, path := entry.resource, entry.path
+		if status := getString(resource, "status"); status != "completed" {
+			diagnostics.add(CODE_PROFILE_STATUS, SeverityError, path+".status", "Immunization.status must be completed, found %q", status)
+		}
+
+		validateCodeableConcept(getMap(resource, "vaccineCode"), path+".vaccineCode", vaccineCodeSystems, &diagnostics)
+		for i, coding := range getSlice(getMap(resource, "vaccineCode"), "coding") {
+			codingMap, _ := coding.(map[string]interface{})
+			if getString(codingMap, "system") == CVX_SYSTEM {
+				validateCVXCode(getString(codingMap, "code"), fmt.Sprintf("%s.vaccineCode.coding[%d].code", path, i), &diagnostics)
+			}
+		}
+
+		bundle.checkSubject(resource, "patient", path, patient, &diagnostics)
+
+		occurrence := getString(resource, "occurrenceDateTime")
+		if occurrence == "" {
+			diagnostics.add(CODE_PROFILE_DATE, SeverityError, path+".occurrenceDateTime", "Immunization.occurrenceDateTime is required")
+		} else if !fhirDateTime.MatchString(occurrence) {
+			diagnostics.add(CODE_PROFILE_DATE, SeverityError, path+".occurrenceDateTime", "%q is not a FHIR dateTime", occurrence)
+		}
+
+		validatePerformers(resource, path, true, &diagnostics)
+
+		if getString(resource, "lotNumber") == "" {
+			diagnostics.add(CODE_PROFILE_LOT_NUMBER, SeverityError, path+".lotNumber", "Immunization.lotNumber is required")
+		}
+	}
+	return diagnostics
+}
+
+// ValidateLaboratoryProfile checks the credential against the VCI laboratory result profile: a single Patient and
+// one or more final Observations referencing it with a LOINC test code, an effective date, a result value and
+// the performing lab.
+func ValidateLaboratoryProfile(vc map[string]interface{}) Diagnostics {
+	var diagnostics Diagnostics
+	bundle := newProfileBundle(vc, &diagnostics)
+	if bundle == nil {
+		return diagnostics
+	}
+
+	patient := bundle.singlePatient(&diagnostics)
+	observations := bundle.byType["Observation"]
+	if len(observations) == 0 {
+		diagnostics.add(CODE_PROFILE_CARDINALITY, SeverityError, bundle.path, "a laboratory card needs at least one Observation")
+	}
+
+	for _, entry := range observations {
+		resource, path := entry.resource, entry.path
+		if status := getString(resource, "status"); !observationStatuses[status] {
+			diagnostics.add(CODE_PROFILE_STATUS, SeverityError, path+".status", "Observation.status must be final, amended or corrected, found %q", status)
+		}
+
+		validateCodeableConcept(getMap(resource, "code"), path+".code", map[string]bool{LOINC_SYSTEM: true}, &diagnostics)
+		for i, coding := range getSlice(getMap(resource, "code"), "coding") {
+			codingMap, _ := coding.(map[string]interface{})
+			if getString(codingMap, "system") == LOINC_SYSTEM && !loincCode.MatchString(getString(codingMap, "code")) {
+				diagnostics.add(CODE_PROFILE_CODE, SeverityError, fmt.Sprintf("%s.code.coding[%d].code", path, i),
+					"%q is not a LOINC code", getString(codingMap, "code"))
+			}
+		}
+
+		bundle.checkSubject(resource, "subject", path, patient, &diagnostics)
+
+		effective := getString(resource, "effectiveDateTime")
+		if effective == "" && getMap(resource, "effectivePeriod") == nil {
+			diagnostics.add(CODE_PROFILE_DATE, SeverityError, path+".effectiveDateTime", "Observation.effectiveDateTime or effectivePeriod is required")
+		} else if effective != "" && !fhirDateTime.MatchString(effective) {
+			diagnostics.add(CODE_PROFILE_DATE, SeverityError, path+".effectiveDateTime", "%q is not a FHIR dateTime", effective)
+		}
+
+		validateObservationValue(resource, path, &diagnostics)
+		validatePerformers(resource, path, false, &diagnostics)
+	}
+	return diagnostics
+}
+
+func validateObservationValue(resource map[string]interface{}, path string, diagnostics *Diagnostics) {
+	values := 0
+	if concept := getMap(resource, "valueCodeableConcept"); concept != nil {
+		values++
+		validateCodeableConcept(concept, path+".valueCodeableConcept", map[string]bool{SNOMED_SYSTEM: true, LOINC_SYSTEM: true}, diagnostics)
+	}
+	if quantity := getMap(resource, "valueQuantity"); quantity != nil {
+		values++
+		if _, ok := quantity["value"].(float64); !ok {
+			diagnostics.add(CODE_PROFILE_VALUE, SeverityError, path+".valueQuantity.value", "valueQuantity needs a numeric value")
+		}
+		if system := getString(quantity, "system"); system != "" && system != UCUM_SYSTEM {
+			diagnostics.add(CODE_PROFILE_CODE_SYSTEM, SeverityWarning, path+".valueQuantity.system", "units should be expressed in UCUM, found %q", system)
+		}
+	}
+	if getString(resource, "valueString") != "" {
+		values++
+	}
+
+	switch {
+	case values == 0:
+		diagnostics.add(CODE_PROFILE_VALUE, SeverityError, path+".value[x]", "Observation needs a valueCodeableConcept, valueQuantity or valueString")
+	case values > 1:
+		diagnostics.add(CODE_PROFILE_VALUE, SeverityError, path+".value[x]", "Observation must have a single value[x], found %d", values)
+	}
+}
+
+// validateCVXCode checks the code against the CVX table. Codes that are not CVX codes at all are errors. Codes
+// missing from the table are only warnings, since the embedded table is a subset of the CDC export and a newer
+// export can be installed with SetDefaultCodeTables. Codes that are no longer (or not yet) administered in the US are
+// flagged but allowed since cards record historical doses.
+func validateCVXCode(code string, path string, diagnostics *Diagnostics) {
+	if !cvxCode.MatchString(code) {
+		diagnostics.add(CODE_PROFILE_CODE, SeverityError, path, "%q is not a CVX code", code)
+		return
+	}
+	vaccine, ok := DefaultCodeTables().CVX(code)
+	if !ok {
+		diagnostics.add(CODE_PROFILE_CODE, SeverityWarning, path, "CVX %s is not in the CVX table (version %s)", code, DefaultCodeTables().Version)
+		return
+	}
+	switch vaccine.Status {
+	case CVX_STATUS_ACTIVE:
+	case CVX_STATUS_NON_US:
+		diagnostics.add(CODE_PROFILE_CODE_STATUS, SeverityInfo, path, "CVX %s (%s) is a non-US vaccine", code, vaccine.ShortDescription)
+	default:
+		diagnostics.add(CODE_PROFILE_CODE_STATUS, SeverityWarning, path, "CVX %s (%s) has status %s", code, vaccine.ShortDescription, vaccine.Status)
+	}
+}
+
+type profileEntry struct {
+	resource map[string]interface{}
+	path     string
+	fullURL  string
+}
+
+// profileBundle indexes the entries of a credential's FHIR bundle for the profile checks
+type profileBundle struct {
+	path      string
+	entries   []profileEntry
+	byType    map[string][]profileEntry
+	byFullURL map[string]profileEntry
+}
+
+func newProfileBundle(vc map[string]interface{}, diagnostics *Diagnostics) *profileBundle {
+	const path = "vc.credentialSubject.fhirBundle"
+	bundle := getMap(getMap(vc, "credentialSubject"), "fhirBundle")
+	if bundle == nil {
+		diagnostics.add(CODE_PROFILE_CARDINALITY, SeverityError, path, "the credential has no FHIR bundle")
+		return nil
+	}
+
+	b := &profileBundle{
+		path:      path,
+		byType:    map[string][]profileEntry{},
+		byFullURL: map[string]profileEntry{},
+	}
+	for i, entry := range getSlice(bundle, "entry") {
+		entryMap, _ := entry.(map[string]interface{})
+		resource := getMap(entryMap, "resource")
+		if resource == nil {
+			continue
+		}
+		e := profileEntry{
+			resource: resource,
+			path:     fmt.Sprintf("%s.entry[%d].resource", path, i),
+			fullURL:  getString(entryMap, "fullUrl"),
+		}
+		if _, duplicate := b.byFullURL[e.fullURL]; duplicate {
+			diagnostics.add(CODE_PROFILE_REFERENCE, SeverityError, fmt.Sprintf("%s.entry[%d].fullUrl", path, i), "fullUrl %q is used by more than one entry", e.fullURL)
+		}
+		b.byFullURL[e.fullURL] = e
+		b.entries = append(b.entries, e)
+		resourceType := getString(resource, "resourceType")
+		b.byType[resourceType] = append(b.byType[resourceType], e)
+	}
+
+	// every reference in the bundle has to resolve to one of its entries
+	for _, e := range b.entries {
+		walkReferences(e.resource, e.path, func(reference string, refPath string) {
+			if !strings.HasPrefix(reference, "resource:") {
+				diagnostics.add(CODE_PROFILE_REFERENCE, SeverityError, refPath, "reference %q must point to a bundle entry as resource:N", reference)
+			} else if _, ok := b.byFullURL[reference]; !ok {
+				diagnostics.add(CODE_PROFILE_REFERENCE, SeverityError, refPath, "reference %q does not match any entry in the bundle", reference)
+			}
+		})
+	}
+	return b
+}
+
+// singlePatient checks the bundle holds exactly one valid Patient and returns its fullUrl
+func (b *profileBundle) singlePatient(diagnostics *Diagnostics) string {
+	patients := b.byType["Patient"]
+	if len(patients) != 1 {
+		diagnostics.add(CODE_PROFILE_CARDINALITY, SeverityError, b.path, "the bundle must contain exactly one Patient, found %d", len(patients))
+		if len(patients) == 0 {
+			return ""
+		}
+	}
+
+	patient := patients[0]
+	if patientName(patient.resource) == "" {
+		diagnostics.add(CODE_PROFILE_PATIENT, SeverityError, patient.path+".name", "Patient.name needs a family name, given name or text")
+	}
+	birthDate := getString(patient.resource, "birthDate")
+	if birthDate == "" {
+		diagnostics.add(CODE_PROFILE_BIRTH_DATE, SeverityError, patient.path+".birthDate", "Patient.birthDate is required")
+	} else if !fhirDate.MatchString(birthDate) {
+		diagnostics.add(CODE_PROFILE_BIRTH_DATE, SeverityError, patient.path+".birthDate", "%q is not a FHIR date", birthDate)
+	}
+	return patient.fullURL
+}
+
+// checkSubject checks that the patient or subject reference of a resource points at the card's Patient
+func (b *profileBundle) checkSubject(resource map[string]interface{}, element string, path string, patient string, diagnostics *Diagnostics) {
+	reference := getString(getMap(resource, element), "reference")
+	if reference == "" {
+		diagnostics.add(CODE_PROFILE_REFERENCE, SeverityError, path+"."+element, "%s.reference is required", element)
+	} else if patient != "" && reference != patient {
+		diagnostics.add(CODE_PROFILE_REFERENCE, SeverityError, path+"."+element, "%s.reference must point to the Patient (%s), found %q", element, patient, reference)
+	}
+}
+
+func validateCodeableConcept(concept map[string]interface{}, path string, systems map[string]bool, diagnostics *Diagnostics) {
+	codings := getSlice(concept, "coding")
+	if len(codings) == 0 {
+		diagnostics.add(CODE_PROFILE_CODE, SeverityError, path+".coding", "at least one coding is required")
+		return
+	}
+	for i, coding := range codings {
+		codingMap, _ := coding.(map[string]interface{})
+		codingPath := fmt.Sprintf("%s.coding[%d]", path, i)
+		if system := getString(codingMap, "system"); !systems[system] {
+			diagnostics.add(CODE_PROFILE_CODE_SYSTEM, SeverityError, codingPath+".system", "code system %q is not allowed here", system)
+		}
+		if getString(codingMap, "code") == "" {
+			diagnostics.add(CODE_PROFILE_CODE, SeverityError, codingPath+".code", "coding has no code")
+		}
+	}
+}
+
+// validatePerformers checks that the resource names who administered or performed it, which verifiers show on the
+// card. Immunization nests the names under actor, Observation does not.
+func validatePerformers(resource map[string]interface{}, path string, nestedActor bool, diagnostics *Diagnostics) {
+	performers := getSlice(resource, "performer")
+	if len(performers) == 0 {
+		diagnostics.add(CODE_PROFILE_PERFORMER, SeverityError, path+".performer", "performer must name who administered or performed it")
+		return
+	}
+	if nestedActor && len(performers) > 1 {
+		diagnostics.add(CODE_PROFILE_CARDINALITY, SeverityWarning, path+".performer", "the profile allows a single performer, found %d", len(performers))
+	}
+	for i, performer := range performers {
+		performerMap, _ := performer.(map[string]interface{})
+		if nestedActor {
+			performerMap = getMap(performerMap, "actor")
+		}
+		if getString(performerMap, "display") == "" {
+			diagnostics.add(CODE_PROFILE_PERFORMER, SeverityError, fmt.Sprintf("%s.performer[%d]", path, i), "performer needs a display name")
+		}
+	}
+}
+
+// walkReferences calls fn for every Reference.reference inside the element
+func walkReferences(element map[string]interface{}, path string, fn func(reference string, path string)) {
+	keys := make([]string, 0, len(element))
+	for key := range element {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		childPath := path + "." + key
+		switch child := element[key].(type) {
+		case string:
+			if key == "reference" {
+				fn(child, childPath)
+			}
+		case map[string]interface{}:
+			walkReferences(child, childPath, fn)
+		case []interface{}:
+			for i, item := range child {
+				if itemMap, ok := item.(map[string]interface{}); ok {
+					walkReferences(itemMap, fmt.Sprintf("%s[%d]", childPath, i), fn)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package issuer
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestValidateImmunizationProfile(t *testing.T) {
+	if diagnostics := ValidateProfile(sampleVerifiableCredential(t)); diagnostics.HasErrors() {
+		t.Fatalf("Expected the sample credential to conform, got %v", diagnostics)
+	}
+
+	vc := sampleVerifiableCredential(t)
+	entries := getSlice(getMap(getMap(vc, "credentialSubject"), "fhirBundle"), "entry")
+	patient := getMap(entries[0].(map[string]interface{}), "resource")
+	delete(patient, "birthDate")
+	immunization := getMap(entries[1].(map[string]interface{}), "resource")
+	immunization["status"] = "not-done"
+	immunization["patient"] = map[string]interface{}{"reference": "resource:9"}
+	getSlice(getMap(immunization, "vaccineCode"), "coding")[0] = map[string]interface{}{
+		"system": "http://example.org/local-codes",
+		"code":   "covid",
+	}
+	delete(immunization, "lotNumber")
+
+	diagnostics := ValidateProfile(vc)
+	for _, code := range []string{CODE_PROFILE_BIRTH_DATE, CODE_PROFILE_STATUS, CODE_PROFILE_REFERENCE, CODE_PROFILE_CODE_SYSTEM} {
+		if found := diagnostics.WithCode(code); len(found) == 0 || found[0].Severity != SeverityError {
+			t.Fatalf("Expected error %s, got %v", code, diagnostics)
+		}
+	}
+	if found := diagnostics.WithCode(CODE_PROFILE_LOT_NUMBER); len(found) != 1 || found[0].Severity != SeverityError {
+		t.Fatalf("Expected a lot number error, got %v", diagnostics)
+	}
+
+	// strict mode blocks issuance, warn mode signs and reports
+	strict, _ := newTestIssuer(t, IssuerOptions{ProfileValidation: ProfileValidationStrict})
+	_, err := strict.Issue(context.Background(), vc)
+	var profileErr *ProfileValidationError
+	if !errors.As(err, &profileErr) {
+		t.Fatalf("Expected a profile validation error, got %v", err)
+	}
+
+	warn, _ := newTestIssuer(t, IssuerOptions{ProfileValidation: ProfileValidationWarn})
+	jws, reported, err := warn.IssueWithDiagnostics(context.Background(), vc)
+	if err != nil || jws == "" {
+		t.Fatalf("Expected warn mode to sign the card: %v", err)
+	}
+	if !reported.HasErrors() {
+		t.Fatalf("Expected warn mode to report the profile errors")
+	}
+}
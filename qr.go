@@ -0,0 +1,93 @@
+package issuer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// SplitJWS splits a JWS that is too large for a single QR code into the fewest chunks of at most MAX_CHUNK_SIZE
+// characters, balanced so that every chunk is roughly the same size as the spec recommends.
+func SplitJWS(jws string) []string {
+	if len(jws) <= MAX_SINGLE_JWS_SIZE {
+		return []string{jws}
+	}
+
+	count := (len(jws) + MAX_CHUNK_SIZE - 1) / MAX_CHUNK_SIZE
+	size := (len(jws) + count - 1) / count
+	chunks := make([]string, 0, count)
+	for start := 0; start < len(jws); start += size {
+		end := start + size
+		if end > len(jws) {
+			end = len(jws)
+		}
+		chunks = append(chunks, jws[start:end])
+	}
+	return chunks
+}
+
+// QRContents returns the shc:/ text for each QR code of the JWS. Chunked cards are prefixed with shc:/<index>/<total>/
+func QRContents(jws string) []string {
+	chunks := SplitJWS(jws)
+	contents := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		prefix := QR_CODE_PREFIX
+		if len(chunks) > 1 {
+			prefix = fmt.Sprintf("%s%d/%d/", QR_CODE_PREFIX, i+1, len(chunks))
+		}
+		contents[i] = prefix + numericEncode(chunk)
+	}
+	return contents
+}
+
+// QRCodePNGs renders one PNG of the given width per QR chunk of the JWS.
+func QRCodePNGs(jws string, size int) ([][]byte, error) {
+	contents := QRContents(jws)
+	images := make([][]byte, len(contents))
+	for i, content := range contents {
+		code, err := newQRCode(content, i+1)
+		if err != nil {
+			return nil, err
+		}
+		png, err := code.PNG(size)
+		if err != nil {
+			return nil, &QRCodeError{Chunk: i + 1, Version: code.VersionNumber, Err: err}
+		}
+		images[i] = png
+	}
+	return images, nil
+}
+
+// newQRCode encodes one chunk's content, refusing codes larger than MAX_QR_VERSION
+func newQRCode(content string, chunk int) (*qrcode.QRCode, error) {
+	code, err := qrcode.New(content, qrcode.Low)
+	if err != nil {
+		return nil, &QRCodeError{Chunk: chunk, Err: err}
+	}
+	if code.VersionNumber > MAX_QR_VERSION {
+		return nil, &QRCodeError{Chunk: chunk, Version: code.VersionNumber}
+	}
+	return code, nil
+}
+
+// qrVersion returns the QR version needed to encode the content at the error correction level used by this package
+func qrVersion(content string) int {
+	code, err := qrcode.New(content, qrcode.Low)
+	if err != nil {
+		return 0
+	}
+	return code.VersionNumber
+}
+
+// numericEncode converts each character of the JWS into two digits, see LOWEST_VALUED_JWS_ORDINAL_VALUE
+func numericEncode(jws string) string {
+	var b strings.Builder
+	b.Grow(len(jws) * 2)
+	for _, r := range jws {
+		v := int(r - LOWEST_VALUED_JWS_ORDINAL_VALUE)
+		b.WriteByte(byte('0' + v/10))
+		b.WriteByte(byte('0' + v%10))
+	}
+	return b.String()
+}
@@ -0,0 +1,270 @@
+package issuer
+
+import (
+	"encoding/base64"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+type SignatureStatus string
+
+const (
+	SignatureVerified   SignatureStatus = "verified"
+	SignatureInvalid    SignatureStatus = "invalid"
+	SignatureNotChecked SignatureStatus = "not-checked"
+)
+
+type RenderOptions struct {
+	// JWKS is the issuer's key set. Without it the page says the signature was not checked.
+	JWKS *jose.JSONWebKeySet
+
+	// QRImageSize is the width in pixels of the embedded QR codes. Defaults to 256.
+	QRImageSize int
+}
+
+// CardView is what the HTML page shows, with codes already resolved to names.
+type CardView struct {
+	IssuerURL       string
+	IssuedAt        time.Time
+	Expires         *time.Time
+	Signature       SignatureStatus
+	SignatureDetail string
+
+	PatientName   string
+	BirthDate     string
+	Immunizations []ImmunizationView
+	Observations  []ObservationView
+
+	// QRCodes are PNG data URIs, one per chunk
+	QRCodes     []template.URL
+	QRImageSize int
+}
+
+type ImmunizationView struct {
+	Vaccine      string `json:"vaccine"`
+	Code         string `json:"code"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Date         string `json:"date"`
+	LotNumber    string `json:"lotNumber,omitempty"`
+	Performer    string `json:"performer,omitempty"`
+}
+
+type ObservationView struct {
+	Test      string `json:"test"`
+	Result    string `json:"result"`
+	Date      string `json:"date"`
+	Performer string `json:"performer,omitempty"`
+}
+
+// NewCardView resolves the card's bundle into display values, checks the signature when a JWKS is given and
+// renders the QR codes.
+func NewCardView(card *DecodedCard, options RenderOptions) (*CardView, error) {
+	if options.QRImageSize == 0 {
+		options.QRImageSize = 256
+	}
+	view := &CardView{
+		IssuerURL: card.Card.IssuerURL,
+		IssuedAt:  time.Unix(int64(card.Card.IssuanceDate), 0).UTC(),
+		Signature: SignatureNotChecked,
+
+		QRImageSize: options.QRImageSize,
+	}
+	if card.Card.ExpirationDate != 0 {
+		expires := time.Unix(int64(card.Card.ExpirationDate), 0).UTC()
+		view.Expires = &expires
+	}
+	if options.JWKS != nil {
+		if _, err := VerifyCard(card.JWS(), *options.JWKS); err != nil {
+			view.Signature = SignatureInvalid
+			view.SignatureDetail = err.Error()
+		} else {
+			view.Signature = SignatureVerified
+		}
+	}
+
+	view.readBundle(card.Card.VerifiableCredential)
+
+	images, err := QRCodePNGs(card.JWS(), options.QRImageSize)
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		// html/template only trusts data URIs passed as template.URL
+		view.QRCodes = append(view.QRCodes, template.URL("data:image/png;base64,"+base64.StdEncoding.EncodeToString(image)))
+	}
+	return view, nil
+}
+
+// readBundle fills in the patient and the display values of each resource in the credential's bundle
+func (v *CardView) readBundle(vc map[string]interface{}) {
+	bundle := getMap(getMap(vc, "credentialSubject"), "fhirBundle")
+	for _, entry := range getSlice(bundle, "entry") {
+		entryMap, _ := entry.(map[string]interface{})
+		resource := getMap(entryMap, "resource")
+		switch getString(resource, "resourceType") {
+		case "Patient":
+			v.PatientName = patientName(resource)
+			v.BirthDate = getString(resource, "birthDate")
+		case "Immunization":
+			v.Immunizations = append(v.Immunizations, immunizationView(resource))
+		case "Observation":
+			v.Observations = append(v.Observations, ObservationView{
+				Test:      summarizeCodeableConcept(getMap(resource, "code")),
+				Result:    observationValue(resource),
+				Date:      getString(resource, "effectiveDateTime"),
+				Performer: performerDisplay(resource),
+			})
+		}
+	}
+}
+
+func immunizationView(resource map[string]interface{}) ImmunizationView {
+	view := ImmunizationView{
+		Date:      getString(resource, "occurrenceDateTime"),
+		LotNumber: getString(resource, "lotNumber"),
+		Performer: performerDisplay(resource),
+	}
+	codings := getSlice(getMap(resource, "vaccineCode"), "coding")
+	for _, coding := range codings {
+		codingMap, _ := coding.(map[string]interface{})
+		system, code := getString(codingMap, "system"), getString(codingMap, "code")
+		if view.Code == "" || system == CVX_SYSTEM {
+			view.Code = codeSystemName(system) + " " + code
+			view.Vaccine = view.Code
+		}
+		if system != CVX_SYSTEM {
+			continue
+		}
+		tables := DefaultCodeTables()
+		if vaccine, ok := tables.CVX(code); ok {
+			view.Vaccine = vaccine.ShortDescription
+		}
+		var names []string
+		for _, manufacturer := range tables.ManufacturersOf(code) {
+			names = append(names, manufacturer.Name)
+		}
+		view.Manufacturer = strings.Join(names, " or ")
+		break
+	}
+	return view
+}
+
+// WriteHTML renders the page.
+func (v *CardView) WriteHTML(w io.Writer) error {
+	return cardTemplate.Execute(w, v)
+}
+
+// RenderHTML writes a standalone, accessible HTML page describing the card.
+func RenderHTML(w io.Writer, card *DecodedCard, options RenderOptions) error {
+	view, err := NewCardView(card, options)
+	if err != nil {
+		return err
+	}
+	return view.WriteHTML(w)
+}
+
+var cardTemplate = template.Must(template.New("card").Funcs(template.FuncMap{
+	"add": func(a, b int) int { return a + b },
+	"date": func(t time.Time) string {
+		return t.Format("January 2, 2006")
+	},
+	"verified": func(s SignatureStatus) bool { return s == SignatureVerified },
+	"invalid":  func(s SignatureStatus) bool { return s == SignatureInvalid },
+}).Parse(cardHTML))
+
+// the page is self-contained (no external CSS, fonts or scripts) so it can be saved or printed offline
+const cardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>SMART Health Card{{if .PatientName}} for {{.PatientName}}{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; line-height: 1.5; max-width: 48rem; margin: 0 auto; padding: 1rem; color: #1a1a1a; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5rem; }
+caption { text-align: left; font-weight: bold; font-size: 1.25rem; padding: 0.5rem 0; }
+th, td { border: 1px solid #767676; padding: 0.4rem 0.6rem; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; }
+.status { padding: 0.5rem 0.75rem; border: 2px solid; font-weight: bold; }
+.verified { border-color: #006100; color: #006100; }
+.invalid { border-color: #b00020; color: #b00020; }
+.not-checked { border-color: #5c5c5c; color: #5c5c5c; }
+.qr { display: flex; flex-wrap: wrap; gap: 1rem; }
+.qr img { max-width: 100%; height: auto; image-rendering: pixelated; }
+</style>
+</head>
+<body>
+<main>
+<h1>SMART Health Card</h1>
+
+<section aria-labelledby="patient">
+<h2 id="patient">Patient</h2>
+<dl>
+<dt>Name</dt><dd>{{or .PatientName "Not recorded"}}</dd>
+<dt>Date of birth</dt><dd>{{or .BirthDate "Not recorded"}}</dd>
+</dl>
+</section>
+
+{{if .Immunizations}}
+<table>
+<caption>Immunizations</caption>
+<thead>
+<tr><th scope="col">Vaccine</th><th scope="col">Date</th><th scope="col">Lot</th><th scope="col">Administered by</th></tr>
+</thead>
+<tbody>
+{{range .Immunizations}}<tr>
+<th scope="row">{{.Vaccine}}<br><small>{{.Code}}{{if .Manufacturer}} &middot; {{.Manufacturer}}{{end}}</small></th>
+<td>{{.Date}}</td>
+<td>{{.LotNumber}}</td>
+<td>{{.Performer}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+{{end}}
+
+{{if .Observations}}
+<table>
+<caption>Laboratory results</caption>
+<thead>
+<tr><th scope="col">Test</th><th scope="col">Result</th><th scope="col">Date</th><th scope="col">Performed by</th></tr>
+</thead>
+<tbody>
+{{range .Observations}}<tr>
+<th scope="row">{{.Test}}</th>
+<td>{{.Result}}</td>
+<td>{{.Date}}</td>
+<td>{{.Performer}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+{{end}}
+
+<section aria-labelledby="issuer">
+<h2 id="issuer">Issuer</h2>
+<dl>
+<dt>Issued by</dt><dd>{{.IssuerURL}}</dd>
+<dt>Issued on</dt><dd><time datetime="{{.IssuedAt.Format "2006-01-02"}}">{{date .IssuedAt}}</time></dd>
+{{with .Expires}}<dt>Expires on</dt><dd><time datetime="{{.Format "2006-01-02"}}">{{date .}}</time></dd>{{end}}
+</dl>
+<p class="status {{.Signature}}" role="status">
+{{if verified .Signature}}Signature verified against the issuer's published keys.
+{{else if invalid .Signature}}Signature could not be verified: {{.SignatureDetail}}
+{{else}}Signature not checked. Scan the QR code with a verifier app before relying on this card.
+{{end}}</p>
+</section>
+
+<section aria-labelledby="qr">
+<h2 id="qr">QR code</h2>
+<div class="qr">
+{{$count := len .QRCodes}}{{range $i, $uri := .QRCodes}}<img src="{{$uri}}" width="{{$.QRImageSize}}" height="{{$.QRImageSize}}" alt="QR code {{add $i 1}} of {{$count}} for this health card">
+{{end}}</div>
+{{if gt (len .QRCodes) 1}}<p>Scan all {{len .QRCodes}} codes, in any order.</p>{{end}}
+</section>
+</main>
+</body>
+</html>
+`
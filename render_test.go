@@ -0,0 +1,70 @@
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRenderHTML(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	vc, err := NewImmunizationCredential(
+		Patient{Family: "Anyperson", Given: []string{"John", "B."}, BirthDate: "1951-01-20"},
+		Immunization{VaccineCode: CVX("207"), OccurrenceDateTime: "2021-01-01", Performer: "ABC <General> Hospital", LotNumber: "0000001"},
+	)
+	if err != nil {
+		t.Fatalf("Failed to build credential: %s", err.Error())
+	}
+	jws, err := issuer.Issue(context.Background(), vc)
+	if err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+	card, err := DecodeCard(jws)
+	if err != nil {
+		t.Fatalf("Failed to decode card: %s", err.Error())
+	}
+	jwks, err := issuer.JWKS()
+	if err != nil {
+		t.Fatalf("Failed to get JWKS: %s", err.Error())
+	}
+
+	var page bytes.Buffer
+	if err := RenderHTML(&page, card, RenderOptions{JWKS: &jwks}); err != nil {
+		t.Fatalf("Failed to render card: %s", err.Error())
+	}
+	html := page.String()
+	for _, expected := range []string{
+		`<html lang="en">`,
+		"John B. Anyperson",
+		"1951-01-20",
+		"COVID-19, mRNA, LNP-S, PF",
+		"Moderna US, Inc.",
+		"0000001",
+		"ABC &lt;General&gt; Hospital",
+		"https://smarthealth.cards/examples/issuer",
+		"June 1, 2021",
+		"Signature verified",
+		`src="data:image/png;base64,`,
+		`alt="QR code 1 of 1 for this health card"`,
+	} {
+		if !strings.Contains(html, expected) {
+			t.Fatalf("Expected the page to contain %q:\n%s", expected, html)
+		}
+	}
+
+	// a key set without the issuer's key
+	other, _ := newTestIssuer(t, IssuerOptions{})
+	otherJWKS, _ := other.JWKS()
+	view, err := NewCardView(card, RenderOptions{JWKS: &otherJWKS})
+	if err != nil {
+		t.Fatalf("Failed to build view: %s", err.Error())
+	}
+	if view.Signature != SignatureInvalid || view.SignatureDetail == "" {
+		t.Fatalf("Expected an invalid signature, got %s", view.Signature)
+	}
+	view, _ = NewCardView(card, RenderOptions{})
+	if view.Signature != SignatureNotChecked {
+		t.Fatalf("Expected the signature not to be checked, got %s", view.Signature)
+	}
+}
@@ -0,0 +1,502 @@
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Error codes of the issuing service's JSON error responses
+const (
+	ERROR_METHOD_NOT_ALLOWED    = "method-not-allowed"
+	ERROR_UNSUPPORTED_MEDIA     = "unsupported-media-type"
+	ERROR_NOT_ACCEPTABLE        = "not-acceptable"
+	ERROR_REQUEST_TOO_LARGE     = "request-too-large"
+	ERROR_INVALID_REQUEST       = "invalid-request"
+	ERROR_PROFILE_VALIDATION    = "profile-validation-failed"
+	ERROR_INTERNAL              = "internal-error"
+	ERROR_UPSTREAM              = "upstream-error"
+	ERROR_NOT_FOUND             = "not-found"
+	ERROR_CARD_TOO_LARGE        = "card-too-large"
+	ERROR_SERVICE_SHUTTING_DOWN = "shutting-down"
+)
+
+const (
+	PNG_CONTENT_TYPE       = "image/png"
+	MULTIPART_CONTENT_TYPE = "multipart/mixed"
+	JSON_CONTENT_TYPE      = "application/json"
+)
+
+// errMultipleQRCodes refuses a card requested as a single image/png that needs several QR codes
+var errMultipleQRCodes = errors.New("the card needs more than one QR code")
+
+type ServiceOptions struct {
+	// MaxRequestBytes limits the size of a request body. Defaults to 1 MiB, far more than any card can hold.
+	MaxRequestBytes int64
+
+	// ShutdownTimeout bounds how long ListenAndServe waits for in-flight requests. Defaults to 10 seconds.
+	ShutdownTimeout time.Duration
+
+	// Authorizer, when set, makes the issuing service's /issue require a SMART access token with a patient launch
+	// context, and only issue cards for that patient
+	Authorizer *SMARTAuthorizer
+
+	// SMARTConfiguration gives the authorization server's endpoints and extra capabilities for the issuing service's
+	// .well-known/smart-configuration, which is only served when the endpoints are given
+	SMARTConfiguration SMARTConfigurationOptions
+
+	// Records is where the issuing service reads the authorized patient's record, and is required with an
+	// Authorizer: a token only proves who the patient is, so the immunizations must come from a trusted server
+	// rather than the request body.
+	Records *FHIRClient
+}
+
+func (o ServiceOptions) withDefaults() ServiceOptions {
+	if o.MaxRequestBytes <= 0 {
+		o.MaxRequestBytes = 1 << 20
+	}
+	if o.ShutdownTimeout <= 0 {
+		o.ShutdownTimeout = 10 * time.Second
+	}
+	return o
+}
+
+// IssuingService is a ready-made HTTP front end for an Issuer:
+//
+//	POST /issue                              sign a vc claim, a {"vc": ...} wrapper or a FHIR Bundle
+//	GET  /.well-known/jwks.json              the issuer's public keys
+//	GET  /.well-known/smart-configuration    SMART discovery metadata, when the authorization server's endpoints are given
+//	GET  /.well-known/crl/<kid>.json         the revocation list of a key, when the issuer has revocation lists
+//	GET  /transparency/...                   the transparency log, when the issuer has one (see TransparencyLog.Handler)
+//	GET  /healthz                            liveness
+//	GET  /readyz                             readiness: the signing key can be loaded and the service is not shutting down
+//
+// /issue responds according to Accept: application/json (the default) returns {"jws": ...},
+// application/smart-health-card returns a card file, image/png returns the QR code and multipart/mixed returns every
+// QR code as a PNG part. Every request signs a new card, so a card that needs several QR codes is refused as image/png
+// before it is signed: its chunks only scan together when they come from the same response.
+type IssuingService struct {
+	issuer   *Issuer
+	options  ServiceOptions
+	mux      *http.ServeMux
+	shutdown int32
+}
+
+func NewIssuingService(issuer *Issuer, options ServiceOptions) (*IssuingService, error) {
+	if options.Authorizer != nil && options.Records == nil {
+		return nil, errors.New("an authorized issuing service needs Records to read the patient's record from")
+	}
+	s := &IssuingService{issuer: issuer, options: options.withDefaults(), mux: http.NewServeMux()}
+	if s.options.Authorizer != nil {
+		s.mux.Handle("/issue", s.options.Authorizer.Middleware(http.HandlerFunc(s.handleIssue)))
+	} else {
+		s.mux.HandleFunc("/issue", s.handleIssue)
+	}
+	s.mux.HandleFunc("/.well-known/jwks.json", s.handleJWKS)
+	if smart := options.SMARTConfiguration; smart.AuthorizationEndpoint != "" || smart.TokenEndpoint != "" {
+		config, err := NewSMARTConfiguration(issuer, options.Authorizer, smart)
+		if err != nil {
+			return nil, err
+		}
+		s.mux.Handle("/.well-known/smart-configuration", config.Handler())
+	}
+	if issuer.crls != nil {
+		s.mux.Handle("/.well-known/crl/", http.StripPrefix("/.well-known/crl/", issuer.crls.Handler()))
+	}
+	if issuer.transparency != nil {
+		s.mux.Handle("/transparency/", http.StripPrefix("/transparency", issuer.transparency.Handler()))
+	}
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	s.mux.HandleFunc("/readyz", s.handleReady)
+	return s, nil
+}
+
+func (s *IssuingService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves on addr until ctx is cancelled, then stops accepting connections, reports not ready and
+// waits up to ShutdownTimeout for in-flight requests to finish.
+func (s *IssuingService) ListenAndServe(ctx context.Context, addr string) error {
+	return listenAndServe(ctx, addr, s, s.options.ShutdownTimeout, &s.shutdown)
+}
+
+// listenAndServe runs handler until ctx is done, then sets shutdown so readiness checks fail while in-flight
+// requests drain
+func listenAndServe(ctx context.Context, addr string, handler http.Handler, timeout time.Duration, shutdown *int32) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	atomic.StoreInt32(shutdown, 1)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ServiceError is the body of every error response.
+type ServiceError struct {
+	Code        string      `json:"code"`
+	Message     string      `json:"message"`
+	Diagnostics Diagnostics `json:"diagnostics,omitempty"`
+}
+
+type issueResponse struct {
+	JWS         string      `json:"jws"`
+	QRCodes     []string    `json:"qrCodes"`
+	Diagnostics Diagnostics `json:"diagnostics,omitempty"`
+}
+
+func (s *IssuingService) handleIssue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeServiceError(w, http.StatusMethodNotAllowed, ServiceError{Code: ERROR_METHOD_NOT_ALLOWED, Message: "use POST"})
+		return
+	}
+	if atomic.LoadInt32(&s.shutdown) == 1 {
+		writeServiceError(w, http.StatusServiceUnavailable, ServiceError{Code: ERROR_SERVICE_SHUTTING_DOWN, Message: "the service is shutting down"})
+		return
+	}
+	format := negotiate(r.Header.Get("Accept"), JSON_CONTENT_TYPE, SMART_HEALTH_CARD_FILE_CONTENT_TYPE, PNG_CONTENT_TYPE, MULTIPART_CONTENT_TYPE)
+	if format == "" {
+		writeServiceError(w, http.StatusNotAcceptable, ServiceError{
+			Code:    ERROR_NOT_ACCEPTABLE,
+			Message: "acceptable responses are application/json, application/smart-health-card, image/png and multipart/mixed",
+		})
+		return
+	}
+	if _, ok := r.URL.Query()["chunk"]; ok {
+		writeServiceError(w, http.StatusBadRequest, ServiceError{
+			Code:    ERROR_INVALID_REQUEST,
+			Message: "each request signs a new card, so chunks cannot be requested one at a time: accept multipart/mixed for every QR code",
+		})
+		return
+	}
+
+	var vc map[string]interface{}
+	if token, authorized := AccessTokenFromContext(r.Context()); authorized {
+		// the record comes from the FHIR server, so the caller cannot put anything on the card
+		var err error
+		if vc, err = s.options.Records.FetchCredential(r.Context(), token.Patient, FetchOptions{}); err != nil {
+			writeServiceError(w, http.StatusBadGateway, ServiceError{Code: ERROR_UPSTREAM, Message: "failed to read the patient's record"})
+			return
+		}
+	} else {
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil ||
+			(mediaType != JSON_CONTENT_TYPE && mediaType != FHIR_JSON_CONTENT_TYPE) {
+			writeServiceError(w, http.StatusUnsupportedMediaType, ServiceError{
+				Code:    ERROR_UNSUPPORTED_MEDIA,
+				Message: "send the credential as application/json or a FHIR Bundle as application/fhir+json",
+			})
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.options.MaxRequestBytes))
+		if err != nil {
+			writeServiceError(w, http.StatusRequestEntityTooLarge, ServiceError{
+				Code:    ERROR_REQUEST_TOO_LARGE,
+				Message: fmt.Sprintf("request bodies are limited to %d bytes", s.options.MaxRequestBytes),
+			})
+			return
+		}
+		if vc, err = requestCredential(body); err != nil {
+			writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: err.Error()})
+			return
+		}
+	}
+
+	if format == PNG_CONTENT_TYPE || format == MULTIPART_CONTENT_TYPE {
+		// refuse QR codes that cannot be rendered before anything is signed, logged or audited
+		if plan, err := s.issuer.plan(vc, false); err == nil {
+			for _, version := range plan.QRVersions {
+				if version == 0 || version > MAX_QR_VERSION {
+					writeServiceError(w, http.StatusUnprocessableEntity, ServiceError{
+						Code:    ERROR_CARD_TOO_LARGE,
+						Message: fmt.Sprintf("the card needs QR codes above version %d", MAX_QR_VERSION),
+					})
+					return
+				}
+			}
+			if format == PNG_CONTENT_TYPE && plan.Chunks > 1 {
+				writeServiceError(w, http.StatusNotAcceptable, ServiceError{
+					Code:    ERROR_NOT_ACCEPTABLE,
+					Message: fmt.Sprintf("the card needs %d QR codes: accept multipart/mixed", plan.Chunks),
+				})
+				return
+			}
+		}
+	}
+
+	ctx := r.Context()
+	if RequesterFromContext(ctx) == "" {
+		ctx = WithRequester(ctx, requestRequester(r))
+	}
+	// QR codes are rendered before the card is logged or audited, so a card refused here leaves no record
+	var images [][]byte
+	var render func(jws string) error
+	var renderErr error
+	if format == PNG_CONTENT_TYPE || format == MULTIPART_CONTENT_TYPE {
+		render = func(jws string) error {
+			if images, renderErr = s.issuer.QRCodes(jws); renderErr == nil && format == PNG_CONTENT_TYPE && len(images) > 1 {
+				// the plan predicted one chunk, but the card was signed a moment later and may have grown across a boundary
+				renderErr = errMultipleQRCodes
+			}
+			return renderErr
+		}
+	}
+	jws, diagnostics, err := s.issuer.issueWith(ctx, vc, render)
+	var profileErr *ProfileValidationError
+	if errors.As(err, &profileErr) {
+		writeServiceError(w, http.StatusUnprocessableEntity, ServiceError{
+			Code:        ERROR_PROFILE_VALIDATION,
+			Message:     "the credential does not conform to its content profile",
+			Diagnostics: profileErr.Diagnostics,
+		})
+		return
+	}
+	if errors.Is(err, ErrInvalidCredential) {
+		writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: err.Error()})
+		return
+	}
+	switch {
+	case errors.Is(renderErr, ErrPayloadTooLarge):
+		writeServiceError(w, http.StatusUnprocessableEntity, ServiceError{Code: ERROR_CARD_TOO_LARGE, Message: renderErr.Error()})
+		return
+	case renderErr == errMultipleQRCodes:
+		writeServiceError(w, http.StatusNotAcceptable, ServiceError{
+			Code:    ERROR_NOT_ACCEPTABLE,
+			Message: fmt.Sprintf("the card needs %d QR codes: accept multipart/mixed", len(images)),
+		})
+		return
+	case renderErr != nil:
+		writeServiceError(w, http.StatusInternalServerError, ServiceError{Code: ERROR_INTERNAL, Message: "failed to render the QR codes"})
+		return
+	}
+	if err != nil {
+		writeServiceError(w, http.StatusInternalServerError, ServiceError{Code: ERROR_INTERNAL, Message: "failed to sign the card"})
+		return
+	}
+
+	switch format {
+	case SMART_HEALTH_CARD_FILE_CONTENT_TYPE:
+		file, err := MarshalCardFile(jws)
+		if err != nil {
+			writeServiceError(w, http.StatusInternalServerError, ServiceError{Code: ERROR_INTERNAL, Message: "failed to build the card file"})
+			return
+		}
+		w.Header().Set("Content-Type", SMART_HEALTH_CARD_FILE_CONTENT_TYPE)
+		w.Header().Set("Content-Disposition", `attachment; filename="card.smart-health-card"`)
+		_, _ = w.Write(file)
+	case PNG_CONTENT_TYPE, MULTIPART_CONTENT_TYPE:
+		writeQRCodes(w, images, format)
+	default:
+		w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+		_ = json.NewEncoder(w).Encode(issueResponse{JWS: jws, QRCodes: QRContents(jws), Diagnostics: diagnostics})
+	}
+}
+
+func writeQRCodes(w http.ResponseWriter, images [][]byte, format string) {
+	w.Header().Set("SHC-QR-Chunk-Count", strconv.Itoa(len(images)))
+	if format == PNG_CONTENT_TYPE {
+		w.Header().Set("Content-Type", PNG_CONTENT_TYPE)
+		_, _ = w.Write(images[0])
+		return
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, image := range images {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", PNG_CONTENT_TYPE)
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="qr-%d.png"`, i+1))
+		part, err := mw.CreatePart(header)
+		if err == nil {
+			_, err = part.Write(image)
+		}
+		if err != nil {
+			writeServiceError(w, http.StatusInternalServerError, ServiceError{Code: ERROR_INTERNAL, Message: "failed to write the QR codes"})
+			return
+		}
+	}
+	_ = mw.Close()
+	w.Header().Set("Content-Type", MULTIPART_CONTENT_TYPE+"; boundary="+mw.Boundary())
+	_, _ = w.Write(body.Bytes())
+}
+
+func (s *IssuingService) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeServiceError(w, http.StatusMethodNotAllowed, ServiceError{Code: ERROR_METHOD_NOT_ALLOWED, Message: "use GET"})
+		return
+	}
+	jwks, err := s.issuer.JWKSJSON()
+	if err != nil {
+		writeServiceError(w, http.StatusInternalServerError, ServiceError{Code: ERROR_INTERNAL, Message: "failed to load the public keys"})
+		return
+	}
+	// verifiers fetch the keys from browsers too, so the spec requires CORS on this endpoint
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+	_, _ = w.Write(jwks)
+}
+
+func (s *IssuingService) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSONStatus(w, http.StatusOK, "ok")
+}
+
+func (s *IssuingService) handleReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.shutdown) == 1 {
+		writeJSONStatus(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	if _, _, err := s.issuer.keys.SigningKey(); err != nil {
+		writeJSONStatus(w, http.StatusServiceUnavailable, "signing key unavailable")
+		return
+	}
+	writeJSONStatus(w, http.StatusOK, "ready")
+}
+
+// requestRequester identifies the caller for the audit log: the access token's subject, client and patient, or
+// the remote address when the service runs without authorization
+func requestRequester(r *http.Request) string {
+	token, ok := AccessTokenFromContext(r.Context())
+	if !ok {
+		return "remote:" + r.RemoteAddr
+	}
+	var parts []string
+	for _, part := range [][2]string{{"sub", token.Subject}, {"fhirUser", token.FHIRUser}, {"client", token.ClientId}, {"patient", token.Patient}} {
+		if part[1] != "" {
+			parts = append(parts, part[0]+":"+part[1])
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// requestCredential accepts a bare vc claim, the {"vc": ...} wrapper used by the spec examples, or a FHIR
+// Bundle, which is minimized into a new credential
+func requestCredential(body []byte) (map[string]interface{}, error) {
+	var request map[string]interface{}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, fmt.Errorf("request body is not JSON: %w", err)
+	}
+	if getString(request, "resourceType") == "Bundle" {
+		record, err := ParseFHIRBundle(body)
+		if err != nil {
+			return nil, &CredentialError{Err: err}
+		}
+		return record.Credential()
+	}
+	if inner := getMap(request, "vc"); inner != nil {
+		request = inner
+	}
+	if getMap(request, "credentialSubject") == nil {
+		return nil, fmt.Errorf("%w: request must be a verifiable credential with a credentialSubject, or a FHIR Bundle", ErrInvalidCredential)
+	}
+	return request, nil
+}
+
+func writeServiceError(w http.ResponseWriter, status int, serviceError ServiceError) {
+	w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error ServiceError `json:"error"`
+	}{serviceError})
+}
+
+func writeJSONStatus(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": message})
+}
+
+// negotiate picks the offer the Accept header prefers, honouring q-values and wildcards. Offers listed first win
+// ties, and a missing Accept header selects the first offer.
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	type candidate struct {
+		offer   string
+		q       float64
+		order   int
+		precise int
+	}
+	var candidates []candidate
+	for order, offer := range offers {
+		best := candidate{offer: offer, q: -1, order: order}
+		for _, item := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if value, ok := params["q"]; ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+			precise := 0
+			switch {
+			case mediaType == offer:
+				precise = 2
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")):
+				precise = 1
+			case mediaType == "*/*":
+			default:
+				continue
+			}
+			// the most specific matching range decides the quality of an offer
+			if precise > best.precise || best.q < 0 {
+				best.q, best.precise = q, precise
+			}
+		}
+		if best.q > 0 {
+			candidates = append(candidates, best)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].q != candidates[j].q {
+			return candidates[i].q > candidates[j].q
+		}
+		return candidates[i].order < candidates[j].order
+	})
+	return candidates[0].offer
+}
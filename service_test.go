@@ -0,0 +1,287 @@
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serviceRequest(t *testing.T, handler http.Handler, method, path, contentType, accept string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func newTestService(t *testing.T, issuer *Issuer, options ServiceOptions) *IssuingService {
+	t.Helper()
+	service, err := NewIssuingService(issuer, options)
+	if err != nil {
+		t.Fatalf("Failed to create issuing service: %s", err.Error())
+	}
+	return service
+}
+
+func serviceErrorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error ServiceError `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected a JSON error body, got %q", w.Body.String())
+	}
+	return body.Error.Code
+}
+
+func TestIssuingService(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	service := newTestService(t, issuer, ServiceOptions{MaxRequestBytes: 64 << 10})
+	jwks, _ := issuer.JWKS()
+	vc, _ := json.Marshal(sampleVerifiableCredential(t))
+
+	// the {"vc": ...} wrapper, answered with JSON by default
+	wrapped, _ := json.Marshal(map[string]interface{}{"vc": sampleVerifiableCredential(t)})
+	w := serviceRequest(t, service, http.MethodPost, "/issue", JSON_CONTENT_TYPE, "", wrapped)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var issued struct {
+		JWS     string   `json:"jws"`
+		QRCodes []string `json:"qrCodes"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &issued)
+	if _, err := VerifyCard(issued.JWS, jwks); err != nil || len(issued.QRCodes) != 1 {
+		t.Fatalf("Expected a verifiable card with one QR code: %v", err)
+	}
+
+	// a FHIR bundle as it comes out of an EHR
+	bundle := `{"resourceType": "Bundle", "type": "searchset", "entry": [
+		{"resource": {"resourceType": "Patient", "id": "123", "name": [{"family": "Anyperson", "given": ["Jane"]}], "birthDate": "1961-01-20", "gender": "female"}},
+		{"resource": {"resourceType": "Immunization", "status": "completed", "patient": {"reference": "Patient/123"},
+			"vaccineCode": {"coding": [{"system": "http://hl7.org/fhir/sid/cvx", "code": "207"}]},
+			"occurrenceDateTime": "2021-01-01", "lotNumber": "0000001"}},
+		{"resource": {"resourceType": "Immunization", "status": "not-done", "patient": {"reference": "Patient/123"},
+			"vaccineCode": {"coding": [{"system": "http://hl7.org/fhir/sid/cvx", "code": "207"}]},
+			"occurrenceDateTime": "2021-01-29", "lotNumber": "REFUSED"}},
+		{"resource": {"resourceType": "Encounter", "id": "e1"}}
+	]}`
+	w = serviceRequest(t, service, http.MethodPost, "/issue", FHIR_JSON_CONTENT_TYPE, SMART_HEALTH_CARD_FILE_CONTENT_TYPE, []byte(bundle))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != SMART_HEALTH_CARD_FILE_CONTENT_TYPE {
+		t.Fatalf("Expected a card file, got %d: %s", w.Code, w.Body.String())
+	}
+	jwsList, err := ExtractJWS(w.Body.Bytes())
+	if err != nil || len(jwsList) != 1 {
+		t.Fatalf("Expected one card in the file: %v", err)
+	}
+	card, err := VerifyCard(jwsList[0], jwks)
+	if err != nil {
+		t.Fatalf("Failed to verify card: %s", err.Error())
+	}
+	if summary := string(card.Payload); !strings.Contains(summary, "Jane") || strings.Contains(summary, "Encounter") {
+		t.Fatalf("Expected the bundle to be minimized into the card: %s", summary)
+	}
+	if strings.Contains(string(card.Payload), "REFUSED") || strings.Contains(string(card.Payload), "not-done") {
+		t.Fatalf("Expected the dose that was not given to be left off the card: %s", card.Payload)
+	}
+
+	// QR codes
+	w = serviceRequest(t, service, http.MethodPost, "/issue", JSON_CONTENT_TYPE, "image/*", vc)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != PNG_CONTENT_TYPE || !bytes.HasPrefix(w.Body.Bytes(), []byte("\x89PNG")) {
+		t.Fatalf("Expected a PNG, got %d: %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	w = serviceRequest(t, service, http.MethodPost, "/issue", JSON_CONTENT_TYPE, "application/json;q=0.5, multipart/mixed", vc)
+	mediaType, params, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != http.StatusOK || mediaType != MULTIPART_CONTENT_TYPE {
+		t.Fatalf("Expected a multipart response, got %d: %s", w.Code, mediaType)
+	}
+	part, err := multipart.NewReader(w.Body, params["boundary"]).NextPart()
+	if err != nil || part.Header.Get("Content-Type") != PNG_CONTENT_TYPE {
+		t.Fatalf("Expected a PNG part: %v", err)
+	}
+
+	// errors
+	for _, test := range []struct {
+		method, contentType, accept string
+		body                        []byte
+		status                      int
+		code                        string
+	}{
+		{http.MethodGet, "", "", nil, http.StatusMethodNotAllowed, ERROR_METHOD_NOT_ALLOWED},
+		{http.MethodPost, "text/plain", "", vc, http.StatusUnsupportedMediaType, ERROR_UNSUPPORTED_MEDIA},
+		{http.MethodPost, JSON_CONTENT_TYPE, "text/html", vc, http.StatusNotAcceptable, ERROR_NOT_ACCEPTABLE},
+		{http.MethodPost, JSON_CONTENT_TYPE, "", []byte("{"), http.StatusBadRequest, ERROR_INVALID_REQUEST},
+		{http.MethodPost, JSON_CONTENT_TYPE, "", []byte(`{"name": "not a credential"}`), http.StatusBadRequest, ERROR_INVALID_REQUEST},
+		{http.MethodPost, JSON_CONTENT_TYPE, "", bytes.Repeat([]byte(" "), 65<<10), http.StatusRequestEntityTooLarge, ERROR_REQUEST_TOO_LARGE},
+	} {
+		w = serviceRequest(t, service, test.method, "/issue", test.contentType, test.accept, test.body)
+		if w.Code != test.status || serviceErrorCode(t, w) != test.code {
+			t.Fatalf("Expected %d %s, got %d: %s", test.status, test.code, w.Code, w.Body.String())
+		}
+	}
+
+	strict, _ := newTestIssuer(t, IssuerOptions{ProfileValidation: ProfileValidationStrict})
+	invalid := sampleVerifiableCredential(t)
+	patient := getMap(getMap(invalid, "credentialSubject"), "fhirBundle")["entry"].([]interface{})[0].(map[string]interface{})
+	getMap(patient, "resource")["birthDate"] = "01/20/1951"
+	body, _ := json.Marshal(invalid)
+	w = serviceRequest(t, newTestService(t, strict, ServiceOptions{}), http.MethodPost, "/issue", JSON_CONTENT_TYPE, "", body)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), CODE_PROFILE_BIRTH_DATE) {
+		t.Fatalf("Expected 422 with the profile diagnostics, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// keys and health
+	w = serviceRequest(t, service, http.MethodGet, "/.well-known/jwks.json", "", "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "*" || !strings.Contains(w.Body.String(), `"kty":"EC"`) {
+		t.Fatalf("Unexpected JWKS response %d: %s", w.Code, w.Body.String())
+	}
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if w = serviceRequest(t, service, http.MethodGet, path, "", "", nil); w.Code != http.StatusOK {
+			t.Fatalf("Expected %s to be OK, got %d", path, w.Code)
+		}
+	}
+	broken, _ := NewIssuer(IssuerConfig{IssuerURL: "https://example.org", KeySource: StaticKey{}})
+	if w = serviceRequest(t, newTestService(t, broken, ServiceOptions{}), http.MethodGet, "/readyz", "", "", nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected not ready without a signing key, got %d", w.Code)
+	}
+}
+
+func TestIssuingServiceMultipleQRCodes(t *testing.T) {
+	test, _ := newTestIssuer(t, IssuerOptions{})
+	var audited []AuditEvent
+	issuer, _ := NewIssuer(IssuerConfig{IssuerURL: test.IssuerURL(), KeySource: test.keys, Audit: AuditSinkFunc(func(ctx context.Context, event AuditEvent) error {
+		audited = append(audited, event)
+		return nil
+	})})
+	service := newTestService(t, issuer, ServiceOptions{})
+	large := largeVerifiableCredential(t, 20)
+	if plan, _ := issuer.Plan(large); plan == nil || plan.Chunks < 2 {
+		t.Fatal("Expected the large credential to need several QR codes")
+	}
+	vc, _ := json.Marshal(large)
+
+	// refused before anything is signed
+	w := serviceRequest(t, service, http.MethodPost, "/issue", JSON_CONTENT_TYPE, PNG_CONTENT_TYPE, vc)
+	if w.Code != http.StatusNotAcceptable || serviceErrorCode(t, w) != ERROR_NOT_ACCEPTABLE {
+		t.Fatalf("Expected 406 for a single PNG of a multi-chunk card, got %d: %s", w.Code, w.Body.String())
+	}
+	w = serviceRequest(t, service, http.MethodPost, "/issue?chunk=1", JSON_CONTENT_TYPE, MULTIPART_CONTENT_TYPE, vc)
+	if w.Code != http.StatusBadRequest || serviceErrorCode(t, w) != ERROR_INVALID_REQUEST {
+		t.Fatalf("Expected 400 for a chunk request, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(audited) != 0 {
+		t.Fatalf("Expected no card to be signed, audited %d", len(audited))
+	}
+
+	// every chunk of one card in one response
+	w = serviceRequest(t, service, http.MethodPost, "/issue", JSON_CONTENT_TYPE, MULTIPART_CONTENT_TYPE, vc)
+	_, params, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != http.StatusOK || len(audited) != 1 {
+		t.Fatalf("Expected one card, got %d: %s", w.Code, w.Body.String())
+	}
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	parts := 0
+	for ; ; parts++ {
+		if _, err := reader.NextPart(); err != nil {
+			break
+		}
+	}
+	if strconv.Itoa(parts) != w.Header().Get("SHC-QR-Chunk-Count") || parts < 2 {
+		t.Fatalf("Expected a part for each of the %s chunks, got %d", w.Header().Get("SHC-QR-Chunk-Count"), parts)
+	}
+}
+
+// growingKeySource signs with a longer kid once rotated, as a key rotation between the plan and signing would
+type growingKeySource struct {
+	key     *ecdsa.PrivateKey
+	rotated bool
+}
+
+func (s *growingKeySource) SigningKey() (*ecdsa.PrivateKey, string, error) {
+	if s.rotated {
+		return s.key, strings.Repeat("k", 600), nil
+	}
+	s.rotated = true
+	return s.key, "k", nil
+}
+
+func TestIssuingServiceRefusedQRCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	test, key := newTestIssuer(t, IssuerOptions{})
+	logKeys, _ := newTestIssuer(t, IssuerOptions{})
+	log, err := OpenTransparencyLog(TransparencyLogConfig{Path: filepath.Join(dir, "log.jsonl"), IssuerURL: test.IssuerURL(), KeySource: logKeys.keys})
+	if err != nil {
+		t.Fatalf("Failed to open transparency log: %s", err.Error())
+	}
+	defer log.Close()
+	var audited []AuditEvent
+	keys := &growingKeySource{key: key}
+	issuer, err := NewIssuer(IssuerConfig{IssuerURL: test.IssuerURL(), KeySource: keys, Transparency: log, Audit: AuditSinkFunc(func(ctx context.Context, event AuditEvent) error {
+		audited = append(audited, event)
+		return nil
+	})})
+	if err != nil {
+		t.Fatalf("Failed to create issuer: %s", err.Error())
+	}
+	service := newTestService(t, issuer, ServiceOptions{})
+	vc, _ := json.Marshal(sampleVerifiableCredential(t))
+
+	// the plan sees the short kid and one QR code, but the card is signed under the long one and needs two
+	keys.rotated = false
+	w := serviceRequest(t, service, http.MethodPost, "/issue", JSON_CONTENT_TYPE, PNG_CONTENT_TYPE, vc)
+	if w.Code != http.StatusNotAcceptable || serviceErrorCode(t, w) != ERROR_NOT_ACCEPTABLE {
+		t.Fatalf("Expected 406 for a card that grew past one QR code, got %d: %s", w.Code, w.Body.String())
+	}
+	if log.Size() != 0 || len(audited) != 0 {
+		t.Fatalf("Expected the refused card not to be recorded, logged %d and audited %d", log.Size(), len(audited))
+	}
+
+	w = serviceRequest(t, service, http.MethodPost, "/issue", JSON_CONTENT_TYPE, MULTIPART_CONTENT_TYPE, vc)
+	if w.Code != http.StatusOK || log.Size() != 1 || len(audited) != 1 {
+		t.Fatalf("Expected the rendered card to be recorded, got %d with %d logged: %s", w.Code, log.Size(), w.Body.String())
+	}
+}
+
+func TestIssuingServiceShutdown(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	service := newTestService(t, issuer, ServiceOptions{ShutdownTimeout: time.Second})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- service.ListenAndServe(ctx, "127.0.0.1:0")
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected a clean shutdown, got %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Service did not shut down")
+	}
+	if w := serviceRequest(t, service, http.MethodGet, "/readyz", "", "", nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected not ready after shutdown, got %d", w.Code)
+	}
+}
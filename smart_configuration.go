@@ -0,0 +1,134 @@
+package issuer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// CAPABILITY_HEALTH_CARDS is the SMART capability wallets look for to find servers that issue health cards
+const CAPABILITY_HEALTH_CARDS = "health-cards"
+
+// SMARTConfiguration is the body of .well-known/smart-configuration. The health_cards_* fields are this package's
+// extensions, so a wallet can find the issuer it will see in the cards and the keys to check them with.
+type SMARTConfiguration struct {
+	Issuer                            string   `json:"issuer,omitempty"`
+	JWKSURI                           string   `json:"jwks_uri,omitempty"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	RegistrationEndpoint              string   `json:"registration_endpoint,omitempty"`
+	ManagementEndpoint                string   `json:"management_endpoint,omitempty"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint                string   `json:"revocation_endpoint,omitempty"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported,omitempty"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported,omitempty"`
+	Capabilities                      []string `json:"capabilities"`
+
+	HealthCardsIssuer        string   `json:"health_cards_issuer"`
+	HealthCardsJWKSURI       string   `json:"health_cards_jwks_uri"`
+	HealthCardsIssueEndpoint string   `json:"health_cards_issue_endpoint,omitempty"`
+	HealthCardsTypes         []string `json:"health_cards_credential_types"`
+}
+
+// SMARTConfigurationOptions describes the parts of the SMART configuration that the issuer and authorizer do not
+// know, such as where apps get their tokens.
+type SMARTConfigurationOptions struct {
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	RegistrationEndpoint  string
+	ManagementEndpoint    string
+	IntrospectionEndpoint string
+	RevocationEndpoint    string
+
+	// IssueEndpoint is the URL of the issuing service's /issue, if it is published
+	IssueEndpoint string
+
+	// Capabilities are advertised after health-cards, e.g. launch-standalone or client-public
+	Capabilities []string
+	// ScopesSupported are advertised after the scopes the authorizer requires
+	ScopesSupported []string
+}
+
+// NewSMARTConfiguration describes an issuer, and the authorizer guarding it if there is one, as a SMART
+// configuration. The issuer URL, JWKS location, credential types and required scopes are read from the same values
+// used to sign cards and check tokens, so the published metadata cannot drift from them. The authorization and token
+// endpoints are required: SMART requires them, and a wallet cannot get a card without them.
+func NewSMARTConfiguration(issuer *Issuer, authorizer *SMARTAuthorizer, options SMARTConfigurationOptions) (*SMARTConfiguration, error) {
+	if issuer == nil {
+		return nil, errors.New("issuer is required")
+	}
+	if options.AuthorizationEndpoint == "" || options.TokenEndpoint == "" {
+		return nil, errors.New("a SMART configuration needs both the authorization and token endpoints")
+	}
+
+	issuerURL := strings.TrimSuffix(issuer.IssuerURL(), "/")
+	config := &SMARTConfiguration{
+		AuthorizationEndpoint: options.AuthorizationEndpoint,
+		TokenEndpoint:         options.TokenEndpoint,
+		RegistrationEndpoint:  options.RegistrationEndpoint,
+		ManagementEndpoint:    options.ManagementEndpoint,
+		IntrospectionEndpoint: options.IntrospectionEndpoint,
+		RevocationEndpoint:    options.RevocationEndpoint,
+
+		GrantTypesSupported:               []string{"authorization_code"},
+		ResponseTypesSupported:            []string{"code"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		TokenEndpointAuthMethodsSupported: []string{"private_key_jwt", "client_secret_basic"},
+		Capabilities:                      []string{CAPABILITY_HEALTH_CARDS},
+
+		HealthCardsIssuer:        issuerURL,
+		HealthCardsJWKSURI:       issuerURL + "/.well-known/jwks.json",
+		HealthCardsIssueEndpoint: options.IssueEndpoint,
+		HealthCardsTypes:         issuer.CredentialTypes(),
+	}
+	for _, capability := range options.Capabilities {
+		if capability != CAPABILITY_HEALTH_CARDS {
+			config.Capabilities = appendUnique(config.Capabilities, capability)
+		}
+	}
+	if authorizer != nil {
+		config.Issuer = authorizer.config.Issuer
+		config.JWKSURI = authorizer.config.JWKSURL
+		config.Capabilities = appendUnique(config.Capabilities, "context-standalone-patient", "permission-patient")
+		config.ScopesSupported = appendUnique([]string{"launch/patient"}, authorizer.config.RequiredScopes...)
+	}
+	config.ScopesSupported = appendUnique(config.ScopesSupported, options.ScopesSupported...)
+	return config, nil
+}
+
+// Handler serves the configuration. It allows any origin, because wallets running in a browser read it too.
+func (c *SMARTConfiguration) Handler() http.Handler {
+	body, err := json.Marshal(c)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeServiceError(w, http.StatusMethodNotAllowed, ServiceError{Code: ERROR_METHOD_NOT_ALLOWED, Message: "use GET"})
+			return
+		}
+		if err != nil {
+			writeServiceError(w, http.StatusInternalServerError, ServiceError{Code: ERROR_INTERNAL, Message: "failed to encode the SMART configuration"})
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+		_, _ = w.Write(body)
+	})
+}
+
+// appendUnique appends the values not already in list
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range list {
+			found = found || existing == value
+		}
+		if !found {
+			list = append(list, value)
+		}
+	}
+	return list
+}
@@ -0,0 +1,79 @@
+package issuer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSMARTConfiguration(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{CredentialTypes: []string{IMMUNIZATION_TYPE, COVID19_TYPE}})
+	tokens := newTokenIssuer(t)
+	authorizer, err := NewSMARTAuthorizer(context.Background(), AuthConfig{Issuer: tokens.server.URL, Audience: "https://issuer.example.org", JWKSURL: tokens.server.URL})
+	if err != nil {
+		t.Fatalf("Failed to create authorizer: %s", err.Error())
+	}
+	service := newTestService(t, issuer, ServiceOptions{
+		Authorizer: authorizer,
+		Records:    newTestRecords(t),
+		SMARTConfiguration: SMARTConfigurationOptions{
+			AuthorizationEndpoint: "https://auth.example.org/authorize",
+			TokenEndpoint:         "https://auth.example.org/token",
+			Capabilities:          []string{"launch-standalone", CAPABILITY_HEALTH_CARDS},
+		},
+	})
+
+	w := serviceRequest(t, service, http.MethodGet, "/.well-known/smart-configuration", "", "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	var config SMARTConfiguration
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatalf("Failed to parse configuration: %s", err.Error())
+	}
+
+	// everything that describes the cards comes from the issuer and authorizer themselves
+	if config.HealthCardsIssuer != issuer.IssuerURL() || config.HealthCardsJWKSURI != issuer.IssuerURL()+"/.well-known/jwks.json" {
+		t.Fatalf("Issuer metadata does not match the issuer: %+v", config)
+	}
+	if config.Issuer != tokens.server.URL || config.JWKSURI != tokens.server.URL || config.TokenEndpoint != "https://auth.example.org/token" {
+		t.Fatalf("Authorization metadata does not match the authorizer: %+v", config)
+	}
+	if types := config.HealthCardsTypes; len(types) != 3 || types[0] != HEALTH_CARD_TYPE || types[1] != IMMUNIZATION_TYPE || types[2] != COVID19_TYPE {
+		t.Fatalf("Expected the issuer's credential types, got %v", types)
+	}
+	expected := []string{CAPABILITY_HEALTH_CARDS, "launch-standalone", "context-standalone-patient", "permission-patient"}
+	if len(config.Capabilities) != len(expected) {
+		t.Fatalf("Expected capabilities %v, got %v", expected, config.Capabilities)
+	}
+	for i := range expected {
+		if config.Capabilities[i] != expected[i] {
+			t.Fatalf("Expected capabilities %v, got %v", expected, config.Capabilities)
+		}
+	}
+	if len(config.ScopesSupported) != 2 || config.ScopesSupported[1] != SCOPE_PATIENT_IMMUNIZATION_READ {
+		t.Fatalf("Expected the authorizer's scopes, got %v", config.ScopesSupported)
+	}
+
+	// without endpoints to get a token from, there is no configuration to publish
+	for _, options := range []SMARTConfigurationOptions{
+		{Capabilities: []string{CAPABILITY_HEALTH_CARDS}},
+		{TokenEndpoint: "https://auth.example.org/token"},
+		{AuthorizationEndpoint: "https://auth.example.org/authorize"},
+	} {
+		if _, err := NewSMARTConfiguration(issuer, nil, options); err == nil {
+			t.Fatalf("Expected an error for the endpoints in %+v", options)
+		}
+		if _, err := NewIssuingService(issuer, ServiceOptions{SMARTConfiguration: options}); options.Capabilities == nil && err == nil {
+			t.Fatalf("Expected the service to refuse the endpoints in %+v", options)
+		}
+	}
+	unconfigured := newTestService(t, issuer, ServiceOptions{})
+	if w := serviceRequest(t, unconfigured, http.MethodGet, "/.well-known/smart-configuration", "", "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected no configuration without endpoints, got %d: %s", w.Code, w.Body.String())
+	}
+	if unrestricted, _ := newTestIssuer(t, IssuerOptions{}); len(unrestricted.CredentialTypes()) != 1 {
+		t.Fatalf("Expected an issuer without credential types to publish only %s, got %v", HEALTH_CARD_TYPE, unrestricted.CredentialTypes())
+	}
+}
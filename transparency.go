@@ -0,0 +1,397 @@
+package issuer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// MAX_TRANSPARENCY_ENTRIES is the most entries served by one request to /transparency/entries
+const MAX_TRANSPARENCY_ENTRIES = 1000
+
+// TransparencyEntry is a leaf of the transparency log: one signed card, described only by what every holder of the
+// card can read from it, so the card alone is enough to find its leaf and check its inclusion proof.
+type TransparencyEntry struct {
+	IssuerURL string `json:"iss"`
+	KeyId     string `json:"kid"`
+	IssuedAt  int64  `json:"nbf"`
+	// PayloadHash is the hex SHA-256 of the card's compressed JWS payload, as in the audit log
+	PayloadHash string `json:"payloadHash"`
+}
+
+// TransparencyEntryForCard returns the entry the log holds for a card, if it was logged.
+func TransparencyEntryForCard(jws string) (TransparencyEntry, error) {
+	decoded, err := DecodeCard(jws)
+	if err != nil {
+		return TransparencyEntry{}, err
+	}
+	return TransparencyEntry{
+		IssuerURL:   decoded.Card.IssuerURL,
+		KeyId:       decoded.Header.KeyId,
+		IssuedAt:    int64(decoded.Card.IssuanceDate),
+		PayloadHash: jwsPayloadHash(decoded.compact),
+	}, nil
+}
+
+// LeafHash returns the hash of the entry in the Merkle tree.
+func (e TransparencyEntry) LeafHash() []byte {
+	leaf, _ := json.Marshal(e)
+	return MerkleLeafHash(leaf)
+}
+
+// SignedTreeHead commits the log to its first TreeSize entries. Monitors keep the heads they have seen and ask for
+// consistency proofs between them, so a log that drops or rewrites entries is caught.
+type SignedTreeHead struct {
+	IssuerURL string `json:"iss"`
+	TreeSize  uint64 `json:"tree_size"`
+	// Timestamp is in milliseconds since the epoch, as in Certificate Transparency
+	Timestamp int64  `json:"timestamp"`
+	RootHash  []byte `json:"sha256_root_hash"`
+	// Signature is a compact ES256 JWS of the other fields, signed with the key named by its kid header
+	Signature string `json:"tree_head_signature,omitempty"`
+}
+
+// Verify checks the signature of the tree head against the key in jwks matching its kid.
+func (h *SignedTreeHead) Verify(jwks jose.JSONWebKeySet) error {
+	signed, err := jose.ParseSigned(h.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to parse tree head signature: %w", err)
+	}
+	if len(signed.Signatures) != 1 {
+		return fmt.Errorf("expected a single signature, found %d", len(signed.Signatures))
+	}
+	keyId := signed.Signatures[0].Protected.KeyID
+	keys := jwks.Key(keyId)
+	if len(keys) == 0 {
+		return fmt.Errorf("no key with kid %s in the key set", keyId)
+	}
+	payload, err := signed.Verify(keys[0].Public())
+	if err != nil {
+		return fmt.Errorf("failed to verify tree head signature: %w", err)
+	}
+	var body SignedTreeHead
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return fmt.Errorf("failed to parse signed tree head: %w", err)
+	}
+	if body.IssuerURL != h.IssuerURL || body.TreeSize != h.TreeSize || body.Timestamp != h.Timestamp || !bytes.Equal(body.RootHash, h.RootHash) {
+		return errors.New("tree head does not match its signature")
+	}
+	return nil
+}
+
+// VerifyCardInclusion checks that a card is in the log: the tree head is signed by a key in jwks and the proof leads
+// from the card's entry to its root.
+func VerifyCardInclusion(jws string, proof *InclusionProof, head *SignedTreeHead, jwks jose.JSONWebKeySet) error {
+	if err := head.Verify(jwks); err != nil {
+		return err
+	}
+	if proof.TreeSize != head.TreeSize {
+		return fmt.Errorf("proof is for a tree of %d entries, the tree head has %d", proof.TreeSize, head.TreeSize)
+	}
+	entry, err := TransparencyEntryForCard(jws)
+	if err != nil {
+		return err
+	}
+	return proof.Verify(entry.LeafHash(), head.RootHash)
+}
+
+type TransparencyLogConfig struct {
+	// Path is the JSON-lines file entries are appended to; it is created if needed (required)
+	Path string
+
+	// IssuerURL and KeySource sign the tree heads (required). The log exists to expose cards signed with a stolen
+	// card key, so KeySource must hold a key of its own: NewIssuer refuses a log that signs with a card key.
+	// Verifiers get its public keys from the log's JWKS, served at /transparency/keys.
+	IssuerURL string
+	KeySource KeySource
+
+	Clock func() time.Time
+}
+
+// TransparencyLog is an append-only Merkle tree of every card signed, in the style of Certificate Transparency.
+// Comparing the log with the keys' usage reveals cards signed with a stolen key: they are valid but not logged.
+type TransparencyLog struct {
+	mu      sync.RWMutex
+	config  TransparencyLogConfig
+	file    *os.File
+	entries []TransparencyEntry
+	tree    merkleTree
+	// byHash finds the first leaf with a payload hash
+	byHash map[string]uint64
+}
+
+// OpenTransparencyLog reads the entries at config.Path and appends new ones to it.
+func OpenTransparencyLog(config TransparencyLogConfig) (*TransparencyLog, error) {
+	if config.Path == "" {
+		return nil, errors.New("transparency log path is required")
+	}
+	if config.IssuerURL == "" || config.KeySource == nil {
+		return nil, errors.New("issuer URL and key source are required to sign tree heads")
+	}
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+
+	file, err := os.OpenFile(config.Path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	log := &TransparencyLog{config: config, file: file, byHash: map[string]uint64{}}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var entry TransparencyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("transparency log %s: line %d is not an entry: %w", config.Path, line, err)
+		}
+		log.add(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+// Append logs an entry and returns its leaf index. The entry is on disk before Append returns.
+func (l *TransparencyLog) Append(entry TransparencyEntry) (uint64, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal transparency entry: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return 0, fmt.Errorf("failed to write transparency entry: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync transparency log: %w", err)
+	}
+	return l.add(entry), nil
+}
+
+func (l *TransparencyLog) add(entry TransparencyEntry) uint64 {
+	index := uint64(len(l.entries))
+	l.entries = append(l.entries, entry)
+	l.tree.append(entry.LeafHash())
+	if _, ok := l.byHash[entry.PayloadHash]; !ok {
+		l.byHash[entry.PayloadHash] = index
+	}
+	return index
+}
+
+// Size returns the number of entries in the log.
+func (l *TransparencyLog) Size() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return uint64(len(l.entries))
+}
+
+// Entries returns the entries from start up to, not including, end.
+func (l *TransparencyLog) Entries(start, end uint64) ([]TransparencyEntry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if start > end || end > uint64(len(l.entries)) {
+		return nil, fmt.Errorf("entries %d to %d are outside a log of %d", start, end, len(l.entries))
+	}
+	return append([]TransparencyEntry{}, l.entries[start:end]...), nil
+}
+
+// Lookup returns the leaf index of the card with the given payload hash.
+func (l *TransparencyLog) Lookup(payloadHash string) (uint64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	index, ok := l.byHash[strings.ToLower(payloadHash)]
+	return index, ok
+}
+
+// TreeHead signs the current root hash.
+func (l *TransparencyLog) TreeHead() (*SignedTreeHead, error) {
+	l.mu.RLock()
+	size := uint64(l.tree.size())
+	root := l.tree.root(0, int(size))
+	l.mu.RUnlock()
+
+	head := &SignedTreeHead{
+		IssuerURL: l.config.IssuerURL,
+		TreeSize:  size,
+		Timestamp: l.config.Clock().UnixNano() / int64(time.Millisecond),
+		RootHash:  root,
+	}
+	key, keyId, err := l.config.KeySource.SigningKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key: %w", err)
+	}
+	if head.Signature, err = signTreeHead(head, key, keyId); err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+// InclusionProof proves that the entry at index is in the tree of the first size entries.
+func (l *TransparencyLog) InclusionProof(index, size uint64) (*InclusionProof, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if size > uint64(l.tree.size()) {
+		return nil, fmt.Errorf("tree size %d is larger than the log of %d", size, l.tree.size())
+	}
+	if index >= size {
+		return nil, fmt.Errorf("entry %d is not in a tree of %d", index, size)
+	}
+	return &InclusionProof{LeafIndex: index, TreeSize: size, AuditPath: l.tree.path(int(index), 0, int(size))}, nil
+}
+
+// ConsistencyProof proves that the tree of the first entries is a prefix of the tree of the second.
+func (l *TransparencyLog) ConsistencyProof(first, second uint64) (*ConsistencyProof, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if first > second || second > uint64(l.tree.size()) {
+		return nil, fmt.Errorf("no consistency proof from %d to %d entries in a log of %d", first, second, l.tree.size())
+	}
+	proof := &ConsistencyProof{First: first, Second: second, Consistency: [][]byte{}}
+	if first > 0 && first < second {
+		proof.Consistency = l.tree.subproof(int(first), 0, int(second), true)
+	}
+	return proof, nil
+}
+
+// JWKS returns the public keys tree heads are signed with.
+func (l *TransparencyLog) JWKS() (jose.JSONWebKeySet, error) {
+	return keySourceJWKS(l.config.KeySource)
+}
+
+// Close closes the log file.
+func (l *TransparencyLog) Close() error {
+	return l.file.Close()
+}
+
+// Handler serves the log to monitors and verifiers. Mount it with http.StripPrefix, as the issuing service does for
+// /transparency/:
+//
+//	GET sth                                     the signed tree head
+//	GET keys                                    the JWKS tree heads are signed with
+//	GET proof?payloadHash=<hex>[&tree_size=N]   inclusion proof of a card, in the current tree by default
+//	GET consistency?first=N&second=M            consistency proof between two tree sizes
+//	GET entries?start=N[&count=M]               up to 1000 entries from start
+func (l *TransparencyLog) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeServiceError(w, http.StatusMethodNotAllowed, ServiceError{Code: ERROR_METHOD_NOT_ALLOWED, Message: "use GET"})
+			return
+		}
+		query := r.URL.Query()
+		size := l.Size()
+		param := func(name string, fallback uint64) (uint64, bool) {
+			value := query.Get(name)
+			if value == "" {
+				return fallback, true
+			}
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: name + " must be a number"})
+				return 0, false
+			}
+			return n, true
+		}
+
+		var body interface{}
+		var err error
+		switch strings.TrimPrefix(r.URL.Path, "/") {
+		case "sth":
+			body, err = l.TreeHead()
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, ServiceError{Code: ERROR_INTERNAL, Message: "failed to sign the tree head"})
+				return
+			}
+		case "keys":
+			body, err = l.JWKS()
+			if err != nil {
+				writeServiceError(w, http.StatusInternalServerError, ServiceError{Code: ERROR_INTERNAL, Message: "failed to load the tree head keys"})
+				return
+			}
+		case "proof":
+			treeSize, ok := param("tree_size", size)
+			if !ok {
+				return
+			}
+			index, found := l.Lookup(query.Get("payloadHash"))
+			if !found || index >= treeSize {
+				writeServiceError(w, http.StatusNotFound, ServiceError{Code: ERROR_NOT_FOUND, Message: "no card with that payload hash in the tree"})
+				return
+			}
+			body, err = l.InclusionProof(index, treeSize)
+		case "consistency":
+			first, ok := param("first", 0)
+			if !ok {
+				return
+			}
+			second, ok := param("second", size)
+			if !ok {
+				return
+			}
+			body, err = l.ConsistencyProof(first, second)
+		case "entries":
+			start, ok := param("start", 0)
+			if !ok {
+				return
+			}
+			count, ok := param("count", MAX_TRANSPARENCY_ENTRIES)
+			if !ok {
+				return
+			}
+			if count > MAX_TRANSPARENCY_ENTRIES {
+				count = MAX_TRANSPARENCY_ENTRIES
+			}
+			end := start + count
+			if end > size || end < start {
+				end = size
+			}
+			var entries []TransparencyEntry
+			entries, err = l.Entries(start, end)
+			body = map[string]interface{}{"start": start, "entries": entries}
+		default:
+			writeServiceError(w, http.StatusNotFound, ServiceError{Code: ERROR_NOT_FOUND, Message: "unknown transparency log endpoint"})
+			return
+		}
+		if err != nil {
+			writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: err.Error()})
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+		_ = json.NewEncoder(w).Encode(body)
+	})
+}
+
+// signTreeHead signs the tree head's fields as an uncompressed compact JWS
+func signTreeHead(head *SignedTreeHead, key *ecdsa.PrivateKey, keyId string) (string, error) {
+	body := *head
+	body.Signature = ""
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal tree head: %w", err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, &jose.SignerOptions{
+		ExtraHeaders: map[jose.HeaderKey]interface{}{"kid": keyId},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create tree head signer: %w", err)
+	}
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign tree head: %w", err)
+	}
+	return signed.CompactSerialize()
+}
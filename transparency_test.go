@@ -0,0 +1,185 @@
+package issuer
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestMerkleProofs(t *testing.T) {
+	// the leaves and root of the RFC 6962 reference tests
+	var leaves [][]byte
+	for _, leaf := range []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"} {
+		data, _ := hex.DecodeString(leaf)
+		leaves = append(leaves, MerkleLeafHash(data))
+	}
+	if root := hex.EncodeToString(merkleRoot(leaves)); root != "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328" {
+		t.Fatalf("Unexpected root hash %s", root)
+	}
+
+	for i := 0; i < 13; i++ {
+		leaves = append(leaves, MerkleLeafHash([]byte{byte(i)}))
+	}
+	// the log's cached tree gives the same roots and proofs as hashing every leaf
+	var tree merkleTree
+	for n := 1; n <= len(leaves); n++ {
+		tree.append(leaves[n-1])
+		for size := 0; size <= n; size++ {
+			if !reflect.DeepEqual(tree.root(0, size), merkleRoot(leaves[:size])) {
+				t.Fatalf("Root of %d of %d leaves differs from the reference", size, n)
+			}
+			for m := 0; m < size; m++ {
+				if !reflect.DeepEqual(tree.path(m, 0, size), merklePath(m, leaves[:size])) ||
+					!reflect.DeepEqual(tree.subproof(m+1, 0, size, true), merkleSubproof(m+1, leaves[:size], true)) {
+					t.Fatalf("Proofs for %d in %d of %d leaves differ from the reference", m, size, n)
+				}
+			}
+		}
+	}
+
+	for n := 1; n <= len(leaves); n++ {
+		root := merkleRoot(leaves[:n])
+		for m := 0; m < n; m++ {
+			proof := &InclusionProof{LeafIndex: uint64(m), TreeSize: uint64(n), AuditPath: merklePath(m, leaves[:n])}
+			if err := proof.Verify(leaves[m], root); err != nil {
+				t.Fatalf("Inclusion of %d in %d: %s", m, n, err.Error())
+			}
+			if proof.Verify(leaves[(m+1)%len(leaves)], root) == nil {
+				t.Fatalf("Expected the wrong leaf not to be included at %d in %d", m, n)
+			}
+		}
+		for m := 0; m <= n; m++ {
+			proof := &ConsistencyProof{First: uint64(m), Second: uint64(n)}
+			if m > 0 && m < n {
+				proof.Consistency = merkleSubproof(m, leaves[:n], true)
+			}
+			if err := proof.Verify(merkleRoot(leaves[:m]), root); err != nil {
+				t.Fatalf("Consistency of %d with %d: %s", m, n, err.Error())
+			}
+			if m > 0 && proof.Verify(merkleRoot(leaves[1:m+1]), root) == nil {
+				t.Fatalf("Expected a rewritten tree of %d not to be consistent with %d", m, n)
+			}
+		}
+	}
+}
+
+func TestTransparencyLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transparency")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log.jsonl")
+
+	test, _ := newTestIssuer(t, IssuerOptions{})
+	logKeys, _ := newTestIssuer(t, IssuerOptions{})
+	config := TransparencyLogConfig{Path: path, IssuerURL: test.IssuerURL(), KeySource: logKeys.keys, Clock: test.clock}
+	log, err := OpenTransparencyLog(config)
+	if err != nil {
+		t.Fatalf("Failed to open transparency log: %s", err.Error())
+	}
+
+	// a log signing with the card key would let a thief of that key sign a forked tree head
+	sameKey, err := OpenTransparencyLog(TransparencyLogConfig{Path: filepath.Join(dir, "same.jsonl"), IssuerURL: test.IssuerURL(), KeySource: test.keys})
+	if err != nil {
+		t.Fatalf("Failed to open transparency log: %s", err.Error())
+	}
+	if _, err := NewIssuer(IssuerConfig{IssuerURL: test.IssuerURL(), KeySource: test.keys, Transparency: sameKey}); err == nil {
+		t.Fatal("Expected a log signing with the card key to be refused")
+	}
+	sameKey.Close()
+	issuer, _ := NewIssuer(IssuerConfig{IssuerURL: test.IssuerURL(), KeySource: test.keys, Clock: test.clock, Transparency: log})
+	var cards []string
+	for i := 0; i < 2; i++ {
+		jws, err := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+		if err != nil {
+			t.Fatalf("Failed to issue card: %s", err.Error())
+		}
+		cards = append(cards, jws)
+	}
+	first, _ := log.TreeHead()
+	log.Close()
+
+	// entries survive a restart, and new ones extend the same tree
+	log, err = OpenTransparencyLog(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen transparency log: %s", err.Error())
+	}
+	defer log.Close()
+	issuer, _ = NewIssuer(IssuerConfig{IssuerURL: test.IssuerURL(), KeySource: test.keys, Clock: test.clock, Transparency: log})
+	jws, _ := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+	cards = append(cards, jws)
+	if log.Size() != 3 {
+		t.Fatalf("Expected 3 entries, got %d", log.Size())
+	}
+
+	service := newTestService(t, issuer, ServiceOptions{})
+	get := func(path string, v interface{}) int {
+		w := serviceRequest(t, service, http.MethodGet, path, "", "", nil)
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("Failed to parse %s: %s", path, err.Error())
+			}
+		}
+		return w.Code
+	}
+
+	var head SignedTreeHead
+	if code := get("/transparency/sth", &head); code != http.StatusOK || head.TreeSize != 3 {
+		t.Fatalf("Unexpected tree head %d %+v", code, head)
+	}
+	var jwks jose.JSONWebKeySet
+	if code := get("/transparency/keys", &jwks); code != http.StatusOK || len(jwks.Keys) != 1 {
+		t.Fatalf("Expected the log's key, got %d %+v", code, jwks)
+	}
+	if cardKeys, _ := issuer.JWKS(); head.Verify(cardKeys) == nil {
+		t.Fatal("Expected the tree head not to verify with the card keys")
+	}
+	for i, card := range cards {
+		entry, _ := TransparencyEntryForCard(card)
+		var proof InclusionProof
+		if code := get("/transparency/proof?payloadHash="+entry.PayloadHash, &proof); code != http.StatusOK {
+			t.Fatalf("Expected a proof for card %d, got %d", i, code)
+		}
+		if err := VerifyCardInclusion(card, &proof, &head, jwks); err != nil {
+			t.Fatalf("Card %d: %s", i, err.Error())
+		}
+	}
+
+	var consistency ConsistencyProof
+	if code := get("/transparency/consistency?first=2&second=3", &consistency); code != http.StatusOK {
+		t.Fatalf("Expected a consistency proof, got %d", code)
+	}
+	if err := consistency.Verify(first.RootHash, head.RootHash); err != nil {
+		t.Fatalf("Expected the tree heads to be consistent: %s", err.Error())
+	}
+
+	var entries struct {
+		Entries []TransparencyEntry `json:"entries"`
+	}
+	if code := get("/transparency/entries?start=1", &entries); code != http.StatusOK || len(entries.Entries) != 2 {
+		t.Fatalf("Expected 2 entries from 1, got %d %+v", code, entries)
+	}
+
+	// a card signed with the key but not through the log has no proof
+	unlogged, _ := NewIssuer(IssuerConfig{IssuerURL: test.IssuerURL(), KeySource: test.keys})
+	stolen, _ := unlogged.Issue(context.Background(), sampleVerifiableCredential(t))
+	entry, _ := TransparencyEntryForCard(stolen)
+	var proof InclusionProof
+	if code := get("/transparency/proof?payloadHash="+entry.PayloadHash, &proof); code != http.StatusNotFound {
+		t.Fatalf("Expected no proof for an unlogged card, got %d", code)
+	}
+
+	head.TreeSize = 2
+	if head.Verify(jwks) == nil {
+		t.Fatal("Expected an altered tree head to fail verification")
+	}
+}
@@ -0,0 +1,152 @@
+package issuer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// TrustedIssuer is an issuer whose cards a verifier accepts, with its public keys and revocation lists.
+type TrustedIssuer struct {
+	IssuerURL string
+	Name      string
+	Website   string
+	Keys      jose.JSONWebKeySet
+
+	// Revocations holds the issuer's revocation list for each key ID that has one
+	Revocations map[string]RevocationList
+}
+
+// RevocationList is a SMART Health Cards CRL: the revocation IDs of cards signed with one key that are no longer
+// valid. An entry "rid.timestamp" only revokes cards issued at or before that Unix time.
+type RevocationList struct {
+	KeyId      string   `json:"kid"`
+	Method     string   `json:"method"`
+	Counter    int      `json:"ctr"`
+	RevokedIds []string `json:"rids"`
+}
+
+// Revoked reports whether a card with this rid issued at nbf is on the list.
+func (l RevocationList) Revoked(rid string, nbf int) bool {
+	for _, entry := range l.RevokedIds {
+		id, timestamp := entry, ""
+		if dot := strings.IndexByte(entry, '.'); dot >= 0 {
+			id, timestamp = entry[:dot], entry[dot+1:]
+		}
+		if id != rid {
+			continue
+		}
+		if timestamp == "" {
+			return true
+		}
+		if before, err := strconv.Atoi(timestamp); err == nil && nbf <= before {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustDirectory is the set of issuers a verifier trusts, keyed by issuer URL.
+type TrustDirectory struct {
+	issuers map[string]*TrustedIssuer
+}
+
+// trustDirectoryEntry is one issuer in the VCI directory format
+type trustDirectoryEntry struct {
+	Issuer struct {
+		IssuerURL string `json:"iss"`
+		Name      string `json:"name"`
+		Website   string `json:"website,omitempty"`
+	} `json:"issuer"`
+	Keys []jose.JSONWebKey `json:"keys"`
+	CRLs []RevocationList  `json:"crls,omitempty"`
+}
+
+// NewTrustDirectory returns a directory holding the given issuers. A later issuer with the same URL replaces an
+// earlier one.
+func NewTrustDirectory(issuers ...TrustedIssuer) *TrustDirectory {
+	d := &TrustDirectory{issuers: map[string]*TrustedIssuer{}}
+	for i := range issuers {
+		issuer := issuers[i]
+		d.issuers[strings.TrimSuffix(issuer.IssuerURL, "/")] = &issuer
+	}
+	return d
+}
+
+// LoadTrustDirectory reads trusted issuers from a JSON file or from every .json file in a directory. Each file is
+// either a VCI directory snapshot ({"issuerInfo": [...]}) or a single issuer entry of the same form:
+//
+//	{"issuer": {"iss": "https://example.org/issuer", "name": "Example"}, "keys": [...], "crls": [...]}
+func LoadTrustDirectory(path string) (*TrustDirectory, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.json")); err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+
+	var issuers []TrustedIssuer
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var snapshot struct {
+			IssuerInfo []trustDirectoryEntry `json:"issuerInfo"`
+		}
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, fmt.Errorf("failed to parse trust directory %s: %w", file, err)
+		}
+		entries := snapshot.IssuerInfo
+		if entries == nil {
+			var entry trustDirectoryEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return nil, fmt.Errorf("failed to parse trust directory %s: %w", file, err)
+			}
+			entries = []trustDirectoryEntry{entry}
+		}
+		for _, entry := range entries {
+			if entry.Issuer.IssuerURL == "" {
+				return nil, fmt.Errorf("trust directory %s: issuer without an iss", file)
+			}
+			issuer := TrustedIssuer{
+				IssuerURL:   entry.Issuer.IssuerURL,
+				Name:        entry.Issuer.Name,
+				Website:     entry.Issuer.Website,
+				Keys:        jose.JSONWebKeySet{Keys: entry.Keys},
+				Revocations: map[string]RevocationList{},
+			}
+			for _, crl := range entry.CRLs {
+				if crl.Method != "" && crl.Method != "rid" {
+					return nil, fmt.Errorf("trust directory %s: unsupported revocation method %q", file, crl.Method)
+				}
+				issuer.Revocations[crl.KeyId] = crl
+			}
+			issuers = append(issuers, issuer)
+		}
+	}
+	return NewTrustDirectory(issuers...), nil
+}
+
+// Issuer returns the trusted issuer with the given URL, ignoring a trailing slash.
+func (d *TrustDirectory) Issuer(issuerURL string) (*TrustedIssuer, bool) {
+	issuer, ok := d.issuers[strings.TrimSuffix(issuerURL, "/")]
+	return issuer, ok
+}
+
+// Len returns the number of trusted issuers.
+func (d *TrustDirectory) Len() int {
+	return len(d.issuers)
+}
@@ -0,0 +1,495 @@
+package issuer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	SeverityInfo    Severity = "info"
+)
+
+// Diagnostic codes are stable identifiers that callers can match on; the messages are not.
+const (
+	// QR numeric text
+	CODE_QR_PREFIX        = "qr-prefix"
+	CODE_QR_CHUNK_HEADER  = "qr-chunk-header"
+	CODE_QR_CHUNK_MISSING = "qr-chunk-missing"
+	CODE_QR_CHUNK_REPEAT  = "qr-chunk-repeated"
+	CODE_QR_DIGITS        = "qr-digits"
+	CODE_QR_CHUNK_SIZE    = "qr-chunk-size"
+	CODE_QR_VERSION       = "qr-version"
+
+	// compact JWS
+	CODE_JWS_WHITESPACE = "jws-whitespace"
+	CODE_JWS_PARTS      = "jws-parts"
+	CODE_JWS_BASE64     = "jws-base64"
+	CODE_JWS_SIZE       = "jws-size"
+	CODE_JWS_SIGNATURE  = "jws-signature-length"
+
+	// protected header
+	CODE_HEADER_JSON         = "header-json"
+	CODE_HEADER_ALG          = "header-alg"
+	CODE_HEADER_ZIP          = "header-zip"
+	CODE_HEADER_KID          = "header-kid"
+	CODE_HEADER_EMBEDDED_JWK = "header-embedded-jwk"
+
+	// payload compression
+	CODE_DEFLATE_ZLIB    = "deflate-zlib-wrapper"
+	CODE_DEFLATE_GZIP    = "deflate-gzip-wrapper"
+	CODE_DEFLATE_INVALID = "deflate-invalid"
+
+	// JSON payload
+	CODE_PAYLOAD_JSON       = "payload-json"
+	CODE_PAYLOAD_WHITESPACE = "payload-whitespace"
+	CODE_PAYLOAD_ISS        = "payload-iss"
+	CODE_PAYLOAD_NBF        = "payload-nbf"
+	CODE_PAYLOAD_EXP        = "payload-exp"
+	CODE_PAYLOAD_VC         = "payload-vc"
+
+	// verifiable credential
+	CODE_VC_TYPE         = "vc-type"
+	CODE_VC_FHIR_VERSION = "vc-fhir-version"
+
+	// FHIR bundle
+	CODE_FHIR_BUNDLE        = "fhir-bundle"
+	CODE_FHIR_BUNDLE_TYPE   = "fhir-bundle-type"
+	CODE_FHIR_ENTRY         = "fhir-entry"
+	CODE_FHIR_FULL_URL      = "fhir-full-url"
+	CODE_FHIR_NOT_MINIMIZED = "fhir-not-minimized"
+)
+
+const (
+	HEALTH_CARD_TYPE  = "https://smarthealth.cards#health-card"
+	IMMUNIZATION_TYPE = "https://smarthealth.cards#immunization"
+	COVID19_TYPE      = "https://smarthealth.cards#covid19"
+)
+
+type Diagnostic struct {
+	Code     string   `json:"code"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+	// Path locates the problem inside the payload where that makes sense, e.g. vc.credentialSubject.fhirBundle.entry[1]
+	Path string `json:"path,omitempty"`
+}
+
+func (d Diagnostic) String() string {
+	if d.Path != "" {
+		return fmt.Sprintf("%s [%s] %s (at %s)", d.Severity, d.Code, d.Message, d.Path)
+	}
+	return fmt.Sprintf("%s [%s] %s", d.Severity, d.Code, d.Message)
+}
+
+type Diagnostics []Diagnostic
+
+// HasErrors reports whether any diagnostic has error severity.
+func (d Diagnostics) HasErrors() bool {
+	for _, diagnostic := range d {
+		if diagnostic.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// WithCode returns the diagnostics with the given code.
+func (d Diagnostics) WithCode(code string) Diagnostics {
+	var matching Diagnostics
+	for _, diagnostic := range d {
+		if diagnostic.Code == code {
+			matching = append(matching, diagnostic)
+		}
+	}
+	return matching
+}
+
+func (d *Diagnostics) add(code string, severity Severity, path string, format string, args ...interface{}) {
+	*d = append(*d, Diagnostic{Code: code, Severity: severity, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks a card at every layer: QR text, compact JWS, header, compression, JSON payload, the verifiable
+// credential and its FHIR bundle. The input may be a JWS, shc:/ QR text or a .smart-health-card file.
+// Signatures are not verified.
+func Validate(data []byte) Diagnostics {
+	var diagnostics Diagnostics
+	switch inputFormat(data) {
+	case "qr":
+		jws, qrDiagnostics := ValidateQR(strings.Fields(string(data)))
+		diagnostics = append(diagnostics, qrDiagnostics...)
+		if jws != "" {
+			diagnostics = append(diagnostics, ValidateJWS(jws)...)
+		}
+	case "file":
+		var file SmartHealthCardFile
+		if err := json.Unmarshal(bytes.TrimSpace(data), &file); err != nil {
+			diagnostics.add(CODE_PAYLOAD_JSON, SeverityError, "", "smart health card file is not valid JSON: %s", err.Error())
+			return diagnostics
+		}
+		if len(file.VerifiableCredential) == 0 {
+			diagnostics.add(CODE_PAYLOAD_VC, SeverityError, "verifiableCredential", "smart health card file contains no credentials")
+		}
+		for _, jws := range file.VerifiableCredential {
+			diagnostics = append(diagnostics, ValidateJWS(jws)...)
+		}
+	default:
+		diagnostics = append(diagnostics, ValidateJWS(string(data))...)
+	}
+	return diagnostics
+}
+
+var chunkHeader = regexp.MustCompile(`^shc:/(\d+)/(\d+)/`)
+
+// ValidateQR checks the shc:/ text of every QR chunk and returns the reassembled JWS, or "" if it cannot be decoded.
+func ValidateQR(contents []string) (string, Diagnostics) {
+	var diagnostics Diagnostics
+	parts := make(map[int]string)
+	total := 0
+
+	for i, content := range contents {
+		if !strings.HasPrefix(content, QR_CODE_PREFIX) {
+			diagnostics.add(CODE_QR_PREFIX, SeverityError, "", "QR %d does not start with %s", i+1, QR_CODE_PREFIX)
+			return "", diagnostics
+		}
+
+		index, digits := 1, strings.TrimPrefix(content, QR_CODE_PREFIX)
+		if match := chunkHeader.FindStringSubmatch(content); match != nil {
+			index, _ = strconv.Atoi(match[1])
+			chunkTotal, _ := strconv.Atoi(match[2])
+			if total != 0 && chunkTotal != total {
+				diagnostics.add(CODE_QR_CHUNK_HEADER, SeverityError, "", "QR %d claims %d chunks, earlier chunks claim %d", i+1, chunkTotal, total)
+			}
+			total = chunkTotal
+			digits = content[len(match[0]):]
+			if index < 1 || index > chunkTotal {
+				diagnostics.add(CODE_QR_CHUNK_HEADER, SeverityError, "", "QR %d has chunk index %d out of %d", i+1, index, chunkTotal)
+				continue
+			}
+		} else if len(contents) > 1 {
+			diagnostics.add(CODE_QR_CHUNK_HEADER, SeverityError, "", "QR %d is missing the shc:/<index>/<total>/ chunk header", i+1)
+			continue
+		}
+
+		if len(digits)%2 != 0 {
+			diagnostics.add(CODE_QR_DIGITS, SeverityError, "", "QR %d has an odd number of digits", i+1)
+			continue
+		}
+		decoded, err := numericDecode(digits)
+		if err != nil {
+			diagnostics.add(CODE_QR_DIGITS, SeverityError, "", "QR %d: %s", i+1, err.Error())
+			continue
+		}
+		if offset := strings.IndexFunc(decoded, func(r rune) bool { return !isJWSCharacter(r) }); offset >= 0 {
+			diagnostics.add(CODE_QR_DIGITS, SeverityError, "", "QR %d encodes a character outside the JWS alphabet at digit %d", i+1, offset*2)
+		}
+		if len(decoded) > MAX_CHUNK_SIZE && (total > 1 || len(decoded) > MAX_SINGLE_JWS_SIZE) {
+			diagnostics.add(CODE_QR_CHUNK_SIZE, SeverityWarning, "", "QR %d carries %d JWS characters, more than the spec allows per QR code", i+1, len(decoded))
+		}
+		if version := qrVersion(content); version == 0 || version > MAX_QR_VERSION {
+			diagnostics.add(CODE_QR_VERSION, SeverityError, "", "QR %d needs a code larger than version %d", i+1, MAX_QR_VERSION)
+		}
+		if _, ok := parts[index]; ok {
+			diagnostics.add(CODE_QR_CHUNK_REPEAT, SeverityError, "", "QR %d repeats chunk %d", i+1, index)
+			continue
+		}
+		parts[index] = decoded
+	}
+
+	if total == 0 {
+		total = 1
+	}
+	var jws strings.Builder
+	for index := 1; index <= total; index++ {
+		part, ok := parts[index]
+		if !ok {
+			diagnostics.add(CODE_QR_CHUNK_MISSING, SeverityError, "", "chunk %d of %d is missing", index, total)
+			return "", diagnostics
+		}
+		jws.WriteString(part)
+	}
+	return jws.String(), diagnostics
+}
+
+// ValidateJWS checks a compact JWS and everything inside it.
+func ValidateJWS(jws string) Diagnostics {
+	var diagnostics Diagnostics
+
+	trimmed := strings.TrimSpace(jws)
+	if strings.IndexFunc(trimmed, unicode.IsSpace) >= 0 {
+		diagnostics.add(CODE_JWS_WHITESPACE, SeverityError, "", "the JWS contains whitespace; compact JWS must not contain any")
+		trimmed = strings.Join(strings.Fields(trimmed), "")
+	} else if trimmed != jws {
+		diagnostics.add(CODE_JWS_WHITESPACE, SeverityWarning, "", "the JWS has leading or trailing whitespace")
+	}
+
+	if len(trimmed) > MAX_SINGLE_JWS_SIZE {
+		chunks := len(SplitJWS(trimmed))
+		diagnostics.add(CODE_JWS_SIZE, SeverityWarning, "", "the JWS is %d characters and needs %d QR codes; a single QR holds %d", len(trimmed), chunks, MAX_SINGLE_JWS_SIZE)
+	}
+	for i, content := range QRContents(trimmed) {
+		if version := qrVersion(content); version == 0 || version > MAX_QR_VERSION {
+			diagnostics.add(CODE_QR_VERSION, SeverityError, "", "QR %d needs a code larger than version %d", i+1, MAX_QR_VERSION)
+		}
+	}
+
+	parts := strings.Split(trimmed, ".")
+	if len(parts) != 3 {
+		diagnostics.add(CODE_JWS_PARTS, SeverityError, "", "compact JWS must have 3 dot-separated parts, found %d", len(parts))
+		return diagnostics
+	}
+
+	segments := make([][]byte, 3)
+	for i, name := range []string{"header", "payload", "signature"} {
+		decoded, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			message := "is not unpadded base64url"
+			if strings.ContainsAny(parts[i], "=+/") {
+				message = "uses padding or the standard base64 alphabet instead of unpadded base64url"
+			}
+			diagnostics.add(CODE_JWS_BASE64, SeverityError, name, "the %s %s", name, message)
+			return diagnostics
+		}
+		segments[i] = decoded
+	}
+
+	if len(segments[2]) != 64 {
+		diagnostics.add(CODE_JWS_SIGNATURE, SeverityError, "signature", "an ES256 signature is 64 bytes, found %d", len(segments[2]))
+	}
+
+	validateHeader(segments[0], &diagnostics)
+
+	payload, ok := validateCompression(segments[1], &diagnostics)
+	if !ok {
+		return diagnostics
+	}
+	validatePayload(payload, &diagnostics)
+	return diagnostics
+}
+
+func validateHeader(raw []byte, diagnostics *Diagnostics) {
+	var header map[string]interface{}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		diagnostics.add(CODE_HEADER_JSON, SeverityError, "header", "the header is not a JSON object: %s", err.Error())
+		return
+	}
+	if alg, _ := header["alg"].(string); alg != "ES256" {
+		diagnostics.add(CODE_HEADER_ALG, SeverityError, "header.alg", "alg must be ES256, found %q", alg)
+	}
+	if zip, _ := header["zip"].(string); zip != "DEF" {
+		diagnostics.add(CODE_HEADER_ZIP, SeverityError, "header.zip", "zip must be DEF, found %q", zip)
+	}
+	if kid, _ := header["kid"].(string); kid == "" {
+		diagnostics.add(CODE_HEADER_KID, SeverityError, "header.kid", "kid is required so verifiers can find the key in the issuer JWKS")
+	}
+	if _, ok := header["jwk"]; ok {
+		diagnostics.add(CODE_HEADER_EMBEDDED_JWK, SeverityWarning, "header.jwk", "the header embeds the public key; verifiers must use the issuer JWKS and it makes the card larger")
+	}
+}
+
+// validateCompression inflates the payload, explaining the common mistake of using zlib or gzip framing
+// instead of raw DEFLATE. The inflated payload is returned whenever it could be recovered so later layers can
+// still be checked.
+func validateCompression(compressed []byte, diagnostics *Diagnostics) ([]byte, bool) {
+	if len(compressed) >= 2 && compressed[0] == 0x1f && compressed[1] == 0x8b {
+		diagnostics.add(CODE_DEFLATE_GZIP, SeverityError, "payload", "the payload is gzip-wrapped; zip DEF requires raw DEFLATE without a header")
+		if r, err := gzip.NewReader(bytes.NewReader(compressed)); err == nil {
+			if payload, err := ioutil.ReadAll(r); err == nil {
+				return payload, true
+			}
+		}
+		return nil, false
+	}
+
+	if payload, err := inflate(compressed); err == nil {
+		return payload, true
+	}
+
+	if len(compressed) >= 2 && compressed[0]&0x0f == 8 && (uint16(compressed[0])<<8|uint16(compressed[1]))%31 == 0 {
+		diagnostics.add(CODE_DEFLATE_ZLIB, SeverityError, "payload", "the payload is zlib-wrapped; zip DEF requires raw DEFLATE without a header")
+		if r, err := zlib.NewReader(bytes.NewReader(compressed)); err == nil {
+			if payload, err := ioutil.ReadAll(r); err == nil {
+				return payload, true
+			}
+		}
+		return nil, false
+	}
+
+	diagnostics.add(CODE_DEFLATE_INVALID, SeverityError, "payload", "the payload is not a valid raw DEFLATE stream")
+	return nil, false
+}
+
+func validatePayload(payload []byte, diagnostics *Diagnostics) {
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		diagnostics.add(CODE_PAYLOAD_JSON, SeverityError, "payload", "the payload is not a JSON object: %s", err.Error())
+		return
+	}
+
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, payload); err == nil && compacted.Len() < len(payload) {
+		diagnostics.add(CODE_PAYLOAD_WHITESPACE, SeverityWarning, "payload", "the payload contains %d bytes of insignificant whitespace", len(payload)-compacted.Len())
+	}
+
+	iss, _ := claims["iss"].(string)
+	switch {
+	case iss == "":
+		diagnostics.add(CODE_PAYLOAD_ISS, SeverityError, "iss", "iss is required")
+	case !strings.HasPrefix(iss, "https://"):
+		diagnostics.add(CODE_PAYLOAD_ISS, SeverityError, "iss", "iss must be an https URL, found %q", iss)
+	case strings.HasSuffix(iss, "/"):
+		diagnostics.add(CODE_PAYLOAD_ISS, SeverityError, "iss", "iss must not end with a slash")
+	}
+
+	nbf, ok := claims["nbf"].(float64)
+	switch {
+	case !ok:
+		diagnostics.add(CODE_PAYLOAD_NBF, SeverityError, "nbf", "nbf is required and must be a number of seconds since the epoch")
+	case nbf > 1e11:
+		diagnostics.add(CODE_PAYLOAD_NBF, SeverityError, "nbf", "nbf looks like milliseconds rather than seconds")
+	case nbf < 1e9:
+		diagnostics.add(CODE_PAYLOAD_NBF, SeverityWarning, "nbf", "nbf is before 2001, it is probably not a timestamp")
+	case time.Unix(int64(nbf), 0).After(time.Now().Add(time.Hour)):
+		diagnostics.add(CODE_PAYLOAD_NBF, SeverityWarning, "nbf", "nbf is in the future")
+	}
+	if exp, ok := claims["exp"]; ok {
+		if expSeconds, isNumber := exp.(float64); !isNumber || expSeconds <= nbf {
+			diagnostics.add(CODE_PAYLOAD_EXP, SeverityError, "exp", "exp must be a number of seconds after nbf")
+		}
+	}
+
+	vc, ok := claims["vc"].(map[string]interface{})
+	if !ok {
+		diagnostics.add(CODE_PAYLOAD_VC, SeverityError, "vc", "the vc claim is required")
+		return
+	}
+	validateCredential(vc, diagnostics)
+}
+
+func validateCredential(vc map[string]interface{}, diagnostics *Diagnostics) {
+	types := stringSlice(vc["type"])
+	hasHealthCard := false
+	for _, t := range types {
+		if t == HEALTH_CARD_TYPE {
+			hasHealthCard = true
+		}
+	}
+	if !hasHealthCard {
+		diagnostics.add(CODE_VC_TYPE, SeverityError, "vc.type", "vc.type must include %s", HEALTH_CARD_TYPE)
+	}
+	if len(types) == 1 && hasHealthCard {
+		diagnostics.add(CODE_VC_TYPE, SeverityWarning, "vc.type", "vc.type should also say what the card contains, e.g. %s", IMMUNIZATION_TYPE)
+	}
+
+	subject := getMap(vc, "credentialSubject")
+	if subject == nil {
+		diagnostics.add(CODE_PAYLOAD_VC, SeverityError, "vc.credentialSubject", "vc.credentialSubject is required")
+		return
+	}
+	if version := getString(subject, "fhirVersion"); version == "" {
+		diagnostics.add(CODE_VC_FHIR_VERSION, SeverityError, "vc.credentialSubject.fhirVersion", "fhirVersion is required")
+	} else if !strings.HasPrefix(version, "4.") {
+		diagnostics.add(CODE_VC_FHIR_VERSION, SeverityWarning, "vc.credentialSubject.fhirVersion", "fhirVersion %s is not FHIR R4", version)
+	}
+
+	validateBundle(getMap(subject, "fhirBundle"), diagnostics)
+}
+
+func validateBundle(bundle map[string]interface{}, diagnostics *Diagnostics) {
+	const path = "vc.credentialSubject.fhirBundle"
+	if bundle == nil || getString(bundle, "resourceType") != "Bundle" {
+		diagnostics.add(CODE_FHIR_BUNDLE, SeverityError, path, "fhirBundle must be a FHIR Bundle resource")
+		return
+	}
+	if bundleType := getString(bundle, "type"); bundleType != "collection" {
+		diagnostics.add(CODE_FHIR_BUNDLE_TYPE, SeverityError, path+".type", "bundle type must be collection, found %q", bundleType)
+	}
+
+	entries := getSlice(bundle, "entry")
+	if len(entries) == 0 {
+		diagnostics.add(CODE_FHIR_ENTRY, SeverityError, path+".entry", "the bundle has no entries")
+	}
+	for i, entry := range entries {
+		entryPath := fmt.Sprintf("%s.entry[%d]", path, i)
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok {
+			diagnostics.add(CODE_FHIR_ENTRY, SeverityError, entryPath, "bundle entry is not an object")
+			continue
+		}
+		if fullURL := getString(entryMap, "fullUrl"); fullURL != fmt.Sprintf("resource:%d", i) {
+			diagnostics.add(CODE_FHIR_FULL_URL, SeverityWarning, entryPath+".fullUrl", "fullUrl should be resource:%d, found %q", i, fullURL)
+		}
+		resource := getMap(entryMap, "resource")
+		if resource == nil || getString(resource, "resourceType") == "" {
+			diagnostics.add(CODE_FHIR_ENTRY, SeverityError, entryPath+".resource", "bundle entry has no resource with a resourceType")
+			continue
+		}
+		checkMinimized(resource, entryPath+".resource", true, diagnostics)
+	}
+}
+
+// checkMinimized reports elements the spec says to strip from card resources to keep them small
+func checkMinimized(element map[string]interface{}, path string, isResource bool, diagnostics *Diagnostics) {
+	if isResource {
+		if _, ok := element["id"]; ok {
+			diagnostics.add(CODE_FHIR_NOT_MINIMIZED, SeverityWarning, path+".id", "Resource.id should be removed")
+		}
+		if _, ok := element["text"]; ok {
+			diagnostics.add(CODE_FHIR_NOT_MINIMIZED, SeverityWarning, path+".text", "narrative text should be removed")
+		}
+		if meta := getMap(element, "meta"); meta != nil {
+			if len(meta) != 1 || meta["security"] == nil {
+				diagnostics.add(CODE_FHIR_NOT_MINIMIZED, SeverityWarning, path+".meta", "Resource.meta should be removed except for meta.security")
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(element))
+	for key := range element {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		childPath := path + "." + key
+		switch child := element[key].(type) {
+		case map[string]interface{}:
+			if key == "vaccineCode" || key == "code" || strings.HasPrefix(key, "valueCodeableConcept") {
+				if _, ok := child["text"]; ok {
+					diagnostics.add(CODE_FHIR_NOT_MINIMIZED, SeverityInfo, childPath+".text", "CodeableConcept.text should be removed")
+				}
+			}
+			checkMinimized(child, childPath, false, diagnostics)
+		case []interface{}:
+			for i, item := range child {
+				itemMap, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				itemPath := fmt.Sprintf("%s[%d]", childPath, i)
+				if key == "coding" {
+					if _, ok := itemMap["display"]; ok {
+						diagnostics.add(CODE_FHIR_NOT_MINIMIZED, SeverityInfo, itemPath+".display", "Coding.display should be removed")
+					}
+				}
+				checkMinimized(itemMap, itemPath, false, diagnostics)
+			}
+		}
+	}
+}
+
+func isJWSCharacter(r rune) bool {
+	return r == '.' || r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
@@ -0,0 +1,95 @@
+package issuer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateIssuedCard(t *testing.T) {
+	issuer, _ := newTestIssuer(t, IssuerOptions{})
+	jws, err := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+	if err != nil {
+		t.Fatalf("Failed to issue card: %s", err.Error())
+	}
+
+	for _, input := range []string{jws, strings.Join(QRContents(jws), "\n")} {
+		if diagnostics := Validate([]byte(input)); diagnostics.HasErrors() {
+			t.Fatalf("Expected an issued card to validate, got %v", diagnostics)
+		}
+	}
+
+	diagnostics := Validate([]byte(jws[:40] + "\n" + jws[40:]))
+	if len(diagnostics.WithCode(CODE_JWS_WHITESPACE)) != 1 || !diagnostics.HasErrors() {
+		t.Fatalf("Expected a whitespace error, got %v", diagnostics)
+	}
+
+	diagnostics = Validate([]byte("shc:/5676" + strings.Repeat("0", 5)))
+	if len(diagnostics.WithCode(CODE_QR_DIGITS)) != 1 {
+		t.Fatalf("Expected a QR digits error, got %v", diagnostics)
+	}
+
+	chunks := QRContents(strings.Repeat(jws, 3))
+	diagnostics = Validate([]byte(strings.Join(chunks[1:], "\n")))
+	if len(diagnostics.WithCode(CODE_QR_CHUNK_MISSING)) != 1 {
+		t.Fatalf("Expected a missing chunk error, got %v", diagnostics)
+	}
+
+	repeated := []string{chunks[0], chunks[0], chunks[1]}
+	if _, diagnostics := ValidateQR(repeated); len(diagnostics.WithCode(CODE_QR_CHUNK_REPEAT)) != 1 || !diagnostics.HasErrors() {
+		t.Fatalf("Expected a repeated chunk error, got %v", diagnostics)
+	}
+
+	// a single QR code carrying the whole of a long JWS needs more than version 22
+	long := jws + strings.Repeat("A", MAX_SINGLE_JWS_SIZE)
+	if _, diagnostics := ValidateQR([]string{QR_CODE_PREFIX + numericEncode(long)}); len(diagnostics.WithCode(CODE_QR_VERSION)) != 1 || !diagnostics.HasErrors() {
+		t.Fatalf("Expected a QR version error, got %v", diagnostics)
+	}
+}
+
+func TestValidateZlibWrappedPayload(t *testing.T) {
+	issuer, key := newTestIssuer(t, IssuerOptions{})
+	_, keyId, _ := issuer.keys.SigningKey()
+
+	card := SmartHealthCard{
+		IssuerURL:            issuer.IssuerURL(),
+		IssuanceDate:         1622505600,
+		VerifiableCredential: sampleVerifiableCredential(t),
+	}
+	payload, err := json.MarshalIndent(card, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to marshal card: %s", err.Error())
+	}
+	// a common mistake: zlib framing instead of raw DEFLATE
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	_, _ = w.Write(payload)
+	_ = w.Close()
+
+	signer, err := newCardSigner(key, keyId, true)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %s", err.Error())
+	}
+	signed, err := signer.Sign(compressed.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to sign card: %s", err.Error())
+	}
+	jws, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize card: %s", err.Error())
+	}
+
+	diagnostics := ValidateJWS(jws)
+	for _, code := range []string{CODE_DEFLATE_ZLIB, CODE_PAYLOAD_WHITESPACE, CODE_HEADER_EMBEDDED_JWK} {
+		if len(diagnostics.WithCode(code)) == 0 {
+			t.Fatalf("Expected diagnostic %s, got %v", code, diagnostics)
+		}
+	}
+	// the payload is still recovered, so the credential layers are checked too
+	if len(diagnostics.WithCode(CODE_PAYLOAD_VC)) != 0 || len(diagnostics.WithCode(CODE_VC_TYPE)) != 0 {
+		t.Fatalf("Unexpected credential diagnostics: %v", diagnostics)
+	}
+}
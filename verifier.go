@@ -0,0 +1,237 @@
+package issuer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Verdict is the overall outcome of verifying a card, from the point of view of someone deciding whether to accept it.
+type Verdict string
+
+const (
+	VerdictValid     Verdict = "valid"
+	VerdictInvalid   Verdict = "invalid"
+	VerdictUntrusted Verdict = "untrusted"
+	VerdictRevoked   Verdict = "revoked"
+	VerdictExpired   Verdict = "expired"
+)
+
+type RevocationStatus string
+
+const (
+	RevocationNotRevoked RevocationStatus = "not-revoked"
+	RevocationRevoked    RevocationStatus = "revoked"
+	// RevocationUnknown means the card has no rid or the issuer publishes no revocation list for its key
+	RevocationUnknown RevocationStatus = "unknown"
+)
+
+// VerificationResult is the verdict on every card in one scan or file. Its JSON form is the verifier service's
+// response and only gains fields over time.
+type VerificationResult struct {
+	// Verdict is valid only when every card is valid, and otherwise the verdict of the first card that is not
+	Verdict Verdict            `json:"verdict"`
+	Cards   []CardVerification `json:"cards"`
+}
+
+type CardVerification struct {
+	Verdict Verdict `json:"verdict"`
+	// Error says why the card could not be decoded, for an invalid card with no other details
+	Error string `json:"error,omitempty"`
+
+	Signature  SignatureCheck  `json:"signature"`
+	Issuer     IssuerCheck     `json:"issuer"`
+	Revocation RevocationCheck `json:"revocation"`
+
+	IssuedAt  *time.Time `json:"issuedAt,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Types     []string   `json:"types,omitempty"`
+
+	Patient       PatientSummary     `json:"patient"`
+	Immunizations []ImmunizationView `json:"immunizations"`
+	Observations  []ObservationView  `json:"observations"`
+}
+
+type SignatureCheck struct {
+	Status SignatureStatus `json:"status"`
+	KeyId  string          `json:"kid,omitempty"`
+	Detail string          `json:"detail,omitempty"`
+}
+
+type IssuerCheck struct {
+	IssuerURL string `json:"iss"`
+	Trusted   bool   `json:"trusted"`
+	Name      string `json:"name,omitempty"`
+	Website   string `json:"website,omitempty"`
+}
+
+type RevocationCheck struct {
+	Status       RevocationStatus `json:"status"`
+	RevocationId string           `json:"rid,omitempty"`
+}
+
+type PatientSummary struct {
+	Name      string `json:"name"`
+	BirthDate string `json:"birthDate"`
+}
+
+type VerifierConfig struct {
+	// Trust holds the issuers whose cards are accepted. Cards from other issuers are reported as untrusted.
+	Trust *TrustDirectory
+
+	// Clock decides whether a card has expired. Defaults to time.Now.
+	Clock func() time.Time
+
+	// Logger and Instrumentation observe every card checked. They default to doing nothing.
+	Logger          Logger
+	Instrumentation Instrumentation
+}
+
+// Verifier checks cards against a local trust directory. It never fetches keys over the network, so a scan is
+// answered the same way whether or not the issuer is reachable.
+type Verifier struct {
+	trust *TrustDirectory
+	clock func() time.Time
+
+	logger          Logger
+	instrumentation Instrumentation
+}
+
+func NewVerifier(config VerifierConfig) (*Verifier, error) {
+	if config.Trust == nil {
+		return nil, errors.New("trust directory is required")
+	}
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+	if config.Logger == nil {
+		config.Logger = nopLogger{}
+	}
+	if config.Instrumentation == nil {
+		config.Instrumentation = nopInstrumentation{}
+	}
+	return &Verifier{trust: config.Trust, clock: config.Clock, logger: config.Logger, instrumentation: config.Instrumentation}, nil
+}
+
+// Verify checks every card in a JWS, a .smart-health-card file or the shc:/ text of one card's QR codes.
+func (v *Verifier) Verify(data []byte) (*VerificationResult, error) {
+	cards, err := ExtractJWS(data)
+	if err != nil {
+		_, done := observe(context.Background(), v.instrumentation, OperationVerify)
+		done(Measurement{FailureReason: string(VerdictInvalid), Err: err})
+		v.logger.Info("card not verified", "reason", VerdictInvalid, "error", err)
+		return nil, err
+	}
+	// QR text has one shc:/ line per chunk; a JWS or file was not scanned
+	chunks := strings.Count(string(data), QR_CODE_PREFIX)
+	return v.verifyJWS(chunks, cards), nil
+}
+
+// VerifyJWS checks each card.
+func (v *Verifier) VerifyJWS(jws ...string) *VerificationResult {
+	return v.verifyJWS(0, jws)
+}
+
+func (v *Verifier) verifyJWS(chunks int, jws []string) *VerificationResult {
+	result := &VerificationResult{Verdict: VerdictValid, Cards: []CardVerification{}}
+	for _, card := range jws {
+		_, done := observe(context.Background(), v.instrumentation, OperationVerify)
+		verification := v.verifyCard(card)
+		measurement := Measurement{
+			KeyId:        verification.Signature.KeyId,
+			JWSBytes:     len(card),
+			PayloadBytes: jwsPayloadSize(card),
+			Chunks:       chunks,
+		}
+		if verification.Verdict != VerdictValid {
+			measurement.FailureReason = string(verification.Verdict)
+			if verification.Error != "" {
+				measurement.Err = errors.New(verification.Error)
+			}
+		}
+		done(measurement)
+		if verification.Verdict == VerdictValid {
+			v.logger.Debug("card verified", "verdict", verification.Verdict, "kid", measurement.KeyId, "iss", verification.Issuer.IssuerURL)
+		} else {
+			v.logger.Info("card rejected", "verdict", verification.Verdict, "kid", measurement.KeyId, "iss", verification.Issuer.IssuerURL)
+		}
+		if result.Verdict == VerdictValid {
+			result.Verdict = verification.Verdict
+		}
+		result.Cards = append(result.Cards, verification)
+	}
+	if len(result.Cards) == 0 {
+		result.Verdict = VerdictInvalid
+	}
+	return result
+}
+
+func (v *Verifier) verifyCard(jws string) CardVerification {
+	result := CardVerification{
+		Signature:     SignatureCheck{Status: SignatureNotChecked},
+		Revocation:    RevocationCheck{Status: RevocationUnknown},
+		Immunizations: []ImmunizationView{},
+		Observations:  []ObservationView{},
+	}
+	card, err := DecodeCard(jws)
+	if err != nil {
+		result.Verdict = VerdictInvalid
+		result.Signature.Status = SignatureInvalid
+		result.Error = err.Error()
+		return result
+	}
+
+	vc := card.Card.VerifiableCredential
+	issuedAt := time.Unix(int64(card.Card.IssuanceDate), 0).UTC()
+	result.IssuedAt = &issuedAt
+	if card.Card.ExpirationDate != 0 {
+		expires := time.Unix(int64(card.Card.ExpirationDate), 0).UTC()
+		result.ExpiresAt = &expires
+	}
+	result.Types = stringSlice(vc["type"])
+	var view CardView
+	view.readBundle(vc)
+	result.Patient = PatientSummary{Name: view.PatientName, BirthDate: view.BirthDate}
+	if view.Immunizations != nil {
+		result.Immunizations = view.Immunizations
+	}
+	if view.Observations != nil {
+		result.Observations = view.Observations
+	}
+
+	result.Signature.KeyId = card.Header.KeyId
+	result.Issuer.IssuerURL = card.Card.IssuerURL
+	trusted, ok := v.trust.Issuer(card.Card.IssuerURL)
+	if ok {
+		result.Issuer = IssuerCheck{IssuerURL: card.Card.IssuerURL, Trusted: true, Name: trusted.Name, Website: trusted.Website}
+		if _, err := VerifyCard(jws, trusted.Keys); err != nil {
+			result.Signature.Status = SignatureInvalid
+			result.Signature.Detail = err.Error()
+		} else {
+			result.Signature.Status = SignatureVerified
+		}
+
+		result.Revocation.RevocationId = getString(vc, "rid")
+		if crl, ok := trusted.Revocations[card.Header.KeyId]; ok && result.Revocation.RevocationId != "" {
+			result.Revocation.Status = RevocationNotRevoked
+			if crl.Revoked(result.Revocation.RevocationId, card.Card.IssuanceDate) {
+				result.Revocation.Status = RevocationRevoked
+			}
+		}
+	}
+
+	switch {
+	case result.Signature.Status == SignatureInvalid:
+		result.Verdict = VerdictInvalid
+	case !result.Issuer.Trusted:
+		result.Verdict = VerdictUntrusted
+	case result.Revocation.Status == RevocationRevoked:
+		result.Verdict = VerdictRevoked
+	case result.ExpiresAt != nil && v.clock().After(*result.ExpiresAt):
+		result.Verdict = VerdictExpired
+	default:
+		result.Verdict = VerdictValid
+	}
+	return result
+}
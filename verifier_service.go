@@ -0,0 +1,210 @@
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// VerificationService is an HTTP front end for a Verifier, for venues checking cards at the door:
+//
+//	POST /verify/qr      the shc:/ text of a scanned card, one QR code per line, or {"qr": ["shc:/...", ...]}
+//	POST /verify/jws     a JWS as text/plain, or {"jws": "..."}
+//	POST /verify/file    a .smart-health-card file, as the body or the "file" field of a multipart upload
+//	GET  /healthz        liveness
+//	GET  /readyz         readiness: the trust directory is not empty and the service is not shutting down
+//
+// Every endpoint answers a readable card with 200 and a VerificationResult, whatever the verdict. Input that is
+// not a card at all gets a JSON error like the issuing service's.
+type VerificationService struct {
+	verifier *Verifier
+	options  ServiceOptions
+	mux      *http.ServeMux
+	shutdown int32
+}
+
+func NewVerificationService(verifier *Verifier, options ServiceOptions) *VerificationService {
+	s := &VerificationService{verifier: verifier, options: options.withDefaults(), mux: http.NewServeMux()}
+	s.mux.HandleFunc("/verify/qr", s.handleQR)
+	s.mux.HandleFunc("/verify/jws", s.handleJWS)
+	s.mux.HandleFunc("/verify/file", s.handleFile)
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	s.mux.HandleFunc("/readyz", s.handleReady)
+	return s
+}
+
+func (s *VerificationService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves on addr until ctx is cancelled, then drains in-flight requests like
+// IssuingService.ListenAndServe.
+func (s *VerificationService) ListenAndServe(ctx context.Context, addr string) error {
+	return listenAndServe(ctx, addr, s, s.options.ShutdownTimeout, &s.shutdown)
+}
+
+func (s *VerificationService) handleQR(w http.ResponseWriter, r *http.Request) {
+	body, mediaType, ok := s.readBody(w, r, "text/plain", JSON_CONTENT_TYPE)
+	if !ok {
+		return
+	}
+	var contents []string
+	if mediaType == JSON_CONTENT_TYPE {
+		var request struct {
+			QR []string `json:"qr"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: "request body is not JSON: " + err.Error()})
+			return
+		}
+		contents = request.QR
+	} else {
+		contents = strings.Fields(string(body))
+	}
+	for _, content := range contents {
+		if !strings.HasPrefix(content, QR_CODE_PREFIX) {
+			writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: "QR text must start with shc:/"})
+			return
+		}
+	}
+	jws, err := ParseQRContents(contents)
+	if err != nil {
+		writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: err.Error()})
+		return
+	}
+	writeVerification(w, s.verifier.VerifyJWS(jws))
+}
+
+func (s *VerificationService) handleJWS(w http.ResponseWriter, r *http.Request) {
+	body, mediaType, ok := s.readBody(w, r, "text/plain", JSON_CONTENT_TYPE)
+	if !ok {
+		return
+	}
+	jws := string(body)
+	if mediaType == JSON_CONTENT_TYPE {
+		var request struct {
+			JWS string `json:"jws"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: "request body is not JSON: " + err.Error()})
+			return
+		}
+		jws = request.JWS
+	}
+	jws = strings.TrimSpace(jws)
+	if strings.Count(jws, ".") != 2 {
+		writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: "request must be a compact JWS"})
+		return
+	}
+	writeVerification(w, s.verifier.VerifyJWS(jws))
+}
+
+func (s *VerificationService) handleFile(w http.ResponseWriter, r *http.Request) {
+	body, mediaType, ok := s.readBody(w, r, SMART_HEALTH_CARD_FILE_CONTENT_TYPE, JSON_CONTENT_TYPE, "multipart/form-data")
+	if !ok {
+		return
+	}
+	if mediaType == "multipart/form-data" {
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		file, err := formFile(body, params["boundary"], "file")
+		if err != nil {
+			writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: err.Error()})
+			return
+		}
+		body = file
+	}
+
+	var file SmartHealthCardFile
+	if err := json.Unmarshal(body, &file); err != nil {
+		writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: "failed to parse smart health card file: " + err.Error()})
+		return
+	}
+	if len(file.VerifiableCredential) == 0 {
+		writeServiceError(w, http.StatusBadRequest, ServiceError{Code: ERROR_INVALID_REQUEST, Message: "smart health card file contains no credentials"})
+		return
+	}
+	writeVerification(w, s.verifier.VerifyJWS(file.VerifiableCredential...))
+}
+
+// readBody checks the method and content type and reads the body up to the size limit, writing the error
+// response itself when it returns false
+func (s *VerificationService) readBody(w http.ResponseWriter, r *http.Request, mediaTypes ...string) ([]byte, string, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeServiceError(w, http.StatusMethodNotAllowed, ServiceError{Code: ERROR_METHOD_NOT_ALLOWED, Message: "use POST"})
+		return nil, "", false
+	}
+	if atomic.LoadInt32(&s.shutdown) == 1 {
+		writeServiceError(w, http.StatusServiceUnavailable, ServiceError{Code: ERROR_SERVICE_SHUTTING_DOWN, Message: "the service is shutting down"})
+		return nil, "", false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	supported := false
+	for _, allowed := range mediaTypes {
+		supported = supported || (err == nil && mediaType == allowed)
+	}
+	if !supported {
+		writeServiceError(w, http.StatusUnsupportedMediaType, ServiceError{
+			Code:    ERROR_UNSUPPORTED_MEDIA,
+			Message: "supported content types are " + strings.Join(mediaTypes, ", "),
+		})
+		return nil, "", false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.options.MaxRequestBytes))
+	if err != nil {
+		writeServiceError(w, http.StatusRequestEntityTooLarge, ServiceError{
+			Code:    ERROR_REQUEST_TOO_LARGE,
+			Message: fmt.Sprintf("request bodies are limited to %d bytes", s.options.MaxRequestBytes),
+		})
+		return nil, "", false
+	}
+	return body, mediaType, true
+}
+
+func (s *VerificationService) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSONStatus(w, http.StatusOK, "ok")
+}
+
+func (s *VerificationService) handleReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.shutdown) == 1 {
+		writeJSONStatus(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	if s.verifier.trust.Len() == 0 {
+		writeJSONStatus(w, http.StatusServiceUnavailable, "no trusted issuers")
+		return
+	}
+	writeJSONStatus(w, http.StatusOK, "ready")
+}
+
+func writeVerification(w http.ResponseWriter, result *VerificationResult) {
+	w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// formFile returns the contents of the named field of a multipart/form-data body
+func formFile(body []byte, boundary string, field string) ([]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("multipart upload has no boundary")
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, fmt.Errorf("multipart upload has no %q field", field)
+		}
+		if part.FormName() == field {
+			return ioutil.ReadAll(part)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTrustDirectory writes a VCI-style snapshot trusting the issuer, with the given rids revoked, and returns
+// its directory
+func writeTrustDirectory(t *testing.T, issuer *Issuer, keyId string, revoked ...string) string {
+	jwks, err := issuer.JWKS()
+	if err != nil {
+		t.Fatalf("Failed to get JWKS: %s", err.Error())
+	}
+	snapshot := map[string]interface{}{
+		"directory": "test",
+		"issuerInfo": []interface{}{
+			map[string]interface{}{
+				"issuer": map[string]interface{}{"iss": issuer.IssuerURL(), "name": "Example Issuer"},
+				"keys":   jwks.Keys,
+				"crls":   []interface{}{map[string]interface{}{"kid": keyId, "method": "rid", "ctr": 1, "rids": revoked}},
+			},
+		},
+	}
+	data, _ := json.Marshal(snapshot)
+	dir, err := ioutil.TempDir("", "trust")
+	if err != nil {
+		t.Fatalf("Failed to create trust directory: %s", err.Error())
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(filepath.Join(dir, "vci.json"), data, 0600); err != nil {
+		t.Fatalf("Failed to write trust directory: %s", err.Error())
+	}
+	return dir
+}
+
+func TestVerifier(t *testing.T) {
+	issuer, key := newTestIssuer(t, IssuerOptions{ExpiresIn: 365 * 24 * time.Hour})
+	keyId, _ := ComputeKeyId(&key.PublicKey)
+	trust, err := LoadTrustDirectory(writeTrustDirectory(t, issuer, keyId, "revokedRid", "laterRid.1622505600"))
+	if err != nil {
+		t.Fatalf("Failed to load trust directory: %s", err.Error())
+	}
+	if trusted, ok := trust.Issuer(issuer.IssuerURL() + "/"); !ok || trusted.Name != "Example Issuer" {
+		t.Fatal("Expected the issuer to be trusted")
+	}
+	now := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	verifier, err := NewVerifier(VerifierConfig{Trust: trust, Clock: func() time.Time { return now }})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %s", err.Error())
+	}
+
+	issue := func(rid string) string {
+		vc := sampleVerifiableCredential(t)
+		vc["rid"] = rid
+		jws, err := issuer.Issue(context.Background(), vc)
+		if err != nil {
+			t.Fatalf("Failed to issue card: %s", err.Error())
+		}
+		return jws
+	}
+
+	valid := issue("MKyCxh7p6uQ")
+	result, err := verifier.Verify([]byte(strings.Join(QRContents(valid), "\n")))
+	if err != nil {
+		t.Fatalf("Failed to verify QR text: %s", err.Error())
+	}
+	card := result.Cards[0]
+	if result.Verdict != VerdictValid || card.Signature.Status != SignatureVerified || !card.Issuer.Trusted || card.Revocation.Status != RevocationNotRevoked {
+		t.Fatalf("Expected a valid card, got %+v", card)
+	}
+	if card.Patient.Name != "John B. Anyperson" || len(card.Immunizations) != 2 || card.Immunizations[0].LotNumber != "0000001" {
+		t.Fatalf("Unexpected card contents %+v", card)
+	}
+
+	// a timestamped entry only revokes cards issued up to that time (the test issuer's clock is 2021-06-01)
+	if result := verifier.VerifyJWS(issue("revokedRid"), issue("laterRid")); result.Verdict != VerdictRevoked ||
+		result.Cards[1].Revocation.Status != RevocationRevoked {
+		t.Fatalf("Expected revoked cards, got %+v", result)
+	}
+
+	other, _ := newTestIssuer(t, IssuerOptions{})
+	forged, _ := other.Issue(context.Background(), sampleVerifiableCredential(t))
+	if result := verifier.VerifyJWS(forged); result.Verdict != VerdictInvalid || result.Cards[0].Signature.Status != SignatureInvalid {
+		t.Fatalf("Expected a forged card to be invalid, got %+v", result.Cards[0])
+	}
+	if result := verifier.VerifyJWS("not.a.card"); result.Verdict != VerdictInvalid || result.Cards[0].Error == "" {
+		t.Fatalf("Expected an undecodable card to be invalid, got %+v", result.Cards[0])
+	}
+
+	untrusted, _ := NewIssuer(IssuerConfig{IssuerURL: "https://example.org/elsewhere", KeySource: issuer.keys})
+	elsewhere, _ := untrusted.Issue(context.Background(), sampleVerifiableCredential(t))
+	if result := verifier.VerifyJWS(elsewhere); result.Verdict != VerdictUntrusted || result.Cards[0].Signature.Status != SignatureNotChecked {
+		t.Fatalf("Expected an untrusted card, got %+v", result.Cards[0])
+	}
+
+	now = now.AddDate(2, 0, 0)
+	if result := verifier.VerifyJWS(valid); result.Verdict != VerdictExpired {
+		t.Fatalf("Expected an expired card, got %s", result.Verdict)
+	}
+}
+
+func TestVerificationService(t *testing.T) {
+	issuer, key := newTestIssuer(t, IssuerOptions{})
+	keyId, _ := ComputeKeyId(&key.PublicKey)
+	trust, _ := LoadTrustDirectory(filepath.Join(writeTrustDirectory(t, issuer, keyId), "vci.json"))
+	verifier, _ := NewVerifier(VerifierConfig{Trust: trust})
+	service := NewVerificationService(verifier, ServiceOptions{})
+	jws, _ := issuer.Issue(context.Background(), sampleVerifiableCredential(t))
+	file, _ := MarshalCardFile(jws)
+
+	var upload bytes.Buffer
+	form := multipart.NewWriter(&upload)
+	part, _ := form.CreateFormFile("file", "card.smart-health-card")
+	_, _ = part.Write(file)
+	_ = form.Close()
+
+	qrJSON, _ := json.Marshal(map[string][]string{"qr": QRContents(jws)})
+	for _, test := range []struct {
+		path, contentType string
+		body              []byte
+	}{
+		{"/verify/qr", "text/plain", []byte(strings.Join(QRContents(jws), "\n"))},
+		{"/verify/qr", JSON_CONTENT_TYPE, qrJSON},
+		{"/verify/jws", "text/plain; charset=utf-8", []byte(jws + "\n")},
+		{"/verify/file", SMART_HEALTH_CARD_FILE_CONTENT_TYPE, file},
+		{"/verify/file", form.FormDataContentType(), upload.Bytes()},
+	} {
+		w := serviceRequest(t, service, http.MethodPost, test.path, test.contentType, "", test.body)
+		var result VerificationResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s %s: expected a verification result, got %d: %s", test.path, test.contentType, w.Code, w.Body.String())
+		}
+		if result.Verdict != VerdictValid || result.Cards[0].Issuer.Name != "Example Issuer" {
+			t.Fatalf("%s %s: expected a valid card, got %+v", test.path, test.contentType, result)
+		}
+	}
+
+	for _, test := range []struct {
+		method, path, contentType string
+		body                      []byte
+		status                    int
+		code                      string
+	}{
+		{http.MethodGet, "/verify/jws", "", nil, http.StatusMethodNotAllowed, ERROR_METHOD_NOT_ALLOWED},
+		{http.MethodPost, "/verify/file", "text/plain", file, http.StatusUnsupportedMediaType, ERROR_UNSUPPORTED_MEDIA},
+		{http.MethodPost, "/verify/qr", "text/plain", []byte("https://example.org"), http.StatusBadRequest, ERROR_INVALID_REQUEST},
+		{http.MethodPost, "/verify/jws", "text/plain", []byte("hello"), http.StatusBadRequest, ERROR_INVALID_REQUEST},
+		{http.MethodPost, "/verify/file", JSON_CONTENT_TYPE, []byte(`{"verifiableCredential": []}`), http.StatusBadRequest, ERROR_INVALID_REQUEST},
+		{http.MethodPost, "/verify/jws", "text/plain", bytes.Repeat([]byte("a"), 2<<20), http.StatusRequestEntityTooLarge, ERROR_REQUEST_TOO_LARGE},
+	} {
+		w := serviceRequest(t, service, test.method, test.path, test.contentType, "", test.body)
+		if w.Code != test.status || serviceErrorCode(t, w) != test.code {
+			t.Fatalf("Expected %d %s, got %d: %s", test.status, test.code, w.Code, w.Body.String())
+		}
+	}
+
+	if w := serviceRequest(t, service, http.MethodGet, "/readyz", "", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the service to be ready, got %d", w.Code)
+	}
+	empty, _ := NewVerifier(VerifierConfig{Trust: NewTrustDirectory()})
+	if w := serviceRequest(t, NewVerificationService(empty, ServiceOptions{}), http.MethodGet, "/readyz", "", "", nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected not ready without trusted issuers, got %d", w.Code)
+	}
+}